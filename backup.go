@@ -0,0 +1,274 @@
+package raft
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+var errBadBackup = errors.New("not a valid backup")
+
+// A backup, as written by SnapshotTo, is
+//
+//	MAGIC VERSION INDEX TERM HASH CONFIGURATION-INDEX
+//	CONFIGURATION-SIZE CONFIGURATION
+//	SNAPSHOT-SIZE SNAPSHOT
+//	SESSIONS-SIZE SESSIONS
+//	CRC
+//
+// INDEX, TERM, and HASH are those of the last entry the snapshot reflects.
+// CONFIGURATION is the configuration in effect as of that entry, encoded as in
+// a configuration entry, and CONFIGURATION-INDEX is that of the entry which
+// established it. The CRC covers everything before it. Integers are
+// little-endian.
+const (
+	backupMagic        = "rbak"
+	backupVersion byte = 1
+)
+
+// backup is a point-in-time snapshot of a server: its state machine, its
+// client sessions, and its configuration, as of the entry at index.
+type backup struct {
+	index, term                       uint64
+	hash                              [sha256.Size]byte
+	configIndex                       uint64
+	configuration, snapshot, sessions []byte
+}
+
+// SnapshotTo writes a backup of the server to w: a snapshot of its state
+// machine, with its configuration, and the index and term of the last entry
+// the snapshot reflects. RestoreFrom restores a server from it. It requires
+// WithSnapshots.
+//
+// The server carries on serving meanwhile. The backup is captured with the
+// log locked, as for Compact, so nothing is committed or applied while the
+// Snapshotter runs, but nothing is held up while it's written. Unlike
+// WriteLogTo, it carries no log entries, so it's no bigger however long the
+// log has grown.
+func (s *Server) SnapshotTo(w io.Writer) error {
+	if s.snapshotter == nil {
+		return errNoSnapshots
+	}
+	b, err := s.log.backup(s.snapshotter.Snapshot)
+	if err != nil {
+		return err
+	}
+	if b.configuration == nil { // its entry is compacted, so it's still in effect
+		_, b.configIndex = s.config.active()
+		if b.configuration, err = s.config.encode(); err != nil {
+			return err
+		}
+	}
+	return b.writeTo(w)
+}
+
+// RestoreFrom restores the server from a backup written by SnapshotTo. Like
+// ReadLogFrom, it must be called before the server is started, and while its
+// log is completely empty, and nothing is restored unless the whole backup is
+// intact.
+//
+// The snapshot is saved to the SnapshotStore, which WithSnapshots must
+// provide, and the application should restore its state machine from it
+// before starting the server. The server resumes from the snapshot's index and
+// term, with its configuration, and its log begins with the entry after it.
+// None of that is written to the store, which only ever holds log entries. A
+// restarted server finds where its log begins from the entries stored after
+// the snapshot, but its configuration only from a configuration entry, so one
+// restarted before any is stored must be restored again. Until it's
+// restarted, the backup's configuration is the baseline for
+// LatestConfiguration.
+func (s *Server) RestoreFrom(r io.Reader) error {
+	if s.running.Get() {
+		return errAlreadyRunning
+	}
+	if s.snapshotStore == nil {
+		return errNoSnapshots
+	}
+	b, err := readBackup(r)
+	if err != nil {
+		return err
+	}
+	oldPeers, newPeers, err := decodeConfiguration(b.configuration, s.config.factory)
+	if err != nil {
+		return err
+	}
+	if err := s.log.restore(b, s.saveSnapshot); err != nil {
+		return err
+	}
+
+	if b.term > s.term {
+		s.term, s.vote = b.term, noVote
+		if err := s.saveHardState(); err != nil {
+			return err
+		}
+	}
+	s.config.restore(oldPeers, newPeers, b.configIndex)
+	return nil
+}
+
+// backup captures a backup of the log as of the last entry the state machine
+// has applied, with a snapshot taken by the passed function. Its configuration
+// is that of the last configuration entry at or before then, if the log knows
+// of one, even compacted; otherwise, it's left nil.
+func (l *raftLog) backup(snapshot func() ([]byte, error)) (backup, error) {
+	l.RLock()
+	defer l.RUnlock()
+
+	b := backup{
+		index: l.getCommitIndexWithLock(),
+		term:  l.compactedTerm,
+		hash:  l.compactedHash,
+	}
+	pos := l.commitPos
+	if l.manualApply && l.appliedTo < b.index {
+		b.index = l.appliedTo
+		pos = sort.Search(len(l.entries), func(i int) bool { return l.entries[i].Index > b.index }) - 1
+	}
+	if pos >= 0 {
+		b.term, b.hash = l.entries[pos].Term, l.entries[pos].hash()
+	}
+	if entry, ok := l.configurationAtWithLock(b.index); ok {
+		b.configIndex, b.configuration = entry.Index, entry.Command
+	}
+
+	var err error
+	if b.sessions, err = l.encodeSessionsWithLock(); err != nil {
+		return backup{}, err
+	}
+	if b.snapshot, err = snapshot(); err != nil {
+		return backup{}, err
+	}
+	return b, nil
+}
+
+// restore loads a backup into the empty log, whose next entry follows the
+// backup's index. The snapshot is first passed to save.
+func (l *raftLog) restore(b backup, save func(index, term uint64, snapshot, sessions []byte) error) error {
+	sessions, err := decodeSessions(b.sessions)
+	if err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if l.lastIndexWithLock() != 0 || l.storeSize != 0 {
+		return errLogNotEmpty
+	}
+	if err := save(b.index, b.term, b.snapshot, b.sessions); err != nil {
+		return err
+	}
+	l.compactedIndex, l.compactedTerm, l.compactedHash = b.index, b.term, b.hash
+	if b.configIndex > 0 {
+		l.compactedConfig = logEntry{Index: b.configIndex, Kind: kindConfiguration, Command: b.configuration}
+	}
+	l.lastApplied, l.appliedTo = b.index, b.index
+	l.sessions.restore(sessions.Sessions)
+	l.sessionsIndex = sessions.Index
+	return nil
+}
+
+// restoreEntries appends entries to a log which holds none after its
+// compacted entries, e.g. one just restored from a snapshot, whose first entry
+// may be far above 1. appendEntries takes the first entry of such a log on
+// trust; here, the first must follow the last compacted entry, and each after
+// it the one before, without gaps, and in no earlier a term. Unless they all
+// do, none is appended.
+func (l *raftLog) restoreEntries(entries []logEntry) error {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.entries) > 0 {
+		return errLogNotEmpty
+	}
+
+	prevIndex, prevTerm := l.compactedIndex, l.compactedTerm
+	for _, entry := range entries {
+		switch {
+		case entry.Term == 0:
+			return l.errorWithLock(ErrBadTerm, entry.Index, entry.Term)
+		case entry.Index <= prevIndex:
+			return l.errorWithLock(ErrIndexTooSmall, entry.Index, entry.Term)
+		case entry.Index > prevIndex+1:
+			return l.errorWithLock(ErrIndexTooBig, entry.Index, entry.Term)
+		case entry.Term < prevTerm:
+			return l.errorWithLock(ErrTermTooSmall, entry.Index, entry.Term)
+		}
+		prevIndex, prevTerm = entry.Index, entry.Term
+	}
+	l.appendWithLock(entries)
+	return nil
+}
+
+// writeTo writes the backup to w.
+func (b backup) writeTo(w io.Writer) error {
+	tw := &transferWriter{w: w, crc: crc32.NewIEEE()}
+	for _, field := range []interface{}{
+		[]byte(backupMagic), backupVersion,
+		b.index, b.term, b.hash, b.configIndex,
+		uint64(len(b.configuration)), b.configuration,
+		uint64(len(b.snapshot)), b.snapshot,
+		uint64(len(b.sessions)), b.sessions,
+	} {
+		if err := binary.Write(tw, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	return binary.Write(w, binary.LittleEndian, tw.crc.Sum32())
+}
+
+// readBackup reads a backup written by writeTo, and checks it's intact.
+func readBackup(r io.Reader) (backup, error) {
+	tr := &transferReader{r: r, crc: crc32.NewIEEE()}
+	read := func(fields ...interface{}) error {
+		for _, field := range fields {
+			if err := binary.Read(tr, binary.LittleEndian, field); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	readBytes := func(b *[]byte) error {
+		var size uint64
+		if err := read(&size); err != nil {
+			return err
+		}
+		buf := &bytes.Buffer{} // grown as it's read, in case size is corrupt
+		if _, err := io.CopyN(buf, tr, int64(size)); err != nil {
+			return err
+		}
+		*b = buf.Bytes()
+		return nil
+	}
+
+	var (
+		b       backup
+		magic   = make([]byte, len(backupMagic))
+		version byte
+	)
+	if err := read(magic, &version); err != nil {
+		return backup{}, err
+	}
+	if string(magic) != backupMagic || version != backupVersion {
+		return backup{}, errBadBackup
+	}
+	if err := read(&b.index, &b.term, &b.hash, &b.configIndex); err != nil {
+		return backup{}, err
+	}
+	for _, field := range []*[]byte{&b.configuration, &b.snapshot, &b.sessions} {
+		if err := readBytes(field); err != nil {
+			return backup{}, err
+		}
+	}
+	sum := tr.crc.Sum32()
+	var crc uint32
+	if err := read(&crc); err != nil {
+		return backup{}, err
+	}
+	if crc != sum {
+		return backup{}, errInvalidChecksum
+	}
+	return b, nil
+}
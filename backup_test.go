@@ -0,0 +1,190 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestSnapshotToRestoreFrom(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 1, which records its peers by description, and whose state
+	// machine counts commands
+	var server *Server
+	factory := func(PeerDescriptor) (Peer, error) { return newLocalPeer(server), nil }
+	command := func() uint64 {
+		index, _, err := server.commandWait([]byte(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return index
+	}
+	sm := &countingStateMachine{}
+	server = NewServer(1, &bytes.Buffer{}, sm.apply, WithPeerFactory(factory), WithSnapshots(sm, &snapshotRecorder{}))
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	waitForState(t, server, leader)
+	for i := 0; i < 3; i++ {
+		command()
+	}
+
+	// is backed up, and carries on committing commands while the backup is
+	// written, which don't make it into the backup
+	r, w := io.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		err := server.SnapshotTo(w)
+		w.CloseWithError(err)
+		errs <- err
+	}()
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(r, first); err != nil {
+		t.Fatal(err)
+	}
+	index := command()
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	backup := append(first, rest...)
+	server.Stop()
+
+	// from which a new server restores
+	sm, snapshots := &countingStateMachine{}, &snapshotRecorder{}
+	server = NewServer(1, &bytes.Buffer{}, sm.apply, WithPeerFactory(factory), WithSnapshots(sm, snapshots))
+	if err := server.RestoreFrom(bytes.NewReader(backup)); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := fmt.Sprintf("%q at index %d", "3", index-1), fmt.Sprintf("%q at index %d", snapshots.snapshot, snapshots.index); expected != got {
+		t.Errorf("expected snapshot %s, got %s", expected, got)
+	}
+	if expected, got := "[1]", fmt.Sprint(server.config.allPeers().ids()); expected != got {
+		t.Errorf("expected configuration %s, got %s", expected, got)
+	}
+	if sm.n, err = strconv.Atoi(string(snapshots.snapshot)); err != nil {
+		t.Fatal(err)
+	}
+
+	// and carries on from it
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+	if got := command(); got <= snapshots.index {
+		t.Errorf("expected a command after index %d, got index %d", snapshots.index, got)
+	}
+	if expected, got := "4", fmt.Sprint(sm.n); expected != got {
+		t.Errorf("expected %s commands applied, got %s", expected, got)
+	}
+}
+
+func TestRestoreFromDamagedBackup(t *testing.T) {
+	sm := &countingStateMachine{}
+	server := NewServer(1, &bytes.Buffer{}, sm.apply, WithSnapshots(sm, &snapshotRecorder{}))
+	gob.Register(acceptingPeer{})
+	server.SetConfiguration(acceptingPeer{1})
+	server.log.appendEntry(logEntry{Index: 1, Term: 1, Command: []byte(`{}`)})
+	server.log.commitTo(1)
+	buf := &bytes.Buffer{}
+	if err := server.SnapshotTo(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	damaged := append([]byte{}, buf.Bytes()...)
+	damaged[len(damaged)-10] ^= 0xff
+	snapshots := &snapshotRecorder{}
+	restored := NewServer(1, &bytes.Buffer{}, noop, WithSnapshots(sm, snapshots))
+	if err := restored.RestoreFrom(bytes.NewReader(damaged)); err != errInvalidChecksum {
+		t.Errorf("expected %v, got %v", errInvalidChecksum, err)
+	}
+	if snapshots.snapshot != nil {
+		t.Errorf("expected nothing saved, got %q", snapshots.snapshot)
+	}
+
+	// nor is a backup restored into a log which isn't empty
+	if err := server.RestoreFrom(bytes.NewReader(buf.Bytes())); err != errLogNotEmpty {
+		t.Errorf("expected %v, got %v", errLogNotEmpty, err)
+	}
+}
+
+func TestRestoreEntriesOntoSnapshot(t *testing.T) {
+	// a log restored from a snapshot at index 100, in term 3
+	var applied []string
+	apply := func(index uint64, cmd []byte) []byte {
+		applied = append(applied, fmt.Sprintf("%d:%s", index, cmd))
+		return []byte{}
+	}
+	store := &bytes.Buffer{}
+	l := newRaftLog(store, apply)
+	sessions, err := l.encodeSessionsWithLock() // nothing else has the log yet
+	if err != nil {
+		t.Fatal(err)
+	}
+	save := func(index, term uint64, snapshot, sessions []byte) error { return nil }
+	if err := l.restore(backup{index: 100, term: 3, sessions: sessions}, save); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := func(from, to, term uint64) []logEntry {
+		var entries []logEntry
+		for index := from; index <= to; index++ {
+			entries = append(entries, logEntry{Index: index, Term: term, Command: []byte(strconv.FormatUint(index, 10))})
+		}
+		return entries
+	}
+
+	// rejects entries which don't follow it, or each other
+	for _, tu := range []struct {
+		entries  []logEntry
+		expected error
+	}{
+		{entries(100, 110, 3), ErrIndexTooSmall},
+		{entries(102, 110, 3), ErrIndexTooBig},
+		{entries(101, 110, 2), ErrTermTooSmall},
+		{entries(101, 110, 0), ErrBadTerm},
+		{append(entries(101, 105, 3), entries(107, 110, 3)...), ErrIndexTooBig},
+		{append(entries(101, 105, 4), entries(106, 110, 3)...), ErrTermTooSmall},
+	} {
+		if err := l.restoreEntries(tu.entries); !errors.Is(err, tu.expected) {
+			t.Errorf("%d-%d: expected %v, got %v", tu.entries[0].Index, tu.entries[len(tu.entries)-1].Index, tu.expected, err)
+		}
+	}
+	if expected, got := uint64(100), l.lastIndex(); expected != got {
+		t.Fatalf("expected nothing appended after %d, got %d", expected, got)
+	}
+
+	// but takes 101-110, and applies only them
+	if err := l.restoreEntries(append(entries(101, 105, 3), entries(106, 110, 4)...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.commitTo(110); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "[101:101 102:102 103:103 104:104 105:105 106:106 107:107 108:108 109:109 110:110]", fmt.Sprint(applied); expected != got {
+		t.Errorf("expected %s applied, got %s", expected, got)
+	}
+
+	// once
+	if err := l.restoreEntries(entries(111, 111, 4)); err != errLogNotEmpty {
+		t.Errorf("expected %v, got %v", errLogNotEmpty, err)
+	}
+
+	// and a log recovered from its store begins with them
+	recovered := newRaftLog(bytes.NewBuffer(store.Bytes()), noop)
+	if expected, got := "101-110", fmt.Sprintf("%d-%d", recovered.firstIndex(), recovered.lastIndex()); expected != got {
+		t.Errorf("expected entries %s, got %s", expected, got)
+	}
+}
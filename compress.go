@@ -0,0 +1,69 @@
+package raft
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+)
+
+var errNoCompressor = errors.New("compressed entry, but no Compressor configured")
+
+// Compressor compresses the commands of large log entries as they're written
+// to the store, and decompresses them when they're recovered. It's transparent
+// to the ApplyFunc, and to peers, which are always sent commands as they are.
+// See WithCompression.
+type Compressor interface {
+	Compress(b []byte) ([]byte, error)
+	Decompress(b []byte) ([]byte, error)
+}
+
+// GzipCompressor is a Compressor using gzip, at the default level.
+type GzipCompressor struct{}
+
+// Compress implements Compressor.
+func (GzipCompressor) Compress(b []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress implements Compressor.
+func (GzipCompressor) Decompress(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// compression is how a log compresses the commands it writes: those larger
+// than threshold bytes, provided that makes them smaller. The zero value
+// compresses nothing.
+type compression struct {
+	compressor Compressor
+	threshold  int
+}
+
+// compress returns the command as it should be written, and whether that's
+// compressed.
+func (c compression) compress(cmd []byte) ([]byte, bool, error) {
+	if c.compressor == nil || len(cmd) <= c.threshold {
+		return cmd, false, nil
+	}
+	compressed, err := c.compressor.Compress(cmd)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(compressed) >= len(cmd) {
+		return cmd, false, nil
+	}
+	return compressed, true, nil
+}
@@ -2,14 +2,18 @@ package raft
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 )
 
 var (
 	errConfigurationAlreadyChanging = errors.New("configuration already changing")
+	errNoPeerFactory                = errors.New("configuration holds peer descriptors, but there's no PeerFactory")
+	errBadConfiguration             = errors.New("malformed configuration")
 )
 
 const (
@@ -24,6 +28,9 @@ type configuration struct {
 	state     string
 	cOldPeers peerMap
 	cNewPeers peerMap
+	index     uint64      // of the log entry which established C_old
+	restored  uint64      // of the C_old,new entry restored by restore, if any
+	factory   PeerFactory // see WithPeerFactory; nil means peers are encoded whole
 }
 
 // newConfiguration returns a new configuration in stable (C_old) state based
@@ -37,18 +44,49 @@ func newConfiguration(pm peerMap) *configuration {
 
 // directSet is used when bootstrapping, and when receiving a replicated
 // configuration from a leader. It directly sets the configuration to the
-// passed peers. It's assumed this is called on a non-leader, and therefore
-// requires no consistency dance.
-func (c *configuration) directSet(pm peerMap) error {
+// passed peers. index is that of the log entry carrying the configuration, or
+// zero when bootstrapping. It's assumed this is called on a non-leader, and
+// therefore requires no consistency dance.
+func (c *configuration) directSet(pm peerMap, index uint64) error {
 	c.Lock()
 	defer c.Unlock()
 
 	c.cOldPeers = pm
 	c.cNewPeers = peerMap{}
 	c.state = cOld
+	c.index = index
+	c.restored = 0
 	return nil
 }
 
+// restore sets the configuration recovered from the log at startup: C_old, and
+// C_new too, if the most recent configuration entry was written during a
+// change. index is that of the entry. A leader which finds itself in C_old,new
+// completes the change, since every recovered entry is committed.
+func (c *configuration) restore(oldPeers, newPeers peerMap, index uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.cOldPeers = oldPeers
+	c.cNewPeers = newPeers
+	c.state = cOld
+	c.index = index
+	c.restored = 0
+	if len(newPeers) > 0 {
+		c.state = cOldNew
+		c.restored = index
+	}
+}
+
+// restoredChange returns the index of the C_old,new entry set by restore, or
+// zero if the configuration has changed since, or wasn't restored mid-change.
+func (c *configuration) restoredChange() uint64 {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.restored
+}
+
 func (c *configuration) get(id uint64) (Peer, bool) {
 	c.RLock()
 	defer c.RUnlock()
@@ -62,14 +100,292 @@ func (c *configuration) get(id uint64) (Peer, bool) {
 	return nil, false
 }
 
+// PeerDescriptor is the serializable description of a peer, from which a
+// PeerFactory can construct a live one. Address is where the peer can be
+// reached, e.g. the URL of an HTTP peer. Role is for the application's own
+// use; see WithPeerRole.
+type PeerDescriptor struct {
+	ID      uint64
+	Address string
+	Role    string
+}
+
+// Membership is the part a peer plays in a server's network.
+type Membership string
+
+const (
+	// Voter peers are in the configuration: they vote in elections, and count
+	// toward the commit quorum.
+	Voter Membership = "voter"
+
+	// ReadReplica peers are sent the log, but don't vote, and don't count
+	// toward any quorum. See AddReadReplica.
+	ReadReplica Membership = "read-replica"
+)
+
+// ConfigurationPeer describes a peer in a Configuration. The Role of its
+// PeerDescriptor is the application's; its Membership is the server's.
+type ConfigurationPeer struct {
+	PeerDescriptor
+	Membership Membership `json:"membership"`
+}
+
+// Configuration is a copy of the peers a server knows of, as returned by
+// Server.Configuration. Peers are in ID order. Index and Term are those of the
+// log entry which established the configuration; both are zero if it was set
+// before the server was started, and Term is zero if the entry has since been
+// compacted.
+type Configuration struct {
+	Peers []ConfigurationPeer `json:"peers"`
+	Index uint64              `json:"index"`
+	Term  uint64              `json:"term"`
+}
+
+// Configuration returns the server's active configuration: the voters, and the
+// read replicas it feeds, including the server itself. While the
+// configuration is changing, it's the configuration being changed from. A read
+// replica reports itself as one.
+func (s *Server) Configuration() Configuration {
+	voters, index := s.config.active()
+	term, _ := s.log.termAt(index)
+	if index == 0 {
+		term = 0
+	}
+
+	peers := []ConfigurationPeer{}
+	for _, peer := range voters {
+		peers = append(peers, ConfigurationPeer{describe(peer), Voter})
+	}
+	for _, peer := range s.replicas.except(voters) {
+		peers = append(peers, ConfigurationPeer{describe(peer), ReadReplica})
+	}
+	if _, ok := voters[s.id]; s.readReplica && !ok {
+		peers = append(peers, ConfigurationPeer{PeerDescriptor{ID: s.id}, ReadReplica})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return Configuration{Peers: peers, Index: index, Term: term}
+}
+
+// LatestConfiguration returns the peers of the latest configuration entry in
+// the log, in ID order, and its index: both halves, if it's a joint
+// configuration. The entry may not be committed yet, or may have been
+// compacted, or carried by the backup the server was restored from; the log
+// keeps track of it, so it's found without scanning. If the log has no
+// configuration entry, it returns no peers and a zero index.
+func (s *Server) LatestConfiguration() ([]Peer, uint64, error) {
+	entry, ok := s.log.lastConfiguration()
+	if !ok {
+		return nil, 0, nil
+	}
+	oldPeers, newPeers, err := decodeConfiguration(entry.Command, s.config.factory)
+	if err != nil {
+		return nil, 0, err
+	}
+	return sortedPeers(oldPeers.union(newPeers)), entry.Index, nil
+}
+
+// PeerFactory constructs a live Peer from its descriptor. See WithPeerFactory.
+type PeerFactory func(PeerDescriptor) (Peer, error)
+
+// describe returns the descriptor of the passed peer. Peers which don't know
+// their address are described by their ID alone.
+func describe(peer Peer) PeerDescriptor {
+	if d, ok := peer.(interface{ descriptor() PeerDescriptor }); ok {
+		return d.descriptor()
+	}
+	return PeerDescriptor{ID: peer.id()}
+}
+
+// encodedConfiguration is what's carried by a configuration entry, gob-encoded,
+// unless there's a PeerFactory; see encodeDescriptors. New is empty unless the
+// entry was written during a change, in C_old,new. Peers are encoded in order
+// of ID, as OldPeers and NewPeers, since gob encodes a map in whatever order
+// it's iterated; Old and New, and the descriptors, are only decoded, from
+// entries written before that.
+type encodedConfiguration struct {
+	Old            peerMap
+	New            peerMap
+	OldPeers       []Peer
+	NewPeers       []Peer
+	OldDescriptors []PeerDescriptor
+	NewDescriptors []PeerDescriptor
+}
+
+// encode encodes the configuration for a configuration entry. Like an entry,
+// the same configuration always encodes to the same bytes, if it's described
+// for a PeerFactory. Otherwise, it's encoded with gob, which numbers the types
+// it encodes in the order the process first encounters them, so the bytes are
+// only the same within a process. Either way, the bytes are replicated as
+// they are, so every server's hash chain agrees.
 func (c *configuration) encode() ([]byte, error) {
+	c.RLock()
+	if c.factory != nil {
+		b := encodeDescriptors(describeAll(c.cOldPeers), describeAll(c.cNewPeers))
+		c.RUnlock()
+		return b, nil
+	}
+	e := encodedConfiguration{OldPeers: sortedPeers(c.cOldPeers), NewPeers: sortedPeers(c.cNewPeers)}
+	c.RUnlock()
+
 	buf := &bytes.Buffer{}
-	if err := gob.NewEncoder(buf).Encode(c.allPeers()); err != nil {
+	if err := gob.NewEncoder(buf).Encode(e); err != nil {
 		return []byte{}, err
 	}
 	return buf.Bytes(), nil
 }
 
+// sortedPeers returns the passed peers, in order of ID.
+func sortedPeers(pm peerMap) []Peer {
+	a := []Peer{}
+	for _, id := range pm.ids() {
+		a = append(a, pm[id])
+	}
+	return a
+}
+
+// descriptorsTag begins a configuration encoded by encodeDescriptors. A gob
+// stream never begins with a zero byte, so it tells the two apart.
+const descriptorsTag = 0
+
+// encodeDescriptors encodes both halves of a configuration, described for a
+// PeerFactory, in a fixed layout:
+//
+//	 -----------------------------------------------------
+//	| uint8 | uvarint | []descriptor | uvarint | []descriptor |
+//	 -----------------------------------------------------
+//	| TAG   | OLD     | C_old        | NEW     | C_new        |
+//	 -----------------------------------------------------
+//
+// TAG is descriptorsTag, and OLD and NEW are the numbers of descriptors which
+// follow. Each descriptor is its ID, as a uvarint, and then its Address and
+// Role, each as a uvarint length and the bytes of the string.
+func encodeDescriptors(oldPeers, newPeers []PeerDescriptor) []byte {
+	b := []byte{descriptorsTag}
+	for _, descriptors := range [][]PeerDescriptor{oldPeers, newPeers} {
+		b = binary.AppendUvarint(b, uint64(len(descriptors)))
+		for _, d := range descriptors {
+			b = binary.AppendUvarint(b, d.ID)
+			b = binary.AppendUvarint(b, uint64(len(d.Address)))
+			b = append(b, d.Address...)
+			b = binary.AppendUvarint(b, uint64(len(d.Role)))
+			b = append(b, d.Role...)
+		}
+	}
+	return b
+}
+
+// decodeDescriptors decodes a configuration encoded by encodeDescriptors.
+func decodeDescriptors(b []byte) (oldPeers, newPeers []PeerDescriptor, err error) {
+	r := bytes.NewReader(b[1:])
+	uvarint := func() uint64 {
+		n, e := binary.ReadUvarint(r)
+		if e != nil && err == nil {
+			err = errBadConfiguration
+		}
+		return n
+	}
+	str := func() string {
+		n := uvarint()
+		if n > uint64(r.Len()) {
+			err = errBadConfiguration
+			return ""
+		}
+		s := make([]byte, n)
+		r.Read(s)
+		return string(s)
+	}
+
+	halves := [2][]PeerDescriptor{}
+	for i := range halves {
+		// each descriptor takes at least 3 bytes, which guards against
+		// allocating a huge slice for a corrupt count
+		n := uvarint()
+		if err != nil || n > uint64(r.Len()) {
+			return nil, nil, errBadConfiguration
+		}
+		halves[i] = make([]PeerDescriptor, n)
+		for j := range halves[i] {
+			halves[i][j] = PeerDescriptor{ID: uvarint(), Address: str(), Role: str()}
+		}
+	}
+	if err != nil || r.Len() > 0 {
+		return nil, nil, errBadConfiguration
+	}
+	return halves[0], halves[1], nil
+}
+
+// describeAll describes the passed peers, in order of ID.
+func describeAll(pm peerMap) []PeerDescriptor {
+	a := []PeerDescriptor{}
+	for _, id := range pm.ids() {
+		a = append(a, describe(pm[id]))
+	}
+	return a
+}
+
+// decodeConfiguration decodes both halves of a configuration, as encoded by
+// encode. newPeers is empty unless it was encoded in C_old,new. Peers encoded
+// as descriptors are constructed by the factory. Before version 3 of the log
+// format, only the union of the peers was encoded; that's returned as
+// oldPeers.
+func decodeConfiguration(b []byte, factory PeerFactory) (oldPeers, newPeers peerMap, err error) {
+	var e encodedConfiguration
+	if len(b) > 0 && b[0] == descriptorsTag {
+		if e.OldDescriptors, e.NewDescriptors, err = decodeDescriptors(b); err != nil {
+			return peerMap{}, peerMap{}, err
+		}
+	} else if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&e); err != nil {
+		var pm peerMap
+		if gob.NewDecoder(bytes.NewReader(b)).Decode(&pm) != nil {
+			return peerMap{}, peerMap{}, err
+		}
+		return pm, peerMap{}, nil
+	}
+	if len(e.OldDescriptors) > 0 || len(e.NewDescriptors) > 0 {
+		if factory == nil {
+			return peerMap{}, peerMap{}, errNoPeerFactory
+		}
+		if e.Old, err = constructAll(e.OldDescriptors, factory); err != nil {
+			return peerMap{}, peerMap{}, err
+		}
+		if e.New, err = constructAll(e.NewDescriptors, factory); err != nil {
+			return peerMap{}, peerMap{}, err
+		}
+	}
+	if len(e.OldPeers) > 0 || len(e.NewPeers) > 0 {
+		e.Old, e.New = makePeerMap(e.OldPeers...), makePeerMap(e.NewPeers...)
+	}
+	if e.Old == nil {
+		e.Old = peerMap{}
+	}
+	if e.New == nil {
+		e.New = peerMap{}
+	}
+	return e.Old, e.New, nil
+}
+
+func constructAll(descriptors []PeerDescriptor, factory PeerFactory) (peerMap, error) {
+	pm := peerMap{}
+	for _, d := range descriptors {
+		peer, err := factory(d)
+		if err != nil {
+			return peerMap{}, fmt.Errorf("constructing peer %d: %s", d.ID, err)
+		}
+		pm[d.ID] = peer
+	}
+	return pm, nil
+}
+
+// decodePeerMap decodes all the peers of a configuration, as encoded by
+// encode, i.e. the union of C_old and C_new.
+func decodePeerMap(b []byte, factory PeerFactory) (peerMap, error) {
+	oldPeers, newPeers, err := decodeConfiguration(b, factory)
+	if err != nil {
+		return peerMap{}, err
+	}
+	return oldPeers.union(newPeers), nil
+}
+
 // allPeers returns the union set of all peers in the configuration.
 func (c *configuration) allPeers() peerMap {
 	c.RLock()
@@ -135,6 +451,44 @@ func (c *configuration) pass(votes map[uint64]bool) bool {
 	return cNewHave >= cNewRequired
 }
 
+// quorum returns the Quorum of the configuration, as built by f, or by
+// NewMajorityQuorum if f is nil: that of C_old, or, in C_old,new, the joint
+// quorum of C_old and C_new.
+func (c *configuration) quorum(f QuorumFunc) Quorum {
+	c.RLock()
+	defer c.RUnlock()
+
+	if f == nil {
+		f = NewMajorityQuorum
+	}
+	if c.state == cOld {
+		return f(c.cOldPeers.ids())
+	}
+	return JointQuorum{Old: f(c.cOldPeers.ids()), New: f(c.cNewPeers.ids())}
+}
+
+// unchanged returns true if the configuration is stable, and its peers are
+// described exactly as the passed ones are: the same IDs, addresses, and
+// roles, if not the same Peer values.
+func (c *configuration) unchanged(pm peerMap) bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.state != cOld {
+		return false
+	}
+	a, b := describeAll(c.cOldPeers), describeAll(pm)
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // changeTo signals a request to change to the configuration represented by the
 // passed peers. changeTo puts the configuration in the C_old,new state.
 // changeTo should be eventually followed by ChangeCommitted or ChangeAborted.
@@ -155,8 +509,30 @@ func (c *configuration) changeTo(pm peerMap) error {
 	return nil
 }
 
-// changeCommitted moves a configuration from C_old,new to C_new.
-func (c *configuration) changeCommitted() {
+// changing returns true if the configuration is in C_old,new.
+func (c *configuration) changing() bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.state != cOld
+}
+
+// active returns the peers of the stable configuration, and the index of the
+// log entry which established it.
+func (c *configuration) active() (peerMap, uint64) {
+	c.RLock()
+	defer c.RUnlock()
+
+	pm := peerMap{}
+	for id, peer := range c.cOldPeers {
+		pm[id] = peer
+	}
+	return pm, c.index
+}
+
+// changeCommitted moves a configuration from C_old,new to C_new. index is that
+// of the committed log entry which carried the change.
+func (c *configuration) changeCommitted(index uint64) {
 	c.Lock()
 	defer c.Unlock()
 
@@ -171,6 +547,8 @@ func (c *configuration) changeCommitted() {
 	c.cOldPeers = c.cNewPeers
 	c.cNewPeers = peerMap{}
 	c.state = cOld
+	c.index = index
+	c.restored = 0
 }
 
 // changeAborted moves a configuration from C_old,new to C_old.
@@ -184,4 +562,5 @@ func (c *configuration) changeAborted() {
 
 	c.cNewPeers = peerMap{}
 	c.state = cOld
+	c.restored = 0
 }
@@ -0,0 +1,285 @@
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// appliedLog records the commands a server's state machine applies, by index.
+type appliedLog struct {
+	sync.Mutex
+	id       uint64
+	commands map[uint64][]byte
+	twice    []uint64 // indices applied more than once
+}
+
+func newAppliedLog(id uint64) *appliedLog {
+	return &appliedLog{id: id, commands: map[uint64][]byte{}}
+}
+
+func (a *appliedLog) apply(index uint64, cmd []byte) []byte {
+	a.Lock()
+	defer a.Unlock()
+	if _, ok := a.commands[index]; ok {
+		a.twice = append(a.twice, index)
+	}
+	a.commands[index] = append([]byte{}, cmd...)
+	return []byte{}
+}
+
+// sequence returns the commands applied, in index order, up to and including
+// index, with nil for any index which wasn't applied, e.g. a configuration.
+func (a *appliedLog) sequence(index uint64) [][]byte {
+	a.Lock()
+	defer a.Unlock()
+	seq := make([][]byte, index)
+	for i := uint64(1); i <= index; i++ {
+		seq[i-1] = a.commands[i]
+	}
+	return seq
+}
+
+// assertLogsConsistent fails the test unless every server applied exactly the
+// same command at every index up to its commit index, and none more than once,
+// and their logs agree on every entry both have committed. That's Raft's core
+// safety property: whatever order the servers learned of them, and whatever
+// leaders came and went, they agree on what was applied.
+func assertLogsConsistent(t *testing.T, servers []*Server, logs []*appliedLog) {
+	t.Helper()
+	var reference *appliedLog
+	var referenceSeq [][]byte
+	for i, server := range servers {
+		if i > 0 {
+			committed := server.log.getCommitIndex()
+			if c := servers[0].log.getCommitIndex(); c < committed {
+				committed = c
+			}
+			if index := divergence(servers[0].log, server.log); index > 0 && index <= committed {
+				t.Errorf("server %d and server %d logs diverge at committed index %d", servers[0].id, server.id, index)
+			}
+		}
+
+		logs[i].Lock()
+		if len(logs[i].twice) > 0 {
+			t.Errorf("server %d: applied indices %v more than once", logs[i].id, logs[i].twice)
+		}
+		logs[i].Unlock()
+
+		seq := logs[i].sequence(server.log.getCommitIndex())
+		if reference == nil {
+			reference, referenceSeq = logs[i], seq
+			continue
+		}
+		for index := 0; index < len(seq) && index < len(referenceSeq); index++ {
+			if !bytes.Equal(seq[index], referenceSeq[index]) {
+				t.Errorf(
+					"server %d and server %d diverge at index %d: %q vs %q",
+					reference.id, logs[i].id, index+1, referenceSeq[index], seq[index],
+				)
+				break
+			}
+		}
+	}
+}
+
+// safetyMonitor collects the safety violations servers report; see
+// Events.OnSafetyViolation. Every server in a test can share one.
+type safetyMonitor struct {
+	sync.Mutex
+	violations []error
+}
+
+func (m *safetyMonitor) events() Events {
+	return Events{OnSafetyViolation: func(err error) {
+		m.Lock()
+		defer m.Unlock()
+		m.violations = append(m.violations, err)
+	}}
+}
+
+func (m *safetyMonitor) get() []error {
+	m.Lock()
+	defer m.Unlock()
+	return append([]error{}, m.violations...)
+}
+
+// assertNoSafetyViolations fails the test if any server reported a safety
+// violation, e.g. two leaders in one term.
+func assertNoSafetyViolations(t *testing.T, m *safetyMonitor) {
+	t.Helper()
+	for _, err := range m.get() {
+		t.Errorf("safety violation: %s", err)
+	}
+}
+
+// partition controls which servers in a network of partitionedPeers can reach
+// each other. Every server is in group 0 to begin with.
+type partition struct {
+	sync.RWMutex
+	group map[uint64]int
+}
+
+func (p *partition) set(group map[uint64]int) {
+	p.Lock()
+	defer p.Unlock()
+	p.group = group
+}
+
+func (p *partition) connected(a, b uint64) bool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.group[a] == p.group[b]
+}
+
+// partitionedPeer is a server's view of a peer, which fails every RPC while the
+// partition separates them.
+type partitionedPeer struct {
+	from uint64
+	to   Peer
+	net  *partition
+}
+
+func (p partitionedPeer) id() uint64 { return p.to.id() }
+func (p partitionedPeer) callAppendEntries(ae appendEntries) appendEntriesResponse {
+	if !p.net.connected(p.from, p.to.id()) {
+		return appendEntriesResponse{}
+	}
+	return p.to.callAppendEntries(ae)
+}
+func (p partitionedPeer) callRequestVote(rv requestVote) requestVoteResponse {
+	if !p.net.connected(p.from, p.to.id()) {
+		return requestVoteResponse{}
+	}
+	return p.to.callRequestVote(rv)
+}
+func (p partitionedPeer) callCommand(cmd []byte, response chan<- []byte) (uint64, error) {
+	if !p.net.connected(p.from, p.to.id()) {
+		return 0, errTimeout
+	}
+	return p.to.callCommand(cmd, response)
+}
+func (p partitionedPeer) callSetConfiguration(peers ...Peer) error {
+	if !p.net.connected(p.from, p.to.id()) {
+		return errTimeout
+	}
+	return p.to.callSetConfiguration(peers...)
+}
+func (p partitionedPeer) callRead(query []byte) ([]byte, error) {
+	if !p.net.connected(p.from, p.to.id()) {
+		return nil, errTimeout
+	}
+	return p.to.callRead(query)
+}
+
+func TestAppliedOrderConsistent(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	seed := time.Now().UnixNano()
+	rng := rand.New(rand.NewSource(seed))
+	t.Logf("seed %d", seed)
+
+	// a network of 5, each of which sees the others through a partition
+	const n = 5
+	var (
+		net     = &partition{}
+		servers = make([]*Server, n)
+		logs    = make([]*appliedLog, n)
+		monitor = &safetyMonitor{}
+	)
+	for i := range servers {
+		logs[i] = newAppliedLog(uint64(i + 1))
+		servers[i] = NewServer(uint64(i+1), &bytes.Buffer{}, logs[i].apply, WithEvents(monitor.events()))
+	}
+	for _, server := range servers {
+		peers := []Peer{newLocalPeer(server)}
+		for _, other := range servers {
+			if other != server {
+				peers = append(peers, partitionedPeer{from: server.id, to: newLocalPeer(other), net: net})
+			}
+		}
+		server.SetConfiguration(peers...)
+		server.Start()
+		defer server.Stop()
+	}
+
+	// sends commands through whichever servers think they're leader, whether
+	// or not they still are
+	sent := 0
+	send := func(count int) {
+		for i := 0; i < count; i++ {
+			for _, server := range servers {
+				if server.state.Get() != leader {
+					continue
+				}
+				sent++
+				server.CommandAsync([]byte(fmt.Sprintf("%d:%d", server.id, sent)))
+			}
+			time.Sleep(time.Duration(rng.Intn(5)) * time.Millisecond)
+		}
+	}
+
+	// a workload interrupted by partitions, which depose leaders, and leave
+	// entries on both sides that can't all be committed
+	for round := 0; round < 8; round++ {
+		group := map[uint64]int{}
+		switch rng.Intn(3) {
+		case 0: // isolate the leader, if there is one
+			for _, server := range servers {
+				if server.state.Get() == leader {
+					group[server.id] = 1
+				}
+			}
+		case 1: // split the network in two
+			for _, server := range servers {
+				group[server.id] = rng.Intn(2)
+			}
+		case 2: // heal it
+		}
+		net.set(group)
+		send(10)
+		time.Sleep(time.Duration(1+rng.Intn(3)) * maximumElectionTimeout())
+	}
+
+	// heal the network, and let it settle on one leader, which commits a
+	// final command everywhere
+	net.set(nil)
+	deadline := time.Now().Add(40 * maximumElectionTimeout())
+	var final uint64
+	for final == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no leader committed a final command")
+		}
+		for _, server := range servers {
+			if server.state.Get() != leader {
+				continue
+			}
+			if index, _, err := server.commandWait([]byte("final")); err == nil {
+				final = index
+				break
+			}
+		}
+		time.Sleep(maximumElectionTimeout())
+	}
+	for _, server := range servers {
+		for server.log.getAppliedTo() < final || server.log.getCommitIndex() < final {
+			if time.Now().After(deadline) {
+				t.Fatalf("server %d didn't apply through index %d", server.id, final)
+			}
+			time.Sleep(minimumElectionTimeout())
+		}
+	}
+
+	assertLogsConsistent(t, servers, logs)
+	assertNoSafetyViolations(t, monitor)
+}
@@ -0,0 +1,177 @@
+package raft
+
+import (
+	"sync"
+	"time"
+)
+
+// Events are optional callbacks, through which a Server reports notable
+// occurrences to the application. Callbacks are invoked from the server's own
+// goroutines, so they should return quickly, and mustn't call back into the
+// server. Any callback may be left nil.
+type Events struct {
+	// OnConfigurationChange is called when a configuration change is
+	// committed, with the IDs of the peers before and after the change, and
+	// the index and term of the log entry which carried it.
+	OnConfigurationChange func(oldPeers, newPeers []uint64, index, term uint64)
+
+	// OnStuckCandidate is called when a candidate has failed to win several
+	// elections in a row, which usually means it's partitioned from a quorum,
+	// or misconfigured. term is that of the latest failed election, and
+	// elapsed is the time since the server became a candidate. See
+	// WithStuckCandidateThreshold.
+	OnStuckCandidate func(term uint64, attempts int, elapsed time.Duration)
+
+	// OnTermGap is called when a peer presents a term too far ahead of the
+	// server's own, and is ignored. See WithMaxTermGap.
+	OnTermGap func(peerID, term, currentTerm uint64)
+
+	// OnVoteFromUnknownPeer is called when a candidate which isn't in the
+	// server's configuration asks for its vote, in the passed term. See
+	// WithUnknownCandidatePolicy.
+	OnVoteFromUnknownPeer func(candidateID, term uint64)
+
+	// OnCommit is called when the log entries with indexes in (from, to] are
+	// committed. Entries committed together are reported together, and with
+	// WithCommitCoalescing, so are those committed in quick succession.
+	// Entries recovered from the store when the server is created aren't
+	// reported.
+	OnCommit func(from, to uint64)
+
+	// OnFatalError is called if the server's main loop panics, which is
+	// always a bug, if its log store fails and the StoreErrorPolicy is
+	// FailOnStoreError, or if its StateStore fails. The server then rejects
+	// every request with ErrServerFailed.
+	OnFatalError func(err error)
+
+	// OnStoreError is called when the server fails to persist the entries
+	// it's committing, through index, to its log store, e.g. because the
+	// disk is full. The entries which couldn't be persisted aren't committed
+	// yet; see StoreErrorPolicy.
+	OnStoreError func(index uint64, err error)
+
+	// OnSlowApply is called when the state machine takes longer than the
+	// threshold set by WithSlowApplyThreshold to apply the command at index.
+	// It's called after the command is applied, with the time it took.
+	OnSlowApply func(index uint64, took time.Duration)
+
+	// OnApplied is called once the command at index has been applied, with
+	// when it was appended to this server's log, when this server learned
+	// it was committed, and when the state machine returned. The three are
+	// in that order, so the gaps are the time spent reaching a quorum and
+	// the time spent waiting for, and in, the state machine. It's not called
+	// for commands recovered from the log store.
+	OnApplied func(index uint64, appended, committed, applied time.Time)
+
+	// OnCaughtUp is called when a follower which was catching up, e.g. one
+	// which just joined, has caught up: its commit index has reached the
+	// leader's commit index as of when it was found to be behind. index is its
+	// commit index. It's called once each time the follower falls behind and
+	// catches up. See Stats.CatchingUp.
+	OnCaughtUp func(index uint64)
+
+	// OnSafetyViolation is called when the server sees evidence that one of
+	// Raft's safety guarantees has been broken, which is always a bug, in
+	// this package or in the transport, e.g. a leader receiving an
+	// AppendEntries RPC from another leader of the same term. err describes
+	// the violation. It's called for each offending RPC, so a violation
+	// which persists is reported repeatedly.
+	OnSafetyViolation func(err error)
+
+	// OnLeaseDisabled is called when a leader stops trusting its clock, and
+	// so disables leasing, after it finds its clock disagreeing with the
+	// monotonic clock once too often; see WithLeaseAnomalyThreshold.
+	// discrepancy is how far they disagreed the last time.
+	OnLeaseDisabled func(discrepancy time.Duration)
+}
+
+func (e Events) configurationChange(oldPeers, newPeers peerMap, index, term uint64) {
+	if e.OnConfigurationChange != nil {
+		e.OnConfigurationChange(oldPeers.ids(), newPeers.ids(), index, term)
+	}
+}
+
+func (e Events) stuckCandidate(term uint64, attempts int, elapsed time.Duration) {
+	if e.OnStuckCandidate != nil {
+		e.OnStuckCandidate(term, attempts, elapsed)
+	}
+}
+
+func (e Events) termGap(peerID, term, currentTerm uint64) {
+	if e.OnTermGap != nil {
+		e.OnTermGap(peerID, term, currentTerm)
+	}
+}
+
+func (e Events) voteFromUnknownPeer(candidateID, term uint64) {
+	if e.OnVoteFromUnknownPeer != nil {
+		e.OnVoteFromUnknownPeer(candidateID, term)
+	}
+}
+
+func (e Events) storeError(index uint64, err error) {
+	if e.OnStoreError != nil {
+		e.OnStoreError(index, err)
+	}
+}
+
+func (e Events) caughtUp(index uint64) {
+	if e.OnCaughtUp != nil {
+		e.OnCaughtUp(index)
+	}
+}
+
+func (e Events) leaseDisabled(discrepancy time.Duration) {
+	if e.OnLeaseDisabled != nil {
+		e.OnLeaseDisabled(discrepancy)
+	}
+}
+
+func (e Events) safetyViolation(err error) {
+	if e.OnSafetyViolation != nil {
+		e.OnSafetyViolation(err)
+	}
+}
+
+func (e Events) fatalError(err error) {
+	if e.OnFatalError != nil {
+		e.OnFatalError(err)
+	}
+}
+
+// commitNotifier reports commits to Events.OnCommit, coalescing those within
+// window of the first into a single range.
+type commitNotifier struct {
+	sync.Mutex
+	notify   func(from, to uint64)
+	window   time.Duration // see WithCommitCoalescing
+	pending  bool
+	from, to uint64
+}
+
+// add reports that the entries in (from, to] were committed.
+func (n *commitNotifier) add(from, to uint64) {
+	if n.notify == nil {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	if n.window <= 0 {
+		n.notify(from, to)
+		return
+	}
+	if n.pending {
+		n.to = to
+		return
+	}
+	n.pending, n.from, n.to = true, from, to
+	time.AfterFunc(n.window, n.flush)
+}
+
+// flush reports the pending range.
+func (n *commitNotifier) flush() {
+	n.Lock()
+	defer n.Unlock()
+	n.pending = false
+	n.notify(n.from, n.to)
+}
@@ -2,9 +2,11 @@ package raft_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"sync/atomic"
 
 	"github.com/peterbourgon/raft"
 )
@@ -68,3 +70,26 @@ func ExampleServer_Command() {
 	// After the command is replicated, we'll receive the response
 	fmt.Printf("%s\n", <-response)
 }
+
+func ExampleWithInterceptor() {
+	// An interceptor which drops every other AppendEntries RPC, for a chaos
+	// test; it could delay or rewrite them instead
+	var sent int32
+	dropEveryOther := func(to uint64, path string, body []byte) ([]byte, error) {
+		if path == raft.AppendEntriesPath && atomic.AddInt32(&sent, 1)%2 == 0 {
+			return nil, errors.New("dropped")
+		}
+		return body, nil
+	}
+
+	// Construct a peer which sends its RPCs through it
+	u, _ := url.Parse("http://10.1.1.11:8080")
+	peer, err := raft.NewHTTPPeer(u, raft.WithInterceptor(dropEveryOther))
+	if err != nil {
+		panic(err)
+	}
+
+	// Configure a server under test with such peers
+	s := raft.NewServer(1, &bytes.Buffer{}, func(uint64, []byte) []byte { return []byte{} })
+	s.SetConfiguration(peer)
+}
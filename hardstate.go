@@ -0,0 +1,185 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var errBadHardState = errors.New("not a valid hard state")
+
+// HardState is what a server must remember across a restart, besides its log:
+// the latest term it's seen, and whom, if anyone, it voted for in that term. A
+// server which forgot its vote could vote twice in a term, and one which forgot
+// its term could vote in an older one.
+//
+// CommitIndex is the server's commit index when the rest was saved. The log
+// store only ever holds committed entries, so the server never needs it, but
+// it's told if its log recovers fewer, which means the log store lost some.
+type HardState struct {
+	Term        uint64
+	Vote        uint64 // zero if the server hasn't voted in Term
+	CommitIndex uint64
+}
+
+// StateStore persists a server's HardState. See WithStateStore.
+type StateStore interface {
+	// SaveHardState durably replaces the saved hard state. It must be
+	// atomic: whenever it fails, or the process crashes part way through,
+	// LoadHardState returns either the old hard state or the new one, and
+	// never, say, a new term with an old vote.
+	SaveHardState(HardState) error
+
+	// LoadHardState returns the last hard state saved, or the zero
+	// HardState if none has been.
+	LoadHardState() (HardState, error)
+}
+
+// saveHardState saves our term and vote, with our commit index, to the
+// StateStore, if any. It's called whenever they change, before anyone is told
+// of either.
+func (s *Server) saveHardState() error {
+	if s.stateStore == nil {
+		return nil
+	}
+	return s.stateStore.SaveHardState(HardState{Term: s.term, Vote: s.vote, CommitIndex: s.log.getCommitIndex()})
+}
+
+// loadHardState resumes with the term and vote saved in the StateStore, if
+// any, unless the log has entries from a later term. It's called when the
+// server is created, after its log is recovered.
+func (s *Server) loadHardState() error {
+	if s.stateStore == nil {
+		return nil
+	}
+	hs, err := s.stateStore.LoadHardState()
+	if err != nil {
+		return err
+	}
+	if hs.Term >= s.term {
+		s.term, s.vote = hs.Term, hs.Vote
+	}
+	if commitIndex := s.log.getCommitIndex(); commitIndex < hs.CommitIndex {
+		s.logGeneric("WARNING: log recovered through index %d, but index %d was committed", commitIndex, hs.CommitIndex)
+	}
+	return nil
+}
+
+// stateFailure is raised by advanceTerm and voteFor, when they can't save the
+// hard state, to fail the server.
+type stateFailure struct{ err error }
+
+// InMemoryStateStore is a StateStore which keeps the hard state in memory. It's
+// intended for tests: a server restarted with the same one resumes where it
+// left off. The zero value holds the zero HardState, ready to use.
+type InMemoryStateStore struct {
+	mtx sync.Mutex
+	hs  HardState
+}
+
+// SaveHardState implements StateStore.
+func (s *InMemoryStateStore) SaveHardState(hs HardState) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.hs = hs
+	return nil
+}
+
+// LoadHardState implements StateStore.
+func (s *InMemoryStateStore) LoadHardState() (HardState, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.hs, nil
+}
+
+// FileStateStore is a StateStore which keeps the hard state in a file. Each
+// save writes a temporary file beside it, syncs it, and renames it over the
+// file, so a crash leaves one or the other intact. The file is
+//
+//	TERM VOTE COMMIT-INDEX CRC
+//
+// where the CRC covers the rest. Integers are little-endian.
+type FileStateStore struct {
+	mtx    sync.Mutex
+	path   string
+	rename func(from, to string) error // os.Rename, unless a test replaces it
+}
+
+// NewFileStateStore returns a FileStateStore which keeps the hard state in the
+// file at path. Until it's first saved, there's no file, and it holds the zero
+// HardState.
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{path: path, rename: os.Rename}
+}
+
+// SaveHardState implements StateStore.
+func (s *FileStateStore) SaveHardState(hs HardState) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, hs) // can't fail
+	binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // once renamed, there's nothing to remove
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := s.rename(f.Name(), s.path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(s.path)) // so the rename survives a crash
+}
+
+// LoadHardState implements StateStore.
+func (s *FileStateStore) LoadHardState() (HardState, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return HardState{}, nil
+	}
+	if err != nil {
+		return HardState{}, err
+	}
+	var (
+		hs  HardState
+		crc uint32
+		r   = bytes.NewReader(b)
+	)
+	if binary.Read(r, binary.LittleEndian, &hs) != nil || binary.Read(r, binary.LittleEndian, &crc) != nil || r.Len() != 0 {
+		return HardState{}, errBadHardState
+	}
+	if crc != crc32.ChecksumIEEE(b[:len(b)-4]) {
+		return HardState{}, errInvalidChecksum
+	}
+	return hs, nil
+}
+
+// syncDir syncs the directory at path, so the entries in it are durable.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,172 @@
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+	store := NewFileStateStore(path)
+
+	// holds the zero hard state until it's saved
+	if hs, err := store.LoadHardState(); err != nil || hs != (HardState{}) {
+		t.Fatalf("expected the zero hard state, got %+v, %v", hs, err)
+	}
+
+	// and then what was saved
+	saved := HardState{Term: 5, Vote: 2, CommitIndex: 9}
+	if err := store.SaveHardState(saved); err != nil {
+		t.Fatal(err)
+	}
+	if hs, err := NewFileStateStore(path).LoadHardState(); err != nil || hs != saved {
+		t.Fatalf("expected %+v, got %+v, %v", saved, hs, err)
+	}
+
+	// a crash before the new one replaces it leaves it intact, and no
+	// temporary files behind
+	crash := errors.New("crash")
+	store.rename = func(string, string) error { return crash }
+	if err := store.SaveHardState(HardState{Term: 6}); err != crash {
+		t.Fatalf("expected %v, got %v", crash, err)
+	}
+	if hs, err := NewFileStateStore(path).LoadHardState(); err != nil || hs != saved {
+		t.Fatalf("expected %+v, got %+v, %v", saved, hs, err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected only the state file, got %d files", len(files))
+	}
+
+	// and a damaged one isn't mistaken for any hard state
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tu := range []struct {
+		damaged  []byte
+		expected error
+	}{
+		{b[:len(b)-1], errBadHardState},
+		{append(b, 0), errBadHardState},
+		{append(append([]byte{}, b[:8]...), make([]byte, len(b)-8)...), errInvalidChecksum},
+	} {
+		if err := ioutil.WriteFile(path, tu.damaged, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.LoadHardState(); err != tu.expected {
+			t.Errorf("%d bytes: expected %v, got %v", len(tu.damaged), tu.expected, err)
+		}
+	}
+}
+
+func TestHardStateSurvivesRestart(t *testing.T) {
+	// a follower in a network of 3, which keeps its hard state in a file
+	dir, err := ioutil.TempDir("", "raft-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+	logStore := &InMemoryStore{}
+	restart := func(states StateStore) *Server {
+		s := NewServer(1, logStore.Reopen(), noop, WithStateStore(states))
+		s.SetConfiguration(acceptingPeer{1}, acceptingPeer{2}, acceptingPeer{3})
+		return s
+	}
+	vote := func(s *Server, term, candidate uint64) (granted bool, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = r.(stateFailure).err
+			}
+		}()
+		resp, _ := s.handleRequestVote(requestVote{Term: term, CandidateID: candidate})
+		return resp.VoteGranted, nil
+	}
+	check := func(s *Server, expected HardState) {
+		t.Helper()
+		if got := (HardState{Term: s.term, Vote: s.vote}); got != expected {
+			t.Errorf("expected %+v, got %+v", expected, got)
+		}
+	}
+
+	// votes for 2 in term 5
+	s := restart(NewFileStateStore(path))
+	if granted, err := vote(s, 5, 2); !granted || err != nil {
+		t.Fatalf("didn't vote for 2 in term 5: %v", err)
+	}
+
+	// and, restarted, still has, so it won't vote for 3
+	s = restart(NewFileStateStore(path))
+	check(s, HardState{Term: 5, Vote: 2})
+	if granted, _ := vote(s, 5, 3); granted {
+		t.Fatal("voted twice in term 5, across a restart")
+	}
+
+	// crashes on moving to term 6, for 3, and restarts in term 5, with its
+	// vote for 2, never in term 6 with that vote
+	crashing := NewFileStateStore(path)
+	crashing.rename = func(string, string) error { return errors.New("crash") }
+	if _, err := vote(restart(crashing), 6, 3); err == nil {
+		t.Fatal("expected a crash")
+	}
+	s = restart(NewFileStateStore(path))
+	check(s, HardState{Term: 5, Vote: 2})
+
+	// and then votes for 3 in term 6, which it remembers too
+	if granted, err := vote(s, 6, 3); !granted || err != nil {
+		t.Fatalf("didn't vote for 3 in term 6: %v", err)
+	}
+	check(restart(NewFileStateStore(path)), HardState{Term: 6, Vote: 3})
+}
+
+func TestStateStoreFailureFailsServer(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	for _, states := range []*failingStateStore{
+		{loadErr: errors.New("unreadable")},
+		{saveErr: errors.New("no space left on device")},
+	} {
+		// a network of 1, whose state store can't be read, or written to
+		// when it starts its first election
+		fatal := make(chan error, 1)
+		server := NewServer(1, &bytes.Buffer{}, noop, WithStateStore(states), WithEvents(Events{
+			OnFatalError: func(err error) { fatal <- err },
+		}))
+		server.SetConfiguration(newLocalPeer(server))
+		server.Start()
+
+		// fails, rather than carrying on with a term or vote it might forget
+		select {
+		case err := <-fatal:
+			if !errors.Is(err, ErrServerFailed) {
+				t.Errorf("expected an error wrapping %v, got %v", ErrServerFailed, err)
+			}
+		case <-time.After(4 * maximumElectionTimeout()):
+			t.Error("fatal error wasn't reported")
+		}
+		if expected, got := ErrServerFailed, server.Command([]byte(`{}`), make(chan []byte, 1)); expected != got {
+			t.Errorf("expected %v, got %v", expected, got)
+		}
+		server.Stop()
+	}
+}
+
+// failingStateStore fails to load, or to save, the hard state.
+type failingStateStore struct{ loadErr, saveErr error }
+
+func (s *failingStateStore) SaveHardState(HardState) error     { return s.saveErr }
+func (s *failingStateStore) LoadHardState() (HardState, error) { return HardState{}, s.loadErr }
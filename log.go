@@ -1,62 +1,408 @@
 package raft
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"sort"
 	"sync"
 	"time"
 )
 
+// The categories of LogError, to match it against with errors.Is. An entry
+// with no index or term fails to encode with ErrBadIndex or ErrBadTerm, and a
+// ForceLeadership from a stale term fails with ErrTermTooSmall, too.
+var (
+	ErrTermTooSmall  = errors.New("term too small")
+	ErrIndexTooSmall = errors.New("index too small")
+	ErrIndexTooBig   = errors.New("commit index too big")
+	ErrBadIndex      = errors.New("bad index")
+	ErrBadTerm       = errors.New("bad term")
+)
+
 var (
-	errTermTooSmall    = errors.New("term too small")
-	errIndexTooSmall   = errors.New("index too small")
-	errIndexTooBig     = errors.New("commit index too big")
 	errInvalidChecksum = errors.New("invalid checksum")
-	errNoCommand       = errors.New("no command")
-	errBadIndex        = errors.New("bad index")
-	errBadTerm         = errors.New("bad term")
+	errBrokenHashChain = errors.New("broken hash chain")
+	errCommandTooBig   = errors.New("command too big")
+	errApplyGap        = errors.New("entry doesn't follow the last applied")
+
+	errStoreUntrimmable = errors.New("store can't be trimmed")
+	errStoreWrite       = errors.New("persisting committed entries failed")
+	errNotALog          = errors.New("store doesn't begin with a log header")
+	errLogVersion       = errors.New("unsupported log format version")
+)
+
+// LogError is an index or term the log can't accept: an entry appended out of
+// order, say, or a commit index past the last entry. Err is its category, one
+// of ErrTermTooSmall, ErrIndexTooSmall, ErrIndexTooBig, ErrBadIndex, and
+// ErrBadTerm, which errors.Is matches it against. The rest is the index and
+// term it was given, if any, and the state of the log at the time.
+type LogError struct {
+	Err         error
+	Index       uint64
+	Term        uint64
+	LastIndex   uint64
+	LastTerm    uint64
+	CommitIndex uint64
+}
+
+func (e *LogError) Error() string {
+	return fmt.Sprintf(
+		"%s: index=%d term=%d (last index=%d term=%d, commit index=%d)",
+		e.Err, e.Index, e.Term, e.LastIndex, e.LastTerm, e.CommitIndex,
+	)
+}
+
+// Unwrap returns the error's category.
+func (e *LogError) Unwrap() error { return e.Err }
+
+// errorWithLock returns a LogError of the passed category, for the passed
+// index and term.
+func (l *raftLog) errorWithLock(err error, index, term uint64) error {
+	return &LogError{
+		Err:         err,
+		Index:       index,
+		Term:        term,
+		LastIndex:   l.lastIndexWithLock(),
+		LastTerm:    l.lastTermWithLock(),
+		CommitIndex: l.getCommitIndexWithLock(),
+	}
+}
+
+const (
+	// maxCommandSize is the largest command that will be encoded or decoded.
+	// It guards against allocating huge buffers when decoding a corrupt size.
+	maxCommandSize = 64 << 20
+
+	// entryHeaderSize is the size of an encoded entry, not counting its
+	// command. See logEntry.encode.
+	entryHeaderSize = 66
+
+	// logMagic and logVersion make up the header at the start of every store,
+	// written before its first entry. The version changes whenever the entry
+	// format does. Version 1 was the original format, which had no header;
+	// version 2 added the hash chain and KIND; version 3 has configuration
+	// entries carry both halves of a joint configuration; version 4 begins
+	// each entry with its own VERSION, so that later formats can be decoded
+	// entry by entry; version 5 flags compressed commands in KIND; and
+	// version 6 adds commit records, which say how much of a store holding
+	// uncommitted entries is committed (see WithDurableAcks); version 7
+	// adds metadata and no-op entries; and version 8 adds EXPIRES, and
+	// tombstones (see CommandTTL). Stores in earlier versions are still
+	// recovered, and written to in their own format, until compaction
+	// upgrades them.
+	logMagic           = "raft"
+	logVersion    byte = 8
+	logHeaderSize      = len(logMagic) + 1
+)
+
+// entryKind says what a log entry holds, and so where it goes once it's
+// committed. It's persisted as the entry's KIND. From version 5, kindCompressed
+// may be set too, if the command is compressed; see WithCompression. From
+// version 6, a store may also hold commit records; see encodeCommitRecord.
+// From version 7, an entry may be metadata, or a no-op; from version 8, a
+// tombstone.
+type entryKind byte
+
+const (
+	kindCommand       entryKind = 0 // passed to the ApplyFunc
+	kindConfiguration entryKind = 1 // changes the configuration
+	kindCommitRecord  entryKind = 2 // never in the log, only in a store
+	kindMetadata      entryKind = 3 // passed to the MetadataFunc
+	kindNoOp          entryKind = 4 // goes nowhere
+	kindTombstone     entryKind = 5 // passed to the ExpiryFunc
+	kindCompressed    entryKind = 0x80
 )
 
+// syncer is implemented by stores which buffer writes, like *os.File. The log
+// syncs such stores before it considers written entries to be committed.
+type syncer interface {
+	Sync() error
+}
+
+// truncater is implemented by stores which can discard their tail, like
+// *os.File and InMemoryStore. The log truncates such stores to get rid of a
+// partly-written entry.
+type truncater interface {
+	Truncate(size int64) error
+}
+
 type raftLog struct {
 	sync.RWMutex
-	store     io.Writer
-	entries   []logEntry
-	commitPos int
-	apply     func(uint64, []byte) []byte
+	store       io.Writer
+	entries     []logEntry
+	commitPos   int
+	lastApplied uint64 // index of the last entry reflected in the state machine
+	appliedTo   uint64 // index of the last committed entry the state machine has caught up with
+	apply       func(uint64, []byte) []byte
+	metadata    MetadataFunc // see WithMetadataFunc
+	expiry      ExpiryFunc   // see WithExpiryFunc
+	manualApply bool         // see WithManualApply
+	responses   ResponsePolicy
+	meta        CommandMeta
+	sessions    *sessionTable   // by client ID, for deduplication
+	latencies   histogram       // of commit latency, from append to apply
+	applyTimes  histogram       // of time spent in the state machine, per command
+	slowApply   slowApply       // see WithSlowApplyThreshold
+	onApplied   appliedNotifier // see Events.OnApplied
+	compression compression     // of commands, as they're written to the store
+	headers     headerBuffers   // see WithEncodeBufferPooling
+
+	// sessionsIndex is the index the sessions were restored as of, if they
+	// were restored from a snapshot. Entries at or below it are already
+	// reflected in the sessions.
+	sessionsIndex uint64
+
+	// The last entry discarded by compactTo, if any. The remaining entries
+	// follow it, as if it were still in the log.
+	compactedIndex uint64
+	compactedTerm  uint64
+	compactedHash  [sha256.Size]byte
+
+	// configIndexes are the indexes of the configuration entries in the
+	// log, in order, so the latest is found without scanning for it.
+	// compactedConfig is the latest configuration entry at or before
+	// compactedIndex, if any is known: one discarded by compactTo, or the
+	// configuration in the backup the log was restored from.
+	configIndexes   []uint64
+	compactedConfig logEntry
+
+	// corrupt is set once the log is found to have diverged from the
+	// leader's; see diverged. It's cleared only when the log is rebuilt.
+	corrupt bool
+
+	// entryBytes is the encoded size of the entries, uncompressed; see size.
+	entryBytes int64
+
+	// storeSize is the number of bytes of whole entries in the store. If
+	// writing an entry fails partway, and the store can't be trimmed back to
+	// storeSize, storeErr is set, and nothing more is written.
+	storeSize int64
+	storeErr  error
+
+	// storeVersion is the format of the entries in the store. It's older than
+	// logVersion only if an older store was recovered, and hasn't yet been
+	// upgraded; see upgradeStoreWithLock.
+	storeVersion byte
+
+	// With durable set, the log persists uncommitted entries, as well as
+	// committed ones; see persist. stored is how many of the entries after
+	// commitPos are in the store, and storeStarts is where each of them
+	// begins, by index, so it can be trimmed off if the entry is truncated.
+	// Once a store has a commit record, storeMarked is set, and every commit
+	// writes another; markAt is where the last one begins.
+	durable     bool
+	stored      int
+	storeStarts map[uint64]int64
+	storeMarked bool
+	markAt      int64
+}
+
+// logOptions configure a raftLog. The zero value is the default.
+type logOptions struct {
+	// appliedIndex is the index of the last entry the state machine is known
+	// to have applied, e.g. because it was restored from its own checkpoint.
+	// Entries at or below appliedIndex are recovered into the log, but not
+	// passed to apply again.
+	appliedIndex uint64
+
+	// sessions, if set, are the encoded sessions from the snapshot the state
+	// machine was restored from. See WithSessions.
+	sessions []byte
+
+	responses   ResponsePolicy  // see WithResponsePolicy
+	meta        CommandMeta     // see WithCommandMeta
+	maxSessions int             // see WithMaxSessions
+	compression compression     // see WithCompression
+	durable     bool            // see WithDurableAcks
+	slowApply   slowApply       // see WithSlowApplyThreshold
+	onApplied   appliedNotifier // see Events.OnApplied
+	metadata    MetadataFunc    // see WithMetadataFunc
+	expiry      ExpiryFunc      // see WithExpiryFunc
+	manualApply bool            // see WithManualApply
+	headers     headerBuffers   // see WithEncodeBufferPooling
 }
 
 func newRaftLog(store io.ReadWriter, apply func(uint64, []byte) []byte) *raftLog {
+	l, _ := recoverRaftLog(store, apply, logOptions{})
+	return l
+}
+
+// recoverRaftLog returns a log populated from the passed store.
+//
+// If recovery stops early, because the store is corrupt or has been tampered
+// with, the returned log holds the entries before the damage, and the error
+// says what went wrong.
+func recoverRaftLog(store io.ReadWriter, apply func(uint64, []byte) []byte, options logOptions) (*raftLog, error) {
+	if options.meta == nil {
+		options.meta = defaultCommandMeta
+	}
+	if options.maxSessions <= 0 {
+		options.maxSessions = defaultMaxSessions
+	}
 	l := &raftLog{
-		store:     store,
-		entries:   []logEntry{},
-		commitPos: -1, // no commits to begin with
-		apply:     apply,
+		store:       store,
+		entries:     []logEntry{},
+		commitPos:   -1, // no commits to begin with
+		lastApplied: options.appliedIndex,
+		apply:       apply,
+		responses:   options.responses,
+		meta:        options.meta,
+		sessions:    newSessionTable(options.maxSessions),
+		compression: options.compression,
+		headers:     options.headers,
+		slowApply:   options.slowApply,
+		onApplied:   options.onApplied,
+		metadata:    options.metadata,
+		expiry:      options.expiry,
+		manualApply: options.manualApply,
+
+		storeVersion: logVersion,
+		durable:      options.durable,
+		storeStarts:  map[uint64]int64{},
 	}
-	l.recover(store)
-	return l
+	if options.sessions != nil {
+		snapshot, err := decodeSessions(options.sessions)
+		if err != nil {
+			l.storeErr = fmt.Errorf("decoding sessions: %s", err)
+			return l, l.storeErr
+		}
+		l.sessions.restore(snapshot.Sessions)
+		l.sessionsIndex = snapshot.Index
+	}
+	err := l.recover(store)
+	return l, err
 }
 
 // recover reads from the log's store, to populate the log with log entries
 // from persistent storage. It should be called once, at log instantiation.
+//
+// Only committed entries are ever written to the store, so every recovered
+// entry is considered committed. Entries are re-applied from lastApplied+1,
+// which means a crash partway through commitTo neither re-applies the entries
+// that made it to the state machine, nor skips the ones that didn't.
+//
+// The whole hash chain is verified before anything is applied. A break in the
+// chain means either the entry before the break was modified, or the one after
+// it was, and we can't tell which; so the log is truncated before both. Then,
+// as with a corrupt or partly-written entry, the store itself is truncated
+// after the last good entry, so new entries don't follow the damage. If the
+// store can't be truncated, or isn't a log in a format we know, nothing more
+// is written to it, and a server using it refuses to start. So too if recovery
+// finds an entry in a later format: it's not damage, so it isn't trimmed.
+//
+// A store in the original format has no hash chain to verify, and doesn't say
+// which entries are configurations; an entry is taken to be one if it decodes
+// as one.
 func (l *raftLog) recover(r io.Reader) error {
+	version, r, err := decodeLogHeader(r)
+	if err == io.EOF {
+		return nil // empty store
+	} else if err != nil {
+		l.storeErr = err
+		return err
+	}
+	l.storeVersion = version
+	if version > 1 {
+		l.storeSize = int64(logHeaderSize)
+	}
+
+	var (
+		entries   = []logEntry{}
+		starts    = []int64{} // where each entry begins in the store
+		committed = -1        // how many entries are, if there are commit records
+	)
 	for {
-		var entry logEntry
-		switch err := entry.decode(r); err {
-		case io.EOF:
-			return nil // successful completion
-		case nil:
-			if err := l.appendEntry(entry); err != nil {
-				return err
+		var (
+			entry logEntry
+			size  int64
+			start = l.storeSize
+		)
+		if size, err = entry.decodeAs(r, version, l.compression.compressor); err != nil {
+			break
+		}
+		if entry.Term == 0 { // a commit record; see encodeCommitRecord
+			l.storeSize += size
+			l.storeMarked, l.markAt = true, start
+			committed = sort.Search(len(entries), func(i int) bool { return entries[i].Index > entry.Index })
+			continue
+		}
+		n := len(entries)
+		if version == 1 {
+			if isLegacyConfiguration(entry.Command) {
+				entry.Kind = kindConfiguration
 			}
-			l.commitPos++
-			l.apply(entry.Index, entry.Command)
-		default:
-			return err // unsuccessful completion
+		} else if n > 0 && entry.PrevHash != entries[n-1].hash() {
+			entries, err = entries[:n-1], errBrokenHashChain
+			l.storeSize = starts[n-1]
+			break
 		}
+		entries, starts = append(entries, entry), append(starts, start)
+		l.storeSize += size
+	}
+	if err == io.EOF {
+		err = nil // successful completion
 	}
+	if errors.Is(err, errLogVersion) {
+		l.storeErr = err // written by a later version, so leave it be
+	}
+	if version == 1 && len(entries) == 0 && err != nil {
+		// With neither a header nor a single good entry, it's not a log.
+		l.storeErr = errNotALog
+		return errNotALog
+	}
+
+	// A store loaded by ReadLogFrom, from a compacted log, begins after the
+	// last compacted entry, whose hash the first entry follows.
+	if len(entries) > 0 && version > 1 {
+		l.compactedIndex, l.compactedHash = entries[0].Index-1, entries[0].PrevHash
+	}
+
+	// The compacted entries are gone, so the state machine must have them
+	// already, from the snapshot it was restored from.
+	if l.lastApplied < l.compactedIndex {
+		l.lastApplied = l.compactedIndex
+	}
+
+	// With commit records, the entries after the last one aren't committed.
+	// They're kept, as the leader may yet commit them, but not applied.
+	if committed < 0 || committed > len(entries) {
+		committed = len(entries)
+	}
+	for i, entry := range entries {
+		if err := l.appendEntry(entry); err != nil {
+			return err
+		}
+		if i >= committed {
+			l.storeStarts[entry.Index] = starts[i]
+		}
+	}
+	l.stored = len(l.entries) - committed
+	if committed > 0 {
+		l.commitPos = committed - 1
+		if !l.manualApply {
+			l.applyWithLock(0, committed)
+		}
+	}
+	if err != nil && l.storeErr == nil {
+		l.trimStore()
+		if l.storeMarked && l.markAt >= l.storeSize && l.storeErr == nil {
+			l.writeCommitRecordWithLock(l.getCommitIndexWithLock()) // the last one was trimmed off
+		}
+	}
+	return err
+}
+
+// storeError returns the error that stops the log from writing to its store,
+// if any.
+func (l *raftLog) storeError() error {
+	l.RLock()
+	defer l.RUnlock()
+	return l.storeErr
 }
 
 // entriesAfter returns a slice of log entries after (i.e. not including) the
@@ -64,6 +410,11 @@ func (l *raftLog) recover(r io.Reader) error {
 // convenience to the caller. (This function is only used by a leader attempting
 // to flush log entries to its followers.)
 //
+// If some of the entries after index have been compacted away, it returns no
+// entries, and compacted is true: a follower that far behind can only be
+// caught up from a snapshot. Otherwise, no entries means there are none after
+// index.
+//
 // This function is called to populate an AppendEntries RPC. That implies they
 // are destined for a follower, which implies the application of the commands
 // should have the response thrown away, which implies we shouldn't pass a
@@ -72,25 +423,29 @@ func (l *raftLog) recover(r io.Reader) error {
 // transport, and lose their commandResponse channel anyway. But in the case of
 // a LocalPeer (or equivalent) this doesn't happen. So, we must make sure to
 // proactively strip commandResponse channels.
-func (l *raftLog) entriesAfter(index uint64) ([]logEntry, uint64) {
+func (l *raftLog) entriesAfter(index uint64) (entries []logEntry, term uint64, compacted bool) {
 	l.RLock()
 	defer l.RUnlock()
 
-	pos := 0
+	first := l.firstIndexWithLock()
+	if index+1 < first {
+		return []logEntry{}, 0, true
+	}
+
+	pos := sort.Search(len(l.entries), func(i int) bool { return l.entries[i].Index > index })
 	lastTerm := uint64(0)
-	for ; pos < len(l.entries); pos++ {
-		if l.entries[pos].Index > index {
-			break
-		}
-		lastTerm = l.entries[pos].Term
+	if pos > 0 {
+		lastTerm = l.entries[pos-1].Term
+	} else if index+1 == first {
+		lastTerm = l.compactedTerm
 	}
 
 	a := l.entries[pos:]
 	if len(a) == 0 {
-		return []logEntry{}, lastTerm
+		return []logEntry{}, lastTerm, false
 	}
 
-	return stripResponseChannels(a), lastTerm
+	return stripResponseChannels(a), lastTerm, false
 }
 
 func stripResponseChannels(a []logEntry) []logEntry {
@@ -101,27 +456,344 @@ func stripResponseChannels(a []logEntry) []logEntry {
 			Term:            entry.Term,
 			Command:         entry.Command,
 			commandResponse: nil,
+			Kind:            entry.Kind,
+			Expires:         entry.Expires,
 		}
 	}
 	return stripped
 }
 
+// positionWithLock returns the position in l.entries of the entry with the
+// passed index, and whether there is one. It's not necessarily true that
+// l.entries[i] has index == i, but entries are in index order, so it's a
+// binary search. If there's no such entry, the position is where it would be.
+func (l *raftLog) positionWithLock(index uint64) (int, bool) {
+	switch {
+	case index < l.firstIndexWithLock():
+		return 0, false
+	case index > l.lastIndexWithLock():
+		return len(l.entries), false
+	}
+	pos := sort.Search(len(l.entries), func(i int) bool { return l.entries[i].Index >= index })
+	return pos, pos < len(l.entries) && l.entries[pos].Index == index
+}
+
+// entryAt returns the log entry with the passed index, without its response
+// channels, and whether the log has it. Indexes before the first entry in the
+// log, or after the last, are never found.
+func (l *raftLog) entryAt(index uint64) (logEntry, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	pos, ok := l.positionWithLock(index)
+	if !ok {
+		return logEntry{}, false
+	}
+	return stripResponseChannels(l.entries[pos : pos+1])[0], true
+}
+
+// committedFrom returns up to max of the committed entries from index on. It
+// returns a LogError matching ErrIndexTooSmall if the entry at index has been
+// compacted.
+func (l *raftLog) committedFrom(index uint64, max int) ([]logEntry, error) {
+	l.RLock()
+	defer l.RUnlock()
+
+	if index < l.firstIndexWithLock() {
+		return nil, l.errorWithLock(ErrIndexTooSmall, index, 0)
+	}
+	pos, ok := l.positionWithLock(index)
+	if !ok || pos > l.commitPos {
+		return nil, nil
+	}
+	end := l.commitPos + 1
+	if end-pos > max {
+		end = pos + max
+	}
+	return stripResponseChannels(l.entries[pos:end]), nil
+}
+
+// walkBack calls fn with each log entry at or before the passed index, newest
+// first, until fn returns false, or there are no more entries. It stops at the
+// first entry after the last compacted one. It's cheap to stop early, so it
+// suits searches from the tail of the log. Entries are passed in place, not
+// copied, so fn mustn't modify or retain them, or call back into the log.
+func (l *raftLog) walkBack(from uint64, fn func(*logEntry) bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	pos, ok := l.positionWithLock(from)
+	if !ok {
+		pos-- // the entry before where it would be
+	}
+	for ; pos >= 0; pos-- {
+		if !fn(&l.entries[pos]) {
+			return
+		}
+	}
+}
+
+// lastConfiguration returns the most recent configuration entry in the log, if
+// there is one. If it's been compacted, only its Index, Kind and Command are
+// set.
+func (l *raftLog) lastConfiguration() (logEntry, bool) {
+	l.RLock()
+	defer l.RUnlock()
+	return l.configurationAtWithLock(l.lastIndexWithLock())
+}
+
+// configurationAtWithLock returns the most recent configuration entry at or
+// before index, like lastConfiguration.
+func (l *raftLog) configurationAtWithLock(index uint64) (logEntry, bool) {
+	for i := len(l.configIndexes) - 1; i >= 0; i-- {
+		if l.configIndexes[i] > index {
+			continue
+		}
+		pos, _ := l.positionWithLock(l.configIndexes[i])
+		return stripResponseChannels(l.entries[pos : pos+1])[0], true
+	}
+	if l.compactedConfig.Index == 0 || l.compactedConfig.Index > index {
+		return logEntry{}, false
+	}
+	return l.compactedConfig, true
+}
+
+// compactConfigurationsWithLock is called when the entries through index are
+// about to be discarded. The latest configuration entry among them, if any,
+// becomes compactedConfig.
+func (l *raftLog) compactConfigurationsWithLock(index uint64) {
+	n := sort.Search(len(l.configIndexes), func(i int) bool { return l.configIndexes[i] > index })
+	if n == 0 {
+		return
+	}
+	pos, _ := l.positionWithLock(l.configIndexes[n-1])
+	entry := l.entries[pos]
+	l.compactedConfig = logEntry{Index: entry.Index, Kind: entry.Kind, Command: entry.Command}
+	l.configIndexes = append([]uint64{}, l.configIndexes[n:]...)
+}
+
+// lastIndexOfTerm returns the index of the last entry at or before the passed
+// index with the passed term, if the log has one.
+func (l *raftLog) lastIndexOfTerm(from, term uint64) (uint64, bool) {
+	var index uint64
+	l.walkBack(from, func(entry *logEntry) bool {
+		if entry.Term == term {
+			index = entry.Index
+		}
+		return entry.Term > term // terms only decrease from here
+	})
+	return index, index > 0
+}
+
+// conflict describes why an entry at the passed index and term doesn't match
+// the log, for a leader backtracking to find where it does: the term of the
+// entry at that index, and the first index the log has in that term. If the
+// log doesn't reach the index, the term is zero, and the index is just after
+// the last entry. If the entry at the index is at or before the commit index,
+// or was compacted, there's no conflict to describe, and both are zero.
+func (l *raftLog) conflict(index uint64) (conflictTerm, conflictIndex uint64) {
+	if last := l.lastIndex(); index > last {
+		return 0, last + 1
+	}
+	entry, ok := l.entryAt(index)
+	if !ok || index <= l.getCommitIndex() {
+		return 0, 0
+	}
+	conflictTerm, conflictIndex = entry.Term, entry.Index
+	l.walkBack(index, func(entry *logEntry) bool {
+		if entry.Term != conflictTerm {
+			return false
+		}
+		conflictIndex = entry.Index
+		return true
+	})
+	return conflictTerm, conflictIndex
+}
+
 // contains returns true if a log entry with the given index and term exists in
 // the log.
 func (l *raftLog) contains(index, term uint64) bool {
+	entry, ok := l.entryAt(index)
+	return ok && entry.Term == term
+}
+
+// termAt returns the term of the log entry with the given index, and whether
+// it's known: that is, whether the entry is in the log, or is the last one
+// compacted.
+func (l *raftLog) termAt(index uint64) (uint64, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	if index == l.compactedIndex {
+		return l.compactedTerm, true
+	}
+	if pos, ok := l.positionWithLock(index); ok {
+		return l.entries[pos].Term, true
+	}
+	return 0, false
+}
+
+// term is termAt, for callers outside the log, which are told why a term isn't
+// known: with ErrIndexTooSmall, for an index before the last compacted entry,
+// or ErrIndexTooBig, for one after the last entry.
+func (l *raftLog) term(index uint64) (uint64, error) {
 	l.RLock()
 	defer l.RUnlock()
 
-	// It's not necessarily true that l.entries[i] has index == i.
+	switch {
+	case index < l.compactedIndex:
+		return 0, l.errorWithLock(ErrIndexTooSmall, index, 0)
+	case index == l.compactedIndex:
+		return l.compactedTerm, nil
+	}
+	pos, ok := l.positionWithLock(index)
+	if !ok {
+		return 0, l.errorWithLock(ErrIndexTooBig, index, 0)
+	}
+	return l.entries[pos].Term, nil
+}
+
+// divergence returns the lowest index at which the two logs hold different
+// entries, by term or command, or zero if they agree wherever both hold one:
+// e.g. if one log is a prefix of the other. Entries either log has compacted
+// aren't compared. It's for tests and diagnosis, since the logs of a safe
+// network never diverge at an index both have committed.
+func divergence(a, b *raftLog) uint64 {
+	from, to := a.firstIndex(), a.lastIndex()
+	if first := b.firstIndex(); first > from {
+		from = first
+	}
+	if last := b.lastIndex(); last < to {
+		to = last
+	}
+	for index := from; index <= to; index++ {
+		ea, _ := a.entryAt(index)
+		eb, _ := b.entryAt(index)
+		if ea.Term != eb.Term || !bytes.Equal(ea.Command, eb.Command) {
+			return index
+		}
+	}
+	return 0
+}
+
+// expired returns the indexes of the commands in the log which expire at or
+// before now, in Unix nanoseconds, and which aren't yet expired by a
+// tombstone in the log, in index order.
+func (l *raftLog) expired(now int64) []uint64 {
+	l.RLock()
+	defer l.RUnlock()
+
+	var (
+		candidates = []uint64{}
+		buried     = map[uint64]bool{}
+	)
 	for _, entry := range l.entries {
-		if entry.Index == index && entry.Term == term {
-			return true
+		switch {
+		case entry.Kind == kindTombstone:
+			buried[tombstoneOf(entry.Command)] = true
+		case entry.Kind == kindCommand && entry.Expires != 0 && entry.Expires <= now:
+			candidates = append(candidates, entry.Index)
 		}
-		if entry.Index > index || entry.Term > term {
-			break
+	}
+
+	expired := candidates[:0]
+	for _, index := range candidates {
+		if !buried[index] {
+			expired = append(expired, index)
 		}
 	}
-	return false
+	return expired
+}
+
+// isCommitted returns true if the entry with the given index is committed: it's
+// at or below the commit index, and either it's in the log, or it's been
+// compacted. An entry which is in the log, but not yet committed, may still be
+// overwritten by a new leader.
+func (l *raftLog) isCommitted(index uint64) bool {
+	l.RLock()
+	defer l.RUnlock()
+
+	if index == 0 || index > l.getCommitIndexWithLock() {
+		return false
+	}
+	if index < l.firstIndexWithLock() {
+		return true
+	}
+	_, ok := l.positionWithLock(index)
+	return ok
+}
+
+// hashAt returns the hash of the entry at the passed index, or of the last
+// compacted entry, and whether the log has it.
+func (l *raftLog) hashAt(index uint64) ([sha256.Size]byte, bool) {
+	l.RLock()
+	defer l.RUnlock()
+	if index == l.compactedIndex {
+		return l.compactedHash, true
+	}
+	pos, ok := l.positionWithLock(index)
+	if !ok {
+		return [sha256.Size]byte{}, false
+	}
+	return l.entries[pos].hash(), true
+}
+
+// diverged reports whether the entry at the passed index, which the caller
+// knows to have the leader's term, doesn't have the leader's hash: so, since
+// the hash chains every entry to the one before, the log doesn't agree with
+// the leader's somewhere at or before it. Then the log is marked corrupt. A
+// leader which doesn't send a hash is taken at its word.
+func (l *raftLog) diverged(index uint64, leaderHash []byte) bool {
+	if index == 0 || len(leaderHash) != sha256.Size {
+		return false
+	}
+	hash, ok := l.hashAt(index)
+	if !ok || bytes.Equal(hash[:], leaderHash) {
+		return false
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.corrupt = true
+	return true
+}
+
+func (l *raftLog) isCorrupt() bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.corrupt
+}
+
+// rebuild discards the whole log, committed entries and all, and the store
+// with it, so that it can be rebuilt from the leader's entries after the one
+// with the passed index, term, and hash, as if that one had been compacted.
+// The state machine isn't rebuilt: entries it's already applied aren't
+// applied again. So it fails if the state machine hasn't reached the index,
+// since the entries between would never be applied; only a snapshot could
+// catch it up.
+func (l *raftLog) rebuild(index, term uint64, hash []byte) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if index > l.lastApplied {
+		return errSnapshotNeeded
+	}
+	l.storeSize = 0
+	if l.trimStore(); l.storeErr != nil {
+		return l.storeErr
+	}
+	for pos := range l.entries {
+		l.entries[pos].abandon()
+	}
+	l.compactConfigurationsWithLock(index)
+	l.configIndexes = nil
+	l.entries, l.entryBytes = []logEntry{}, 0
+	l.commitPos, l.appliedTo = -1, index
+	l.compactedIndex, l.compactedTerm = index, term
+	copy(l.compactedHash[:], hash)
+	l.storeVersion, l.stored, l.storeStarts = logVersion, 0, map[uint64]int64{}
+	l.storeMarked, l.markAt = false, 0
+	l.corrupt = false
+	return nil
 }
 
 // ensureLastIs deletes all non-committed log entries after the given index and
@@ -137,48 +809,34 @@ func (l *raftLog) ensureLastIs(index, term uint64) error {
 	// Taken loosely from benbjohnson's impl
 
 	if index < l.getCommitIndexWithLock() {
-		return errIndexTooSmall
+		return l.errorWithLock(ErrIndexTooSmall, index, term)
 	}
 
 	if index > l.lastIndexWithLock() {
-		return errIndexTooBig
+		return l.errorWithLock(ErrIndexTooBig, index, term)
 	}
 
 	// It's possible that the passed index is 0. It means the leader has come to
 	// decide we need a complete log rebuild. Of course, that's only valid if we
 	// haven't committed anything, so this check comes after that one.
 	if index == 0 {
-		for pos := 0; pos < len(l.entries); pos++ {
-			if l.entries[pos].commandResponse != nil {
-				close(l.entries[pos].commandResponse)
-				l.entries[pos].commandResponse = nil
-			}
-			if l.entries[pos].committed != nil {
-				l.entries[pos].committed <- false
-				close(l.entries[pos].committed)
-				l.entries[pos].committed = nil
-			}
-		}
-		l.entries = []logEntry{}
-		return nil
+		return l.truncateWithLock(0)
 	}
 
-	// Normal case: find the position of the matching log entry.
-	pos := 0
-	for ; pos < len(l.entries); pos++ {
-		if l.entries[pos].Index < index {
-			continue // didn't find it yet
-		}
-		if l.entries[pos].Index > index {
-			return errBadIndex // somehow went past it
-		}
-		if l.entries[pos].Index != index {
-			panic("not <, not >, but somehow !=")
-		}
-		if l.entries[pos].Term != term {
-			return errBadTerm
-		}
+	// Normal case: find the position of the matching log entry. If it's the
+	// last compacted entry, that's just before the first one in the log.
+	pos, ok := l.positionWithLock(index)
+	switch {
+	case ok && l.entries[pos].Term != term:
+		return l.errorWithLock(ErrBadTerm, index, term)
+	case ok:
 		break // good
+	case index+1 == l.firstIndexWithLock() && term != l.compactedTerm:
+		return l.errorWithLock(ErrBadTerm, index, term)
+	case index+1 == l.firstIndexWithLock():
+		pos = -1 // good
+	default:
+		return l.errorWithLock(ErrBadIndex, index, term) // somehow went past it
 	}
 
 	// Sanity check.
@@ -188,30 +846,54 @@ func (l *raftLog) ensureLastIs(index, term uint64) error {
 
 	// `pos` is the position of log entry matching index and term.
 	// We want to truncate everything after that.
-	truncateFrom := pos + 1
-	if truncateFrom >= len(l.entries) {
+	return l.truncateWithLock(pos + 1)
+}
+
+// bulkTruncate discards every entry from fromIndex on, however many there are,
+// in one go: the store is truncated once, to where the entry at fromIndex
+// began, and the log once, rather than an entry at a time. Committed entries
+// can never be discarded, so fromIndex must follow the commit index. If it
+// follows the last entry, there's nothing to discard.
+func (l *raftLog) bulkTruncate(fromIndex uint64) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if fromIndex <= l.getCommitIndexWithLock() {
+		return l.errorWithLock(ErrIndexTooSmall, fromIndex, 0)
+	}
+	if fromIndex > l.lastIndexWithLock() {
+		return nil
+	}
+	pos, ok := l.positionWithLock(fromIndex)
+	if !ok {
+		return l.errorWithLock(ErrBadIndex, fromIndex, 0)
+	}
+	return l.truncateWithLock(pos)
+}
+
+// truncateWithLock discards the entries from position pos on, from the store
+// as well as the log. None of them may be committed.
+func (l *raftLog) truncateWithLock(pos int) error {
+	if pos >= len(l.entries) {
 		return nil // nothing to truncate
 	}
 
+	if err := l.unstoreWithLock(pos); err != nil {
+		return err
+	}
+
 	// If we blow away log entries that haven't yet sent responses to clients,
-	// signal the clients to stop waiting, by closing the channel without a
-	// response value.
-	for pos = truncateFrom; pos < len(l.entries); pos++ {
-		if l.entries[pos].commandResponse != nil {
-			close(l.entries[pos].commandResponse)
-			l.entries[pos].commandResponse = nil
-		}
-		if l.entries[pos].committed != nil {
-			l.entries[pos].committed <- false
-			close(l.entries[pos].committed)
-			l.entries[pos].committed = nil
-		}
+	// signal the clients to stop waiting.
+	for i := pos; i < len(l.entries); i++ {
+		l.entryBytes -= l.entries[i].size()
+		l.entries[i].abandon()
 	}
 
 	// Truncate the log.
-	l.entries = l.entries[:truncateFrom]
-
-	// Done.
+	from := l.entries[pos].Index
+	n := sort.Search(len(l.configIndexes), func(i int) bool { return l.configIndexes[i] >= from })
+	l.configIndexes = l.configIndexes[:n]
+	l.entries = l.entries[:pos]
 	return nil
 }
 
@@ -223,9 +905,198 @@ func (l *raftLog) getCommitIndex() uint64 {
 	return l.getCommitIndexWithLock()
 }
 
+// trimStore discards anything after the last whole entry in the store, e.g.
+// what was written by a failed encode, or found corrupt at recovery, so that
+// later entries don't follow garbage. If the store can't be trimmed, it's
+// marked as unusable.
+func (l *raftLog) trimStore() {
+	t, ok := l.store.(truncater)
+	if !ok {
+		l.storeErr = errStoreUntrimmable
+		return
+	}
+	if err := t.Truncate(l.storeSize); err != nil {
+		l.storeErr = fmt.Errorf("trimming store: %s", err)
+		return
+	}
+	if s, ok := l.store.(io.Seeker); ok {
+		if _, err := s.Seek(l.storeSize, io.SeekStart); err != nil {
+			l.storeErr = fmt.Errorf("trimming store: %s", err)
+		}
+	}
+}
+
+// writeStoreHeaderWithLock writes the header to a new store, before its first
+// entry.
+func (l *raftLog) writeStoreHeaderWithLock() error {
+	if l.storeSize > 0 {
+		return nil
+	}
+	if err := encodeLogHeader(l.store); err != nil {
+		l.trimStore()
+		return err
+	}
+	l.storeSize = int64(logHeaderSize)
+	return nil
+}
+
+// writeCommitRecordWithLock writes a commit record for the passed index to the
+// store. From then on, the store has commit records, and every commit writes
+// another.
+func (l *raftLog) writeCommitRecordWithLock(index uint64) error {
+	size, err := encodeCommitRecord(l.store, index, l.headers)
+	if err != nil {
+		l.trimStore()
+		return err
+	}
+	l.storeMarked, l.markAt = true, l.storeSize
+	l.storeSize += size
+	return nil
+}
+
+// persist writes the log's uncommitted entries to the store, and syncs it,
+// provided the log is durable. A follower created WithDurableAcks persists the
+// entries it's sent before it acknowledges them, so it never acknowledges an
+// entry it could lose in a crash. The store then holds entries which may yet
+// be truncated, so it must be able to trim them off, and commit records, which
+// say how many of the entries before them are committed.
+func (l *raftLog) persist() error {
+	l.Lock()
+	defer l.Unlock()
+
+	if !l.durable || l.commitPos+l.stored >= len(l.entries)-1 {
+		return nil
+	}
+	if l.storeErr != nil {
+		return l.storeErr
+	}
+	if _, ok := l.store.(truncater); !ok {
+		return errStoreUntrimmable
+	}
+	if err := l.upgradeStoreWithLock(); err != nil {
+		return err
+	}
+	if l.storeVersion != logVersion {
+		return fmt.Errorf("%w: can't persist uncommitted entries in version %d", errLogVersion, l.storeVersion)
+	}
+	if err := l.writeStoreHeaderWithLock(); err != nil {
+		return err
+	}
+
+	// Without a commit record, every entry in the store would be recovered as
+	// committed.
+	if !l.storeMarked {
+		if err := l.writeCommitRecordWithLock(l.getCommitIndexWithLock()); err != nil {
+			return err
+		}
+	}
+	if l.storeStarts == nil {
+		l.storeStarts = map[uint64]int64{}
+	}
+	for pos := l.commitPos + l.stored + 1; pos < len(l.entries); pos++ {
+		size, err := l.entries[pos].encodeAs(l.store, l.storeVersion, l.compression, l.headers)
+		if err != nil {
+			l.trimStore()
+			return err
+		}
+		l.storeStarts[l.entries[pos].Index] = l.storeSize
+		l.storeSize += size
+		l.stored++
+	}
+	if s, ok := l.store.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// unstoreWithLock trims the entries from the passed position on off the store,
+// if persist wrote them, before they're truncated from the log. A commit record
+// written after them is written again.
+func (l *raftLog) unstoreWithLock(pos int) error {
+	if pos > l.commitPos+l.stored {
+		return nil
+	}
+	start, ok := l.storeStarts[l.entries[pos].Index]
+	if !ok {
+		panic(fmt.Sprintf("stored entry %d has no start; bad bookkeeping in raftLog", l.entries[pos].Index))
+	}
+	for ; l.stored > 0 && l.commitPos+l.stored >= pos; l.stored-- {
+		delete(l.storeStarts, l.entries[l.commitPos+l.stored].Index)
+	}
+	l.storeSize = start
+	if l.trimStore(); l.storeErr != nil {
+		return l.storeErr
+	}
+	if l.markAt >= start {
+		if err := l.writeCommitRecordWithLock(l.getCommitIndexWithLock()); err != nil {
+			return err
+		}
+	}
+	if s, ok := l.store.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// upgradeStoreWithLock rewrites a store in an older format in the current one,
+// provided it can be truncated, and the log still holds every entry in it, i.e.
+// it hasn't yet been compacted. Otherwise, the store stays in its own format.
+//
+// The new store is encoded in full before the old one is truncated, but the
+// rewrite isn't atomic: if the process dies partway through, the entries not
+// yet rewritten are lost from the store.
+func (l *raftLog) upgradeStoreWithLock() error {
+	t, ok := l.store.(truncater)
+	if !ok || l.storeVersion == logVersion || l.compactedIndex > 0 || l.storeErr != nil {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	if err := encodeLogHeader(buf); err != nil {
+		return err
+	}
+	for pos := 0; pos <= l.commitPos; pos++ {
+		if _, err := l.entries[pos].encodeAs(buf, logVersion, l.compression, l.headers); err != nil {
+			return err
+		}
+	}
+
+	fail := func(err error) error {
+		l.storeErr = fmt.Errorf("upgrading store: %s", err)
+		return l.storeErr
+	}
+	if err := t.Truncate(0); err != nil {
+		return fail(err)
+	}
+	if s, ok := l.store.(io.Seeker); ok {
+		if _, err := s.Seek(0, io.SeekStart); err != nil {
+			return fail(err)
+		}
+	}
+	if _, err := l.store.Write(buf.Bytes()); err != nil {
+		return fail(err)
+	}
+	if s, ok := l.store.(syncer); ok {
+		if err := s.Sync(); err != nil {
+			return fail(err)
+		}
+	}
+	l.storeSize, l.storeVersion = int64(buf.Len()), logVersion
+	return nil
+}
+
+// getAppliedTo returns the index of the last committed entry which the state
+// machine has caught up with: it's applied it, or it was a configuration, or a
+// duplicate, or the state machine had already seen it.
+func (l *raftLog) getAppliedTo() uint64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.appliedTo
+}
+
 func (l *raftLog) getCommitIndexWithLock() uint64 {
 	if l.commitPos < 0 {
-		return 0
+		return l.compactedIndex
 	}
 	if l.commitPos >= len(l.entries) {
 		panic(fmt.Sprintf("commitPos %d > len(l.entries) %d; bad bookkeeping in raftLog", l.commitPos, len(l.entries)))
@@ -233,6 +1104,108 @@ func (l *raftLog) getCommitIndexWithLock() uint64 {
 	return l.entries[l.commitPos].Index
 }
 
+// sizes returns the number of entries in the log, their size as they'd be
+// encoded, and the size of the store, which compaction doesn't shrink.
+func (l *raftLog) sizes() (int, int64, int64) {
+	l.RLock()
+	defer l.RUnlock()
+	return len(l.entries), l.entryBytes, l.storeSize
+}
+
+// firstIndex returns the index of the oldest entry in the log, i.e. the first
+// one which hasn't been compacted: 1, until the log is compacted, or restored
+// from a snapshot. If the log is empty, it's the index the next entry will
+// have. Every bounds check on an index goes by it, so none assumes the log
+// begins at 1.
+func (l *raftLog) firstIndex() uint64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.firstIndexWithLock()
+}
+
+func (l *raftLog) firstIndexWithLock() uint64 {
+	return l.compactedIndex + 1
+}
+
+// appendedBefore returns the index of the last entry in (from, to] which was
+// appended before t, or zero if there's none. Entries are appended in order,
+// so every entry in (from, index] was too.
+func (l *raftLog) appendedBefore(t time.Time, from, to uint64) uint64 {
+	l.RLock()
+	defer l.RUnlock()
+
+	var index uint64
+	pos, ok := l.positionWithLock(from + 1)
+	for ; ok && pos < len(l.entries) && l.entries[pos].Index <= to && l.entries[pos].appended.Before(t); pos++ {
+		index = l.entries[pos].Index
+	}
+	return index
+}
+
+// compactTo discards committed log entries up to and including the passed
+// index, which the state machine no longer needs. snapshot is first called
+// with the commit index and its term, to snapshot the state machine as of that
+// index, along with the encoded client sessions as of that index. It's called
+// with the log locked, so nothing is applied while it runs, and it mustn't call
+// back into the log. If snapshot fails, nothing is discarded.
+//
+// The first compaction also upgrades a store in an older format, while the log
+// still holds every entry in it.
+func (l *raftLog) compactTo(index uint64, snapshot func(index, term uint64, sessions []byte) error) error {
+	l.Lock()
+	defer l.Unlock()
+
+	commitIndex := l.getCommitIndexWithLock()
+	if index > commitIndex {
+		return l.errorWithLock(ErrIndexTooBig, index, 0)
+	}
+
+	// With WithManualApply, the state machine may not have applied
+	// everything committed yet, and the snapshot can only reflect what it
+	// has.
+	commitPos := l.commitPos
+	if l.appliedTo < commitIndex {
+		commitIndex = l.appliedTo
+		commitPos = sort.Search(len(l.entries), func(i int) bool { return l.entries[i].Index > commitIndex }) - 1
+		if index > commitIndex {
+			index = commitIndex
+		}
+	}
+	if index <= l.compactedIndex {
+		return nil // nothing to do
+	}
+
+	commitTerm := l.compactedTerm
+	if commitPos >= 0 {
+		commitTerm = l.entries[commitPos].Term
+	}
+	sessions, err := l.encodeSessionsWithLock()
+	if err != nil {
+		return err
+	}
+	if err := snapshot(commitIndex, commitTerm, sessions); err != nil {
+		return err
+	}
+	if err := l.upgradeStoreWithLock(); err != nil {
+		return err
+	}
+
+	pos, ok := l.positionWithLock(index)
+	if !ok {
+		panic(fmt.Sprintf("committed index %d not found in log", index))
+	}
+	l.compactConfigurationsWithLock(index)
+	l.compactedIndex = l.entries[pos].Index
+	l.compactedTerm = l.entries[pos].Term
+	l.compactedHash = l.entries[pos].hash()
+	for i := 0; i <= pos; i++ {
+		l.entryBytes -= l.entries[i].size()
+	}
+	l.entries = append([]logEntry{}, l.entries[pos+1:]...) // release the prefix
+	l.commitPos -= pos + 1
+	return nil
+}
+
 // lastIndex returns the index of the most recent log entry.
 func (l *raftLog) lastIndex() uint64 {
 	l.RLock()
@@ -242,7 +1215,7 @@ func (l *raftLog) lastIndex() uint64 {
 
 func (l *raftLog) lastIndexWithLock() uint64 {
 	if len(l.entries) <= 0 {
-		return 0
+		return l.compactedIndex
 	}
 	return l.entries[len(l.entries)-1].Index
 }
@@ -256,33 +1229,81 @@ func (l *raftLog) lastTerm() uint64 {
 
 func (l *raftLog) lastTermWithLock() uint64 {
 	if len(l.entries) <= 0 {
-		return 0
+		return l.compactedTerm
 	}
 	return l.entries[len(l.entries)-1].Term
 }
 
-// appendEntry appends the passed log entry to the log. It will return an error
-// if the entry's term is smaller than the log's most recent term, or if the
-// entry's index is too small relative to the log's most recent entry.
+// lastHashWithLock returns the hash of the most recent log entry, which is the
+// PrevHash of the next one. The first entry follows the zero hash.
+func (l *raftLog) lastHashWithLock() [sha256.Size]byte {
+	if len(l.entries) <= 0 {
+		return l.compactedHash
+	}
+	return l.entries[len(l.entries)-1].hash()
+}
+
+// appendEntry appends the passed log entry to the log, chaining it to the most
+// recent entry by setting its PrevHash. It will return an error if the entry's
+// term is smaller than the log's most recent term, or if the entry's index is
+// too small relative to the log's most recent entry.
 func (l *raftLog) appendEntry(entry logEntry) error {
+	return l.appendEntries([]logEntry{entry})
+}
+
+// appendEntries appends the passed entries to the log, in order, as
+// appendEntry would one at a time, but under a single lock. The batch is
+// appended atomically: the whole of it is validated first, each entry against
+// the one before it, in the log or in the batch, and unless they're all valid,
+// none is appended, so nothing of a failed batch is ever committed, or written
+// to the store. An entry is invalid if it has no term, if its command is too
+// big ever to be stored, or if it's out of order with the one before.
+func (l *raftLog) appendEntries(entries []logEntry) error {
 	l.Lock()
 	defer l.Unlock()
 
-	if len(l.entries) > 0 {
-		lastTerm := l.lastTermWithLock()
-		if entry.Term < lastTerm {
-			return errTermTooSmall
+	checked, lastTerm, lastIndex := len(l.entries) > 0, l.lastTermWithLock(), l.lastIndexWithLock()
+	for _, entry := range entries {
+		if entry.Term == 0 {
+			return l.errorWithLock(ErrBadTerm, entry.Index, entry.Term)
 		}
-		lastIndex := l.lastIndexWithLock()
-		if entry.Term == lastTerm && entry.Index <= lastIndex {
-			return errIndexTooSmall
+		if len(entry.Command) > maxCommandSize {
+			return errCommandTooBig
 		}
+		if checked {
+			if entry.Term < lastTerm {
+				return l.errorWithLock(ErrTermTooSmall, entry.Index, entry.Term)
+			}
+			if entry.Term == lastTerm && entry.Index <= lastIndex {
+				return l.errorWithLock(ErrIndexTooSmall, entry.Index, entry.Term)
+			}
+		}
+		checked, lastTerm, lastIndex = true, entry.Term, entry.Index
 	}
-
-	l.entries = append(l.entries, entry)
+	l.appendWithLock(entries)
 	return nil
 }
 
+// appendWithLock appends entries which have already been validated.
+func (l *raftLog) appendWithLock(entries []logEntry) {
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.Command == nil {
+			// Codecs differ on whether an empty command comes back nil;
+			// ours never does, so nor does any command the state machine
+			// is given.
+			entry.Command = []byte{}
+		}
+		entry.PrevHash = l.lastHashWithLock()
+		entry.appended = now
+		if entry.Kind == kindConfiguration {
+			l.configIndexes = append(l.configIndexes, entry.Index)
+		}
+		l.entries = append(l.entries, entry)
+		l.entryBytes += entry.size()
+	}
+}
+
 // commitTo commits all log entries up to and including the passed commitIndex.
 // Commit means: synchronize the log entry to persistent storage, and call the
 // state machine apply function for the log entry's command.
@@ -296,12 +1317,12 @@ func (l *raftLog) commitTo(commitIndex uint64) error {
 
 	// Reject old commit indexes
 	if commitIndex < l.getCommitIndexWithLock() {
-		return errIndexTooSmall
+		return l.errorWithLock(ErrIndexTooSmall, commitIndex, 0)
 	}
 
 	// Reject new commit indexes
 	if commitIndex > l.lastIndexWithLock() {
-		return errIndexTooBig
+		return l.errorWithLock(ErrIndexTooBig, commitIndex, 0)
 	}
 
 	// If we've already committed to the commitIndex, great!
@@ -309,44 +1330,82 @@ func (l *raftLog) commitTo(commitIndex uint64) error {
 		return nil
 	}
 
+	// Otherwise it's after the first entry, and before the last, but it might
+	// fall in a gap between them.
+	if _, ok := l.positionWithLock(commitIndex); !ok {
+		return l.errorWithLock(ErrBadIndex, commitIndex, 0)
+	}
+
 	// We should start committing at precisely the last commitPos + 1
 	pos := l.commitPos + 1
 	if pos < 0 {
 		panic("pending commit pos < 0")
 	}
 
-	// Commit entries between our existing commit index and the passed index.
-	// Remember to include the passed index.
-	for {
-		// Sanity checks. TODO replace with plain `for` when this is stable.
-		if pos >= len(l.entries) {
-			panic(fmt.Sprintf("commitTo pos=%d advanced past all log entries (%d)", pos, len(l.entries)))
+	// A failed write may have left the store in a state we can't append to.
+	if l.storeErr != nil {
+		return fmt.Errorf("%w: %s", errStoreWrite, l.storeErr)
+	}
+
+	if err := l.writeStoreHeaderWithLock(); err != nil {
+		return fmt.Errorf("%w: %s", errStoreWrite, err)
+	}
+
+	// Encode entries between our existing commit index and the passed index
+	// to persistent storage, unless persist already has. Remember to include
+	// the passed index.
+	end, err := pos, error(nil)
+	storedPos, before := l.commitPos+l.stored, l.storeSize
+	for ; end < len(l.entries) && l.entries[end].Index <= commitIndex; end++ {
+		if end <= storedPos {
+			continue
 		}
-		if l.entries[pos].Index > commitIndex {
-			panic("commitTo advanced past the desired commitIndex")
+		var size int64
+		if size, err = l.entries[end].encodeAs(l.store, l.storeVersion, l.compression, l.headers); err != nil {
+			l.trimStore()
+			err = fmt.Errorf("%w: index %d: %s", errStoreWrite, l.entries[end].Index, err)
+			break // commit what we managed to persist
 		}
+		l.storeSize += size
+		storedPos = end
+	}
+	if err == nil && l.entries[end-1].Index != commitIndex {
+		panic(fmt.Sprintf(
+			"entry Index %d precedes our desired commitIndex %d, but the next one is beyond it",
+			l.entries[end-1].Index,
+			commitIndex,
+		))
+	}
 
-		// Encode the entry to persistent storage.
-		if err := l.entries[pos].encode(l.store); err != nil {
-			return err
+	// A store with commit records needs another, now that there's more
+	// committed; otherwise, these entries would be recovered as uncommitted.
+	if l.storeMarked && end > pos && l.storeErr == nil {
+		if err := l.writeCommitRecordWithLock(l.entries[end-1].Index); err != nil {
+			l.storeSize = before // they'll be written again
+			l.trimStore()
+			return fmt.Errorf("%w: %s", errStoreWrite, err)
 		}
+	}
+	l.stored = storedPos - l.commitPos
 
-		// Forward non-configuration commands to the state machine.
-		// Send the responses to the waiting client, if applicable.
-		if !l.entries[pos].isConfiguration {
-			resp := l.apply(l.entries[pos].Index, l.entries[pos].Command)
-			if l.entries[pos].commandResponse != nil {
-				select {
-				case l.entries[pos].commandResponse <- resp:
-					break
-				case <-time.After(maximumElectionTimeout()): // << ElectionInterval
-					panic("uncoöperative command response receiver")
-				}
-				close(l.entries[pos].commandResponse)
-				l.entries[pos].commandResponse = nil
-			}
+	// Sync them with a single call, so that many concurrent commands that
+	// commit together share the cost (group commit). No entry is applied, or
+	// acknowledged to its client, before it's synced.
+	if s, ok := l.store.(syncer); ok && end > pos {
+		if err := s.Sync(); err != nil {
+			return fmt.Errorf("%w: sync: %s", errStoreWrite, err)
 		}
+	}
 
+	now := time.Now()
+	for i := pos; i < end; i++ {
+		l.entries[i].committedAt = now
+	}
+	if !l.manualApply {
+		l.applyWithLock(pos, end)
+	}
+
+	for ; pos < end; pos++ {
 		// Signal the entry has been committed, if applicable.
 		if l.entries[pos].committed != nil {
 			l.entries[pos].committed <- true
@@ -356,25 +1415,88 @@ func (l *raftLog) commitTo(commitIndex uint64) error {
 
 		// Mark our commit position cursor.
 		l.commitPos = pos
+		l.stored--
+		delete(l.storeStarts, l.entries[pos].Index)
+	}
 
-		// If that was the last one, we're done.
-		if l.entries[pos].Index == commitIndex {
-			break
+	// Done.
+	return err
+}
+
+// drainApply applies the committed entries the state machine hasn't caught up
+// with yet, and returns how many there were. See WithManualApply.
+func (l *raftLog) drainApply() int {
+	l.Lock()
+	defer l.Unlock()
+
+	from := sort.Search(len(l.entries), func(i int) bool { return l.entries[i].Index > l.appliedTo })
+	end := l.commitPos + 1
+	if from >= end {
+		return 0
+	}
+	l.applyWithLock(from, end)
+	return end - from
+}
+
+// applyWithLock applies the committed entries at the passed positions, and
+// records that the state machine has caught up with them.
+func (l *raftLog) applyWithLock(pos, end int) {
+	// Forward non-configuration commands to the state machine, unless it's
+	// already seen them, and send the responses to the waiting clients, if
+	// applicable. A client whose command was a retry, and whose response
+	// isn't known, gets its channel closed instead.
+	jobs := l.applyCommitted(pos, end)
+	for _, job := range jobs {
+		entry := &l.entries[job.pos]
+		l.latencies.observe(time.Since(entry.appended))
+		applied := time.Now()
+		if job.apply {
+			l.applyTimes.observe(job.took)
+			l.slowApply.check(entry.Index, job.took)
+			applied = job.applied
+		}
+		if !entry.committedAt.IsZero() { // not recovered from the store
+			l.onApplied.notify(entry.Index, entry.appended, entry.committedAt, applied)
 		}
-		if l.entries[pos].Index > commitIndex {
-			panic(fmt.Sprintf(
-				"current entry Index %d is beyond our desired commitIndex %d",
-				l.entries[pos].Index,
-				commitIndex,
-			))
+		entry.lost = nil // it's too late to lose it
+		if entry.commandResponse == nil {
+			continue
 		}
+		if job.known {
+			l.respond(entry.commandResponse, job.resp)
+		} else {
+			close(entry.commandResponse)
+		}
+		entry.commandResponse = nil
+	}
+	if end > pos {
+		l.appliedTo = l.entries[end-1].Index
+	}
+}
 
-		// Otherwise, advance!
-		pos++
+// respond sends resp to a waiting client, and closes the channel, without ever
+// blocking: a client that's gone away mustn't stall the log. If the client
+// isn't ready to receive, the log's ResponsePolicy decides what happens.
+func (l *raftLog) respond(c chan<- []byte, resp []byte) {
+	select {
+	case c <- resp:
+		close(c)
+		return
+	default:
 	}
 
-	// Done.
-	return nil
+	switch l.responses {
+	case DropResponses:
+		close(c)
+	default:
+		go func() {
+			defer close(c)
+			select {
+			case c <- resp:
+			case <-time.After(maximumElectionTimeout()): // << ElectionInterval
+			}
+		}()
+	}
 }
 
 // logEntry is the atomic unit being managed by the distributed log. A log entry
@@ -382,81 +1504,386 @@ func (l *raftLog) commitTo(commitIndex uint64) error {
 // network leader first sees the entry, and a command. The command is what gets
 // executed against the node state machine when the log entry is successfully
 // replicated.
+//
+// Each entry also carries the hash of the entry before it, so the log forms a
+// hash chain: modifying any persisted entry, or reordering entries, breaks the
+// chain, and is detected at recovery. The hash isn't replicated; every node
+// computes its own chain as it appends, and identical logs yield identical
+// chains.
 type logEntry struct {
-	Index           uint64        `json:"index"`
-	Term            uint64        `json:"term"` // when received by leader
-	Command         []byte        `json:"command,omitempty"`
-	committed       chan bool     `json:"-"`
-	commandResponse chan<- []byte `json:"-"` // only non-nil on receiver's log
-	isConfiguration bool          `json:"-"` // for configuration change entries
+	Index           uint64            `json:"index"`
+	Term            uint64            `json:"term"` // when received by leader
+	Command         []byte            `json:"command,omitempty"` // empty, not nil, once appended
+	PrevHash        [sha256.Size]byte `json:"-"` // set by appendEntry
+	appended        time.Time         `json:"-"` // set by appendEntry
+	committed       chan bool         `json:"-"`
+	committedAt     time.Time         `json:"-"` // set by commitTo
+	commandResponse chan<- []byte     `json:"-"` // only non-nil on receiver's log
+	lost            chan<- error      `json:"-"` // if not nil, told if the entry is truncated
+	Kind            entryKind         `json:"kind,omitempty"`
+	Expires         int64             `json:"expires,omitempty"` // in Unix nanoseconds, by the leader's clock; see CommandTTL
 }
 
-// encode serializes the log entry to the passed io.Writer.
+// abandon tells whoever's waiting on the entry, which is being discarded before
+// it's committed, that it never will be. A waiter for the command's response
+// has its chan closed without a response, and, if it's waiting for the command
+// to be lost too, gets ErrEntryTruncated, unless it's already been told, e.g.
+// with ErrLeadershipLost.
+func (e *logEntry) abandon() {
+	if e.lost != nil {
+		select {
+		case e.lost <- ErrEntryTruncated:
+		default:
+		}
+		e.lost = nil
+	}
+	if e.commandResponse != nil {
+		close(e.commandResponse)
+		e.commandResponse = nil
+	}
+	if e.committed != nil {
+		e.committed <- false
+		close(e.committed)
+		e.committed = nil
+	}
+}
+
+// hash returns the SHA-256 of the entry's PrevHash, term, index, kind, and
+// command. Its expiry isn't covered, as older formats don't persist it.
+func (e *logEntry) hash() [sha256.Size]byte {
+	buf := make([]byte, sha256.Size+17)
+	copy(buf, e.PrevHash[:])
+	binary.LittleEndian.PutUint64(buf[sha256.Size:], e.Term)
+	binary.LittleEndian.PutUint64(buf[sha256.Size+8:], e.Index)
+	buf[sha256.Size+16] = byte(e.Kind)
+
+	h := sha256.New()
+	h.Write(buf)
+	h.Write(e.Command)
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// encode serializes the log entry to the passed io.Writer, in the current
+// format.
 //
 // Entries are serialized in a simple binary format:
 //
-//		 ---------------------------------------------
-//		| uint32 | uint64 | uint64 | uint32 | []byte  |
-//		 ---------------------------------------------
-//		| CRC    | TERM   | INDEX  | SIZE   | COMMAND |
-//		 ---------------------------------------------
+//		 ----------------------------------------------------------------------------------
+//		| uint8   | uint32 | uint64 | uint64 | [32]byte | uint8 | uint32 | int64   | []byte  |
+//		 ----------------------------------------------------------------------------------
+//		| VERSION | CRC    | TERM   | INDEX  | PREVHASH | KIND  | SIZE   | EXPIRES | COMMAND |
+//		 ----------------------------------------------------------------------------------
+//
+// VERSION is the format of the entry, and KIND is its entryKind, which may
+// flag a compressed COMMAND, whose SIZE is then its compressed size. EXPIRES
+// is the entry's expiry, or zero. The CRC covers everything but itself, as
+// written. Before version 8 of the format, entries had no EXPIRES, so an
+// expiry written in an older format is lost; in version 4, commands were never
+// compressed; in versions 2 and 3, entries had no VERSION; and in version 1,
+// they had no PREVHASH or KIND either. See logVersion.
+//
+// The layout is fixed, and every field is written whole, so the same entry
+// always encodes to the same bytes, in any process; the CRC and hash chain
+// rely on it. Configuration entries are encoded likewise, with a PeerFactory;
+// see configuration.encode.
 //
+// The header is written first, and then the command, straight from the entry,
+// so large commands aren't copied. If the second write fails, the store is
+// left with a header and no command; commitTo trims it, and so does recovery,
+// should the process die in between.
 func (e *logEntry) encode(w io.Writer) error {
-	if len(e.Command) <= 0 {
-		return errNoCommand
+	_, err := e.encodeAs(w, logVersion, compression{}, headerBuffers{})
+	return err
+}
+
+// encodeAs serializes the log entry in the passed format, compressing its
+// command if the format allows it, and c calls for it. It returns the number
+// of bytes it wrote, provided it wrote them all. See encode.
+func (e *logEntry) encodeAs(w io.Writer, version byte, c compression, hb headerBuffers) (int64, error) {
+	if len(e.Command) > maxCommandSize {
+		return 0, errCommandTooBig
 	}
 	if e.Index <= 0 {
-		return errBadIndex
+		return 0, ErrBadIndex
 	}
 	if e.Term <= 0 {
-		return errBadTerm
+		return 0, ErrBadTerm
 	}
 
-	commandSize := len(e.Command)
-	buf := make([]byte, 24+commandSize)
+	command, kind := e.Command, e.Kind
+	if version >= 5 {
+		compressed, ok, err := c.compress(command)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			command, kind = compressed, kind|kindCompressed
+		}
+	}
 
-	binary.LittleEndian.PutUint64(buf[4:12], e.Term)
-	binary.LittleEndian.PutUint64(buf[12:20], e.Index)
-	binary.LittleEndian.PutUint32(buf[20:24], uint32(commandSize))
+	buf := hb.get()
+	defer hb.put(buf)
+	header := buf[:entryHeaderSizeOf(version)]
+	o := 0 // offset of the CRC
+	if version >= 4 {
+		header[0], o = version, 1
+	}
 
-	copy(buf[24:], e.Command)
+	binary.LittleEndian.PutUint64(header[o+4:o+12], e.Term)
+	binary.LittleEndian.PutUint64(header[o+12:o+20], e.Index)
+	if version == 1 {
+		binary.LittleEndian.PutUint32(header[20:24], uint32(len(e.Command)))
+	} else {
+		copy(header[o+20:o+52], e.PrevHash[:])
+		header[o+52] = byte(kind)
+		binary.LittleEndian.PutUint32(header[o+53:o+57], uint32(len(command)))
+	}
+	if version >= 8 {
+		binary.LittleEndian.PutUint64(header[o+57:o+65], uint64(e.Expires))
+	}
+	binary.LittleEndian.PutUint32(header[o:o+4], entryChecksum(header, o, command))
 
-	binary.LittleEndian.PutUint32(
-		buf[0:4],
-		crc32.ChecksumIEEE(buf[4:]),
-	)
+	if _, err := w.Write(header); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(command); err != nil {
+		return 0, err
+	}
+	return int64(len(header) + len(command)), nil
+}
+
+// encodeCommitRecord writes a commit record to w, in the current format, and
+// returns its size. It's encoded like an entry, with a KIND of
+// kindCommitRecord, and the commit index as its INDEX, but no TERM, PREVHASH,
+// or COMMAND; it isn't part of the hash chain. It marks the entries before it
+// in the store, up to and including that index, as committed. See persist.
+func encodeCommitRecord(w io.Writer, index uint64, hb headerBuffers) (int64, error) {
+	buf := hb.get()
+	defer hb.put(buf)
+	header := buf[:]
+	header[0] = logVersion
+	binary.LittleEndian.PutUint64(header[13:21], index)
+	header[53] = byte(kindCommitRecord)
+	binary.LittleEndian.PutUint32(header[1:5], entryChecksum(header, 1, nil))
+	if _, err := w.Write(header); err != nil {
+		return 0, err
+	}
+	return int64(len(header)), nil
+}
+
+// tombstone returns the command of a tombstone, which expires the entry with
+// the passed index.
+func tombstone(index uint64) []byte {
+	command := make([]byte, 8)
+	binary.LittleEndian.PutUint64(command, index)
+	return command
+}
+
+// tombstoneOf returns the index of the entry expired by the passed tombstone
+// command, or zero if it's malformed.
+func tombstoneOf(command []byte) uint64 {
+	if len(command) != 8 {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(command)
+}
+
+// headerPool holds the buffers entry headers, and commit records, are encoded
+// into: entryHeaderSize bytes, the largest header of any format. Each is
+// written out as soon as it's encoded, and an io.Writer mustn't retain what
+// it's passed, so the buffer goes straight back to the pool, rather than
+// leaving garbage behind for every entry appended. Commands are written from
+// the entries themselves, and never pass through it.
+var headerPool = sync.Pool{
+	New: func() interface{} { return new([entryHeaderSize]byte) },
+}
+
+// headerBuffers hands out zeroed buffers for entry headers: from headerPool,
+// unless pooling is disabled, in which case each is freshly allocated. See
+// WithEncodeBufferPooling.
+type headerBuffers struct {
+	unpooled bool
+}
+
+func (hb headerBuffers) get() *[entryHeaderSize]byte {
+	if hb.unpooled {
+		return new([entryHeaderSize]byte)
+	}
+	buf := headerPool.Get().(*[entryHeaderSize]byte)
+	*buf = [entryHeaderSize]byte{}
+	return buf
+}
 
-	_, err := w.Write(buf)
+func (hb headerBuffers) put(buf *[entryHeaderSize]byte) {
+	if !hb.unpooled {
+		headerPool.Put(buf)
+	}
+}
+
+// entryChecksum returns the CRC of an entry's header, except for the CRC
+// itself, at offset o, and its command.
+func entryChecksum(header []byte, o int, command []byte) uint32 {
+	crc := crc32.Update(0, crc32.IEEETable, header[:o])
+	crc = crc32.Update(crc, crc32.IEEETable, header[o+4:])
+	return crc32.Update(crc, crc32.IEEETable, command)
+}
+
+// size returns the size of the entry as it's encoded in the current format,
+// without compression.
+func (e *logEntry) size() int64 {
+	return int64(entryHeaderSize + len(e.Command))
+}
+
+// entryHeaderSizeOf returns the size of an encoded entry in the passed format,
+// not counting its command.
+func entryHeaderSizeOf(version byte) int {
+	switch version {
+	case 1:
+		return 24
+	case 2, 3:
+		return 57
+	case 4, 5, 6, 7:
+		return 58 // they differ only in KIND
+	}
+	return entryHeaderSize
+}
+
+// encodeLogHeader writes the header which begins every store.
+func encodeLogHeader(w io.Writer) error {
+	_, err := w.Write(append([]byte(logMagic), logVersion))
 	return err
 }
 
-// decode deserializes one log entry from the passed io.Reader.
+// decodeLogHeader reads the header at the start of a store, and returns the
+// format of the entries after it, and a reader of them. A store without a
+// header is taken to be in the original format, version 1, and the returned
+// reader begins at the start of the store. It returns io.EOF if the store is
+// empty.
+func decodeLogHeader(r io.Reader) (byte, io.Reader, error) {
+	header := make([]byte, logHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err == io.EOF {
+		return 0, nil, err
+	}
+	if err != nil || string(header[:len(logMagic)]) != logMagic {
+		return 1, io.MultiReader(bytes.NewReader(header[:n]), r), nil
+	}
+	if version := header[len(logMagic)]; version < 2 || version > logVersion {
+		return 0, nil, fmt.Errorf("%w: %d", errLogVersion, version)
+	}
+	return header[len(logMagic)], r, nil
+}
+
+// decode deserializes one log entry, in the current format, from the passed
+// io.Reader. It reads the header, and then exactly as many command bytes as
+// the header specifies, straight into the entry's command. An empty command
+// decodes as empty, never nil.
 func (e *logEntry) decode(r io.Reader) error {
-	header := make([]byte, 24)
+	_, err := e.decodeAs(r, logVersion, nil)
+	return err
+}
 
-	if _, err := r.Read(header); err != nil {
-		return err
+// decodeAs deserializes one log entry from a store in the passed format. From
+// version 4, each entry begins with its own format, which it's decoded by, and
+// which may be newer than the store's. An entry in a format we don't know
+// returns errLogVersion. A compressed command is decompressed with c. A commit
+// record decodes as an entry with no term. It returns the number of bytes the
+// entry took up.
+func (e *logEntry) decodeAs(r io.Reader, storeVersion byte, c Compressor) (int64, error) {
+	buf := make([]byte, entryHeaderSize) // the largest header, of any format
+	header := buf[:entryHeaderSizeOf(storeVersion)]
+	version, o := storeVersion, 0 // format, and offset of the CRC
+	if storeVersion >= 4 {
+		if _, err := io.ReadFull(r, header[:1]); err != nil {
+			return 0, err
+		}
+		if version, o = header[0], 1; version < 4 || version > logVersion {
+			return 0, fmt.Errorf("%w: %d", errLogVersion, version)
+		}
+		header = buf[:entryHeaderSizeOf(version)]
 	}
 
-	command := make([]byte, binary.LittleEndian.Uint32(header[20:24]))
+	if _, err := io.ReadFull(r, header[o:]); err != nil {
+		if err == io.EOF && o > 0 {
+			err = io.ErrUnexpectedEOF // we've already read the version
+		}
+		return 0, err
+	}
 
-	if _, err := r.Read(command); err != nil {
-		return err
+	sizeAt := o + 53
+	if version == 1 {
+		sizeAt = 20
+	}
+	size := binary.LittleEndian.Uint32(header[sizeAt : sizeAt+4])
+	if size > maxCommandSize {
+		return 0, errCommandTooBig
 	}
 
-	crc := binary.LittleEndian.Uint32(header[:4])
+	command := make([]byte, size)
 
-	check := crc32.NewIEEE()
-	check.Write(header[4:])
-	check.Write(command)
+	if _, err := io.ReadFull(r, command); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF // we've already read the header
+		}
+		return 0, err
+	}
 
-	if crc != check.Sum32() {
-		return errInvalidChecksum
+	if binary.LittleEndian.Uint32(header[o:o+4]) != entryChecksum(header, o, command) {
+		return 0, errInvalidChecksum
 	}
+	n := int64(len(header) + len(command))
 
-	e.Term = binary.LittleEndian.Uint64(header[4:12])
-	e.Index = binary.LittleEndian.Uint64(header[12:20])
+	e.Term = binary.LittleEndian.Uint64(header[o+4 : o+12])
+	e.Index = binary.LittleEndian.Uint64(header[o+12 : o+20])
+	e.Expires = 0
+	if version >= 8 {
+		e.Expires = int64(binary.LittleEndian.Uint64(header[o+57 : o+65]))
+	}
+	if version > 1 {
+		copy(e.PrevHash[:], header[o+20:o+52])
+		kind := entryKind(header[o+52])
+		if version >= 5 && kind&kindCompressed != 0 {
+			if c == nil {
+				return 0, errNoCompressor
+			}
+			var err error
+			if command, err = c.Decompress(command); err != nil {
+				return 0, err
+			}
+			if len(command) > maxCommandSize {
+				return 0, errCommandTooBig
+			}
+			kind &^= kindCompressed
+		}
+		e.Kind = kind
+		if version >= 6 && (kind == kindCommitRecord) != (e.Term == 0) {
+			return 0, ErrBadTerm // only commit records have no term
+		}
+	}
+
+	// The index arithmetic relies on no entry having a zero index or term,
+	// and none is ever written with one, though a commit record has no term,
+	// and may have no index. Such an entry is corrupt, even if its CRC
+	// checks out.
+	if record := version >= 6 && e.Kind == kindCommitRecord; !record {
+		if e.Index == 0 {
+			return 0, ErrBadIndex
+		}
+		if e.Term == 0 {
+			return 0, ErrBadTerm
+		}
+	}
 	e.Command = command
 
-	return nil
+	return n, nil
+}
+
+// isLegacyConfiguration reports whether an entry from a store in the original
+// format, which didn't record which entries were configurations, is one.
+func isLegacyConfiguration(cmd []byte) bool {
+	pm, err := decodePeerMap(cmd, nil)
+	return err == nil && len(pm) > 0
 }
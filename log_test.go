@@ -2,11 +2,27 @@ package raft
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"math"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
 func oneshot() chan []byte {
 	return make(chan []byte, 1)
 }
@@ -15,6 +31,13 @@ func noop(uint64, []byte) []byte {
 	return []byte{}
 }
 
+// chain links the passed entries into a hash chain, as appendEntry would.
+func chain(entries []logEntry) {
+	for i := 1; i < len(entries); i++ {
+		entries[i].PrevHash = entries[i-1].hash()
+	}
+}
+
 func TestLogEntriesAfter(t *testing.T) {
 	c := []byte(`{}`)
 	buf := &bytes.Buffer{}
@@ -33,7 +56,7 @@ func TestLogEntriesAfter(t *testing.T) {
 		{3, 0, 0},
 		{4, 0, 0},
 	} {
-		entries, term := log.entriesAfter(tu.AfterIndex)
+		entries, term, _ := log.entriesAfter(tu.AfterIndex)
 		if expected, got := tu.ExpectedEntries, len(entries); expected != got {
 			t.Errorf("with %d, After(%d): entries: expected %d got %d", 0, tu.AfterIndex, expected, got)
 		}
@@ -42,7 +65,7 @@ func TestLogEntriesAfter(t *testing.T) {
 		}
 	}
 
-	log.appendEntry(logEntry{1, 1, c, nil, oneshot(), false})
+	log.appendEntry(logEntry{Index: 1, Term: 1, Command: c, commandResponse: oneshot()})
 	for _, tu := range []tuple{
 		{0, 1, 0},
 		{1, 0, 1},
@@ -50,7 +73,7 @@ func TestLogEntriesAfter(t *testing.T) {
 		{3, 0, 1},
 		{4, 0, 1},
 	} {
-		entries, term := log.entriesAfter(tu.AfterIndex)
+		entries, term, _ := log.entriesAfter(tu.AfterIndex)
 		if expected, got := tu.ExpectedEntries, len(entries); expected != got {
 			t.Errorf("with %d, After(%d): entries: expected %d got %d", 1, tu.AfterIndex, expected, got)
 		}
@@ -59,7 +82,7 @@ func TestLogEntriesAfter(t *testing.T) {
 		}
 	}
 
-	log.appendEntry(logEntry{2, 1, c, nil, oneshot(), false})
+	log.appendEntry(logEntry{Index: 2, Term: 1, Command: c, commandResponse: oneshot()})
 	for _, tu := range []tuple{
 		{0, 2, 0},
 		{1, 1, 1},
@@ -67,7 +90,7 @@ func TestLogEntriesAfter(t *testing.T) {
 		{3, 0, 1},
 		{4, 0, 1},
 	} {
-		entries, term := log.entriesAfter(tu.AfterIndex)
+		entries, term, _ := log.entriesAfter(tu.AfterIndex)
 		if expected, got := tu.ExpectedEntries, len(entries); expected != got {
 			t.Errorf("with %d, After(%d): entries: expected %d got %d", 2, tu.AfterIndex, expected, got)
 		}
@@ -76,7 +99,7 @@ func TestLogEntriesAfter(t *testing.T) {
 		}
 	}
 
-	log.appendEntry(logEntry{3, 2, c, nil, oneshot(), false})
+	log.appendEntry(logEntry{Index: 3, Term: 2, Command: c, commandResponse: oneshot()})
 	for _, tu := range []tuple{
 		{0, 3, 0},
 		{1, 2, 1},
@@ -84,7 +107,7 @@ func TestLogEntriesAfter(t *testing.T) {
 		{3, 0, 2},
 		{4, 0, 2},
 	} {
-		entries, term := log.entriesAfter(tu.AfterIndex)
+		entries, term, _ := log.entriesAfter(tu.AfterIndex)
 		if expected, got := tu.ExpectedEntries, len(entries); expected != got {
 			t.Errorf("with %d, After(%d): entries: expected %d got %d", 3, tu.AfterIndex, expected, got)
 		}
@@ -94,14 +117,243 @@ func TestLogEntriesAfter(t *testing.T) {
 	}
 }
 
+func TestLogEntryAtAndWalkBack(t *testing.T) {
+	log := newRaftLog(&bytes.Buffer{}, noop)
+	for _, entry := range []logEntry{
+		{Index: 1, Term: 1, Command: []byte(`{}`)},
+		{Index: 2, Term: 1, Command: []byte(`{}`)},
+		{Index: 3, Term: 2, Command: []byte(`{}`), commandResponse: oneshot()},
+		{Index: 4, Term: 3, Command: []byte(`{}`)},
+	} {
+		if err := log.appendEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// entryAt finds every entry in the log, and nothing outside of it
+	for index := uint64(0); index <= 5; index++ {
+		entry, ok := log.entryAt(index)
+		if expected, got := index >= 1 && index <= 4, ok; expected != got {
+			t.Errorf("entryAt(%d): expected found %v, got %v", index, expected, got)
+			continue
+		}
+		if ok && entry.Index != index {
+			t.Errorf("entryAt(%d): got index %d", index, entry.Index)
+		}
+		if entry.commandResponse != nil {
+			t.Errorf("entryAt(%d): got a response channel", index)
+		}
+	}
+
+	// walkBack visits entries newest first, from the passed index
+	visited := []uint64{}
+	log.walkBack(3, func(entry *logEntry) bool {
+		visited = append(visited, entry.Index)
+		return true
+	})
+	if expected, got := "[3 2 1]", fmt.Sprint(visited); expected != got {
+		t.Errorf("walkBack(3): expected %s, got %s", expected, got)
+	}
+
+	// and stops as soon as it's told to
+	visited = visited[:0]
+	log.walkBack(100, func(entry *logEntry) bool {
+		visited = append(visited, entry.Index)
+		return entry.Term > 2
+	})
+	if expected, got := "[4 3]", fmt.Sprint(visited); expected != got {
+		t.Errorf("walkBack(100): expected %s, got %s", expected, got)
+	}
+}
+
+func TestLogConflict(t *testing.T) {
+	// a log whose entries are in terms 1 1 1 2 2 2 3 3
+	log := newRaftLog(&bytes.Buffer{}, noop)
+	for i, term := range []uint64{1, 1, 1, 2, 2, 2, 3, 3} {
+		if err := log.appendEntry(logEntry{Index: uint64(i + 1), Term: term, Command: []byte(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.commitTo(2); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tu := range []struct {
+		index                       uint64
+		conflictTerm, conflictIndex uint64
+	}{
+		{6, 2, 4},  // the first index of the entry's term
+		{8, 3, 7},  // from the last entry
+		{10, 0, 9}, // past the end, so just after it
+		{2, 0, 0},  // committed, so nothing to say
+	} {
+		term, index := log.conflict(tu.index)
+		if tu.conflictTerm != term || tu.conflictIndex != index {
+			t.Errorf("conflict(%d): expected %d/%d, got %d/%d", tu.index, tu.conflictTerm, tu.conflictIndex, term, index)
+		}
+	}
+
+	// lastIndexOfTerm finds the last entry in a term, at or before an index
+	for _, tu := range []struct {
+		from, term uint64
+		index      uint64
+		ok         bool
+	}{
+		{8, 2, 6, true},
+		{5, 2, 5, true},
+		{8, 4, 0, false},
+		{3, 2, 0, false},
+	} {
+		index, ok := log.lastIndexOfTerm(tu.from, tu.term)
+		if tu.index != index || tu.ok != ok {
+			t.Errorf("lastIndexOfTerm(%d, %d): expected %d/%v, got %d/%v", tu.from, tu.term, tu.index, tu.ok, index, ok)
+		}
+	}
+}
+
+func TestLogCompactTo(t *testing.T) {
+	log := newRaftLog(&bytes.Buffer{}, noop)
+	for _, entry := range []logEntry{
+		{Index: 1, Term: 1, Command: []byte(`{}`)},
+		{Index: 2, Term: 1, Command: []byte(`{}`)},
+		{Index: 3, Term: 2, Command: []byte(`{}`)},
+		{Index: 4, Term: 2, Command: []byte(`{}`)},
+		{Index: 5, Term: 2, Command: []byte(`{}`)},
+	} {
+		log.appendEntry(entry)
+	}
+	log.commitTo(4)
+
+	// uncommitted entries can't be compacted
+	noSnapshot := func(uint64, uint64, []byte) error { return nil }
+	if expected, got := ErrIndexTooBig, log.compactTo(5, noSnapshot); !errors.Is(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// the snapshot is taken at the commit index, even if less is discarded
+	var snapshotIndex, snapshotTerm uint64
+	if err := log.compactTo(3, func(index, term uint64, _ []byte) error {
+		snapshotIndex, snapshotTerm = index, term
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if snapshotIndex != 4 || snapshotTerm != 2 {
+		t.Errorf("expected snapshot at 4/2, got %d/%d", snapshotIndex, snapshotTerm)
+	}
+	if expected, got := uint64(4), log.firstIndex(); expected != got {
+		t.Errorf("expected first index %d, got %d", expected, got)
+	}
+	if expected, got := uint64(4), log.getCommitIndex(); expected != got {
+		t.Errorf("expected commit index %d, got %d", expected, got)
+	}
+
+	// a follower can still be caught up from the last compacted entry
+	entries, prevTerm, compacted := log.entriesAfter(3)
+	if len(entries) != 2 || prevTerm != 2 || compacted {
+		t.Errorf("entriesAfter(3): expected 2 entries after term 2, got %d after term %d (compacted %v)", len(entries), prevTerm, compacted)
+	}
+
+	// but not from before it, which takes a snapshot
+	if entries, _, compacted := log.entriesAfter(2); len(entries) != 0 || !compacted {
+		t.Errorf("entriesAfter(2): expected no entries, and compacted, got %d entries (compacted %v)", len(entries), compacted)
+	}
+
+	// and uncommitted entries after it can still be truncated
+	if err := log.ensureLastIs(4, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.appendEntry(logEntry{Index: 5, Term: 3, Command: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.commitTo(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.compactTo(5, noSnapshot); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(5), log.lastIndex(); expected != got {
+		t.Errorf("once empty, expected last index %d, got %d", expected, got)
+	}
+	if expected, got := uint64(3), log.lastTerm(); expected != got {
+		t.Errorf("once empty, expected last term %d, got %d", expected, got)
+	}
+}
+
+func TestLogBoundsAtFirstIndex(t *testing.T) {
+	// a log with entries 1-5 from term 1, and 6-8 from term 2, compacted
+	// through the commit index, 5, so its first index is 6
+	log := newRaftLog(&bytes.Buffer{}, noop)
+	for index := uint64(1); index <= 8; index++ {
+		term := uint64(1)
+		if index > 5 {
+			term = 2
+		}
+		log.appendEntry(logEntry{Index: index, Term: term, Command: []byte(`{}`)})
+	}
+	log.commitTo(5)
+	if err := log.compactTo(5, func(uint64, uint64, []byte) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(6), log.firstIndex(); expected != got {
+		t.Fatalf("expected first index %d, got %d", expected, got)
+	}
+
+	// has the first index, but not the one before
+	if _, ok := log.entryAt(5); ok || log.contains(5, 1) {
+		t.Errorf("expected no entry at 5")
+	}
+	if _, ok := log.entryAt(6); !ok || !log.contains(6, 2) {
+		t.Errorf("expected an entry at 6")
+	}
+	if !log.isCommitted(5) || log.isCommitted(6) {
+		t.Errorf("expected 5 committed, and 6 not")
+	}
+
+	// sends entries from the first index on, after the one before, but can't
+	// from any earlier
+	if entries, term, compacted := log.entriesAfter(5); len(entries) != 3 || entries[0].Index != 6 || term != 1 || compacted {
+		t.Errorf("entriesAfter(5): expected 6-8 after term 1, got %d entries after term %d (compacted %v)", len(entries), term, compacted)
+	}
+	if entries, _, compacted := log.entriesAfter(4); len(entries) != 0 || !compacted {
+		t.Errorf("entriesAfter(4): expected compacted, got %d entries (compacted %v)", len(entries), compacted)
+	}
+
+	// truncates back to the one before the first index, given its term, but
+	// no further
+	if err := log.ensureLastIs(5, 2); !errors.Is(err, ErrBadTerm) {
+		t.Errorf("ensureLastIs(5, 2): expected %v, got %v", ErrBadTerm, err)
+	}
+	if err := log.ensureLastIs(4, 1); !errors.Is(err, ErrIndexTooSmall) {
+		t.Errorf("ensureLastIs(4, 1): expected %v, got %v", ErrIndexTooSmall, err)
+	}
+	if err := log.ensureLastIs(5, 1); err != nil {
+		t.Fatalf("ensureLastIs(5, 1): %s", err)
+	}
+	if expected, got := "6/5", fmt.Sprintf("%d/%d", log.firstIndex(), log.lastIndex()); expected != got {
+		t.Errorf("expected first/last index %s, got %s", expected, got)
+	}
+
+	// and commits from the first index on, but not before it
+	if err := log.appendEntry(logEntry{Index: 6, Term: 3, Command: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.commitTo(4); !errors.Is(err, ErrIndexTooSmall) {
+		t.Errorf("commitTo(4): expected %v, got %v", ErrIndexTooSmall, err)
+	}
+	if err := log.commitTo(6); err != nil {
+		t.Errorf("commitTo(6): %s", err)
+	}
+}
+
 func TestLogEncodeDecode(t *testing.T) {
 	for _, e := range []logEntry{
-		logEntry{1, 1, []byte(`{}`), nil, oneshot(), false},
-		logEntry{1, 2, []byte(`{}`), nil, oneshot(), false},
-		logEntry{1, 2, []byte(`{}`), nil, oneshot(), false},
-		logEntry{2, 2, []byte(`{}`), nil, oneshot(), false},
-		logEntry{255, 3, []byte(`{"cmd": 123}`), nil, oneshot(), false},
-		logEntry{math.MaxUint64 - 1, math.MaxUint64, []byte(`{}`), nil, oneshot(), false},
+		logEntry{Index: 1, Term: 1, Command: []byte(`{}`), commandResponse: oneshot()},
+		logEntry{Index: 1, Term: 2, Command: []byte(`{}`), commandResponse: oneshot()},
+		logEntry{Index: 1, Term: 2, Command: []byte(`{}`), commandResponse: oneshot()},
+		logEntry{Index: 2, Term: 2, Command: []byte(`{}`), commandResponse: oneshot()},
+		logEntry{Index: 255, Term: 3, Command: []byte(`{"cmd": 123}`), commandResponse: oneshot()},
+		logEntry{Index: math.MaxUint64 - 1, Term: math.MaxUint64, Command: []byte(`{}`), commandResponse: oneshot()},
 	} {
 		b := &bytes.Buffer{}
 		if err := e.encode(b); err != nil {
@@ -117,27 +369,464 @@ func TestLogEncodeDecode(t *testing.T) {
 	}
 }
 
+func TestLogEmptyCommands(t *testing.T) {
+	var applied [][]byte
+	apply := func(index uint64, cmd []byte) []byte {
+		applied = append(applied, cmd)
+		return []byte{}
+	}
+
+	// nil and empty commands, the first as a leader appends it, and the
+	// second as a follower receives it, with JSON's take on empty
+	store := &InMemoryStore{}
+	log := newRaftLog(store, apply)
+	log.appendEntry(logEntry{Index: 1, Term: 1, Command: nil})
+	var received appendEntries
+	b, _ := json.Marshal(appendEntries{Entries: []logEntry{{Index: 2, Term: 1, Command: []byte{}}}})
+	if err := json.Unmarshal(b, &received); err != nil {
+		t.Fatal(err)
+	}
+	log.appendEntry(received.Entries[0])
+	if err := log.commitTo(2); err != nil {
+		t.Fatal(err)
+	}
+
+	// are both applied as empty, and recovered as empty
+	if _, err := recoverRaftLog(store.Reopen(), apply, logOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 4, len(applied); expected != got {
+		t.Fatalf("expected %d commands applied, got %d", expected, got)
+	}
+	for i, cmd := range applied {
+		if cmd == nil || len(cmd) != 0 {
+			t.Errorf("%d: expected an empty command, got %#v", i, cmd)
+		}
+	}
+}
+
+func TestLogEntryKinds(t *testing.T) {
+	var applied, metadata []uint64
+	apply := func(index uint64, cmd []byte) []byte {
+		applied = append(applied, index)
+		return []byte{}
+	}
+	options := logOptions{metadata: func(index uint64, data []byte) {
+		if expected, got := `{"flag":true}`, string(data); expected != got {
+			t.Errorf("index %d: expected metadata %s, got %s", index, expected, got)
+		}
+		metadata = append(metadata, index)
+	}}
+
+	// a command, metadata, which a follower receives through JSON, a no-op,
+	// and another command
+	store := &InMemoryStore{}
+	log, _ := recoverRaftLog(store, apply, options)
+	var received appendEntries
+	b, _ := json.Marshal(appendEntries{Entries: []logEntry{
+		{Index: 1, Term: 1, Command: []byte(`{}`)},
+		{Index: 2, Term: 1, Command: []byte(`{"flag":true}`), Kind: kindMetadata},
+		{Index: 3, Term: 1, Command: []byte{}, Kind: kindNoOp},
+		{Index: 4, Term: 1, Command: []byte(`{}`)},
+	}})
+	if err := json.Unmarshal(b, &received); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.appendEntries(received.Entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.commitTo(4); err != nil {
+		t.Fatal(err)
+	}
+
+	// each goes where it should, and only there
+	if expected, got := "[1 4]", fmt.Sprint(applied); expected != got {
+		t.Errorf("applied: expected %s, got %s", expected, got)
+	}
+	if expected, got := "[2]", fmt.Sprint(metadata); expected != got {
+		t.Errorf("metadata: expected %s, got %s", expected, got)
+	}
+
+	// and the same again when they're recovered, unless they're applied
+	// already
+	applied, metadata = nil, nil
+	if _, err := recoverRaftLog(store.Reopen(), apply, options); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "[1 4] [2]", fmt.Sprint(applied, metadata); expected != got {
+		t.Errorf("recovered: expected %s, got %s", expected, got)
+	}
+	applied, metadata = nil, nil
+	options.appliedIndex = 2
+	if _, err := recoverRaftLog(store.Reopen(), apply, options); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "[4] []", fmt.Sprint(applied, metadata); expected != got {
+		t.Errorf("recovered after index 2: expected %s, got %s", expected, got)
+	}
+}
+
+func TestLogEntryExpiry(t *testing.T) {
+	// an expiry survives encoding in the current format, but not in older ones
+	e := logEntry{Index: 1, Term: 1, Command: []byte(`{}`), Expires: 12345}
+	for _, tu := range []struct {
+		version  byte
+		expected int64
+	}{
+		{logVersion, 12345},
+		{7, 0},
+	} {
+		var buf bytes.Buffer
+		if _, err := e.encodeAs(&buf, tu.version, compression{}, headerBuffers{}); err != nil {
+			t.Fatal(err)
+		}
+		var decoded logEntry
+		if _, err := decoded.decodeAs(&buf, tu.version, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := decoded.Expires; tu.expected != got {
+			t.Errorf("version %d: expected expiry %d, got %d", tu.version, tu.expected, got)
+		}
+	}
+
+	// two expiring commands, which a follower receives through JSON, and a
+	// tombstone for the first
+	type expiry struct{ index, expired uint64 }
+	var expiries []expiry
+	options := logOptions{expiry: func(index, expired uint64) {
+		expiries = append(expiries, expiry{index, expired})
+	}}
+	store := &InMemoryStore{}
+	log, _ := recoverRaftLog(store, noop, options)
+	var received appendEntries
+	b, _ := json.Marshal(appendEntries{Entries: []logEntry{
+		{Index: 1, Term: 1, Command: []byte(`{}`), Expires: 100},
+		{Index: 2, Term: 1, Command: []byte(`{}`), Expires: 200},
+		{Index: 3, Term: 1, Command: tombstone(1), Kind: kindTombstone},
+	}})
+	if err := json.Unmarshal(b, &received); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.appendEntries(received.Entries); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the second is yet to be buried, once it's expired
+	for _, tu := range []struct {
+		now      int64
+		expected string
+	}{
+		{150, "[]"},
+		{200, "[2]"},
+	} {
+		if got := fmt.Sprint(log.expired(tu.now)); tu.expected != got {
+			t.Errorf("at %d: expected %s, got %s", tu.now, tu.expected, got)
+		}
+	}
+
+	// the tombstone goes to the expiry func, once committed, and again when
+	// it's recovered, along with the expiries
+	if err := log.commitTo(3); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "[{3 1}]", fmt.Sprint(expiries); expected != got {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+	expiries = nil
+	recovered, err := recoverRaftLog(store.Reopen(), noop, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "[{3 1}] [2]", fmt.Sprint(expiries, recovered.expired(200)); expected != got {
+		t.Errorf("recovered: expected %s, got %s", expected, got)
+	}
+}
+
+func TestLogEntryEncodingDeterministic(t *testing.T) {
+	// one of each kind of entry, in a store
+	gob.Register(&serializablePeer{})
+	entries := []logEntry{
+		{Index: 1, Term: 1, Command: []byte(`{"op":"set"}`)},
+		{Index: 2, Term: 1, Command: encodeDescriptors(
+			[]PeerDescriptor{{ID: 1, Address: "http://a:7000"}, {ID: 2, Address: "http://b:7000", Role: "witness"}},
+			[]PeerDescriptor{{ID: 2, Address: "http://b:7000", Role: "witness"}},
+		), Kind: kindConfiguration},
+		{Index: 3, Term: 2, Command: []byte(`flags=on`), Kind: kindMetadata},
+		{Index: 4, Term: 2, Command: []byte(`{"op":"lock"}`), Expires: 1700000000000000000},
+		{Index: 5, Term: 2, Command: tombstone(4), Kind: kindTombstone},
+		{Index: 6, Term: 3, Command: []byte{}, Kind: kindNoOp},
+	}
+	store := &InMemoryStore{}
+	log := newRaftLog(store, noop)
+	for _, entry := range entries {
+		if err := log.appendEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.commitTo(6); err != nil {
+		t.Fatal(err)
+	}
+
+	// each encodes to the same bytes every time
+	for _, entry := range log.entries {
+		var a, b bytes.Buffer
+		entry.encode(&a)
+		entry.encode(&b)
+		if !bytes.Equal(a.Bytes(), b.Bytes()) {
+			t.Errorf("index %d: encoded differently:\n%x\n%x", entry.Index, a.Bytes(), b.Bytes())
+		}
+	}
+
+	// and to the same bytes in any process
+	golden := filepath.Join("testdata", "log.golden")
+	if *updateGolden {
+		if err := ioutil.WriteFile(golden, store.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, store.Bytes()) {
+		t.Errorf("store differs from %s:\n%x\n%x", golden, expected, store.Bytes())
+	}
+	recovered, err := recoverRaftLog(bytes.NewBuffer(expected), noop, logOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, entry := range recovered.entries {
+		if entry.Index != entries[i].Index || entry.Term != entries[i].Term || entry.Kind != entries[i].Kind ||
+			entry.Expires != entries[i].Expires || !bytes.Equal(entry.Command, entries[i].Command) {
+			t.Errorf("recovered %+v, expected %+v", entry, entries[i])
+		}
+	}
+
+	// a configuration of many peers encodes to the same bytes every time,
+	// whatever order its map is iterated in
+	peers := []Peer{}
+	for id := uint64(1); id <= 20; id++ {
+		peers = append(peers, serializablePeer{id, ""})
+	}
+	config := newConfiguration(makePeerMap(peers...))
+	first, err := config.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if again, _ := config.encode(); !bytes.Equal(first, again) {
+			t.Fatalf("configuration encoded differently:\n%x\n%x", first, again)
+		}
+	}
+	if oldPeers, _, err := decodeConfiguration(first, nil); err != nil || !reflect.DeepEqual(makePeerMap(peers...).ids(), oldPeers.ids()) {
+		t.Errorf("decoded %v, %v", oldPeers.ids(), err)
+	}
+}
+
+func TestLogManualApply(t *testing.T) {
+	var applied []uint64
+	apply := func(index uint64, _ []byte) []byte {
+		applied = append(applied, index)
+		return []byte{}
+	}
+	options := logOptions{manualApply: true}
+
+	// committed entries wait to be drained
+	store := &InMemoryStore{}
+	log, _ := recoverRaftLog(store, apply, options)
+	for index := uint64(1); index <= 4; index++ {
+		if err := log.appendEntry(logEntry{Index: index, Term: 1, Command: []byte(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.commitTo(2); err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) > 0 || log.getAppliedTo() != 0 {
+		t.Fatalf("applied %v, through %d, before draining", applied, log.getAppliedTo())
+	}
+	if expected, got := 2, log.drainApply(); expected != got {
+		t.Errorf("expected %d drained, got %d", expected, got)
+	}
+
+	// and compaction goes no further than they've been drained
+	if err := log.commitTo(4); err != nil {
+		t.Fatal(err)
+	}
+	var snapshotAt uint64
+	if err := log.compactTo(4, func(index, _ uint64, _ []byte) error { snapshotAt = index; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "2 2 [1 2]", fmt.Sprint(snapshotAt, log.compactedIndex, applied); expected != got {
+		t.Errorf("expected snapshot, compaction, and applied %s, got %s", expected, got)
+	}
+	if expected, got := 2, log.drainApply(); expected != got {
+		t.Errorf("expected %d drained, got %d", expected, got)
+	}
+
+	// nor are recovered entries applied until they're drained, even those
+	// the state machine has seen
+	applied = nil
+	options.appliedIndex = 2
+	recovered, err := recoverRaftLog(store.Reopen(), apply, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) > 0 {
+		t.Fatalf("applied %v on recovery", applied)
+	}
+	if expected, got := 4, recovered.drainApply(); expected != got {
+		t.Errorf("recovered: expected %d drained, got %d", expected, got)
+	}
+	if expected, got := "[3 4]", fmt.Sprint(applied); expected != got {
+		t.Errorf("recovered: expected %s applied, got %s", expected, got)
+	}
+}
+
+func TestLogApplyGap(t *testing.T) {
+	var applied []uint64
+	apply := func(index uint64, _ []byte) []byte {
+		applied = append(applied, index)
+		return []byte{}
+	}
+
+	// a state machine restored through index 10, and a log installed from a
+	// snapshot which compacted through 11, so it's missing entry 11
+	log, err := recoverRaftLog(&InMemoryStore{}, apply, logOptions{appliedIndex: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.compactedIndex, log.compactedTerm = 11, 1
+	if err := log.appendEntry(logEntry{Index: 12, Term: 1, Command: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the entry after the gap is caught, not applied
+	err = func() (err error) {
+		defer func() { err, _ = recover().(error) }()
+		return log.commitTo(12)
+	}()
+	if !errors.Is(err, errApplyGap) {
+		t.Errorf("expected %v, got %v", errApplyGap, err)
+	}
+	if len(applied) > 0 {
+		t.Errorf("expected nothing applied, got %v", applied)
+	}
+}
+
+func TestLogEncodeDecodeLargeCommand(t *testing.T) {
+	e := logEntry{Index: 1, Term: 1, Command: bytes.Repeat([]byte{'x'}, 8<<20)}
+
+	// encoding writes the command straight from the entry
+	if allocs := testing.AllocsPerRun(10, func() {
+		if err := e.encode(ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}); allocs > 1 {
+		t.Errorf("encode: %.0f allocs per run", allocs)
+	}
+
+	// decoding reads it straight into the decoded entry
+	b := &bytes.Buffer{}
+	if err := e.encode(b); err != nil {
+		t.Fatal(err)
+	}
+	encoded := b.Bytes()
+	var e0 logEntry
+	if allocs := testing.AllocsPerRun(10, func() {
+		if err := e0.decode(bytes.NewReader(encoded)); err != nil {
+			t.Fatal(err)
+		}
+	}); allocs > 3 {
+		t.Errorf("decode: %.0f allocs per run", allocs)
+	}
+	if !bytes.Equal(e.Command, e0.Command) {
+		t.Errorf("command didn't round-trip")
+	}
+
+	// but it won't allocate for a size that's too big
+	binary.LittleEndian.PutUint32(encoded[54:58], maxCommandSize+1)
+	if expected, got := errCommandTooBig, e0.decode(bytes.NewReader(encoded)); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestLogEncodePooledHeaders(t *testing.T) {
+	// an entry, and a commit record, encode without allocating, since their
+	// headers are encoded into pooled buffers
+	e := logEntry{Index: 1, Term: 1, Command: []byte(`{}`)}
+	if allocs := testing.AllocsPerRun(100, func() {
+		if err := e.encode(ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}); allocs > 0 {
+		t.Errorf("encode: %.0f allocs per run", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		if _, err := encodeCommitRecord(ioutil.Discard, 1, headerBuffers{}); err != nil {
+			t.Fatal(err)
+		}
+	}); allocs > 0 {
+		t.Errorf("encodeCommitRecord: %.0f allocs per run", allocs)
+	}
+
+	// unless pooling is disabled, when each header is allocated afresh
+	unpooled := headerBuffers{unpooled: true}
+	if allocs := testing.AllocsPerRun(100, func() {
+		if _, err := e.encodeAs(ioutil.Discard, logVersion, compression{}, unpooled); err != nil {
+			t.Fatal(err)
+		}
+	}); allocs != 1 {
+		t.Errorf("unpooled encode: %.0f allocs per run, expected 1", allocs)
+	}
+	if server := NewServer(1, &bytes.Buffer{}, noop, WithEncodeBufferPooling(false)); !server.log.headers.unpooled {
+		t.Errorf("WithEncodeBufferPooling(false) didn't disable pooling")
+	}
+
+	// and a buffer's reuse leaves no trace of the header it held before, in
+	// any format
+	full := logEntry{Index: math.MaxUint64, Term: math.MaxUint64, Command: []byte(`{}`), Kind: kindMetadata, Expires: -1}
+	for i := range full.PrevHash {
+		full.PrevHash[i] = 0xff
+	}
+	for _, version := range []byte{1, 4, logVersion} {
+		expected, got := &bytes.Buffer{}, &bytes.Buffer{}
+		if _, err := e.encodeAs(expected, version, compression{}, headerBuffers{}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			full.encode(ioutil.Discard)
+		}
+		if _, err := e.encodeAs(got, version, compression{}, headerBuffers{}); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected.Bytes(), got.Bytes()) {
+			t.Errorf("version %d: expected %x, got %x", version, expected.Bytes(), got.Bytes())
+		}
+	}
+}
+
 func TestLogAppend(t *testing.T) {
 	c := []byte(`{}`)
 	buf := &bytes.Buffer{}
 	log := newRaftLog(buf, noop)
 
 	// Append 3 valid LogEntries
-	if err := log.appendEntry(logEntry{1, 1, c, nil, oneshot(), false}); err != nil {
+	if err := log.appendEntry(logEntry{Index: 1, Term: 1, Command: c, commandResponse: oneshot()}); err != nil {
 		t.Errorf("Append: %s", err)
 	}
-	if err := log.appendEntry(logEntry{2, 1, c, nil, oneshot(), false}); err != nil {
+	if err := log.appendEntry(logEntry{Index: 2, Term: 1, Command: c, commandResponse: oneshot()}); err != nil {
 		t.Errorf("Append: %s", err)
 	}
-	if err := log.appendEntry(logEntry{3, 2, c, nil, oneshot(), false}); err != nil {
+	if err := log.appendEntry(logEntry{Index: 3, Term: 2, Command: c, commandResponse: oneshot()}); err != nil {
 		t.Errorf("Append: %s", err)
 	}
 
 	// Append some invalid LogEntries
-	if err := log.appendEntry(logEntry{4, 1, c, nil, oneshot(), false}); err != errTermTooSmall {
+	if err := log.appendEntry(logEntry{Index: 4, Term: 1, Command: c, commandResponse: oneshot()}); !errors.Is(err, ErrTermTooSmall) {
 		t.Errorf("Append: expected ErrTermTooSmall, got %v", err)
 	}
-	if err := log.appendEntry(logEntry{2, 2, c, nil, oneshot(), false}); err != errIndexTooSmall {
+	if err := log.appendEntry(logEntry{Index: 2, Term: 2, Command: c, commandResponse: oneshot()}); !errors.Is(err, ErrIndexTooSmall) {
 		t.Errorf("Append: expected ErrIndexTooSmall, got %v", nil)
 	}
 
@@ -152,7 +841,10 @@ func TestLogAppend(t *testing.T) {
 		t.Fatalf("commitTo: %s", err)
 	}
 
-	// Check our flush buffer
+	// Check our flush buffer, which should begin with the store header
+	if version, _, err := decodeLogHeader(buf); err != nil || version != logVersion {
+		t.Fatalf("after commit, got version %d: %v", version, err)
+	}
 	for i, expected := range log.entries[:2] {
 		var got logEntry
 		if err := got.decode(buf); err != nil {
@@ -173,10 +865,10 @@ func TestLogAppend(t *testing.T) {
 	}
 
 	// Make some invalid commits
-	if err := log.commitTo(1); err != errIndexTooSmall {
+	if err := log.commitTo(1); !errors.Is(err, ErrIndexTooSmall) {
 		t.Errorf("Commit: expected ErrIndexTooSmall, got %v", err)
 	}
-	if err := log.commitTo(4); err != errIndexTooBig {
+	if err := log.commitTo(4); !errors.Is(err, ErrIndexTooBig) {
 		t.Errorf("Commit: expected ErrIndexTooBig, got %v", err)
 	}
 
@@ -205,20 +897,138 @@ func TestLogAppend(t *testing.T) {
 	}
 }
 
-func TestLogContains(t *testing.T) {
-	c := []byte(`{}`)
-	buf := &bytes.Buffer{}
-	log := newRaftLog(buf, noop)
+func TestLogAppendBatch(t *testing.T) {
+	entries := []logEntry{}
+	for index := uint64(1); index <= 100; index++ {
+		entries = append(entries, logEntry{Index: index, Term: 1 + index/30, Command: []byte(fmt.Sprint(index))})
+	}
 
-	for _, tuple := range []struct {
-		Index uint64
+	// a batch appended at once
+	batched := newRaftLog(&InMemoryStore{}, noop)
+	if err := batched.appendEntries(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	// matches the same entries appended one at a time
+	single := newRaftLog(&InMemoryStore{}, noop)
+	for _, entry := range entries {
+		if err := single.appendEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected, got := len(single.entries), len(batched.entries); expected != got {
+		t.Fatalf("expected %d entries, got %d", expected, got)
+	}
+	for i := range single.entries {
+		expected, got := single.entries[i], batched.entries[i]
+		if expected.Index != got.Index || expected.Term != got.Term || !bytes.Equal(expected.Command, got.Command) || expected.PrevHash != got.PrevHash {
+			t.Fatalf("entry %d: expected %+v, got %+v", i, expected, got)
+		}
+	}
+	if expected, got := single.entryBytes, batched.entryBytes; expected != got {
+		t.Errorf("expected %d bytes, got %d", expected, got)
+	}
+
+	// and commits to the same store
+	for _, l := range []*raftLog{single, batched} {
+		if err := l.commitTo(100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(single.store.(*InMemoryStore).Bytes(), batched.store.(*InMemoryStore).Bytes()) {
+		t.Errorf("expected the same store")
+	}
+
+	// but a batch with an invalid entry anywhere isn't appended at all
+	for _, invalid := range [][]logEntry{
+		{{Index: 101, Term: 4}, {Index: 102, Term: 3}},                        // term goes backwards
+		{{Index: 101, Term: 4}, {Index: 102, Term: 4}, {Index: 102, Term: 4}}, // index repeats
+		{{Index: 100, Term: 4}, {Index: 50, Term: 4}},                         // index goes backwards
+	} {
+		if err := batched.appendEntries(invalid); err == nil {
+			t.Errorf("%+v: expected an error", invalid)
+		}
+		if expected, got := uint64(100), batched.lastIndex(); expected != got {
+			t.Errorf("%+v: expected last index %d, got %d", invalid, expected, got)
+		}
+	}
+}
+
+func TestLogAppendBatchAllOrNothing(t *testing.T) {
+	// a log with entries 1-3, committed
+	store := &InMemoryStore{}
+	log := newRaftLog(store, noop)
+	for index := uint64(1); index <= 3; index++ {
+		if err := log.appendEntry(logEntry{Index: index, Term: 1, Command: []byte(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.commitTo(3); err != nil {
+		t.Fatal(err)
+	}
+	size, entryBytes := store.Len(), log.entryBytes
+
+	// appends none of a batch whose third entry is invalid
+	for _, tu := range []struct {
+		third    logEntry
+		expected error
+	}{
+		{logEntry{Index: 6, Term: 1, Command: []byte(`{}`)}, ErrTermTooSmall},
+		{logEntry{Index: 5, Term: 2, Command: []byte(`{}`)}, ErrIndexTooSmall},
+		{logEntry{Index: 6, Command: []byte(`{}`)}, ErrBadTerm},
+		{logEntry{Index: 6, Term: 2, Command: make([]byte, maxCommandSize+1)}, errCommandTooBig},
+	} {
+		batch := []logEntry{
+			{Index: 4, Term: 2, Command: []byte(`{}`)},
+			{Index: 5, Term: 2, Command: []byte(`{}`)},
+			tu.third,
+		}
+		if err := log.appendEntries(batch); !errors.Is(err, tu.expected) {
+			t.Errorf("expected %v, got %v", tu.expected, err)
+		}
+		if expected, got := uint64(3), log.lastIndex(); expected != got {
+			t.Errorf("%v: expected last index %d, got %d", tu.expected, expected, got)
+		}
+		if expected, got := entryBytes, log.entryBytes; expected != got {
+			t.Errorf("%v: expected %d bytes of entries, got %d", tu.expected, expected, got)
+		}
+	}
+
+	// so there's nothing more to commit, or to write to the store
+	if err := log.commitTo(4); !errors.Is(err, ErrIndexTooBig) {
+		t.Errorf("expected %v, got %v", ErrIndexTooBig, err)
+	}
+	if expected, got := size, store.Len(); expected != got {
+		t.Errorf("expected %d bytes in the store, got %d", expected, got)
+	}
+
+	// but the batch is appended whole once it's valid
+	if err := log.appendEntries([]logEntry{
+		{Index: 4, Term: 2, Command: []byte(`{}`)},
+		{Index: 5, Term: 2, Command: []byte(`{}`)},
+		{Index: 6, Term: 2, Command: []byte(`{}`)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(6), log.lastIndex(); expected != got {
+		t.Errorf("expected last index %d, got %d", expected, got)
+	}
+}
+
+func TestLogContains(t *testing.T) {
+	c := []byte(`{}`)
+	buf := &bytes.Buffer{}
+	log := newRaftLog(buf, noop)
+
+	for _, tuple := range []struct {
+		Index uint64
 		Term  uint64
 	}{
 		{1, 1},
 		{2, 1},
 		{3, 2},
 	} {
-		e := logEntry{tuple.Index, tuple.Term, c, nil, oneshot(), false}
+		e := logEntry{Index: tuple.Index, Term: tuple.Term, Command: c, commandResponse: oneshot()}
 		if err := log.appendEntry(e); err != nil {
 			t.Fatalf("appendEntry(%v): %s", e, err)
 		}
@@ -249,6 +1059,143 @@ func TestLogContains(t *testing.T) {
 	}
 }
 
+func TestLogTerm(t *testing.T) {
+	// a log with entries 1-5 from term 1, and 6-8 from term 2
+	log := newRaftLog(&bytes.Buffer{}, noop)
+	for index := uint64(1); index <= 8; index++ {
+		term := uint64(1)
+		if index > 5 {
+			term = 2
+		}
+		log.appendEntry(logEntry{Index: index, Term: term, Command: []byte(`{}`)})
+	}
+	check := func(index, expected uint64, expectedErr error) {
+		t.Helper()
+		got, err := log.term(index)
+		if !errors.Is(err, expectedErr) || (err != nil) != (expectedErr != nil) {
+			t.Errorf("term(%d): expected error %v, got %v", index, expectedErr, err)
+		} else if got != expected {
+			t.Errorf("term(%d): expected %d, got %d", index, expected, got)
+		}
+	}
+
+	// knows the term of every entry, and of index 0
+	for index, expected := range []uint64{0, 1, 1, 1, 1, 1, 2, 2, 2} {
+		check(uint64(index), expected, nil)
+	}
+	check(9, 0, ErrIndexTooBig)
+
+	// and, once compacted through 6, the snapshot's, but no earlier
+	log.commitTo(6)
+	if err := log.compactTo(6, func(uint64, uint64, []byte) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	check(0, 0, ErrIndexTooSmall)
+	check(5, 0, ErrIndexTooSmall)
+	check(6, 2, nil)
+	check(7, 2, nil)
+	check(8, 2, nil)
+	check(9, 0, ErrIndexTooBig)
+}
+
+func TestLogDivergence(t *testing.T) {
+	// two logs which agree through index 4, then diverge: one with entries
+	// from term 2, the other with a different command in term 1
+	build := func(entries ...logEntry) *raftLog {
+		log := newRaftLog(&bytes.Buffer{}, noop)
+		for _, entry := range entries {
+			if err := log.appendEntry(entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return log
+	}
+	common := []logEntry{}
+	for index := uint64(1); index <= 4; index++ {
+		common = append(common, logEntry{Index: index, Term: 1, Command: []byte(`{}`)})
+	}
+	a := build(append(common,
+		logEntry{Index: 5, Term: 2, Command: []byte(`{"a":5}`)},
+		logEntry{Index: 6, Term: 2, Command: []byte(`{"a":6}`)},
+	)...)
+	b := build(append(common,
+		logEntry{Index: 5, Term: 1, Command: []byte(`{"b":5}`)},
+	)...)
+	c := build(append(common,
+		logEntry{Index: 5, Term: 1, Command: []byte(`{"c":5}`)},
+	)...)
+
+	// they diverge at 5, whichever way round, by term or by command alone
+	for _, tu := range []struct {
+		x, y     *raftLog
+		expected uint64
+	}{
+		{a, b, 5},
+		{b, a, 5},
+		{b, c, 5},
+		{a, a, 0},
+		{a, build(common...), 0}, // a prefix doesn't diverge
+		{a, build(), 0},
+	} {
+		if got := divergence(tu.x, tu.y); got != tu.expected {
+			t.Errorf("expected divergence at %d, got %d", tu.expected, got)
+		}
+	}
+
+	// and, once one is compacted past the divergence, they agree on what's left
+	b.commitTo(5)
+	if err := b.compactTo(5, func(uint64, uint64, []byte) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if got := divergence(a, b); got != 0 {
+		t.Errorf("expected no divergence, got %d", got)
+	}
+}
+
+func TestLogIsCommitted(t *testing.T) {
+	log := newRaftLog(&InMemoryStore{}, noop)
+	for index := uint64(1); index <= 5; index++ {
+		if err := log.appendEntry(logEntry{Index: index, Term: 1, Command: []byte(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.commitTo(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.compactTo(1, func(uint64, uint64, []byte) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tuple := range []struct {
+		Index     uint64
+		Present   bool
+		Committed bool
+	}{
+		{0, false, false},
+		{1, false, true}, // compacted
+		{2, true, true},
+		{3, true, true},
+		{4, true, false}, // appended, but not committed
+		{5, true, false},
+		{6, false, false},
+	} {
+		if got := log.contains(tuple.Index, 1); tuple.Present != got {
+			t.Errorf("contains(%d, 1): expected %v, got %v", tuple.Index, tuple.Present, got)
+		}
+		if got := log.isCommitted(tuple.Index); tuple.Committed != got {
+			t.Errorf("isCommitted(%d): expected %v, got %v", tuple.Index, tuple.Committed, got)
+		}
+	}
+
+	// until it is
+	if err := log.commitTo(4); err != nil {
+		t.Fatal(err)
+	}
+	if !log.isCommitted(4) {
+		t.Errorf("isCommitted(4): expected true after commit")
+	}
+}
+
 func TestLogTruncation(t *testing.T) {
 	c := []byte(`{}`)
 	buf := &bytes.Buffer{}
@@ -262,7 +1209,7 @@ func TestLogTruncation(t *testing.T) {
 		{2, 1},
 		{3, 2},
 	} {
-		e := logEntry{tuple.Index, tuple.Term, c, nil, oneshot(), false}
+		e := logEntry{Index: tuple.Index, Term: tuple.Term, Command: c, commandResponse: oneshot()}
 		if err := log.appendEntry(e); err != nil {
 			t.Fatalf("appendEntry(%v): %s", e, err)
 		}
@@ -272,13 +1219,13 @@ func TestLogTruncation(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if expected, got := errIndexTooBig, log.ensureLastIs(4, 3); expected != got {
+	if expected, got := ErrIndexTooBig, log.ensureLastIs(4, 3); !errors.Is(got, expected) {
 		t.Errorf("expected %s, got %v", expected, got)
 	}
-	if expected, got := errIndexTooSmall, log.ensureLastIs(1, 1); expected != got {
+	if expected, got := ErrIndexTooSmall, log.ensureLastIs(1, 1); !errors.Is(got, expected) {
 		t.Errorf("expected %s, got %v", expected, got) // before commitIndex
 	}
-	if expected, got := errBadTerm, log.ensureLastIs(3, 4); expected != got {
+	if expected, got := ErrBadTerm, log.ensureLastIs(3, 4); !errors.Is(got, expected) {
 		t.Errorf("expected %s, got %v", expected, got)
 	}
 
@@ -296,6 +1243,166 @@ func TestLogTruncation(t *testing.T) {
 	}
 }
 
+func TestLogBulkTruncate(t *testing.T) {
+	// a durable log, with 3 committed entries, and 7 persisted after them,
+	// whose clients are waiting
+	store := &truncateCountingStore{InMemoryStore: &InMemoryStore{}}
+	l, _ := recoverRaftLog(store, noop, logOptions{durable: true})
+	responses := []chan []byte{}
+	for index := uint64(1); index <= 10; index++ {
+		response := make(chan []byte, 1)
+		responses = append(responses, response)
+		l.appendEntry(logEntry{Index: index, Term: 1, Command: []byte(`{}`), commandResponse: response})
+	}
+	if err := l.commitTo(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	// can't discard committed entries
+	if err := l.bulkTruncate(3); !errors.Is(err, ErrIndexTooSmall) {
+		t.Errorf("expected %v, got %v", ErrIndexTooSmall, err)
+	}
+
+	// nor anything after its last entry, which is nothing to do
+	truncates := store.truncates
+	if err := l.bulkTruncate(11); err != nil {
+		t.Fatal(err)
+	}
+	if store.truncates != truncates {
+		t.Errorf("expected no truncation, got %d", store.truncates-truncates)
+	}
+
+	// but discards the rest, with a single truncation of the store
+	if err := l.bulkTruncate(5); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 1, store.truncates-truncates; expected != got {
+		t.Errorf("expected %d truncation, got %d", expected, got)
+	}
+	if expected, got := uint64(4), l.lastIndex(); expected != got {
+		t.Errorf("expected last index %d, got %d", expected, got)
+	}
+	for i, response := range responses[4:] {
+		if _, ok := <-response; ok {
+			t.Errorf("%d: expected the response closed", i+5)
+		}
+	}
+
+	// and recovers without them
+	recovered, err := recoverRaftLog(store.Reopen(), noop, logOptions{durable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "3/4", fmt.Sprintf("%d/%d", recovered.getCommitIndex(), recovered.lastIndex()); expected != got {
+		t.Errorf("expected commit/last index %s, got %s", expected, got)
+	}
+}
+
+func TestLogTruncationTellsWaiters(t *testing.T) {
+	// a log with a committed entry, and two uncommitted, each with a waiter,
+	// the last of which has already been told its command was lost
+	log := newRaftLog(&bytes.Buffer{}, noop)
+	var (
+		responses = []chan []byte{}
+		lost      = []chan error{}
+	)
+	for index := uint64(1); index <= 3; index++ {
+		responses = append(responses, make(chan []byte, 1))
+		lost = append(lost, make(chan error, 1))
+		entry := logEntry{Index: index, Term: 1, Command: []byte(`{}`), commandResponse: responses[index-1], lost: lost[index-1]}
+		if err := log.appendEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.commitTo(1); err != nil {
+		t.Fatal(err)
+	}
+	lost[2] <- ErrLeadershipLost
+
+	// which are truncated
+	if err := log.ensureLastIs(1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// so the waiter for the first is told why, and its response chan closed
+	select {
+	case err := <-lost[1]:
+		if err != ErrEntryTruncated {
+			t.Errorf("expected %v, got %v", ErrEntryTruncated, err)
+		}
+	default:
+		t.Errorf("expected %v, got nothing", ErrEntryTruncated)
+	}
+	if _, ok := <-responses[1]; ok {
+		t.Errorf("expected the response chan closed")
+	}
+
+	// but not the one that was already told
+	if expected, got := ErrLeadershipLost, <-lost[2]; expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if _, ok := <-responses[2]; ok {
+		t.Errorf("expected the response chan closed")
+	}
+
+	// nor the committed one, which got its response
+	if len(lost[0]) != 0 {
+		t.Errorf("expected nothing lost, got %v", <-lost[0])
+	}
+	if _, ok := <-responses[0]; !ok {
+		t.Errorf("expected a response")
+	}
+}
+
+// truncateCountingStore counts the truncations of its store.
+type truncateCountingStore struct {
+	*InMemoryStore
+	truncates int
+}
+
+func (s *truncateCountingStore) Truncate(size int64) error {
+	s.truncates++
+	return s.InMemoryStore.Truncate(size)
+}
+
+func TestLogError(t *testing.T) {
+	// a log with entries through index 3, committed through 2
+	log := newRaftLog(&bytes.Buffer{}, noop)
+	for _, entry := range []logEntry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 2}} {
+		if err := log.appendEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.commitTo(2); err != nil {
+		t.Fatal(err)
+	}
+
+	// rejects a commit past its last entry, saying so, and why
+	err := log.commitTo(5)
+	if !errors.Is(err, ErrIndexTooBig) || errors.Is(err, ErrIndexTooSmall) {
+		t.Fatalf("expected %v, got %v", ErrIndexTooBig, err)
+	}
+	var logErr *LogError
+	if !errors.As(err, &logErr) {
+		t.Fatalf("expected a LogError, got %T", err)
+	}
+	if expected, got := (LogError{Err: ErrIndexTooBig, Index: 5, LastIndex: 3, LastTerm: 2, CommitIndex: 2}), *logErr; expected != got {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+
+	// and an entry out of order, even wrapped
+	err = fmt.Errorf("appending: %w", log.appendEntry(logEntry{Index: 4, Term: 1}))
+	if !errors.Is(err, ErrTermTooSmall) || !errors.As(err, &logErr) {
+		t.Fatalf("expected %v, got %v", ErrTermTooSmall, err)
+	}
+	if logErr.Index != 4 || logErr.Term != 1 {
+		t.Errorf("expected index 4, term 1, got index %d, term %d", logErr.Index, logErr.Term)
+	}
+}
+
 func TestLogCommitNoDuplicate(t *testing.T) {
 	// A pathological case: serial commitTo may double-apply the first command
 	hits := 0
@@ -339,16 +1446,18 @@ func TestLogCommitTwice(t *testing.T) {
 
 func TestCleanLogRecovery(t *testing.T) {
 	entries := []logEntry{
-		{1, 1, []byte("{}"), nil, nil, false},
-		{2, 1, []byte("{}"), nil, nil, false},
-		{3, 2, []byte("{}"), nil, nil, false},
+		{Index: 1, Term: 1, Command: []byte("{}")},
+		{Index: 2, Term: 1, Command: []byte("{}")},
+		{Index: 3, Term: 2, Command: []byte("{}")},
 	}
+	chain(entries)
 
-	buf := new(bytes.Buffer)
+	store := &InMemoryStore{}
+	encodeLogHeader(store)
 	for _, entry := range entries {
-		entry.encode(buf)
+		entry.encode(store)
 	}
-	log := newRaftLog(buf, noop)
+	log := newRaftLog(store, noop)
 
 	if expected, got := len(entries), len(log.entries); expected != got {
 		t.Fatalf("expected %d, got %d", expected, got)
@@ -372,10 +1481,11 @@ func TestCleanLogRecovery(t *testing.T) {
 		t.Errorf("expected term = %d, got %d", expected, got)
 	}
 
+	size := store.Len()
 	log.commitTo(3) // should be a no-op
 
-	if buf.Len() > 0 {
-		t.Errorf("commit to recovered index wrote to buffer")
+	if store.Len() > size {
+		t.Errorf("commit to recovered index wrote to store")
 	}
 
 	if err := log.appendEntry(logEntry{
@@ -395,15 +1505,21 @@ func TestCleanLogRecovery(t *testing.T) {
 
 func TestCorruptedLogRecovery(t *testing.T) {
 	entries := []logEntry{
-		{1, 1, []byte("{}"), nil, nil, false},
+		{Index: 1, Term: 1, Command: []byte("{}")},
 	}
 
-	buf := &bytes.Buffer{}
+	store := &InMemoryStore{}
+	encodeLogHeader(store)
 	for _, entry := range entries {
-		entry.encode(buf)
+		entry.encode(store)
+	}
+	size := store.Len()
+	store.Write(append([]byte{logVersion}, "garbage"...))
+	log := newRaftLog(store, noop)
+
+	if expected, got := size, store.Len(); expected != got {
+		t.Errorf("expected the garbage trimmed from the store, leaving %d bytes, got %d", expected, got)
 	}
-	buf.Write([]byte("garbage"))
-	log := newRaftLog(buf, noop)
 
 	if expected, got := len(entries), len(log.entries); expected != got {
 		t.Fatalf("expected %d, got %d", expected, got)
@@ -433,3 +1549,761 @@ func TestCorruptedLogRecovery(t *testing.T) {
 		t.Errorf("log doesn't contain index=4 term=3")
 	}
 }
+
+func TestCommitDoesntBlockOnUnreceivedResponse(t *testing.T) {
+	for _, policy := range []ResponsePolicy{DeliverResponsesAsync, DropResponses} {
+		log := newRaftLog(&bytes.Buffer{}, noop)
+		log.responses = policy
+
+		// an unbuffered channel, which nobody is receiving from (yet)
+		response := make(chan []byte)
+		log.appendEntry(logEntry{Index: 1, Term: 1, Command: []byte(`{}`), commandResponse: response})
+
+		committed := make(chan error)
+		go func() { committed <- log.commitTo(1) }()
+		select {
+		case err := <-committed:
+			if err != nil {
+				t.Fatalf("policy %d: %s", policy, err)
+			}
+		case <-time.After(minimumElectionTimeout()):
+			t.Fatalf("policy %d: commit blocked on the response channel", policy)
+		}
+
+		// a late receiver still gets the response, unless it was dropped
+		_, ok := <-response
+		if expected, got := policy == DeliverResponsesAsync, ok; expected != got {
+			t.Errorf("policy %d: expected response delivered %v, got %v", policy, expected, got)
+		}
+	}
+}
+
+func TestCommandMetaDefault(t *testing.T) {
+	applied := 0
+	log := newRaftLog(&bytes.Buffer{}, func(uint64, []byte) []byte { applied++; return []byte{} })
+
+	// by default, identical commands are all applied
+	for i := uint64(1); i <= 3; i++ {
+		log.appendEntry(logEntry{Index: i, Term: 1, Command: []byte(`same`)})
+	}
+	log.commitTo(3)
+	if expected, got := 3, applied; expected != got {
+		t.Errorf("expected %d applied, got %d", expected, got)
+	}
+}
+
+func TestCommandMetaDedup(t *testing.T) {
+	// commands are "client seq"
+	meta := func(cmd []byte) (string, uint64, uint64) {
+		var client, seq uint64
+		fmt.Sscanf(string(cmd), "%d %d", &client, &seq)
+		return "", client, seq
+	}
+	applied := []string{}
+	apply := func(index uint64, cmd []byte) []byte {
+		applied = append(applied, string(cmd))
+		return []byte(fmt.Sprintf("response to %s", cmd))
+	}
+
+	store := &InMemoryStore{}
+	log, _ := recoverRaftLog(store, apply, logOptions{meta: meta})
+	responses := []chan []byte{}
+	for i, cmd := range []string{"1 1", "1 2", "1 2", "1 1", "2 1"} {
+		response := make(chan []byte, 1)
+		responses = append(responses, response)
+		log.appendEntry(logEntry{Index: uint64(i + 1), Term: 1, Command: []byte(cmd), commandResponse: response})
+	}
+	log.commitTo(5)
+
+	// retries aren't applied again
+	if expected, got := "[1 1 1 2 2 1]", fmt.Sprint(applied); expected != got {
+		t.Errorf("expected applied %s, got %s", expected, got)
+	}
+
+	// and a retry of the latest command gets the original response
+	if expected, got := "response to 1 2", string(<-responses[2]); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	// while a retry of an older one gets none
+	if resp, ok := <-responses[3]; ok {
+		t.Errorf("expected no response to a stale retry, got %q", resp)
+	}
+
+	// recovery makes the same decisions
+	applied = applied[:0]
+	recoverRaftLog(store.Reopen(), apply, logOptions{meta: meta})
+	if expected, got := "[1 1 1 2 2 1]", fmt.Sprint(applied); expected != got {
+		t.Errorf("on recovery, expected applied %s, got %s", expected, got)
+	}
+}
+
+func TestHashChainTamperDetection(t *testing.T) {
+	store := &InMemoryStore{}
+	log := newRaftLog(store, noop)
+	for i := uint64(1); i <= 3; i++ {
+		if err := log.appendEntry(logEntry{Index: i, Term: 1, Command: []byte(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.commitTo(3); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite the middle entry's command, and fix up its CRC, so the entry
+	// itself still looks valid. Each entry is a header, plus 2 bytes of
+	// command.
+	b := store.Bytes()
+	size := entryHeaderSize + 2
+	entry2 := b[logHeaderSize+size : logHeaderSize+2*size]
+	copy(entry2[entryHeaderSize:], `[]`)
+	binary.LittleEndian.PutUint32(entry2[1:5], entryChecksum(entry2[:entryHeaderSize], 1, entry2[entryHeaderSize:]))
+	tampered := &InMemoryStore{}
+	tampered.Write(b)
+
+	applied := []uint64{}
+	recovered, err := recoverRaftLog(tampered, func(index uint64, cmd []byte) []byte {
+		applied = append(applied, index)
+		return []byte{}
+	}, logOptions{})
+	if expected, got := errBrokenHashChain, err; expected != got {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	// The break is between entries 2 and 3, and either could be the one
+	// that was modified, so the log should be truncated after entry 1.
+	if expected, got := uint64(1), recovered.lastIndex(); expected != got {
+		t.Errorf("expected last index %d, got %d", expected, got)
+	}
+	if expected, got := "[1]", fmt.Sprint(applied); expected != got {
+		t.Errorf("expected applied %s, got %s", expected, got)
+	}
+
+	// and so should the store, so that new entries don't follow the break
+	if expected, got := logHeaderSize+size, tampered.Len(); expected != got {
+		t.Errorf("expected the store truncated to %d bytes, got %d", expected, got)
+	}
+}
+
+func TestLogRecoveryRejectsZeroIndexOrTerm(t *testing.T) {
+	for _, tu := range []struct {
+		field    string
+		at       int // offset in the header
+		expected error
+	}{
+		{"index", 13, ErrBadIndex},
+		{"term", 5, ErrBadTerm},
+	} {
+		store := &InMemoryStore{}
+		log := newRaftLog(store, noop)
+		for i := uint64(1); i <= 4; i++ {
+			if err := log.appendEntry(logEntry{Index: i, Term: 1, Command: []byte(`{}`)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := log.commitTo(4); err != nil {
+			t.Fatal(err)
+		}
+
+		// Zero the third entry's field, and fix up its CRC, so the entry
+		// itself still looks valid. Each entry is a header, plus 2 bytes of
+		// command.
+		b := store.Bytes()
+		size := entryHeaderSize + 2
+		entry3 := b[logHeaderSize+2*size : logHeaderSize+3*size]
+		binary.LittleEndian.PutUint64(entry3[tu.at:tu.at+8], 0)
+		binary.LittleEndian.PutUint32(entry3[1:5], entryChecksum(entry3[:entryHeaderSize], 1, entry3[entryHeaderSize:]))
+		corrupt := &InMemoryStore{}
+		corrupt.Write(b)
+
+		// recovery stops before it, and truncates the store there
+		applied := []uint64{}
+		recovered, err := recoverRaftLog(corrupt, func(index uint64, cmd []byte) []byte {
+			applied = append(applied, index)
+			return []byte{}
+		}, logOptions{})
+		if expected, got := tu.expected, err; expected != got {
+			t.Errorf("zero %s: expected %v, got %v", tu.field, expected, got)
+		}
+		if expected, got := uint64(2), recovered.lastIndex(); expected != got {
+			t.Errorf("zero %s: expected last index %d, got %d", tu.field, expected, got)
+		}
+		if expected, got := "[1 2]", fmt.Sprint(applied); expected != got {
+			t.Errorf("zero %s: expected applied %s, got %s", tu.field, expected, got)
+		}
+		if expected, got := logHeaderSize+2*size, corrupt.Len(); expected != got {
+			t.Errorf("zero %s: expected the store truncated to %d bytes, got %d", tu.field, expected, got)
+		}
+	}
+}
+
+func TestLogRecoveryRejectsUnknownFormats(t *testing.T) {
+	// a store with no header, and not even a whole entry in the original,
+	// headerless format
+	old := &InMemoryStore{}
+	old.Write([]byte{0x2a, 0x2a, 0x2a, 0x2a, 1, 0, 0, 0, 0, 0, 0, 0})
+
+	// one from a later version
+	future := &InMemoryStore{}
+	future.Write(append([]byte(logMagic), logVersion+1))
+
+	// and one in the current version, but whose second entry is from a later
+	// one
+	mixed := &InMemoryStore{}
+	l := newRaftLog(mixed, noop)
+	l.appendEntry(logEntry{Index: 1, Term: 1, Command: []byte(`{}`)})
+	l.commitTo(1)
+	mixed.Write([]byte{logVersion + 1, 0, 0, 0, 0})
+
+	for _, store := range []*InMemoryStore{old, future, mixed} {
+		size := store.Len()
+		log, err := recoverRaftLog(store, noop, logOptions{})
+		if err == nil {
+			t.Errorf("expected an error recovering %x", store.Bytes())
+			continue
+		}
+
+		// nothing is written to such a store
+		index := log.lastIndex() + 1
+		log.appendEntry(logEntry{Index: index, Term: 1, Command: []byte(`{}`)})
+		if log.commitTo(index) == nil {
+			t.Errorf("expected commit to %x to fail", store.Bytes())
+		}
+		if expected, got := size, store.Len(); expected != got {
+			t.Errorf("expected the store left at %d bytes, got %d", expected, got)
+		}
+	}
+}
+
+func TestLogRecoversOlderFormats(t *testing.T) {
+	gob.Register(acceptingPeer{})
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(makePeerMap(acceptingPeer{1}, acceptingPeer{2})); err != nil {
+		t.Fatal(err)
+	}
+	configuration := buf.Bytes()
+
+	// synthetic stores in each older format, holding a configuration and two
+	// commands, encoded by hand
+	v1 := &InMemoryStore{}
+	v2 := &InMemoryStore{}
+	v2.Write(append([]byte(logMagic), 2))
+	v4 := &InMemoryStore{}
+	v4.Write(append([]byte(logMagic), 4))
+	var prevHash [sha256.Size]byte
+	for i, cmd := range [][]byte{configuration, []byte(`{"a":1}`), []byte(`{"b":2}`)} {
+		index, term := uint64(i+1), uint64(1)
+		kind := kindCommand
+		if i == 0 {
+			kind = kindConfiguration
+		}
+
+		header := make([]byte, 24) // CRC TERM INDEX SIZE
+		binary.LittleEndian.PutUint64(header[4:12], term)
+		binary.LittleEndian.PutUint64(header[12:20], index)
+		binary.LittleEndian.PutUint32(header[20:24], uint32(len(cmd)))
+		binary.LittleEndian.PutUint32(header[0:4], crc32.ChecksumIEEE(append(header[4:], cmd...)))
+		v1.Write(append(header, cmd...))
+
+		header = make([]byte, 57) // CRC TERM INDEX PREVHASH KIND SIZE
+		binary.LittleEndian.PutUint64(header[4:12], term)
+		binary.LittleEndian.PutUint64(header[12:20], index)
+		copy(header[20:52], prevHash[:])
+		header[52] = byte(kind)
+		binary.LittleEndian.PutUint32(header[53:57], uint32(len(cmd)))
+		binary.LittleEndian.PutUint32(header[0:4], crc32.ChecksumIEEE(append(header[4:], cmd...)))
+		v2.Write(append(header, cmd...))
+
+		e := logEntry{Index: index, Term: term, Command: cmd, PrevHash: prevHash, Kind: kind}
+		if _, err := e.encodeAs(v4, 4, compression{}, headerBuffers{}); err != nil {
+			t.Fatal(err)
+		}
+		prevHash = e.hash()
+	}
+
+	for _, store := range []*InMemoryStore{v1, v2, v4} {
+		version := store.Bytes()[len(logMagic)]
+		if store == v1 {
+			version = 1
+		}
+
+		// are recovered by the current version, configuration and all
+		applied := []string{}
+		apply := func(index uint64, cmd []byte) []byte {
+			applied = append(applied, string(cmd))
+			return []byte{}
+		}
+		l, err := recoverRaftLog(store, apply, logOptions{})
+		if err != nil {
+			t.Fatalf("v%d: %s", version, err)
+		}
+		if expected, got := `[{"a":1} {"b":2}]`, fmt.Sprint(applied); expected != got {
+			t.Errorf("v%d: expected applied %s, got %s", version, expected, got)
+		}
+		entry, ok := l.lastConfiguration()
+		if !ok || entry.Index != 1 {
+			t.Fatalf("v%d: expected the configuration at index 1, got %v", version, entry)
+		}
+		if peers, err := decodePeerMap(entry.Command, nil); err != nil || len(peers) != 2 {
+			t.Errorf("v%d: expected 2 peers, got %v (%v)", version, peers, err)
+		}
+
+		// and still written to, in their own format
+		l.appendEntry(logEntry{Index: 4, Term: 1, Command: []byte(`{"c":3}`)})
+		if err := l.commitTo(4); err != nil {
+			t.Fatal(err)
+		}
+		reopened, err := recoverRaftLog(store.Reopen(), noop, logOptions{})
+		if err != nil {
+			t.Fatalf("v%d: after a commit: %s", version, err)
+		}
+		if expected, got := uint64(4), reopened.lastIndex(); expected != got {
+			t.Errorf("v%d: after a commit, expected last index %d, got %d", version, expected, got)
+		}
+
+		// until compaction upgrades them
+		if err := l.compactTo(2, func(uint64, uint64, []byte) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		b := store.Bytes()
+		if expected, got := append([]byte(logMagic), logVersion), b[:logHeaderSize]; !bytes.Equal(expected, got) {
+			t.Errorf("v%d: after compaction, expected header %x, got %x", version, expected, got)
+		}
+		upgraded, err := recoverRaftLog(store.Reopen(), noop, logOptions{})
+		if err != nil {
+			t.Fatalf("v%d: after upgrade: %s", version, err)
+		}
+		if expected, got := uint64(4), upgraded.lastIndex(); expected != got {
+			t.Errorf("v%d: after upgrade, expected last index %d, got %d", version, expected, got)
+		}
+		if _, ok := upgraded.lastConfiguration(); !ok {
+			t.Errorf("v%d: after upgrade, lost the configuration", version)
+		}
+	}
+}
+
+func TestLogLatestConfiguration(t *testing.T) {
+	// a log with configuration entries at 2, 4 and 6
+	store := &InMemoryStore{}
+	l := newRaftLog(store, noop)
+	appendThrough := func(from, to uint64, configs ...uint64) {
+		for index := from; index <= to; index++ {
+			entry := logEntry{Index: index, Term: 1, Command: []byte(fmt.Sprintf("c%d", index))}
+			for _, config := range configs {
+				if index == config {
+					entry.Kind = kindConfiguration
+				}
+			}
+			if err := l.appendEntry(entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	expectLatest := func(l *raftLog, when string, expected uint64) {
+		t.Helper()
+		entry, ok := l.lastConfiguration()
+		if expected == 0 {
+			if ok {
+				t.Errorf("%s: expected no configuration, got index %d", when, entry.Index)
+			}
+			return
+		}
+		if !ok || entry.Index != expected {
+			t.Errorf("%s: expected the configuration at index %d, got %v (%v)", when, expected, entry.Index, ok)
+		} else if want := fmt.Sprintf("c%d", expected); string(entry.Command) != want {
+			t.Errorf("%s: expected command %s, got %s", when, want, entry.Command)
+		}
+	}
+	expectLatest(l, "when empty", 0)
+	appendThrough(1, 8, 2, 4, 6)
+	expectLatest(l, "after appending", 6)
+
+	// forgets those it truncates
+	if err := l.ensureLastIs(5, 1); err != nil {
+		t.Fatal(err)
+	}
+	expectLatest(l, "after truncation", 4)
+	appendThrough(6, 9, 7)
+	expectLatest(l, "after appending again", 7)
+	if err := l.commitTo(9); err != nil {
+		t.Fatal(err)
+	}
+
+	// is recovered as the store is replayed
+	reopened, err := recoverRaftLog(store.Reopen(), noop, logOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLatest(reopened, "after recovery", 7)
+
+	// keeps the latest of those it compacts
+	snapshot := func(uint64, uint64, []byte) error { return nil }
+	if err := l.compactTo(5, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	expectLatest(l, "after compacting before it", 7)
+	if err := l.compactTo(8, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	expectLatest(l, "after compacting it", 7)
+
+	// and a snapshot's configuration is the baseline for a restored log
+	b, err := l.backup(func() ([]byte, error) { return []byte{}, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.configIndex != 7 {
+		t.Fatalf("expected the backup's configuration at index 7, got %d", b.configIndex)
+	}
+	restored := newRaftLog(&bytes.Buffer{}, noop)
+	save := func(index, term uint64, snapshot, sessions []byte) error { return nil }
+	if err := restored.restore(b, save); err != nil {
+		t.Fatal(err)
+	}
+	expectLatest(restored, "after restoring", 7)
+	if err := restored.restoreEntries([]logEntry{
+		{Index: 10, Term: 1, Command: []byte("c10")},
+		{Index: 11, Term: 1, Command: []byte("c11"), Kind: kindConfiguration},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expectLatest(restored, "after a configuration change", 11)
+}
+
+func TestLogRecoveryAfterPartialApply(t *testing.T) {
+	// a state machine that crashes after applying 2 of 3 committed entries
+	applied := []uint64{}
+	crashy := func(index uint64, cmd []byte) []byte {
+		if index == 3 {
+			panic("crash")
+		}
+		applied = append(applied, index)
+		return []byte{}
+	}
+
+	store := &InMemoryStore{}
+	log := newRaftLog(store, crashy)
+	for _, index := range []uint64{1, 2, 3} {
+		if err := log.appendEntry(logEntry{Index: index, Term: 1, Command: []byte(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	func() {
+		defer func() { recover() }()
+		log.commitTo(3)
+	}()
+	if expected, got := 2, len(applied); expected != got {
+		t.Fatalf("before crash: expected %d applied, got %d", expected, got)
+	}
+
+	// on restart, the state machine checkpoint says it applied index 2
+	reapplied := []uint64{}
+	record := func(index uint64, cmd []byte) []byte {
+		reapplied = append(reapplied, index)
+		return []byte{}
+	}
+	log, err := recoverRaftLog(store.Reopen(), record, logOptions{appliedIndex: applied[len(applied)-1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// so exactly the remaining entry should be applied
+	if expected, got := uint64(3), log.getCommitIndex(); expected != got {
+		t.Errorf("expected commit index %d, got %d", expected, got)
+	}
+	if len(reapplied) != 1 || reapplied[0] != 3 {
+		t.Errorf("expected only index 3 to be applied on restart, got %v", reapplied)
+	}
+}
+
+func TestLogCommitGroupSync(t *testing.T) {
+	// a store which records writes and syncs, and a state machine which
+	// records applies, in a shared history
+	history := []string{}
+	store := &syncingStore{}
+	store.onWrite = func() { history = append(history, "write") }
+	store.onSync = func() { history = append(history, "sync") }
+	apply := func(uint64, []byte) []byte { history = append(history, "apply"); return []byte{} }
+	log := newRaftLog(store, apply)
+
+	// when several entries are committed together
+	for _, index := range []uint64{1, 2, 3} {
+		log.appendEntry(logEntry{Index: index, Term: 1, Command: []byte(`{}`)})
+	}
+	if err := log.commitTo(3); err != nil {
+		t.Fatal(err)
+	}
+
+	// they should share a single sync, which precedes every apply (the store
+	// gets its header, then each entry is written as a header, and then a
+	// command)
+	expected := "[write write write write write write write sync apply apply apply]"
+	if got := fmt.Sprint(history); expected != got {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestLogCommitTrimsFailedWrite(t *testing.T) {
+	// a log, over a store whose writes can be made to fail partway
+	store := &tearingStore{}
+	log := newRaftLog(store, noop)
+	for _, index := range []uint64{1, 2, 3} {
+		log.appendEntry(logEntry{Index: index, Term: 1, Command: []byte(`{}`)})
+	}
+	if err := log.commitTo(1); err != nil {
+		t.Fatal(err)
+	}
+	size := store.Len()
+
+	// when an entry is torn
+	store.tear = true
+	if err := log.commitTo(2); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// the partial entry should be gone from the store
+	if expected, got := size, store.Len(); expected != got {
+		t.Fatalf("expected the store trimmed back to %d bytes, got %d", expected, got)
+	}
+
+	// so that later entries can be committed, and recovered
+	store.tear = false
+	if err := log.commitTo(3); err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := recoverRaftLog(store.Reopen(), noop, logOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(3), recovered.lastIndex(); expected != got {
+		t.Errorf("expected to recover up to index %d, got %d", expected, got)
+	}
+}
+
+func TestLogRecoveryTrimsHeaderWithoutCommand(t *testing.T) {
+	// a log with one entry in its store
+	store := &InMemoryStore{}
+	log := newRaftLog(store, noop)
+	log.appendEntry(logEntry{Index: 1, Term: 1, Command: []byte(`{}`)})
+	if err := log.commitTo(1); err != nil {
+		t.Fatal(err)
+	}
+	size := store.Len()
+
+	// and the header of a second, whose command never made it to the store
+	log.appendEntry(logEntry{Index: 2, Term: 1, Command: []byte(`{}`)})
+	buf := &bytes.Buffer{}
+	if err := log.entries[1].encode(buf); err != nil {
+		t.Fatal(err)
+	}
+	store.Write(buf.Bytes()[:entryHeaderSize])
+
+	// recovers the first, and trims the second from the store
+	reopened := store.Reopen()
+	recovered, err := recoverRaftLog(reopened, noop, logOptions{})
+	if expected, got := io.ErrUnexpectedEOF, err; expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if expected, got := uint64(1), recovered.lastIndex(); expected != got {
+		t.Errorf("expected last index %d, got %d", expected, got)
+	}
+	if expected, got := size, reopened.Len(); expected != got {
+		t.Errorf("expected the store trimmed back to %d bytes, got %d", expected, got)
+	}
+}
+
+// tearingStore is an InMemoryStore whose writes, when tear is set, write
+// only half of what they're given, and fail.
+type tearingStore struct {
+	InMemoryStore
+	tear bool
+}
+
+func (s *tearingStore) Write(p []byte) (int, error) {
+	if s.tear {
+		n, _ := s.InMemoryStore.Write(p[:len(p)/2])
+		return n, fmt.Errorf("torn write")
+	}
+	return s.InMemoryStore.Write(p)
+}
+
+// syncingStore is a bytes.Buffer which counts calls to Sync, and optionally
+// reports writes and syncs as they happen.
+type syncingStore struct {
+	bytes.Buffer
+	syncs   int32
+	onWrite func()
+	onSync  func()
+}
+
+func (s *syncingStore) Write(p []byte) (int, error) {
+	if s.onWrite != nil {
+		s.onWrite()
+	}
+	return s.Buffer.Write(p)
+}
+
+func (s *syncingStore) Sync() error {
+	atomic.AddInt32(&s.syncs, 1)
+	if s.onSync != nil {
+		s.onSync()
+	}
+	return nil
+}
+
+func TestLogCompression(t *testing.T) {
+	large := bytes.Repeat([]byte(`{"key":"value"}`), 1000)
+	small := []byte(`{"key":"value"}`)
+	write := func(c compression) *InMemoryStore {
+		store := &InMemoryStore{}
+		l, err := recoverRaftLog(store, noop, logOptions{compression: c})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.appendEntry(logEntry{Index: 1, Term: 1, Command: large})
+		l.appendEntry(logEntry{Index: 2, Term: 1, Command: small})
+		if err := l.commitTo(2); err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := int64(store.Len()), l.storeSize; expected != got {
+			t.Errorf("expected store size %d, got %d", expected, got)
+		}
+		return store
+	}
+	c := compression{GzipCompressor{}, 1024}
+	plain, compressed := write(compression{}), write(c)
+
+	// a large command is stored compressed, and a small one as it is
+	if plain.Len() <= compressed.Len() {
+		t.Errorf("expected compression to shrink the store, got %d bytes, vs %d", compressed.Len(), plain.Len())
+	}
+	if !bytes.Contains(compressed.Bytes(), small) {
+		t.Errorf("expected the small command stored uncompressed")
+	}
+
+	// and both are recovered as they were, given the compressor
+	applied := [][]byte{}
+	apply := func(index uint64, cmd []byte) []byte {
+		applied = append(applied, cmd)
+		return []byte{}
+	}
+	if _, err := recoverRaftLog(compressed.Reopen(), apply, logOptions{compression: c}); err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 2 || !bytes.Equal(large, applied[0]) || !bytes.Equal(small, applied[1]) {
+		t.Errorf("expected the commands recovered intact, got %d commands", len(applied))
+	}
+
+	// but not without it
+	if _, err := recoverRaftLog(compressed.Reopen(), noop, logOptions{}); err != errNoCompressor {
+		t.Errorf("expected %v, got %v", errNoCompressor, err)
+	}
+}
+
+func TestLogDurableTruncation(t *testing.T) {
+	// a durable log, with one committed entry, and two persisted after it
+	store := &InMemoryStore{}
+	l, _ := recoverRaftLog(store, noop, logOptions{durable: true})
+	for index := uint64(1); index <= 3; index++ {
+		l.appendEntry(logEntry{Index: index, Term: 1, Command: []byte(`{}`)})
+	}
+	if err := l.commitTo(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	// whose uncommitted entries are truncated, and replaced
+	if err := l.ensureLastIs(2, 1); err != nil {
+		t.Fatal(err)
+	}
+	l.appendEntry(logEntry{Index: 3, Term: 2, Command: []byte(`{"c":3}`)})
+	if err := l.persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	// is recovered with only the replacement
+	applied := []uint64{}
+	apply := func(index uint64, cmd []byte) []byte {
+		applied = append(applied, index)
+		return []byte{}
+	}
+	recovered, err := recoverRaftLog(store.Reopen(), apply, logOptions{durable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(2), recovered.lastTerm(); expected != got {
+		t.Errorf("expected last term %d, got %d", expected, got)
+	}
+	if expected, got := "[1]", fmt.Sprint(applied); expected != got {
+		t.Errorf("expected applied %s, got %s", expected, got)
+	}
+
+	// and once it's all committed, it's all applied at recovery, even by a log
+	// which isn't durable
+	if err := l.commitTo(3); err != nil {
+		t.Fatal(err)
+	}
+	applied = []uint64{}
+	if _, err := recoverRaftLog(store.Reopen(), apply, logOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "[1 2 3]", fmt.Sprint(applied); expected != got {
+		t.Errorf("after commit: expected applied %s, got %s", expected, got)
+	}
+}
+
+func BenchmarkLogBulkTruncate_100k(b *testing.B)   { benchmarkLogTruncate(b, 100000, true) }
+func BenchmarkLogSingleTruncate_100k(b *testing.B) { benchmarkLogTruncate(b, 100000, false) }
+
+// benchmarkLogTruncate discards n persisted, uncommitted entries from a durable
+// log, with bulkTruncate, either all at once, or one at a time from the end.
+func benchmarkLogTruncate(b *testing.B, n int, bulk bool) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		l, _ := recoverRaftLog(&InMemoryStore{}, noop, logOptions{durable: true})
+		for index := uint64(1); index <= uint64(n); index++ {
+			l.appendEntry(logEntry{Index: index, Term: 1, Command: []byte(`{}`)})
+		}
+		if err := l.persist(); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		if bulk {
+			if err := l.bulkTruncate(1); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+		for index := uint64(n); index >= 1; index-- {
+			if err := l.bulkTruncate(index); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkLogAppendCommit appends entries one at a time, committing each, to a
+// store which discards them: the encoding path every entry takes.
+func BenchmarkLogAppendCommit(b *testing.B) {
+	b.ReportAllocs()
+	store := struct {
+		io.Reader
+		io.Writer
+	}{&bytes.Buffer{}, ioutil.Discard}
+	l := newRaftLog(store, noop)
+	command := []byte(`{}`)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index := uint64(i + 1)
+		if err := l.appendEntry(logEntry{Index: index, Term: 1, Command: command}); err != nil {
+			b.Fatal(err)
+		}
+		if err := l.commitTo(index); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
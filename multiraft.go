@@ -0,0 +1,97 @@
+package raft
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	// GroupHeader is the HTTP header in which HTTP peers send the ID of the
+	// Raft group an RPC is destined for. It's only set by peers constructed
+	// with WithGroup, and only consulted by a MultiRaftHTTPTransport.
+	GroupHeader = "X-Raft-Group"
+)
+
+var (
+	errInvalidGroup = errors.New("group ID must be > 0")
+)
+
+// MultiRaft routes incoming RPCs to one of many Servers, each a member of a
+// different Raft group, by group ID. It allows e.g. a sharded system to run a
+// Raft group per shard, while every group on a node shares a single HTTP
+// server, and every HTTP peer shares the same pool of connections.
+type MultiRaft struct {
+	sync.RWMutex
+	servers map[uint64]*Server
+}
+
+// NewMultiRaft returns an empty MultiRaft.
+func NewMultiRaft() *MultiRaft {
+	return &MultiRaft{servers: map[uint64]*Server{}}
+}
+
+// Register makes the server the destination for RPCs to the given group. Like
+// server IDs, group IDs must be greater than 0; an RPC without a GroupHeader
+// isn't destined for any group.
+func (m *MultiRaft) Register(group uint64, s *Server) error {
+	if group <= 0 {
+		return errInvalidGroup
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.servers[group] = s
+	return nil
+}
+
+// Unregister removes the server for the given group, if any.
+func (m *MultiRaft) Unregister(group uint64) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.servers, group)
+}
+
+func (m *MultiRaft) get(group uint64) (*Server, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	s, ok := m.servers[group]
+	return s, ok
+}
+
+// MultiRaftHTTPTransport is like HTTPTransport, but for many servers. It
+// installs handlers for all the necessary RPCs to the passed mux, which
+// dispatch each RPC to the server registered in the MultiRaft for the group
+// named in its GroupHeader. RPCs for unknown groups fail with 404 Not Found,
+// and unknown RPCs as they do with HTTPTransport, with the same options.
+func MultiRaftHTTPTransport(mux *http.ServeMux, m *MultiRaft, options ...TransportOption) {
+	mux.HandleFunc(IDPath, versioned(m.dispatch(idHandler)))
+	mux.HandleFunc(AppendEntriesPath, versioned(m.dispatch(appendEntriesHandler)))
+	mux.HandleFunc(RequestVotePath, versioned(m.dispatch(requestVoteHandler)))
+	mux.HandleFunc(CommandPath, versioned(m.dispatch(commandHandler)))
+	mux.HandleFunc(SetConfigurationPath, versioned(m.dispatch(setConfigurationHandler)))
+	mux.HandleFunc(ReadPath, versioned(m.dispatch(readHandler)))
+	handleUnsupported(mux, options)
+}
+
+func (m *MultiRaft) dispatch(handler func(*Server) http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := r.Header.Get(GroupHeader)
+		if h == "" {
+			http.Error(w, "no "+GroupHeader, http.StatusNotFound)
+			return
+		}
+		group, err := strconv.ParseUint(h, 10, 64)
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		s, ok := m.get(group)
+		if !ok {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		handler(s)(w, r)
+	}
+}
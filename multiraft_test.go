@@ -0,0 +1,125 @@
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMultiRaftOverHTTP(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+	oldMin, oldMax := resetElectionTimeoutMS(100, 200)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// 3 nodes, each with a single HTTP server, hosting a member of 2 groups
+	const nodes = 3
+	groups := []uint64{1, 2}
+	multis := make([]*MultiRaft, nodes)
+	httpServers := make([]*httptest.Server, nodes)
+	for i := 0; i < nodes; i++ {
+		multis[i] = NewMultiRaft()
+		mux := http.NewServeMux()
+		MultiRaftHTTPTransport(mux, multis[i])
+		httpServers[i] = httptest.NewServer(mux)
+	}
+
+	raftServers := map[uint64][]*Server{}
+	stateMachines := map[uint64][]*protectedSlice{}
+	for _, group := range groups {
+		for i := 0; i < nodes; i++ {
+			sm := &protectedSlice{}
+			s := NewServer(uint64(i+1), &bytes.Buffer{}, appender(sm))
+			if err := multis[i].Register(group, s); err != nil {
+				t.Fatal(err)
+			}
+			raftServers[group] = append(raftServers[group], s)
+			stateMachines[group] = append(stateMachines[group], sm)
+		}
+	}
+
+	// each group's peers address that group on each node
+	for _, group := range groups {
+		peers := []Peer{}
+		for i := 0; i < nodes; i++ {
+			u, _ := url.Parse(httpServers[i].URL)
+			peer, err := NewHTTPPeer(u, WithGroup(group))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, got := uint64(i+1), peer.id(); expected != got {
+				t.Fatalf("group %d: expected peer id %d, got %d", group, expected, got)
+			}
+			peers = append(peers, peer)
+		}
+		for _, s := range raftServers[group] {
+			s.SetConfiguration(peers...)
+			s.Start()
+			defer s.Stop()
+		}
+	}
+
+	// an unknown group isn't found
+	u, _ := url.Parse(httpServers[0].URL)
+	if _, err := NewHTTPPeer(u, WithGroup(3)); err == nil {
+		t.Errorf("constructed a peer for an unknown group")
+	}
+
+	// wait for the groups to organize
+	time.Sleep(nodes * maximumElectionTimeout())
+
+	// send a different command into each group
+	for _, group := range groups {
+		cmd := []byte(fmt.Sprintf(`{"group":%d}`, group))
+		response := make(chan []byte, 1)
+		if err := raftServers[group][0].Command(cmd, response); err != nil {
+			t.Fatalf("group %d: %s", group, err)
+		}
+		select {
+		case <-response:
+		case <-time.After(4 * maximumElectionTimeout()):
+			t.Fatalf("group %d: timeout waiting for command response", group)
+		}
+	}
+
+	// every member of each group should apply only its group's command
+	cutoff := time.Now().Add(4 * maximumElectionTimeout())
+	for _, group := range groups {
+		expected := fmt.Sprintf(`{"group":%d}`, group)
+		for i, sm := range stateMachines[group] {
+			for len(sm.Get()) < 1 && time.Now().Before(cutoff) {
+				time.Sleep(minimumElectionTimeout())
+			}
+			slice := sm.Get()
+			if len(slice) != 1 || string(slice[0]) != expected {
+				t.Errorf("group %d, node %d: expected [%s], got %q", group, i+1, expected, slice)
+			}
+		}
+	}
+}
+
+func TestMultiRaftRejectsGroupZero(t *testing.T) {
+	// group 0 can't be registered, as it's what a missing header would mean
+	m := NewMultiRaft()
+	if expected, got := errInvalidGroup, m.Register(0, NewServer(1, &bytes.Buffer{}, noop)); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// and RPCs without a header aren't routed anywhere
+	mux := http.NewServeMux()
+	MultiRaftHTTPTransport(mux, m)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	if _, err := NewHTTPPeer(u); err == nil {
+		t.Errorf("resolved the ID of a peer without a group")
+	}
+}
@@ -0,0 +1,442 @@
+package raft
+
+import (
+	"time"
+)
+
+// Option configures optional behavior of a Server. Options are passed to
+// NewServer, and take effect before the server's log is recovered.
+type Option func(*Server)
+
+// WithAppliedIndex tells the server that its state machine has already durably
+// applied every command up to and including index, e.g. because the state
+// machine persists its own checkpoints. When the server recovers its log, it
+// passes only the commands after index to the ApplyFunc. The default, 0, means
+// every recovered command is applied, which is correct for state machines that
+// live only in memory.
+//
+// The responses to recovered commands that aren't applied aren't known, so
+// retries of them can't be answered. If the state machine was restored from a
+// snapshot, pass the sessions saved with it to WithSessions, and they can.
+func WithAppliedIndex(index uint64) Option {
+	return func(s *Server) { s.logOptions.appliedIndex = index }
+}
+
+// WithEvents registers callbacks for notable occurrences in the server.
+func WithEvents(e Events) Option {
+	return func(s *Server) { s.events = e }
+}
+
+// WithCommitCoalescing makes the server report commits to Events.OnCommit at
+// most once per window: the first commit starts the window, and every commit
+// until it ends is reported with it, as a single range. By default, each
+// commit is reported as it happens.
+func WithCommitCoalescing(window time.Duration) Option {
+	return func(s *Server) { s.commits.window = window }
+}
+
+// TieBreak selects which of two otherwise-equal candidates is preferred in an
+// election. See WithTieBreak.
+type TieBreak int
+
+const (
+	// NoTieBreak treats all candidates equally. It's the default.
+	NoTieBreak TieBreak = iota
+
+	// PreferLowerID prefers the candidate with the lower ID.
+	PreferLowerID
+
+	// PreferHigherID prefers the candidate with the higher ID.
+	PreferHigherID
+)
+
+// prefers returns true if the tie-break prefers candidate a over candidate b.
+func (tb TieBreak) prefers(a, b uint64) bool {
+	switch tb {
+	case PreferLowerID:
+		return a < b
+	case PreferHigherID:
+		return a > b
+	default:
+		return false
+	}
+}
+
+// WithTieBreak enables a deterministic tie-break between candidates, to reduce
+// repeated split votes. It never grants a second vote in a term.
+//
+// A follower asked for its vote by a candidate, when the tie-break prefers
+// some other server, holds back its answer for a broadcast interval. If the
+// preferred server asks for its vote in the same term within that time, the
+// follower votes for it; otherwise it votes as usual.
+//
+// A candidate which receives a requestVote from another candidate in the same
+// term, whose log is exactly as up-to-date as its own, and whom the tie-break
+// prefers, abandons its own election. It still denies the vote, as it has
+// already voted for itself, but it becomes a follower and restarts its
+// election timeout, giving the preferred candidate a head start in the next
+// election.
+//
+// By default, there's no tie-break.
+func WithTieBreak(tb TieBreak) Option {
+	return func(s *Server) { s.tieBreak = tb }
+}
+
+// WithLeaderStickiness makes the server ignore a requestVote which arrives
+// within the minimum election timeout of its hearing from the leader, or, if
+// it's leader, of a quorum acknowledging its heartbeat. It neither grants the
+// vote nor adopts the candidate's term. No candidate in a healthy network can
+// have waited out an election timeout in that time, so one which asks is
+// likely disruptive: e.g. just back from a partition, with an inflated term,
+// which would otherwise unseat the leader. So that a new leader can be
+// elected when the old one fails, every server should be given it.
+//
+// By default, a requestVote for a later term is always heeded.
+func WithLeaderStickiness() Option {
+	return func(s *Server) { s.sticky = true }
+}
+
+// PreAppendHook is a client-provided function which validates a command on the
+// leader, before it's appended to the log. If it returns an error, the command
+// is rejected: Command returns the error, and nothing is appended. Unlike the
+// ApplyFunc, it's invoked only on the leader, and only once per submission.
+// It never runs on the server's own goroutine (normally it runs in the one
+// that called Command), so a slow hook delays only the command it validates.
+type PreAppendHook func(cmd []byte) error
+
+// WithPreAppendHook installs a PreAppendHook, for admission control or
+// validation of commands. By default, every command is accepted.
+func WithPreAppendHook(h PreAppendHook) Option {
+	return func(s *Server) { s.preAppend = h }
+}
+
+// ResponsePolicy says what a server does with a command's response when the
+// client isn't ready to receive it as soon as the command is applied. Either
+// way, applying further commands never waits for the client.
+type ResponsePolicy int
+
+const (
+	// DeliverResponsesAsync hands the response to a goroutine, which waits up
+	// to an election timeout for the client to receive it, and then gives up.
+	// It's the default.
+	DeliverResponsesAsync ResponsePolicy = iota
+
+	// DropResponses discards the response immediately.
+	DropResponses
+)
+
+// WithResponsePolicy sets the ResponsePolicy. Whenever a response is given up
+// on, the client's response channel is closed without a value, just as if the
+// command had been discarded, so clients which need every response should pass
+// a buffered channel to Command.
+func WithResponsePolicy(p ResponsePolicy) Option {
+	return func(s *Server) { s.logOptions.responses = p }
+}
+
+// StoreErrorPolicy says what a server does when it fails to persist the
+// entries it's committing to its log store. Either way, those entries aren't
+// applied, or acknowledged to their clients, and the error is reported to
+// Events.OnStoreError.
+type StoreErrorPolicy int
+
+const (
+	// RetryStoreWrites applies backpressure: the commit index stops at the
+	// last entry which was persisted, and each later attempt to commit
+	// retries the write. Replication carries on, but nothing more is
+	// committed until the store recovers. It's the default.
+	RetryStoreWrites StoreErrorPolicy = iota
+
+	// FailOnStoreError fails the server, which then rejects every request
+	// with ErrServerFailed, so it can be replaced.
+	FailOnStoreError
+)
+
+// WithStoreErrorPolicy sets the StoreErrorPolicy.
+func WithStoreErrorPolicy(p StoreErrorPolicy) Option {
+	return func(s *Server) { s.storeErrors = p }
+}
+
+// WithStuckCandidateThreshold reports a stuck candidate, via a log line and
+// the OnStuckCandidate event, once it has failed n elections in a row, and
+// again after every n more. By default, stuck candidates aren't reported.
+func WithStuckCandidateThreshold(n int) Option {
+	return func(s *Server) { s.stuckAfter = n }
+}
+
+// WithMetadataFunc sets the function which receives the cluster-wide metadata
+// appended by AppendMetadata, once it's committed. Without one, metadata is
+// replicated and committed like anything else, but delivered nowhere.
+func WithMetadataFunc(f MetadataFunc) Option {
+	return func(s *Server) { s.logOptions.metadata = f }
+}
+
+// WithExpiryFunc sets the function which is told when commands appended by
+// CommandTTL expire. Without one, they still expire, and their tombstones are
+// replicated and committed like anything else, but delivered nowhere.
+func WithExpiryFunc(f ExpiryFunc) Option {
+	return func(s *Server) { s.logOptions.expiry = f }
+}
+
+// WithManualApply stops the server applying committed entries itself. Instead,
+// the application calls DrainApply, e.g. from its own event loop, which applies
+// them on the calling goroutine. Until it does, clients' responses wait, and
+// so do reads, which need the state machine to be up to date, and compaction
+// goes no further than what's applied.
+func WithManualApply() Option {
+	return func(s *Server) { s.logOptions.manualApply = true }
+}
+
+// WithSlowApplyThreshold reports, with the OnSlowApply event, each command the
+// state machine takes longer than d to apply, which can tell a slow state
+// machine apart from slow replication. By default, none are reported.
+func WithSlowApplyThreshold(d time.Duration) Option {
+	return func(s *Server) { s.logOptions.slowApply.threshold = d }
+}
+
+// WithQuorum sets how the leader decides which entries are committed: it
+// builds the Quorum of each configuration with f, or, while the configuration
+// is changing, the JointQuorum of the old and new ones. The default is
+// NewMajorityQuorum. Whatever the quorum, an entry from an earlier term is
+// only committed once every voter has it, or once a later entry is committed.
+func WithQuorum(f QuorumFunc) Option {
+	return func(s *Server) { s.quorumFunc = f }
+}
+
+// WithRequiredPeers designates peers, by ID, which must have an entry, as well
+// as the quorum, before the leader commits it; see RequiredQuorum. While any of
+// them is down, or behind, nothing more is committed. Once an entry the quorum
+// alone would have committed has waited on them for longer than timeout, its
+// waiter, e.g. CommandWait, gets ErrRequiredPeersTimeout, though the entry is
+// still committed once they catch up. A timeout of zero waits indefinitely.
+func WithRequiredPeers(timeout time.Duration, ids ...uint64) Option {
+	return func(s *Server) { s.required, s.requiredTimeout = ids, timeout }
+}
+
+// WithStateStore persists the server's term and vote, its HardState, to store,
+// together, whenever either changes, so a restarted server resumes with them,
+// rather than with the term of its last log entry, and no vote. Without one, a
+// server which restarts in the middle of a term could vote twice in it. If the
+// store fails, so does the server, with ErrServerFailed: it mustn't carry on
+// with a term or vote it might forget.
+func WithStateStore(store StateStore) Option {
+	return func(s *Server) { s.stateStore = store }
+}
+
+// WithStartupGrace holds off the server's first election until d after it's
+// started, on top of the usual election timeout, giving its peers time to come
+// up, or an existing leader time to make contact, e.g. during a rolling deploy.
+// A leader which makes contact within the grace period ends it early. The
+// default is no grace period.
+func WithStartupGrace(d time.Duration) Option {
+	return func(s *Server) { s.grace = d }
+}
+
+// UnknownCandidatePolicy decides how a server answers a RequestVote from a
+// candidate which isn't in its configuration, e.g. a server that was removed,
+// and hasn't noticed. See WithUnknownCandidatePolicy.
+type UnknownCandidatePolicy int
+
+const (
+	// DenyUnknownCandidates denies them the vote, but otherwise handles their
+	// requests as usual, so a newer term is still adopted. It's the default.
+	DenyUnknownCandidates UnknownCandidatePolicy = iota
+
+	// IgnoreUnknownCandidates denies them the vote without adopting their
+	// term, or changing any other state, so a removed server can't disrupt
+	// the cluster by repeatedly starting elections.
+	IgnoreUnknownCandidates
+
+	// AllowUnknownCandidates treats them like any other candidate.
+	AllowUnknownCandidates
+)
+
+// WithUnknownCandidatePolicy sets how the server answers a RequestVote from a
+// candidate which isn't in its configuration. Whatever the policy, each such
+// request is reported with the OnVoteFromUnknownPeer event. A server whose
+// configuration is empty, e.g. a new server which is yet to hear from the
+// leader, treats every candidate as known.
+func WithUnknownCandidatePolicy(p UnknownCandidatePolicy) Option {
+	return func(s *Server) { s.unknown = p }
+}
+
+// WithUnsafeOperations permits operations which may lose committed data, like
+// ForceLeadership. They exist only for manual disaster recovery. By default,
+// they're refused.
+func WithUnsafeOperations() Option {
+	return func(s *Server) { s.unsafeOps = true }
+}
+
+// WithObserverMode hands leader election to an external coordinator, e.g. a
+// lock service. The server never starts an election, nor votes in one; it
+// leads only once told to, with AssumeLeadership, and stops with Relinquish,
+// or when it hears from a leader in a later term. Log replication and commit
+// work as usual. Every server in the network should be in observer mode.
+func WithObserverMode() Option {
+	return func(s *Server) { s.observer = true }
+}
+
+// WithSnapshots lets the server snapshot the state machine, and persist those
+// snapshots, so that log entries may be compacted. See Compact.
+func WithSnapshots(sm Snapshotter, store SnapshotStore) Option {
+	return func(s *Server) {
+		s.snapshotter = sm
+		s.snapshotStore = store
+	}
+}
+
+// WithRetainSnapshotEntries makes compaction keep the k entries at and below
+// the compaction boundary, rather than discarding everything the snapshot
+// covers, so the log's first index becomes boundary - k + 1. A follower which
+// is no more than k entries behind can then still be caught up by
+// AppendEntries, e.g. by a server which compacted while it was a follower, and
+// has since become leader. The default is 0.
+func WithRetainSnapshotEntries(k int) Option {
+	return func(s *Server) { s.retainEntries = k }
+}
+
+// WithPeerFactory makes the server record peers in configuration entries by
+// their PeerDescriptor, rather than encoding the Peers themselves, and
+// construct live peers from those descriptors with f whenever it reads a
+// configuration entry. Peers then needn't be encodable, nor registered with
+// encoding/gob. Every server in the network must be given a factory, since a
+// server without one can't read configurations written by those with one.
+func WithPeerFactory(f PeerFactory) Option {
+	return func(s *Server) { s.config.factory = f }
+}
+
+// CommandMeta is a client-provided function which extracts metadata from an
+// opaque command. key partitions commands: commands with different keys don't
+// depend on each other. clientID and seq identify a command for deduplication:
+// each client numbers its commands with increasing seqs, and a command whose
+// seq isn't greater than the last applied for its client is a retry, so it's
+// not applied again. A clientID of zero means the command isn't deduplicated.
+//
+// Commands with different keys may be applied concurrently. Commands with the
+// same key are always applied in log order.
+type CommandMeta func(cmd []byte) (key string, clientID uint64, seq uint64)
+
+// defaultCommandMeta puts every command under the same key, and deduplicates
+// nothing.
+func defaultCommandMeta([]byte) (string, uint64, uint64) { return "", 0, 0 }
+
+// WithCommandMeta installs a CommandMeta. By default, every command has the
+// same key, and commands are never deduplicated.
+func WithCommandMeta(m CommandMeta) Option {
+	return func(s *Server) { s.logOptions.meta = m }
+}
+
+// WithMaxSessions sets how many clients' sessions are kept for deduplication.
+// Beyond that, the clients whose latest commands are oldest are forgotten, and
+// their retries are applied again. Every server in a cluster must use the same
+// value, so their state machines see the same commands. The default is 10000.
+func WithMaxSessions(n int) Option {
+	return func(s *Server) { s.logOptions.maxSessions = n }
+}
+
+// WithSessions restores the client sessions saved with a snapshot, for a state
+// machine restored from that snapshot. Use it with WithAppliedIndex. If the
+// sessions can't be decoded, the server refuses to start.
+func WithSessions(sessions []byte) Option {
+	return func(s *Server) { s.logOptions.sessions = sessions }
+}
+
+// WithReadReplica makes the server a read replica. A read replica never votes,
+// and never stands for election, so it can't affect the availability of the
+// cluster. It accepts log entries only from source, or from any leader if
+// source is zero. The source must be told about the replica with
+// AddReadReplica.
+func WithReadReplica(source uint64) Option {
+	return func(s *Server) {
+		s.readReplica = true
+		s.replicaSource = source
+	}
+}
+
+// WithMaxTermGap makes the server ignore any RPC, or RPC response, whose term
+// is more than gap ahead of its own, and report it with the OnTermGap event. A
+// peer with a corrupt term, or a misbehaving one, can then no longer force
+// the cluster into a new term at will. But nor can a server that legitimately
+// falls that far behind, e.g. after a long partition, catch up without being
+// restarted with a larger gap, so gap should be generous. By default, it's
+// unlimited.
+func WithMaxTermGap(gap uint64) Option {
+	return func(s *Server) { s.maxTermGap = gap }
+}
+
+// WithReadFunc sets the function which answers queries made with
+// ConsistentRead or StaleRead, on this server or forwarded to it by a
+// follower. Without it, such queries fail.
+func WithReadFunc(f ReadFunc) Option {
+	return func(s *Server) { s.readFunc = f }
+}
+
+// WithMaxClockDrift bounds how much faster another server's clock may run than
+// ours, over an election timeout. A leader's lease is shortened by that much;
+// see LeaseRead. The default is the heartbeat interval: a tenth of the
+// minimum election timeout, unless SetElectionTimeoutMultiplier says otherwise.
+func WithMaxClockDrift(d time.Duration) Option {
+	return func(s *Server) { s.clockDrift = d }
+}
+
+// WithLeaseAnomalyThreshold sets how many clock anomalies a server tolerates
+// before it disables leasing for good, so LeaseRead falls back to a ReadIndex,
+// as ConsistentRead performs. An anomaly is a flush after which the time since
+// the previous one, by the server's clock, differs from the time by the
+// monotonic clock by more than WithMaxClockDrift allows, e.g. because the
+// clock was stepped, or the machine was suspended. The default is 1. A
+// negative threshold trusts the clock regardless, and never disables leasing.
+func WithLeaseAnomalyThreshold(n int) Option {
+	return func(s *Server) { s.anomalyThreshold = n }
+}
+
+// WithMaxPendingEntries bounds how many entries a leader may have appended,
+// but not yet committed. Beyond that, commands fail with
+// ErrTooManyPendingEntries until replication catches up. By default, it's
+// unlimited.
+func WithMaxPendingEntries(n uint64) Option {
+	return func(s *Server) { s.maxPending = n }
+}
+
+// WithCompression compresses, with c, the commands of log entries larger than
+// threshold bytes, as they're written to the store, wherever that makes them
+// smaller. Commands are applied, and sent to peers, uncompressed. A store with
+// compressed entries can only be recovered by a server with the same
+// Compressor.
+func WithCompression(c Compressor, threshold int) Option {
+	return func(s *Server) { s.logOptions.compression = compression{c, threshold} }
+}
+
+// WithDurableAcks makes the server, as a follower, persist the entries it's
+// sent, and sync its store, before it acknowledges them to the leader. By
+// default, only committed entries are persisted, so a follower acknowledges
+// entries it would lose in a crash; should the leader crash too, before the
+// follower hears they're committed, entries the leader committed could be
+// lost. With WithDurableAcks, the store holds uncommitted entries, which are
+// trimmed off if they're truncated, so it must implement Truncate, as
+// *os.File does; and a store written with it can't be recovered by an older
+// version of this package.
+func WithDurableAcks() Option {
+	return func(s *Server) { s.logOptions.durable = true }
+}
+
+// WithMaxConcurrentTransfers limits the number of log transfers, each of
+// which streams the log, and a snapshot, to a new server, that WriteLogTo, and
+// so the HTTPTransport's LogPath handler, makes at once. Any more wait their
+// turn. By default, there's one at a time; n <= 0 means no limit.
+func WithMaxConcurrentTransfers(n int) Option {
+	return func(s *Server) {
+		s.transfers = nil
+		if n > 0 {
+			s.transfers = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithEncodeBufferPooling sets whether the headers of log entries, and of
+// commit records, are encoded into buffers drawn from a pool shared by every
+// server in the process, or into a fresh buffer each time. Pooling saves an
+// allocation per entry written to the store; without it, no buffer is ever
+// shared between servers. By default, buffers are pooled.
+func WithEncodeBufferPooling(enabled bool) Option {
+	return func(s *Server) { s.logOptions.headers = headerBuffers{unpooled: !enabled} }
+}
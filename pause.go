@@ -0,0 +1,58 @@
+package raft
+
+import (
+	"sync"
+)
+
+// PausePeer stops this server, whenever it's leader, from sending anything to
+// the peer with the passed ID, until ResumePeer is called: e.g. while the peer
+// is down for maintenance, so it isn't hammered with retries. A paused peer
+// stays in the configuration, and still counts towards the quorum with the
+// entries it already has, but it gets no more, so the rest of the quorum must
+// carry on without it. Nor does it count against the leader, which doesn't
+// step down for want of hearing from it. A paused peer which is still running
+// misses heartbeats, so it will stand for election; pause one which is down.
+func (s *Server) PausePeer(id uint64) {
+	s.paused.pause(id)
+}
+
+// ResumePeer undoes PausePeer. The leader catches the peer up from its next
+// flush.
+func (s *Server) ResumePeer(id uint64) {
+	s.paused.resume(id)
+}
+
+// pausedPeers is the set of peers, by ID, which PausePeer has paused. The zero
+// value is ready to use.
+type pausedPeers struct {
+	sync.RWMutex
+	ids map[uint64]bool
+}
+
+func (p *pausedPeers) pause(id uint64) {
+	p.Lock()
+	defer p.Unlock()
+	if p.ids == nil {
+		p.ids = map[uint64]bool{}
+	}
+	p.ids[id] = true
+}
+
+func (p *pausedPeers) resume(id uint64) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.ids, id)
+}
+
+// except returns the peers in pm which aren't paused.
+func (p *pausedPeers) except(pm peerMap) peerMap {
+	p.RLock()
+	defer p.RUnlock()
+	except := peerMap{}
+	for id, peer := range pm {
+		if !p.ids[id] {
+			except[id] = peer
+		}
+	}
+	return except
+}
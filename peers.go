@@ -2,6 +2,7 @@ package raft
 
 import (
 	"errors"
+	"sort"
 	"time"
 )
 
@@ -16,8 +17,9 @@ type Peer interface {
 	id() uint64
 	callAppendEntries(appendEntries) appendEntriesResponse
 	callRequestVote(requestVote) requestVoteResponse
-	callCommand([]byte, chan<- []byte) error
+	callCommand([]byte, chan<- []byte) (uint64, error)
 	callSetConfiguration(...Peer) error
+	callRead([]byte) ([]byte, error)
 }
 
 // localPeer is the simplest kind of peer, mapped to a server in the
@@ -39,14 +41,18 @@ func (p *localPeer) callRequestVote(rv requestVote) requestVoteResponse {
 	return p.server.requestVote(rv)
 }
 
-func (p *localPeer) callCommand(cmd []byte, response chan<- []byte) error {
-	return p.server.Command(cmd, response)
+func (p *localPeer) callCommand(cmd []byte, response chan<- []byte) (uint64, error) {
+	return p.server.CommandIndex(cmd, response)
 }
 
 func (p *localPeer) callSetConfiguration(peers ...Peer) error {
 	return p.server.SetConfiguration(peers...)
 }
 
+func (p *localPeer) callRead(query []byte) ([]byte, error) {
+	return p.server.readIndex(query)
+}
+
 // requestVoteTimeout issues the requestVote to the given peer.
 // If no response is received before timeout, an error is returned.
 func requestVoteTimeout(p Peer, rv requestVote, timeout time.Duration) (requestVoteResponse, error) {
@@ -94,8 +100,39 @@ func (pm peerMap) except(id uint64) peerMap {
 	return except
 }
 
+// union returns the peers in either peerMap.
+func (pm peerMap) union(other peerMap) peerMap {
+	union := peerMap{}
+	for id, peer := range pm {
+		union[id] = peer
+	}
+	for id, peer := range other {
+		union[id] = peer
+	}
+	return union
+}
+
 func (pm peerMap) count() int { return len(pm) }
 
+// ids returns the IDs of the peers, in ascending order.
+func (pm peerMap) ids() []uint64 {
+	ids := make([]uint64, 0, len(pm))
+	for id := range pm {
+		ids = append(ids, id)
+	}
+	sort.Sort(uint64Slice(ids))
+	return ids
+}
+
+type uint64Slice []uint64
+
+func (a uint64Slice) Len() int           { return len(a) }
+func (a uint64Slice) Less(i, j int) bool { return a[i] < a[j] }
+func (a uint64Slice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// quorum returns the number of votes required for a majority of the peers. A
+// network of 2 needs both votes: a lone node can neither elect itself nor
+// commit anything, so a network of 2 tolerates no failures at all.
 func (pm peerMap) quorum() int {
 	switch n := len(pm); n {
 	case 0, 1:
@@ -149,7 +186,11 @@ func (pm peerMap) requestVotes(r requestVote) (chan voteResponseTuple, canceler)
 						continue // will need to retry
 					}
 					respondedAlready[t.id] = nil // set membership semantics
-					tupleChan <- t
+					select {
+					case tupleChan <- t:
+					case <-abortChan:
+						return // nobody's listening
+					}
 
 				case <-abortChan:
 					return // give up
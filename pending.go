@@ -0,0 +1,107 @@
+package raft
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrLeadershipLost is returned by CommandWait when the leader steps down
+// before the command is committed. The command may yet be committed by the new
+// leader, so a client which retries it there should identify it with
+// CommandMeta, to have it applied at most once.
+var ErrLeadershipLost = errors.New("leadership lost before the command was committed")
+
+// ErrEntryTruncated is sent to whoever waits on a command, as CommandWait
+// does, when the command's entry is discarded from the log before it's
+// committed, e.g. because a new leader's log overwrote it. Unlike after
+// ErrLeadershipLost, the command will never be committed, so it's always safe
+// to retry. A waiter is only told once, so one already told ErrLeadershipLost,
+// as every waiter on a leader is when it steps down, isn't told again.
+var ErrEntryTruncated = errors.New("entry truncated before it was committed")
+
+// ErrRequiredPeersTimeout is returned by CommandWait when the command's entry
+// is replicated to a quorum, but not, within the timeout WithRequiredPeers
+// sets, to every required peer, so it isn't committed yet. As after
+// ErrLeadershipLost, it may yet be committed, once they catch up, so a client
+// which retries it should identify it with CommandMeta.
+var ErrRequiredPeersTimeout = errors.New("required peers didn't replicate the command in time")
+
+// pendingCommands is the registry of commands a leader has appended, but not
+// yet committed, by index. Each may have a waiter, to be told if the leader
+// steps down first. The zero value is ready to use.
+type pendingCommands struct {
+	sync.Mutex
+	waiters map[uint64]chan<- error // nil for commands nobody waits on
+}
+
+// add registers the command appended at index, with its waiter, if any, which
+// must be buffered.
+func (p *pendingCommands) add(index uint64, waiter chan<- error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.waiters == nil {
+		p.waiters = map[uint64]chan<- error{}
+	}
+	p.waiters[index] = waiter
+}
+
+// committed forgets the commands through index, which no longer need their
+// waiters.
+func (p *pendingCommands) committed(index uint64) {
+	p.Lock()
+	defer p.Unlock()
+	for i := range p.waiters {
+		if i <= index {
+			delete(p.waiters, i)
+		}
+	}
+}
+
+// fail sends err to every waiter, and forgets every command. A waiter which
+// has already been told its command was lost, e.g. with ErrEntryTruncated,
+// isn't told again.
+func (p *pendingCommands) fail(err error) {
+	p.Lock()
+	defer p.Unlock()
+	for i, waiter := range p.waiters {
+		if waiter != nil {
+			select {
+			case waiter <- err:
+			default:
+			}
+		}
+		delete(p.waiters, i)
+	}
+}
+
+// failThrough sends err to the waiters of the commands through index, and
+// forgets them, though the commands themselves may yet be committed.
+func (p *pendingCommands) failThrough(index uint64, err error) {
+	p.Lock()
+	defer p.Unlock()
+	for i, waiter := range p.waiters {
+		if i > index {
+			continue
+		}
+		if waiter != nil {
+			select {
+			case waiter <- err:
+			default:
+			}
+		}
+		delete(p.waiters, i)
+	}
+}
+
+// indices returns the indices of the pending commands, in order.
+func (p *pendingCommands) indices() []uint64 {
+	p.Lock()
+	defer p.Unlock()
+	indices := make([]uint64, 0, len(p.waiters))
+	for i := range p.waiters {
+		indices = append(indices, i)
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+	return indices
+}
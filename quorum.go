@@ -0,0 +1,102 @@
+package raft
+
+import (
+	"sort"
+)
+
+// Quorum decides how far a leader may commit, from how far its log has been
+// replicated. The leader consults the quorum of its current configuration
+// after each round of flushes.
+type Quorum interface {
+	// Committed returns the highest index which is replicated to enough of
+	// the voters to be committed, given the highest index each server is
+	// known to have, by ID, including the leader's own last index. Servers
+	// missing from matchIndexes are taken to have nothing.
+	Committed(matchIndexes map[uint64]uint64) uint64
+}
+
+// QuorumFunc returns the Quorum of the passed voters. A server builds the
+// quorum for each configuration it adopts with its QuorumFunc; see WithQuorum.
+type QuorumFunc func(voters []uint64) Quorum
+
+// NewMajorityQuorum is the default QuorumFunc. It returns a MajorityQuorum.
+func NewMajorityQuorum(voters []uint64) Quorum {
+	return MajorityQuorum(voters)
+}
+
+// MajorityQuorum is a Quorum which commits the entries replicated to a
+// majority of its voters, which are given by ID. Servers which aren't voters,
+// e.g. read replicas, don't count. A quorum with no voters commits nothing.
+type MajorityQuorum []uint64
+
+// Committed implements Quorum.
+func (q MajorityQuorum) Committed(matchIndexes map[uint64]uint64) uint64 {
+	if len(q) <= 0 {
+		return 0
+	}
+	indexes := make([]uint64, len(q))
+	for i, id := range q {
+		indexes[i] = matchIndexes[id]
+	}
+	sort.Sort(sort.Reverse(uint64Slice(indexes)))
+	return indexes[len(q)/2] // the lowest of the highest majority
+}
+
+// commitIndex returns the highest index N which a leader in currentTerm may
+// commit: the quorum has every entry through N, and the entry at N is from
+// currentTerm. It returns zero if there's no such index. termAt returns the
+// term of the entry at an index, and whether it's known.
+//
+// It needn't scan the log for N. The quorum's index is the highest any could
+// be, and terms never decrease along a log, so if the entry there is from an
+// earlier term, so is every entry before it. A leader never has entries from
+// a later term.
+func commitIndex(q Quorum, matchIndexes map[uint64]uint64, currentTerm uint64, termAt func(uint64) (uint64, bool)) uint64 {
+	index := q.Committed(matchIndexes)
+	if term, ok := termAt(index); !ok || term != currentTerm {
+		return 0
+	}
+	return index
+}
+
+// JointQuorum is the Quorum of a configuration in transition, from Old to
+// New, under joint consensus: an entry is committed only once it's committed
+// by both. If New is nil, it's just Old.
+type JointQuorum struct {
+	Old Quorum
+	New Quorum
+}
+
+// Committed implements Quorum.
+func (q JointQuorum) Committed(matchIndexes map[uint64]uint64) uint64 {
+	committed := q.Old.Committed(matchIndexes)
+	if q.New == nil {
+		return committed
+	}
+	if n := q.New.Committed(matchIndexes); n < committed {
+		committed = n
+	}
+	return committed
+}
+
+// RequiredQuorum is a Quorum which commits an entry only once Quorum does, and
+// every server in Required has it too: e.g. a replica which must hold every
+// committed entry. That's stricter than Quorum alone, so while any of them is
+// down, or behind, nothing more is committed. Required servers missing from
+// matchIndexes, i.e. not in the configuration, are ignored, so one which is
+// removed from it doesn't hold up commits forever. See WithRequiredPeers.
+type RequiredQuorum struct {
+	Quorum   Quorum
+	Required []uint64
+}
+
+// Committed implements Quorum.
+func (q RequiredQuorum) Committed(matchIndexes map[uint64]uint64) uint64 {
+	committed := q.Quorum.Committed(matchIndexes)
+	for _, id := range q.Required {
+		if index, ok := matchIndexes[id]; ok && index < committed {
+			committed = index
+		}
+	}
+	return committed
+}
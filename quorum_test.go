@@ -0,0 +1,268 @@
+package raft
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMajorityQuorum(t *testing.T) {
+	for _, tu := range []struct {
+		voters   []uint64
+		matches  map[uint64]uint64
+		expected uint64
+	}{
+		{nil, map[uint64]uint64{1: 5}, 0},
+		{[]uint64{1}, map[uint64]uint64{1: 5}, 5},
+		{[]uint64{1, 2}, map[uint64]uint64{1: 5, 2: 3}, 3},
+		{[]uint64{1, 2, 3}, map[uint64]uint64{1: 5, 2: 3, 3: 1}, 3},
+		{[]uint64{1, 2, 3}, map[uint64]uint64{1: 5}, 0},
+		{[]uint64{1, 2, 3, 4}, map[uint64]uint64{1: 5, 2: 4, 3: 3, 4: 2}, 3},
+		{[]uint64{1, 2, 3, 4, 5}, map[uint64]uint64{1: 9, 2: 9, 3: 7, 4: 1}, 7},
+		{[]uint64{1, 2, 3}, map[uint64]uint64{1: 5, 2: 5, 3: 1, 4: 9, 5: 9}, 5}, // 4 and 5 aren't voters
+	} {
+		if got := MajorityQuorum(tu.voters).Committed(tu.matches); got != tu.expected {
+			t.Errorf("%v with %v: expected %d, got %d", tu.voters, tu.matches, tu.expected, got)
+		}
+	}
+}
+
+func TestJointQuorum(t *testing.T) {
+	// from 1, 2, 3 to 3, 4, 5
+	q := JointQuorum{Old: MajorityQuorum{1, 2, 3}, New: MajorityQuorum{3, 4, 5}}
+	for _, tu := range []struct {
+		matches  map[uint64]uint64
+		expected uint64
+	}{
+		{map[uint64]uint64{1: 5, 2: 5, 3: 5, 4: 5, 5: 5}, 5},
+		{map[uint64]uint64{1: 5, 2: 5}, 0},                   // C_old alone isn't enough
+		{map[uint64]uint64{4: 5, 5: 5}, 0},                   // nor is C_new
+		{map[uint64]uint64{1: 9, 2: 9, 4: 5, 5: 4}, 4},       // each has a majority through 4
+		{map[uint64]uint64{1: 2, 3: 7, 4: 7, 5: 1, 6: 9}, 2}, // 6 is in neither
+	} {
+		if got := q.Committed(tu.matches); got != tu.expected {
+			t.Errorf("%v: expected %d, got %d", tu.matches, tu.expected, got)
+		}
+	}
+
+	// without C_new, it's just C_old
+	if expected, got := uint64(5), (JointQuorum{Old: MajorityQuorum{1, 2, 3}}).Committed(map[uint64]uint64{1: 5, 2: 5}); expected != got {
+		t.Errorf("expected %d, got %d", expected, got)
+	}
+}
+
+func TestRemovalQuorum(t *testing.T) {
+	// from 1, 2, 3 to 1, 2, where 3 is unreachable
+	c := newConfiguration(makePeerMap(nonresponsivePeer(1), nonresponsivePeer(2), nonresponsivePeer(3)))
+	if err := c.changeTo(makePeerMap(nonresponsivePeer(1), nonresponsivePeer(2))); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1 and 2 are a majority of both halves, without 3
+	if !c.pass(map[uint64]bool{1: true, 2: true}) {
+		t.Errorf("1 and 2 should pass")
+	}
+	if expected, got := uint64(5), c.quorum(nil).Committed(map[uint64]uint64{1: 5, 2: 5, 3: 0}); expected != got {
+		t.Errorf("expected %d, got %d", expected, got)
+	}
+
+	// and 3 can't stand in for either of them in C_new
+	if c.pass(map[uint64]bool{1: true, 3: true}) {
+		t.Errorf("1 and 3 shouldn't pass")
+	}
+	if expected, got := uint64(0), c.quorum(nil).Committed(map[uint64]uint64{1: 5, 2: 0, 3: 5}); expected != got {
+		t.Errorf("expected %d, got %d", expected, got)
+	}
+
+	// nor, once the change is committed, at all
+	c.changeCommitted(4)
+	if c.pass(map[uint64]bool{1: true, 3: true}) {
+		t.Errorf("after the change, 1 and 3 shouldn't pass")
+	}
+}
+
+func TestRequiredQuorum(t *testing.T) {
+	// a majority of 1, 2, 3, which also requires 3
+	q := RequiredQuorum{Quorum: MajorityQuorum{1, 2, 3}, Required: []uint64{3}}
+	for _, tu := range []struct {
+		matches  map[uint64]uint64
+		expected uint64
+	}{
+		{map[uint64]uint64{1: 5, 2: 5, 3: 5}, 5},
+		{map[uint64]uint64{1: 5, 2: 5, 3: 0}, 0}, // a majority without 3 isn't enough
+		{map[uint64]uint64{1: 5, 2: 5, 3: 4}, 4},
+		{map[uint64]uint64{1: 5, 2: 0, 3: 5}, 5}, // 3 needn't be more than a majority
+		{map[uint64]uint64{1: 5, 2: 5}, 5},       // 3 isn't in the configuration
+	} {
+		if got := q.Committed(tu.matches); got != tu.expected {
+			t.Errorf("%v: expected %d, got %d", tu.matches, tu.expected, got)
+		}
+	}
+}
+
+func TestRequiredPeers(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a leader of 3, which requires 3, which is silent, so only 2 has anything
+	timeout := 500 * time.Millisecond
+	server := NewServer(1, &bytes.Buffer{}, noop, WithRequiredPeers(timeout, 3))
+	var silent2, silent3 int32 = 0, 1
+	server.SetConfiguration(
+		newLocalPeer(server),
+		silenceablePeer{acceptingPeer{2}, &silent2},
+		silenceablePeer{acceptingPeer{3}, &silent3},
+	)
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	type result struct {
+		index uint64
+		err   error
+	}
+	command := func() <-chan result {
+		c := make(chan result, 1)
+		go func() {
+			index, _, err := server.commandWait([]byte(`{}`))
+			c <- result{index, err}
+		}()
+		return c
+	}
+
+	// waits for 3, although a majority has the command
+	c := command()
+	time.Sleep(timeout / 5)
+	select {
+	case r := <-c:
+		t.Fatalf("expected to wait for 3, got index %d, %v", r.index, r.err)
+	default:
+	}
+	if got := server.log.getCommitIndex(); got != 0 {
+		t.Fatalf("expected nothing committed without 3, got index %d", got)
+	}
+
+	// and commits it once 3 has it too
+	atomic.StoreInt32(&silent3, 0)
+	if r := <-c; r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	// but stops waiting for it after the timeout, and commits it once 3 is back
+	atomic.StoreInt32(&silent3, 1)
+	r := <-command()
+	if r.err != ErrRequiredPeersTimeout {
+		t.Fatalf("expected %v, got %v", ErrRequiredPeersTimeout, r.err)
+	}
+	if got := server.log.getCommitIndex(); got >= r.index {
+		t.Fatalf("expected index %d uncommitted without 3, got commit index %d", r.index, got)
+	}
+	atomic.StoreInt32(&silent3, 0)
+	deadline := time.Now().Add(timeout)
+	for server.log.getCommitIndex() < r.index {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected index %d committed once 3 is back, got commit index %d", r.index, server.log.getCommitIndex())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCommittablePreviousTerm(t *testing.T) {
+	// a leader in term 2, of a network of 3, with entries from term 1
+	s := &Server{
+		id:     1,
+		term:   2,
+		config: newConfiguration(makePeerMap(nonresponsivePeer(1), nonresponsivePeer(2), nonresponsivePeer(3))),
+		log:    newRaftLog(&bytes.Buffer{}, noop),
+	}
+	for _, entry := range []logEntry{
+		{Index: 1, Term: 1, Command: []byte(`{}`)},
+		{Index: 2, Term: 1, Command: []byte(`{}`)},
+		{Index: 3, Term: 2, Command: []byte(`{}`)},
+	} {
+		if err := s.log.appendEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tu := range []struct {
+		matches  map[uint64]uint64
+		expected uint64
+	}{
+		{map[uint64]uint64{1: 3, 2: 2, 3: 0}, 0}, // a majority from term 1 isn't enough
+		{map[uint64]uint64{1: 3, 2: 2, 3: 1}, 1}, // but every voter is
+		{map[uint64]uint64{1: 3, 2: 3, 3: 0}, 3}, // as is a majority from term 2
+	} {
+		if got := s.committable(tu.matches); got != tu.expected {
+			t.Errorf("%v: expected %d, got %d", tu.matches, tu.expected, got)
+		}
+	}
+}
+
+func TestCommitIndex(t *testing.T) {
+	// a log with entries 1-3 from term 1, and 4-6 from term 2
+	termAt := func(index uint64) (uint64, bool) {
+		switch {
+		case index == 0:
+			return 0, true
+		case index <= 3:
+			return 1, true
+		case index <= 6:
+			return 2, true
+		}
+		return 0, false
+	}
+
+	for _, tu := range []struct {
+		voters   []uint64
+		matches  map[uint64]uint64
+		term     uint64
+		expected uint64
+	}{
+		// the majority boundary
+		{[]uint64{1, 2, 3}, map[uint64]uint64{1: 6, 2: 5, 3: 0}, 2, 5},
+		{[]uint64{1, 2, 3}, map[uint64]uint64{1: 6, 2: 0, 3: 0}, 2, 0},
+		{[]uint64{1, 2, 3, 4}, map[uint64]uint64{1: 6, 2: 6, 3: 0, 4: 0}, 2, 0},
+		{[]uint64{1, 2, 3, 4}, map[uint64]uint64{1: 6, 2: 6, 3: 4, 4: 0}, 2, 4},
+		{[]uint64{1, 2, 3, 4, 5}, map[uint64]uint64{1: 6, 2: 6, 3: 5, 4: 4, 5: 4}, 2, 5},
+		{[]uint64{1, 2, 3, 4, 5}, map[uint64]uint64{1: 6, 2: 6, 3: 0, 4: 0, 5: 0}, 2, 0},
+
+		// term safety: the quorum's index must be from the current term
+		{[]uint64{1, 2, 3}, map[uint64]uint64{1: 6, 2: 3, 3: 3}, 2, 0},
+		{[]uint64{1, 2, 3}, map[uint64]uint64{1: 6, 2: 6, 3: 6}, 3, 0},
+		{[]uint64{1, 2, 3}, map[uint64]uint64{1: 3, 2: 3, 3: 3}, 1, 3},
+		{[]uint64{1, 2, 3}, map[uint64]uint64{1: 9, 2: 9, 3: 9}, 2, 0}, // not in the log
+	} {
+		if got := commitIndex(MajorityQuorum(tu.voters), tu.matches, tu.term, termAt); got != tu.expected {
+			t.Errorf("%v in term %d: expected %d, got %d", tu.matches, tu.term, tu.expected, got)
+		}
+	}
+}
+
+func BenchmarkCommitIndex_3Voters(b *testing.B)    { benchmarkCommitIndex(b, 3) }
+func BenchmarkCommitIndex_101Voters(b *testing.B)  { benchmarkCommitIndex(b, 101) }
+func BenchmarkCommitIndex_1001Voters(b *testing.B) { benchmarkCommitIndex(b, 1001) }
+
+func benchmarkCommitIndex(b *testing.B, n int) {
+	var (
+		voters  = make([]uint64, n)
+		matches = make(map[uint64]uint64, n)
+		termAt  = func(uint64) (uint64, bool) { return 1, true }
+	)
+	for i := range voters {
+		voters[i] = uint64(i + 1)
+		matches[voters[i]] = uint64(1000 + i*7%n)
+	}
+	q := MajorityQuorum(voters)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		commitIndex(q, matches, 1, termAt)
+	}
+}
@@ -0,0 +1,402 @@
+// Package rafttest runs networks of Raft servers in a single process, for
+// integration tests of the raft package, and of applications built on it.
+package rafttest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/raft"
+)
+
+var (
+	errNoLeader   = errors.New("no leader")
+	errTimeout    = errors.New("timeout")
+	errNoResponse = errors.New("command dropped, or its response is unknown")
+)
+
+// Entry is a command applied to a server's state machine.
+type Entry struct {
+	Index   uint64
+	Command []byte
+}
+
+// Cluster is a network of n servers, with IDs 1 to n, each with an in-memory
+// store, and a state machine which records every command it applies. The
+// servers talk to each other over HTTP, via a listener for every ordered pair
+// of servers, so that any link between two servers can be cut.
+type Cluster struct {
+	sync.RWMutex
+	nodes   map[uint64]*node
+	cut     map[[2]uint64]bool // links which are down, as {from, to}
+	options []raft.Option
+}
+
+type node struct {
+	sync.Mutex
+	id        uint64
+	server    *raft.Server
+	store     *raft.InMemoryStore
+	mux       *http.ServeMux // the HTTPTransport of server
+	peers     []raft.Peer    // as seen by server
+	applied   []Entry        // by server, since it was last (re)started
+	down      bool           // killed, and not yet restarted
+	listeners []*httptest.Server
+}
+
+// NewCluster starts a network of n servers, created with the passed options,
+// and wires them together. It doesn't wait for a leader to be elected.
+func NewCluster(n int, options ...raft.Option) (*Cluster, error) {
+	c := &Cluster{
+		nodes:   map[uint64]*node{},
+		cut:     map[[2]uint64]bool{},
+		options: options,
+	}
+	for id := uint64(1); id <= uint64(n); id++ {
+		nd := &node{id: id, store: &raft.InMemoryStore{}}
+		c.nodes[id] = nd
+		nd.reset(c.options)
+	}
+
+	// every server reaches every other (and itself) through its own listener
+	urls := map[[2]uint64]*url.URL{}
+	for from := range c.nodes {
+		for to, nd := range c.nodes {
+			l := httptest.NewServer(c.handler(from, to))
+			nd.listeners = append(nd.listeners, l)
+			u, err := url.Parse(l.URL)
+			if err != nil {
+				c.closeListeners()
+				return nil, err
+			}
+			urls[[2]uint64{from, to}] = u
+		}
+	}
+
+	for from, nd := range c.nodes {
+		peers := []raft.Peer{}
+		for to := range c.nodes {
+			peer, err := raft.NewHTTPPeer(urls[[2]uint64{from, to}])
+			if err != nil {
+				c.closeListeners()
+				return nil, err
+			}
+			peers = append(peers, peer)
+		}
+		if err := nd.server.SetConfiguration(peers...); err != nil {
+			c.closeListeners()
+			return nil, err
+		}
+		nd.peers = peers
+	}
+	for _, nd := range c.nodes {
+		nd.server.Start()
+	}
+	return c, nil
+}
+
+// reset replaces the node's server with a new one, recovered from its store,
+// whose state machine starts out empty.
+func (nd *node) reset(options []raft.Option) {
+	nd.Lock()
+	defer nd.Unlock()
+
+	nd.applied = []Entry{}
+	nd.store = nd.store.Reopen()
+	nd.server = raft.NewServer(nd.id, nd.store, nd.apply, options...)
+	nd.mux = http.NewServeMux()
+	raft.HTTPTransport(nd.mux, nd.server)
+	nd.down = false
+}
+
+func (nd *node) apply(index uint64, cmd []byte) []byte {
+	nd.Lock()
+	defer nd.Unlock()
+	nd.applied = append(nd.applied, Entry{index, append([]byte{}, cmd...)})
+	return cmd
+}
+
+// handler passes requests from one server to another, unless the link between
+// them is cut, or the recipient is down.
+func (c *Cluster) handler(from, to uint64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.reachable(from, to) {
+			http.Error(w, "unreachable", http.StatusServiceUnavailable)
+			return
+		}
+		nd := c.node(to)
+		nd.Lock()
+		mux := nd.mux
+		nd.Unlock()
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (c *Cluster) node(id uint64) *node {
+	c.RLock()
+	defer c.RUnlock()
+	nd, ok := c.nodes[id]
+	if !ok {
+		panic(fmt.Sprintf("no server %d", id))
+	}
+	return nd
+}
+
+// reachable returns true if a request from one server can reach another.
+func (c *Cluster) reachable(from, to uint64) bool {
+	c.RLock()
+	cut := c.cut[[2]uint64{from, to}]
+	nd := c.nodes[to]
+	c.RUnlock()
+
+	nd.Lock()
+	defer nd.Unlock()
+	return !cut && !nd.down
+}
+
+// Server returns the server with the passed ID.
+func (c *Cluster) Server(id uint64) *raft.Server {
+	nd := c.node(id)
+	nd.Lock()
+	defer nd.Unlock()
+	return nd.server
+}
+
+// Kill stops the server with the passed ID. Its store survives, so it can be
+// restarted.
+func (c *Cluster) Kill(id uint64) {
+	nd := c.node(id)
+	nd.Lock()
+	nd.down = true
+	server := nd.server
+	nd.Unlock()
+	server.Stop()
+}
+
+// Restart starts a new server in place of a killed one, over the same store,
+// and with the same peers. Its state machine starts out empty, and the
+// recovered log is applied to it again.
+func (c *Cluster) Restart(id uint64) error {
+	nd := c.node(id)
+	nd.Lock()
+	down := nd.down
+	nd.Unlock()
+	if !down {
+		return fmt.Errorf("server %d is running", id)
+	}
+
+	nd.reset(c.options)
+	if err := nd.server.SetConfiguration(nd.peers...); err != nil {
+		return err
+	}
+	nd.server.Start()
+	return nil
+}
+
+// Partition cuts every link between servers in different groups. Servers in
+// no group are cut off from all the others. Any previous partition is healed
+// first.
+func (c *Cluster) Partition(groups ...[]uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	group := map[uint64]int{}
+	for i, ids := range groups {
+		for _, id := range ids {
+			group[id] = i + 1
+		}
+	}
+	c.cut = map[[2]uint64]bool{}
+	for from := range c.nodes {
+		for to := range c.nodes {
+			if from != to && (group[from] == 0 || group[from] != group[to]) {
+				c.cut[[2]uint64{from, to}] = true
+			}
+		}
+	}
+}
+
+// Heal restores every link between servers.
+func (c *Cluster) Heal() {
+	c.Lock()
+	defer c.Unlock()
+	c.cut = map[[2]uint64]bool{}
+}
+
+// Leader returns the ID of a running server which believes it's the leader,
+// and which a majority of the servers, itself included, can reach, and
+// recognize as the leader. A deposed leader which hasn't yet heard of its
+// successor is therefore never returned.
+func (c *Cluster) Leader() (uint64, bool) {
+	c.RLock()
+	ids := make([]uint64, 0, len(c.nodes))
+	for id := range c.nodes {
+		ids = append(ids, id)
+	}
+	c.RUnlock()
+
+	for _, id := range ids {
+		if server, ok := c.running(id); !ok || server.Stats().State != "Leader" {
+			continue
+		}
+		followers := 0
+		for _, to := range ids {
+			server, ok := c.running(to)
+			if ok && c.reachable(id, to) && seenLeader(server) == id {
+				followers++
+			}
+		}
+		if followers > len(ids)/2 {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// running returns the server with the passed ID, unless it's been killed.
+func (c *Cluster) running(id uint64) (*raft.Server, bool) {
+	nd := c.node(id)
+	nd.Lock()
+	defer nd.Unlock()
+	return nd.server, !nd.down
+}
+
+// seenLeader returns the leader the server has observed, without waiting for
+// one.
+func seenLeader(server *raft.Server) uint64 {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	id, _ := server.WaitForLeader(ctx)
+	return id
+}
+
+// WaitForLeader blocks until there's a leader, as defined by Leader, and
+// returns its ID, or fails after the timeout.
+func (c *Cluster) WaitForLeader(timeout time.Duration) (uint64, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if id, ok := c.Leader(); ok {
+			return id, nil
+		}
+		if time.Now().After(deadline) {
+			return 0, errNoLeader
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// SubmitAndWait submits cmd to the leader, once there is one, and waits for it
+// to be applied there. It returns the leader's response, which is cmd itself.
+// A command the leader accepts is never resubmitted, so it's applied at most
+// once, even if SubmitAndWait times out; if the leader is deposed before it's
+// committed, it may be dropped instead.
+func (c *Cluster) SubmitAndWait(cmd []byte, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for {
+		id, err := c.WaitForLeader(time.Until(deadlineOf(ctx)))
+		if err != nil {
+			return nil, err
+		}
+		response := make(chan []byte, 1)
+		if err := c.Server(id).Command(cmd, response); err != nil {
+			select {
+			case <-ctx.Done():
+				return nil, err
+			case <-time.After(10 * time.Millisecond):
+				continue // the leader moved on; try the next one
+			}
+		}
+		select {
+		case resp, ok := <-response:
+			if !ok {
+				return nil, errNoResponse
+			}
+			return resp, nil
+		case <-ctx.Done():
+			return nil, errTimeout
+		}
+	}
+}
+
+func deadlineOf(ctx context.Context) time.Time {
+	deadline, _ := ctx.Deadline()
+	return deadline
+}
+
+// Applied returns the commands applied by the server with the passed ID, in
+// order, since it was last (re)started.
+func (c *Cluster) Applied(id uint64) []Entry {
+	nd := c.node(id)
+	nd.Lock()
+	defer nd.Unlock()
+	return append([]Entry{}, nd.applied...)
+}
+
+// AssertLogsConsistent checks that the servers' state machines agree: of any
+// two servers, the one which has applied fewer commands has applied the same
+// commands, at the same indexes, as the other did first. It returns an error
+// describing the first disagreement it finds.
+func (c *Cluster) AssertLogsConsistent() error {
+	c.RLock()
+	ids := make([]uint64, 0, len(c.nodes))
+	for id := range c.nodes {
+		ids = append(ids, id)
+	}
+	c.RUnlock()
+
+	var (
+		longest   []Entry
+		longestID uint64
+	)
+	for _, id := range ids {
+		if applied := c.Applied(id); len(applied) > len(longest) {
+			longest, longestID = applied, id
+		}
+	}
+	for _, id := range ids {
+		for i, entry := range c.Applied(id) {
+			if other := longest[i]; entry.Index != other.Index || !bytes.Equal(entry.Command, other.Command) {
+				return fmt.Errorf(
+					"server %d applied %q at index %d, but server %d applied %q at index %d",
+					id, entry.Command, entry.Index, longestID, other.Command, other.Index,
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// Close stops every server, and closes every listener.
+func (c *Cluster) Close() {
+	c.RLock()
+	for _, nd := range c.nodes {
+		nd.Lock()
+		down, server := nd.down, nd.server
+		nd.down = true
+		nd.Unlock()
+		if !down {
+			server.Stop()
+		}
+	}
+	c.RUnlock()
+	c.closeListeners()
+}
+
+func (c *Cluster) closeListeners() {
+	c.RLock()
+	defer c.RUnlock()
+	for _, nd := range c.nodes {
+		for _, l := range nd.listeners {
+			l.Close()
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package rafttest
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCluster(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+
+	c, err := NewCluster(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	submit := func(cmd string) {
+		resp, err := c.SubmitAndWait([]byte(cmd), 10*time.Second)
+		if err != nil {
+			t.Fatalf("%s: %s", cmd, err)
+		}
+		if expected, got := cmd, string(resp); expected != got {
+			t.Errorf("%s: expected response %q, got %q", cmd, expected, got)
+		}
+	}
+
+	// elects a leader, which commits a command
+	first, err := c.WaitForLeader(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	submit("a")
+
+	// elects another, once the first is partitioned from the others
+	others := []uint64{}
+	for id := uint64(1); id <= 3; id++ {
+		if id != first {
+			others = append(others, id)
+		}
+	}
+	c.Partition([]uint64{first}, others)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if id, ok := c.Leader(); ok && id != first {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no new leader after a partition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Heal()
+	submit("b")
+
+	// survives a follower's restart
+	follower := others[0]
+	if leader, _ := c.Leader(); leader == follower {
+		follower = others[1]
+	}
+	c.Kill(follower)
+	if err := c.Restart(follower); err != nil {
+		t.Fatal(err)
+	}
+	submit("c")
+
+	// and every server eventually applies the same commands
+	deadline = time.Now().Add(10 * time.Second)
+	for id := uint64(1); id <= 3; id++ {
+		for len(c.Applied(id)) < 3 {
+			if time.Now().After(deadline) {
+				t.Fatalf("server %d applied only %d commands", id, len(c.Applied(id)))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if err := c.AssertLogsConsistent(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLeaderHistory(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+
+	c, err := NewCluster(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// two failovers, each after the leader is killed
+	first, err := c.WaitForLeader(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Kill(first)
+	second, err := c.WaitForLeader(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Restart(first); err != nil {
+		t.Fatal(err)
+	}
+	c.Kill(second)
+	third, err := c.WaitForLeader(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// are recorded, in order, by the server which stayed up throughout
+	survivor := uint64(6) - first - second
+	leaders := []uint64{}
+	var term uint64
+	for _, change := range c.Server(survivor).LeaderHistory() {
+		if change.Term <= term {
+			t.Errorf("terms out of order: %+v", c.Server(survivor).LeaderHistory())
+		}
+		term = change.Term
+		leaders = append(leaders, change.Leader)
+	}
+	expected := []uint64{first, second, third}
+	for _, leader := range leaders {
+		if len(expected) > 0 && leader == expected[0] {
+			expected = expected[1:]
+		}
+	}
+	if len(expected) > 0 || leaders[len(leaders)-1] != third {
+		t.Errorf("expected leaders %d, %d, %d, in order, got %v", first, second, third, leaders)
+	}
+}
@@ -0,0 +1,456 @@
+package raft
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errLeaseExpired = errors.New("leader lease expired")
+	errNoReadFunc   = errors.New("no ReadFunc configured")
+)
+
+// ReadFunc is a client-provided function that answers query from the local
+// state machine, without changing it. It may be called concurrently with the
+// ApplyFunc, and with itself. See WithReadFunc.
+type ReadFunc func(query []byte) []byte
+
+// lease is a leader's assurance that no other leader can have been elected.
+// Followers don't start an election until at least the minimum election timeout
+// after they last heard from the leader, so once a quorum of followers has
+// acknowledged flushes that began at time t or later, no other server can
+// become leader before t + minimumElectionTimeout, as measured by their clocks.
+// Ours may run slow, so the lease ends a little earlier; see
+// WithMaxClockDrift. The acknowledgements needn't come from the same flush;
+// see quorumAckedSince.
+//
+// The lease is invalidated as soon as the server sees a higher term or stops
+// being leader. Every invalidation bumps the epoch, so that a flush which began
+// under an old lease can't extend a new one, and so that a read which began
+// under the lease can tell the lease was lost while it was in progress.
+type lease struct {
+	sync.Mutex
+	term  uint64
+	until time.Time
+	epoch uint64
+}
+
+// current returns the epoch of the lease.
+func (l *lease) current() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.epoch
+}
+
+// extend pushes out the expiry of the lease, provided it hasn't been
+// invalidated since epoch.
+func (l *lease) extend(epoch, term uint64, until time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	if epoch != l.epoch || until.Before(l.until) {
+		return
+	}
+	l.term, l.until = term, until
+}
+
+// invalidate revokes the lease.
+func (l *lease) invalidate() {
+	l.Lock()
+	defer l.Unlock()
+	l.epoch++
+	l.term, l.until = 0, time.Time{}
+}
+
+// rebase forgets when the lease runs out, without invalidating it, after our
+// clock jumps: the expiry was reckoned by the clock's old readings, so it means
+// nothing by the new ones, and may well be later than any the lease is
+// extended to. Until a quorum acknowledges another flush, it isn't held, and
+// no leadership is confirmed.
+func (l *lease) rebase() {
+	l.Lock()
+	defer l.Unlock()
+	l.until = time.Time{}
+}
+
+// expiry returns the epoch of the lease, and when it runs out. That's the zero
+// time if it isn't held.
+func (l *lease) expiry() (uint64, time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	if l.term == 0 {
+		return l.epoch, time.Time{}
+	}
+	return l.epoch, l.until
+}
+
+// held returns true if the lease is still held at the given time, and hasn't
+// been invalidated since epoch.
+func (l *lease) held(epoch uint64, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	return epoch == l.epoch && l.term > 0 && now.Before(l.until)
+}
+
+// established returns true if the lease has been taken, though not
+// necessarily still held, since epoch.
+func (l *lease) established(epoch uint64) bool {
+	l.Lock()
+	defer l.Unlock()
+	return epoch == l.epoch && l.term > 0
+}
+
+// confirmedSince returns true if a flush which began at or after t has been
+// acknowledged by a quorum, in a lease of duration d that hasn't been
+// invalidated since epoch.
+func (l *lease) confirmedSince(epoch uint64, t time.Time, d time.Duration) bool {
+	l.Lock()
+	defer l.Unlock()
+	return epoch == l.epoch && l.term > 0 && !l.until.Add(-d).Before(t)
+}
+
+// quorumAckedSince returns the latest time t such that a quorum, as judged by
+// pass, has acknowledged flushes which began at t or later. acked holds, for
+// each server, when the latest flush it acknowledged began; the leader counts
+// as acknowledging every flush it sends. It returns false if there's no such
+// quorum.
+func quorumAckedSince(acked map[uint64]time.Time, pass func(map[uint64]bool) bool) (time.Time, bool) {
+	times := make([]time.Time, 0, len(acked))
+	for _, t := range acked {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+
+	votes := map[uint64]bool{}
+	for _, t := range times {
+		for id, at := range acked {
+			votes[id] = !at.Before(t)
+		}
+		if pass(votes) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// extendLease extends the lease after a quorum acknowledged flushes which began
+// at the passed time or later. A new leader only takes a lease once it's
+// committed every entry it inherited, which happens no later than the first
+// commit of an entry from its own term. Before then, there may be committed
+// entries which it hasn't applied.
+func (s *Server) extendLease(epoch uint64, began time.Time, inherited uint64) {
+	if s.log.getCommitIndex() < inherited {
+		return
+	}
+	s.lease.extend(epoch, s.term, began.Add(s.leaseDuration()))
+}
+
+// leaseDuration is how long a lease lasts, from the beginning of the flush
+// which earned it.
+func (s *Server) leaseDuration() time.Duration {
+	return minimumElectionTimeout() - s.maxDrift()
+}
+
+// maxDrift is how far the lease allows clocks to drift; see WithMaxClockDrift.
+func (s *Server) maxDrift() time.Duration {
+	if s.clockDrift <= 0 {
+		return broadcastInterval()
+	}
+	return s.clockDrift
+}
+
+// clockAnomalies counts the times a leader has caught its clock disagreeing
+// with the monotonic clock, and records whether it's disabled leasing as a
+// result. See checkClock.
+type clockAnomalies struct {
+	count    int   // only touched by the server's goroutine
+	disabled int32 // set once leasing is disabled, for good
+}
+
+func (a *clockAnomalies) leasingDisabled() bool {
+	return atomic.LoadInt32(&a.disabled) != 0
+}
+
+// checkClock compares the time since the previous flush by our clock with the
+// time by the monotonic clock. A lease assumes our clock keeps time, give or
+// take the drift it allows, so each time they disagree by more is an anomaly,
+// and after WithLeaseAnomalyThreshold of them, leasing is disabled. Whatever
+// the threshold, the lease is rebased, since we can't tell how long it has
+// left. It returns true for an anomaly.
+func (s *Server) checkClock(byClock, byMono time.Duration) bool {
+	discrepancy := byClock - byMono
+	if discrepancy < 0 {
+		discrepancy = -discrepancy
+	}
+	if discrepancy <= s.maxDrift() || s.anomalyThreshold < 0 {
+		return false
+	}
+	s.anomalies.count++
+	s.lease.rebase()
+	s.logGeneric("clock anomaly: %s since the last flush by our clock, but %s by the monotonic clock", byClock, byMono)
+	threshold := s.anomalyThreshold
+	if threshold == 0 {
+		threshold = 1
+	}
+	if s.anomalies.count >= threshold && !s.anomalies.leasingDisabled() {
+		s.logGeneric("WARNING: leasing disabled after %d clock anomalies", s.anomalies.count)
+		atomic.StoreInt32(&s.anomalies.disabled, 1)
+		s.events.leaseDisabled(discrepancy)
+	}
+	return true
+}
+
+// LeaseValidUntil returns when this server's lease runs out, or the zero time
+// if it doesn't hold one, e.g. because it isn't the leader. Until then, no
+// other server can have been elected, provided clocks drift by no more than
+// WithMaxClockDrift allows. The lease is renewed as followers acknowledge
+// heartbeats, so it lapses an election timeout, less drift, after the last
+// flush a quorum acknowledged. Once leasing is disabled, it's always the zero
+// time; see WithLeaseAnomalyThreshold.
+func (s *Server) LeaseValidUntil() time.Time {
+	if s.anomalies.leasingDisabled() {
+		return time.Time{}
+	}
+	_, until := s.lease.expiry()
+	return until
+}
+
+// A server answers reads in one of three modes, from strongest to weakest:
+//
+//   - ConsistentRead is linearizable, whatever the clocks do. It's the default,
+//     and the one to use unless there's a reason not to.
+//   - LeaseRead is linearizable provided clocks drift no more than
+//     WithMaxClockDrift allows, and saves a round-trip to the followers.
+//   - StaleRead answers from whatever this server has applied, which may be
+//     arbitrarily out of date.
+//
+// The weaker modes are only ever used when they're asked for by name.
+
+// ConsistentRead answers query with the ReadFunc, from a state machine which
+// reflects every command committed before ConsistentRead was called, so reads
+// are linearizable, like commands, without being appended to the log. It's the
+// read counterpart of Command. If this server is the leader, it answers the
+// query itself; otherwise it forwards the query to the leader, through its
+// peer. A leader whose transport predates forwarded reads fails them with
+// ErrUnsupportedRPC, and an HTTP peer then fails any more without a round
+// trip, until the leader is upgraded; reads can still be made on the leader.
+//
+// The leader performs a ReadIndex: it notes its commit index, waits until a
+// quorum has acknowledged a flush which began after the query arrived, so it
+// knows it was still the leader, and then waits for its state machine to catch
+// up with the noted index. It doesn't depend on clocks at all, but it costs a
+// round-trip to the followers. A newly elected leader may not yet know which
+// of the entries it inherited are committed, so until it's committed an entry
+// from its own term, it appends a no-op, and waits for that to commit before
+// noting its commit index.
+func (s *Server) ConsistentRead(query []byte) ([]byte, error) {
+	if s.state.Get() == leader {
+		return s.readIndex(query)
+	}
+	id, _ := s.seen.Get()
+	if id == unknownLeader {
+		return nil, errUnknownLeader
+	}
+	peer, ok := s.config.get(id)
+	if !ok {
+		return nil, errUnknownLeader
+	}
+	return peer.callRead(query)
+}
+
+// LeaseRead invokes read against the local state machine, and returns its
+// result, provided this server is the leader and holds a valid lease. Lease
+// reads don't require a round-trip to the followers, but they assume bounded
+// clock drift between servers: if another server's clock runs faster than
+// WithMaxClockDrift allows, it may have been elected, and have committed
+// commands, which the result doesn't reflect. Prefer ConsistentRead unless
+// the round-trip matters more.
+//
+// Before read is invoked, the state machine is brought up to date with the
+// commit index. Leadership is checked both before and after read is invoked. If
+// the server steps down while read is in progress, the result is discarded and
+// an error is returned, since it may no longer reflect the authoritative state.
+// LeaseRead is never forwarded.
+//
+// Once the server has caught its clock misbehaving, and disabled leasing (see
+// WithLeaseAnomalyThreshold), a leader confirms its leadership for each read
+// with a ReadIndex instead, as ConsistentRead does, and other servers fail.
+func (s *Server) LeaseRead(read func() []byte) ([]byte, error) {
+	if s.anomalies.leasingDisabled() {
+		if s.state.Get() != leader {
+			return nil, errNotLeader
+		}
+		return s.confirmedRead(read)
+	}
+	epoch, until := s.lease.expiry()
+	if !s.now().Before(until) {
+		return nil, errLeaseExpired
+	}
+	for commitIndex := s.log.getCommitIndex(); s.log.getAppliedTo() < commitIndex; {
+		if !s.lease.held(epoch, s.now()) {
+			return nil, errLeaseExpired
+		}
+		time.Sleep(time.Millisecond)
+	}
+	resp := read()
+	if !s.lease.held(epoch, s.now()) {
+		return nil, errLeaseExpired
+	}
+	return resp, nil
+}
+
+// StaleRead answers query with the ReadFunc, from this server's state machine
+// as it stands, on any server, leader or not, without consulting anyone. The
+// result reflects only committed commands, and never goes backwards on the
+// same server, but it may be arbitrarily out of date: the server may be
+// partitioned from the leader, or deposed without knowing it. It suits reads
+// which can tolerate that, e.g. to spread load across followers.
+func (s *Server) StaleRead(query []byte) ([]byte, error) {
+	if s.readFunc == nil {
+		return nil, errNoReadFunc
+	}
+	return s.readFunc(query), nil
+}
+
+// readIndex answers query as the leader. See ConsistentRead.
+func (s *Server) readIndex(query []byte) ([]byte, error) {
+	if s.readFunc == nil {
+		return nil, errNoReadFunc
+	}
+	return s.confirmedRead(func() []byte { return s.readFunc(query) })
+}
+
+// confirmedRead invokes read once our state machine reflects every command
+// committed before confirmedRead was called, as we confirm with a ReadIndex.
+// It gives up if the state machine hasn't caught up within an election
+// timeout, e.g. with WithManualApply, if nothing drains it; or if we stop
+// being the leader meanwhile. See ConsistentRead.
+func (s *Server) confirmedRead(read func() []byte) ([]byte, error) {
+	if err := s.commitInTerm(); err != nil {
+		return nil, err
+	}
+	commitIndex := s.log.getCommitIndex()
+	if err := s.confirmLeadership(); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(maximumElectionTimeout())
+	for s.log.getAppliedTo() < commitIndex {
+		if !s.leading() {
+			return nil, errNotLeader
+		}
+		if time.Now().After(deadline) {
+			return nil, errTimeout
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return read(), nil
+}
+
+// leading returns true if we're the leader, and haven't been stopped.
+func (s *Server) leading() bool {
+	select {
+	case <-s.stopped:
+		return false
+	default:
+		return s.state.Get() == leader
+	}
+}
+
+// pendingNoOp is the no-op a new leader appends so that reads can proceed;
+// see commitInTerm. There's at most one per lease epoch, however many reads
+// are waiting for it.
+type pendingNoOp struct {
+	sync.Mutex
+	epoch   uint64
+	claimed bool   // by the read appending it
+	index   uint64 // once it's appended
+}
+
+// claim returns true if the caller should append the no-op for epoch, because
+// nobody else has, and isn't doing so.
+func (p *pendingNoOp) claim(epoch uint64) bool {
+	p.Lock()
+	defer p.Unlock()
+	if p.epoch == epoch && p.claimed {
+		return false
+	}
+	p.epoch, p.claimed, p.index = epoch, true, 0
+	return true
+}
+
+// appended records the index of the no-op for epoch, or, if index is 0, that
+// it couldn't be appended, so another read may try.
+func (p *pendingNoOp) appended(epoch, index uint64) {
+	p.Lock()
+	defer p.Unlock()
+	if p.epoch != epoch {
+		return
+	}
+	p.claimed, p.index = index != 0, index
+}
+
+// commitInTerm waits until we, as leader, have committed every entry we
+// inherited, which we take the lease to mean; see extendLease. If we haven't,
+// a no-op is appended, since entries from an earlier term are only committed
+// along with one from ours; concurrent reads share the one no-op.
+func (s *Server) commitInTerm() error {
+	epoch := s.lease.current()
+	if s.lease.established(epoch) {
+		return nil
+	}
+	if s.noOp.claim(epoch) {
+		var (
+			err   = make(chan error)
+			index uint64
+		)
+		select {
+		case s.commandChan <- commandTuple{Command: []byte{}, Err: err, Index: &index, Kind: kindNoOp, admitted: true}:
+		case <-s.stopped:
+			s.noOp.appended(epoch, 0)
+			return errNotLeader
+		}
+		if e := <-err; e != nil {
+			s.noOp.appended(epoch, 0)
+			return e
+		}
+		s.noOp.appended(epoch, index)
+	}
+
+	deadline := time.Now().Add(maximumElectionTimeout())
+	for !s.lease.established(epoch) {
+		if s.lease.current() != epoch || !s.leading() {
+			return errNotLeader
+		}
+		if time.Now().After(deadline) {
+			return errTimeout
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+// confirmLeadership waits until a quorum has acknowledged a flush which began
+// after it was called, so we know we were still the leader then.
+func (s *Server) confirmLeadership() error {
+	if s.state.Get() != leader {
+		return errNotLeader
+	}
+
+	var (
+		epoch    = s.lease.current()
+		start    = s.now()
+		deadline = time.Now().Add(maximumElectionTimeout())
+	)
+	for !s.lease.confirmedSince(epoch, start, s.leaseDuration()) {
+		if !s.leading() {
+			return errNotLeader
+		}
+		if time.Now().After(deadline) {
+			return errTimeout
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
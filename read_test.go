@@ -0,0 +1,613 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLeaseRead(t *testing.T) {
+	// a leader in term=2, which holds a lease
+	s := Server{
+		id:     1,
+		term:   2,
+		state:  &protectedString{value: leader},
+		leader: 1,
+		log:    newRaftLog(&bytes.Buffer{}, noop),
+		now:    time.Now,
+	}
+	s.lease.extend(s.lease.current(), s.term, time.Now().Add(time.Minute))
+
+	// can serve reads
+	resp, err := s.LeaseRead(func() []byte { return []byte(`ok`) })
+	if err != nil {
+		t.Fatalf("lease read: %s", err)
+	}
+	if expected, got := `ok`, string(resp); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	// but not once the lease runs out
+	s.lease.invalidate()
+	s.lease.extend(s.lease.current(), s.term, time.Now().Add(-time.Millisecond))
+	if _, err := s.LeaseRead(func() []byte { return []byte(`stale`) }); err != errLeaseExpired {
+		t.Errorf("expired lease: expected %v, got %v", errLeaseExpired, err)
+	}
+}
+
+func TestLeaseReadRacesStepDown(t *testing.T) {
+	// a leader in term=2, which holds a lease
+	s := Server{
+		id:     1,
+		term:   2,
+		state:  &protectedString{value: leader},
+		leader: 1,
+		log:    newRaftLog(&bytes.Buffer{}, noop),
+		now:    time.Now,
+	}
+	s.lease.extend(s.lease.current(), s.term, time.Now().Add(time.Minute))
+
+	// while a lease read is in progress, it hears from a leader in term=3
+	resp, err := s.LeaseRead(func() []byte {
+		s.handleAppendEntries(appendEntries{Term: 3, LeaderID: 2})
+		return []byte(`stale`)
+	})
+
+	// so the read should fail, rather than return possibly-stale data
+	if err != errLeaseExpired {
+		t.Errorf("expected %v, got %v (%q)", errLeaseExpired, err, resp)
+	}
+
+	// and a flush that began under the old lease can't renew it
+	epoch := s.lease.current() - 1
+	s.lease.extend(epoch, 2, time.Now().Add(time.Minute))
+	if _, until := s.lease.expiry(); time.Now().Before(until) {
+		t.Errorf("lease was renewed by a flush from before the step-down")
+	}
+}
+
+func TestLeaseAwaitsInheritedEntries(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	for _, inherit := range []bool{false, true} {
+		// a leader of 3, which can reach a quorum, but can't commit, because
+		// one follower never answers
+		s := NewServer(1, &bytes.Buffer{}, noop, WithUnsafeOperations())
+		s.SetConfiguration(newLocalPeer(s), &countingPeer{id_: 2}, nonresponsivePeer(3))
+		if inherit {
+			// and which inherited an entry it doesn't know is committed
+			if err := s.log.appendEntry(logEntry{Index: 1, Term: 1, Command: []byte(`{}`)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.ForceLeadership(2); err != nil {
+			t.Fatal(err)
+		}
+		s.Start()
+		time.Sleep(minimumElectionTimeout())
+
+		// should only take a lease if it inherited nothing
+		_, err := s.LeaseRead(func() []byte { return nil })
+		s.Stop()
+		if inherit && err != errLeaseExpired {
+			t.Errorf("with an inherited entry: expected %v, got %v", errLeaseExpired, err)
+		}
+		if !inherit && err != nil {
+			t.Errorf("without an inherited entry: %s", err)
+		}
+	}
+}
+
+func TestLeaseExpiresWhenQuorumSilent(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a leader of 3, on a clock which only moves when we move it, which would
+	// otherwise count as a clock anomaly
+	clock := &fakeClock{t: time.Now()}
+	server := NewServer(1, &bytes.Buffer{}, noop, WithLeaseAnomalyThreshold(-1))
+	server.now = clock.now
+	var silent2, silent3 int32
+	server.SetConfiguration(
+		newLocalPeer(server),
+		silenceablePeer{acceptingPeer{2}, &silent2},
+		silenceablePeer{acceptingPeer{3}, &silent3},
+	)
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	d := server.leaseDuration()
+	waitForLease := func(expected time.Time) {
+		deadline := time.Now().Add(4 * maximumElectionTimeout())
+		for !server.LeaseValidUntil().Equal(expected) {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected lease until %s, got %s", expected, server.LeaseValidUntil())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// holds a lease while its followers acknowledge heartbeats
+	waitForLease(clock.now().Add(d))
+
+	// and while a quorum does, counting itself
+	atomic.StoreInt32(&silent2, 1)
+	clock.advance(10 * time.Millisecond)
+	waitForLease(clock.now().Add(d))
+
+	// but once a quorum goes silent, the lease isn't renewed
+	atomic.StoreInt32(&silent3, 1)
+	until := server.LeaseValidUntil()
+	clock.advance(10 * time.Millisecond)
+	time.Sleep(4 * broadcastInterval())
+	if expected, got := until, server.LeaseValidUntil(); !expected.Equal(got) {
+		t.Errorf("expected lease until %s, got %s", expected, got)
+	}
+
+	// and expires
+	clock.advance(d)
+	if _, err := server.LeaseRead(func() []byte { return nil }); err != errLeaseExpired {
+		t.Errorf("expected %v, got %v", errLeaseExpired, err)
+	}
+}
+
+// silenceablePeer acknowledges everything, until it's silenced.
+type silenceablePeer struct {
+	acceptingPeer
+	silent *int32
+}
+
+func (p silenceablePeer) callAppendEntries(ae appendEntries) appendEntriesResponse {
+	if atomic.LoadInt32(p.silent) != 0 {
+		return appendEntriesResponse{}
+	}
+	return p.acceptingPeer.callAppendEntries(ae)
+}
+
+func TestLeaseDisabledByClockJump(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a leader of 3, on a clock which keeps time until it's stepped
+	clock := &steppableClock{}
+	disabled := make(chan time.Duration, 1)
+	server := NewServer(1, &bytes.Buffer{}, noop, WithEvents(Events{
+		OnLeaseDisabled: func(discrepancy time.Duration) { disabled <- discrepancy },
+	}))
+	server.now = clock.now
+	var silent int32
+	server.SetConfiguration(
+		newLocalPeer(server),
+		silenceablePeer{acceptingPeer{2}, &silent},
+		silenceablePeer{acceptingPeer{3}, &silent},
+	)
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+	read := func() []byte { return []byte("ok") }
+
+	// reads under its lease
+	deadline := time.Now().Add(4 * maximumElectionTimeout())
+	for server.LeaseValidUntil().IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("no lease")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := server.LeaseRead(read); err != nil {
+		t.Fatal(err)
+	}
+
+	// until its clock is stepped back an hour, which would make the lease
+	// look good for an hour, so it disables leasing
+	clock.step(-time.Hour)
+	select {
+	case discrepancy := <-disabled:
+		if discrepancy < time.Hour-time.Second {
+			t.Errorf("expected a discrepancy of about an hour, got %s", discrepancy)
+		}
+	case <-time.After(maximumElectionTimeout()):
+		t.Fatal("leasing wasn't disabled")
+	}
+	if got := server.LeaseValidUntil(); !got.IsZero() {
+		t.Errorf("expected no lease, got one until %s", got)
+	}
+
+	// and falls back to a ReadIndex, which needs its followers
+	atomic.StoreInt32(&silent, 1)
+	if _, err := server.LeaseRead(read); err != errTimeout {
+		t.Errorf("with its followers silent, expected %v, got %v", errTimeout, err)
+	}
+	atomic.StoreInt32(&silent, 0)
+	if resp, err := server.LeaseRead(read); err != nil || string(resp) != "ok" {
+		t.Errorf("expected ok, got %q, %v", resp, err)
+	}
+}
+
+// steppableClock keeps real time, give or take however far it's been stepped.
+type steppableClock struct{ offset int64 }
+
+func (c *steppableClock) now() time.Time {
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&c.offset)))
+}
+
+func (c *steppableClock) step(d time.Duration) { atomic.AddInt64(&c.offset, int64(d)) }
+
+func TestConsistentRead(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 3, each of whose state machines holds the last command
+	servers := []*Server{}
+	for id := uint64(1); id <= 3; id++ {
+		var (
+			mu   sync.Mutex
+			last []byte
+		)
+		apply := func(_ uint64, cmd []byte) []byte {
+			mu.Lock()
+			defer mu.Unlock()
+			last = cmd
+			return []byte{}
+		}
+		read := func([]byte) []byte {
+			mu.Lock()
+			defer mu.Unlock()
+			return last
+		}
+		servers = append(servers, NewServer(id, &bytes.Buffer{}, apply, WithReadFunc(read)))
+	}
+	peers := []Peer{}
+	for _, server := range servers {
+		peers = append(peers, newLocalPeer(server))
+	}
+	for _, server := range servers {
+		server.SetConfiguration(peers...)
+		server.Start()
+		defer server.Stop()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*maximumElectionTimeout())
+	defer cancel()
+	id, err := servers[0].WaitForLeader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var follower *Server
+	for _, server := range servers {
+		if server.id != id {
+			follower = server
+			break
+		}
+	}
+
+	// a command committed through the leader
+	response := make(chan []byte, 1)
+	if err := servers[id-1].Command([]byte(`written`), response); err != nil {
+		t.Fatal(err)
+	}
+	<-response
+
+	// is seen by a read through a follower
+	resp, err := follower.ConsistentRead([]byte(`query`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := `written`, string(resp); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestConsistentReadAnywhere(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 3, each of whose state machines holds the last command
+	servers := []*Server{}
+	for id := uint64(1); id <= 3; id++ {
+		var (
+			mu   sync.Mutex
+			last []byte
+		)
+		apply := func(_ uint64, cmd []byte) []byte {
+			mu.Lock()
+			defer mu.Unlock()
+			last = cmd
+			return []byte{}
+		}
+		read := func([]byte) []byte {
+			mu.Lock()
+			defer mu.Unlock()
+			return last
+		}
+		servers = append(servers, NewServer(id, &bytes.Buffer{}, apply, WithReadFunc(read)))
+	}
+	peers := []Peer{}
+	for _, server := range servers {
+		peers = append(peers, newLocalPeer(server))
+	}
+	for _, server := range servers {
+		server.SetConfiguration(peers...)
+		server.Start()
+		defer server.Stop()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*maximumElectionTimeout())
+	defer cancel()
+	id, err := servers[0].WaitForLeader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each query, wherever it's made, sees the latest committed write
+	for i := 0; i < 5; i++ {
+		written := fmt.Sprintf("written %d", i)
+		if _, err := servers[id-1].CommandWait([]byte(written)); err != nil {
+			t.Fatal(err)
+		}
+		for _, server := range servers {
+			resp, err := server.ConsistentRead([]byte(`query`))
+			if err != nil {
+				t.Fatalf("%d: %s", server.id, err)
+			}
+			if expected, got := written, string(resp); expected != got {
+				t.Errorf("%d: expected %q, got %q", server.id, expected, got)
+			}
+		}
+	}
+
+	// but a leader can't answer without a ReadFunc
+	server := NewServer(4, &bytes.Buffer{}, noop)
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+	if _, err := server.ConsistentRead([]byte(`query`)); err != errNoReadFunc {
+		t.Errorf("expected %v, got %v", errNoReadFunc, err)
+	}
+}
+
+func TestConsistentReadAfterElection(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a leader of 3, whose state machine counts commands, which inherited a
+	// command from term 1 it doesn't know is committed, and which can reach a
+	// quorum, but not every follower
+	sm := &countingStateMachine{}
+	read := func([]byte) []byte {
+		resp, _ := sm.Snapshot()
+		return resp
+	}
+	server := NewServer(1, &bytes.Buffer{}, sm.apply, WithReadFunc(read), WithUnsafeOperations())
+	server.SetConfiguration(newLocalPeer(server), &countingPeer{id_: 2}, nonresponsivePeer(3))
+	if err := server.log.appendEntry(logEntry{Index: 1, Term: 1, Command: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ForceLeadership(2); err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Stop()
+	time.Sleep(minimumElectionTimeout())
+	if server.log.getCommitIndex() != 0 {
+		t.Fatalf("expected the inherited command to be uncommitted")
+	}
+
+	// can only commit it along with an entry from its own term, so a read
+	// appends a no-op, and sees the command once both are committed
+	resp, err := server.ConsistentRead([]byte(`query`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "1", string(resp); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	// but once it has, reads append nothing
+	lastIndex := server.log.lastIndex()
+	if _, err := server.ConsistentRead([]byte(`query`)); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(2), server.log.lastIndex(); expected != lastIndex || expected != got {
+		t.Errorf("expected last index %d, got %d, then %d", expected, lastIndex, got)
+	}
+}
+
+func TestConcurrentReadsAfterElection(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a leader of 3, as in TestConsistentReadAfterElection
+	sm := &countingStateMachine{}
+	read := func([]byte) []byte {
+		resp, _ := sm.Snapshot()
+		return resp
+	}
+	server := NewServer(1, &bytes.Buffer{}, sm.apply, WithReadFunc(read), WithUnsafeOperations())
+	server.SetConfiguration(newLocalPeer(server), &countingPeer{id_: 2}, nonresponsivePeer(3))
+	if err := server.log.appendEntry(logEntry{Index: 1, Term: 1, Command: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ForceLeadership(2); err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Stop()
+	time.Sleep(minimumElectionTimeout())
+
+	// answers many reads at once, which append a single no-op between them
+	const reads = 10
+	errs := make(chan error, reads)
+	for i := 0; i < reads; i++ {
+		go func() {
+			_, err := server.ConsistentRead([]byte(`query`))
+			errs <- err
+		}()
+	}
+	for i := 0; i < reads; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected, got := uint64(2), server.log.lastIndex(); expected != got {
+		t.Errorf("expected last index %d, got %d", expected, got)
+	}
+}
+
+func TestConsistentReadManualApply(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a leader whose state machine is driven by hand, with a command committed
+	// but not applied
+	read := func([]byte) []byte { return []byte(`ok`) }
+	server := NewServer(1, &bytes.Buffer{}, noop, WithReadFunc(read), WithManualApply())
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	waitForState(t, server, leader)
+	server.DrainApply()
+	commit := func() {
+		index, err := server.CommandIndex([]byte(`{}`), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for cutoff := time.Now().Add(maximumElectionTimeout()); !server.IsCommitted(index); time.Sleep(time.Millisecond) {
+			if time.Now().After(cutoff) {
+				t.Fatal("command wasn't committed")
+			}
+		}
+	}
+	commit()
+
+	// gives up on a read, rather than waiting forever for it to be applied
+	if _, err := server.ConsistentRead([]byte(`query`)); err != errTimeout {
+		t.Errorf("expected %v, got %v", errTimeout, err)
+	}
+
+	// answers one once it's drained
+	errs := make(chan error, 1)
+	go func() {
+		_, err := server.ConsistentRead([]byte(`query`))
+		errs <- err
+	}()
+	time.Sleep(maximumElectionTimeout() / 2)
+	server.DrainApply()
+	if err := <-errs; err != nil {
+		t.Errorf("after draining: %v", err)
+	}
+
+	// and fails one at once if the server stops
+	commit()
+	go func() {
+		_, err := server.ConsistentRead([]byte(`query`))
+		errs <- err
+	}()
+	time.Sleep(maximumElectionTimeout() / 2)
+	server.Stop()
+	select {
+	case err := <-errs:
+		if err != errNotLeader {
+			t.Errorf("after stopping, expected %v, got %v", errNotLeader, err)
+		}
+	case <-time.After(maximumElectionTimeout()):
+		t.Error("read still waiting after the server stopped")
+	}
+}
+
+func TestConsistentReadWithoutClocks(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a leader which allows for so much clock drift that it never holds a
+	// lease
+	read := func([]byte) []byte { return []byte(`ok`) }
+	server := NewServer(1, &bytes.Buffer{}, noop, WithReadFunc(read), WithMaxClockDrift(2*maximumElectionTimeout()))
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+	if _, err := server.CommandWait([]byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// can't answer a lease read
+	if _, err := server.LeaseRead(func() []byte { return read(nil) }); err != errLeaseExpired {
+		t.Errorf("expected %v, got %v", errLeaseExpired, err)
+	}
+
+	// but answers a consistent read, which doesn't depend on clocks
+	resp, err := server.ConsistentRead([]byte(`query`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := `ok`, string(resp); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestStaleRead(t *testing.T) {
+	// a follower, cut off from its leader, whose state machine holds the last
+	// command it applied
+	var last []byte
+	apply := func(_ uint64, cmd []byte) []byte {
+		last = cmd
+		return []byte{}
+	}
+	read := func([]byte) []byte { return last }
+	server := NewServer(1, &bytes.Buffer{}, apply, WithReadFunc(read))
+	server.SetConfiguration(nonresponsivePeer(1), nonresponsivePeer(2), nonresponsivePeer(3))
+	server.log.appendEntry(logEntry{Index: 1, Term: 1, Command: []byte(`applied`)})
+	server.log.appendEntry(logEntry{Index: 2, Term: 1, Command: []byte(`replicated`)})
+	server.log.commitTo(1)
+
+	// can't answer a consistent read, nor a lease read
+	if _, err := server.ConsistentRead([]byte(`query`)); err != errUnknownLeader {
+		t.Errorf("expected %v, got %v", errUnknownLeader, err)
+	}
+	if _, err := server.LeaseRead(func() []byte { return read(nil) }); err != errLeaseExpired {
+		t.Errorf("expected %v, got %v", errLeaseExpired, err)
+	}
+
+	// but answers a stale read, from what it's applied, not what it's only
+	// replicated
+	resp, err := server.StaleRead([]byte(`query`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := `applied`, string(resp); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	// provided it has a ReadFunc
+	server = NewServer(1, &bytes.Buffer{}, noop)
+	if _, err := server.StaleRead([]byte(`query`)); err != errNoReadFunc {
+		t.Errorf("expected %v, got %v", errNoReadFunc, err)
+	}
+}
@@ -0,0 +1,158 @@
+package raft
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	errReadReplica = errors.New("read replicas can't become leader")
+)
+
+// AddReadReplica tells the server to replicate its log to the passed peers:
+// whenever it's leader, or, if it's a read replica itself, whenever it's fed by
+// its own source. So replicas may be chained. The peers should have been
+// created with WithReadReplica. They don't count towards quorum, so they never
+// hold up a commit, but a slow replica may prevent the log from being
+// compacted.
+//
+// Replicas aren't part of the configuration, and a server only feeds the
+// replicas it's been told about. So, for a replica to survive a change of
+// leader, add it to every voting server, and give it a source of zero.
+func (s *Server) AddReadReplica(peers ...Peer) {
+	s.replicas.add(peers...)
+}
+
+// AddLearner is AddReadReplica, except that whenever this server is leader,
+// and a peer has caught up to within the passed number of entries of its last
+// index, it promotes the peer to a voter: it changes the configuration to add
+// it, as if by SetConfiguration. So a new server can be added to the network
+// without holding up commits, or elections, while it catches up. The peers
+// should have been created with WithReadReplica, with a source of zero; each
+// stops being a read replica once it finds itself in the configuration.
+//
+// Only one configuration change can be under way at a time, so learners
+// which catch up together are promoted one after another. A learner is only
+// promoted once: if the change doesn't commit, e.g. because the leader is
+// deposed, it stays a read replica.
+func (s *Server) AddLearner(within uint64, peers ...Peer) {
+	s.replicas.add(peers...)
+	s.learners.add(within, peers...)
+}
+
+// learners are the read replicas added by AddLearner, by ID, with how far
+// behind the leader's last index each may be when it's promoted. The zero
+// value is ready to use.
+type learners struct {
+	sync.Mutex
+	within map[uint64]uint64
+}
+
+func (l *learners) add(within uint64, peers ...Peer) {
+	l.Lock()
+	defer l.Unlock()
+	if l.within == nil {
+		l.within = map[uint64]uint64{}
+	}
+	for _, peer := range peers {
+		l.within[peer.id()] = within
+	}
+}
+
+// caughtUp returns the ID of a learner in matches whose match index is within
+// its threshold of lastIndex, and forgets it, so it's only promoted once.
+func (l *learners) caughtUp(matches map[uint64]uint64, lastIndex uint64) (uint64, bool) {
+	l.Lock()
+	defer l.Unlock()
+	for id, match := range matches {
+		if within, ok := l.within[id]; ok && match+within >= lastIndex {
+			delete(l.within, id)
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// promoteLearners begins promoting a learner among the passed read replicas
+// which has caught up, if any, unless the configuration is already changing.
+// It's called by the leader after each flush.
+func (s *Server) promoteLearners(replicas peerMap, ni *nextIndex, flush, expelled chan struct{}) {
+	if len(replicas) <= 0 || s.config.changing() {
+		return
+	}
+	matches := ni.matches(replicas)
+	id, ok := s.learners.caughtUp(matches, s.log.lastIndex())
+	if !ok {
+		return
+	}
+	voters, _ := s.config.active()
+	voters[id] = replicas[id]
+	if err := s.changeConfiguration(voters, flush, expelled); err != nil {
+		s.logGeneric("learner %d caught up, through index %d, but promoting it failed: %s", id, matches[id], err)
+		return
+	}
+	s.logGeneric("learner %d caught up, through index %d: promoting it to a voter", id, matches[id])
+}
+
+// isReadReplica returns true if we were created with WithReadReplica, and
+// haven't since been promoted to a voter, i.e. we're not in the
+// configuration.
+func (s *Server) isReadReplica() bool {
+	if !s.readReplica {
+		return false
+	}
+	_, ok := s.config.allPeers()[s.id]
+	return !ok
+}
+
+// protectedPeers is a peerMap protected by a mutex.
+type protectedPeers struct {
+	sync.RWMutex
+	pm peerMap
+}
+
+func (p *protectedPeers) add(peers ...Peer) {
+	p.Lock()
+	defer p.Unlock()
+	if p.pm == nil {
+		p.pm = peerMap{}
+	}
+	for _, peer := range peers {
+		p.pm[peer.id()] = peer
+	}
+}
+
+// except returns the peers whose IDs aren't in the passed peerMap.
+func (p *protectedPeers) except(pm peerMap) peerMap {
+	p.RLock()
+	defer p.RUnlock()
+	except := peerMap{}
+	for id, peer := range p.pm {
+		if _, ok := pm[id]; !ok {
+			except[id] = peer
+		}
+	}
+	return except
+}
+
+// acceptsFrom returns true if we should take log entries from the passed
+// leader. Only read replicas are choosy.
+func (s *Server) acceptsFrom(leaderID uint64) bool {
+	return !s.isReadReplica() || s.replicaSource == 0 || s.replicaSource == leaderID
+}
+
+// feedReplicas passes our log on to our own read replicas, if we have any.
+// It's called by read replicas, from the server goroutine, after each
+// successful appendEntries from their source.
+func (s *Server) feedReplicas() {
+	downstream := s.replicas.except(s.config.allPeers())
+	if len(downstream) <= 0 {
+		return
+	}
+	if s.downstream == nil {
+		s.downstream = newNextIndex(peerMap{}, 0)
+		s.downstreamFlights = newInFlight()
+	}
+	s.downstream.add(downstream)
+	s.concurrentFlush(downstream, s.downstream, s.downstreamFlights, broadcastInterval())
+}
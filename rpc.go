@@ -10,21 +10,33 @@ type requestVoteTuple struct {
 	Response chan requestVoteResponse
 }
 
-// appendEntries represents an appendEntries RPC.
+// appendEntries represents an appendEntries RPC. PrevLogHash is the leader's
+// hash of the entry at PrevLogIndex, if it's not zero; a follower whose entry
+// there has the same term, but not the same hash, has a log which diverged
+// from the leader's. Repair asks a follower which reported its log corrupt to
+// discard the whole log, and rebuild it from the entries after PrevLogIndex.
 type appendEntries struct {
 	Term         uint64     `json:"term"`
 	LeaderID     uint64     `json:"leader_id"`
 	PrevLogIndex uint64     `json:"prev_log_index"`
 	PrevLogTerm  uint64     `json:"prev_log_term"`
+	PrevLogHash  []byte     `json:"prev_log_hash,omitempty"`
 	Entries      []logEntry `json:"entries"`
 	CommitIndex  uint64     `json:"commit_index"`
+	Repair       bool       `json:"repair,omitempty"`
 }
 
 // appendEntriesResponse represents the response to an appendEntries RPC.
+// When the follower's log doesn't match at PrevLogIndex, ConflictTerm and
+// ConflictIndex say where it diverges; see raftLog.conflict. Corrupt means the
+// follower's log can't be repaired entry by entry, and must be rebuilt.
 type appendEntriesResponse struct {
-	Term    uint64 `json:"term"`
-	Success bool   `json:"success"`
-	reason  string
+	Term          uint64 `json:"term"`
+	Success       bool   `json:"success"`
+	ConflictTerm  uint64 `json:"conflict_term,omitempty"`
+	ConflictIndex uint64 `json:"conflict_index,omitempty"`
+	Corrupt       bool   `json:"corrupt,omitempty"`
+	reason        string
 }
 
 // requestVote represents a requestVote RPC.
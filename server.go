@@ -2,8 +2,7 @@
 package raft
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -19,6 +18,7 @@ const (
 	follower  = "Follower"
 	candidate = "Candidate"
 	leader    = "Leader"
+	failed    = "Failed" // see ErrServerFailed
 )
 
 const (
@@ -34,16 +34,62 @@ var (
 	MinimumElectionTimeoutMS int32 = 250
 
 	maximumElectionTimeoutMS = 2 * MinimumElectionTimeoutMS
+
+	// electionTimeoutMultiplier is how many broadcast intervals make up the
+	// minimum election timeout. See SetElectionTimeoutMultiplier.
+	electionTimeoutMultiplier int32 = 10
 )
 
+// catchUpThreshold is how many entries a follower's log may be behind the
+// leader's commit index before it reports that it's catching up.
+const catchUpThreshold = 64
+
+// minElectionTimeoutMultiplier is the smallest multiplier that
+// SetElectionTimeoutMultiplier accepts. Any less, and a follower could time out
+// after a couple of heartbeats are delayed, or dropped.
+const minElectionTimeoutMultiplier = 5
+
+// ErrServerFailed is returned by every request to a server whose main loop has
+// panicked, because of a bug, or whose log store has failed; see
+// FailOnStoreError. The failed server stays up, rejecting requests,
+// so it's clearly dead rather than silently hung; it should be stopped and
+// replaced.
+var ErrServerFailed = errors.New("server failed")
+
+// ErrTooManyPendingEntries is returned by Command, and its variants, when the
+// leader already has as many uncommitted entries as WithMaxPendingEntries
+// allows. The command isn't appended; the client should back off, and retry.
+var ErrTooManyPendingEntries = errors.New("too many pending entries")
+
+// ErrPreconditionFailed is returned by CommandIf when the condition doesn't
+// hold against the leader's applied state. The command isn't appended.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ErrServerStopped is returned for a command the leader had set aside, e.g. a
+// CommandIf waiting for the state machine, when the server is stopped before
+// it's appended.
+var ErrServerStopped = errors.New("server stopped")
+
 var (
 	errNotLeader             = errors.New("not the leader")
 	errUnknownLeader         = errors.New("unknown leader")
 	errDeposed               = errors.New("deposed during replication")
 	errAppendEntriesRejected = errors.New("appendEntries RPC rejected")
+	errFollowerCorrupt       = errors.New("follower's log is corrupt")
+	errTwoLeaders            = errors.New("two leaders in one term")
+	errNoResponse            = errors.New("no response")
 	errReplicationFailed     = errors.New("command replication failed (but will keep retrying)")
 	errOutOfSync             = errors.New("out of sync")
+	errFlushInFlight         = errors.New("previous flush still in flight")
 	errAlreadyRunning        = errors.New("already running")
+	errLogNotEmpty           = errors.New("log not empty")
+	errUnsafeOpsDisabled     = errors.New("unsafe operations are disabled")
+	errAlreadyLeader         = errors.New("already the leader")
+	errNotObserver           = errors.New("leadership is assigned externally only in observer mode")
+	errTermGap               = errors.New("term too far ahead")
+	errBadHeartbeat          = errors.New("heartbeat interval must be at least a millisecond")
+	errBadTTL                = errors.New("TTL must be positive")
+	errMultiplierTooSmall    = fmt.Errorf("election timeout multiplier must be at least %d", minElectionTimeoutMultiplier)
 )
 
 // resetElectionTimeoutMS sets the minimum and maximum election timeouts to the
@@ -56,30 +102,53 @@ func resetElectionTimeoutMS(newMin, newMax int) (int, int) {
 	return int(oldMin), int(oldMax)
 }
 
+// SetElectionTimeoutMultiplier derives every election timing from the interval
+// between a leader's heartbeats: the minimum election timeout becomes
+// heartbeat * multiplier, and the maximum, as ever, twice that, with each
+// timeout chosen at random in between. It's the one knob to turn for clusters
+// whose round trips are long, e.g. across regions, and it keeps heartbeats
+// much more frequent than elections, as Raft requires. The multiplier must be
+// at least 5, and the heartbeat at least a millisecond. The default is a
+// multiplier of 10, with a heartbeat of 25ms.
+//
+// Like MinimumElectionTimeoutMS, it applies to every server in the process,
+// and should be called at package initialization, before any is started.
+func SetElectionTimeoutMultiplier(heartbeat time.Duration, multiplier int) error {
+	if multiplier < minElectionTimeoutMultiplier {
+		return errMultiplierTooSmall
+	}
+	if heartbeat < time.Millisecond {
+		return errBadHeartbeat
+	}
+	min := heartbeat * time.Duration(multiplier) / time.Millisecond
+	atomic.StoreInt32(&electionTimeoutMultiplier, int32(multiplier))
+	resetElectionTimeoutMS(int(min), int(2*min))
+	return nil
+}
+
 // minimumElectionTimeout returns the current minimum election timeout.
 func minimumElectionTimeout() time.Duration {
-	return time.Duration(MinimumElectionTimeoutMS) * time.Millisecond
+	return time.Duration(atomic.LoadInt32(&MinimumElectionTimeoutMS)) * time.Millisecond
 }
 
 // maximumElectionTimeout returns the current maximum election time.
 func maximumElectionTimeout() time.Duration {
-	return time.Duration(maximumElectionTimeoutMS) * time.Millisecond
+	return time.Duration(atomic.LoadInt32(&maximumElectionTimeoutMS)) * time.Millisecond
 }
 
 // electionTimeout returns a variable time.Duration, between the minimum and
 // maximum election timeouts.
 func electionTimeout() time.Duration {
-	n := rand.Intn(int(maximumElectionTimeoutMS - MinimumElectionTimeoutMS))
-	d := int(MinimumElectionTimeoutMS) + n
-	return time.Duration(d) * time.Millisecond
+	min, max := minimumElectionTimeout(), maximumElectionTimeout()
+	return min + time.Duration(rand.Int63n(int64(max-min)))
 }
 
 // broadcastInterval returns the interval between heartbeats (AppendEntry RPCs)
-// broadcast from the leader. It is the minimum election timeout / 10, as
-// dictated by the spec: BroadcastInterval << ElectionTimeout << MTBF.
+// broadcast from the leader. It is the minimum election timeout / 10, unless
+// SetElectionTimeoutMultiplier says otherwise, as dictated by the spec:
+// BroadcastInterval << ElectionTimeout << MTBF.
 func broadcastInterval() time.Duration {
-	d := MinimumElectionTimeoutMS / 10
-	return time.Duration(d) * time.Millisecond
+	return minimumElectionTimeout() / time.Duration(atomic.LoadInt32(&electionTimeoutMultiplier))
 }
 
 // protectedString is just a string protected by a mutex.
@@ -118,6 +187,58 @@ func (s *protectedBool) Set(value bool) {
 	s.value = value
 }
 
+// protectedLeader publishes the leader observed by the server's goroutine to
+// other goroutines, and lets them wait for it to change.
+type protectedLeader struct {
+	sync.Mutex
+	value   uint64
+	changed chan struct{} // closed and replaced on every change
+}
+
+func (l *protectedLeader) Get() (uint64, <-chan struct{}) {
+	l.Lock()
+	defer l.Unlock()
+	if l.changed == nil {
+		l.changed = make(chan struct{})
+	}
+	return l.value, l.changed
+}
+
+func (l *protectedLeader) Set(value uint64) {
+	l.Lock()
+	defer l.Unlock()
+	if value == l.value {
+		return
+	}
+	l.value = value
+	if l.changed != nil {
+		close(l.changed)
+		l.changed = nil
+	}
+}
+
+// protectedContacts records when we last heard from each peer.
+type protectedContacts struct {
+	sync.RWMutex
+	m map[uint64]time.Time
+}
+
+func (c *protectedContacts) Get(id uint64) (time.Time, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	t, ok := c.m[id]
+	return t, ok
+}
+
+func (c *protectedContacts) Set(id uint64, t time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if c.m == nil {
+		c.m = map[uint64]time.Time{}
+	}
+	c.m[id] = t
+}
+
 // Server is the agent that performs all of the Raft protocol logic.
 // In a typical application, each running process that wants to be part of
 // the distributed state machine will contain a server component.
@@ -125,30 +246,117 @@ type Server struct {
 	id      uint64 // id of this server
 	state   *protectedString
 	running *protectedBool
+	seen    *protectedLeader
 	leader  uint64 // who we believe is the leader
 	term    uint64 // "current term number, which increases monotonically"
 	vote    uint64 // who we voted for this term, if applicable
 	log     *raftLog
 	config  *configuration
+	lease   lease             // only held by a leader
+	noOp    pendingNoOp       // see commitInTerm
+	contact protectedContacts // see LastContact
+	traffic trafficCounters   // see Stats
+	leaders leaderHistory     // see LeaderHistory
+
+	catchingUp protectedBool // see Stats
+	caughtUpAt uint64        // while catching up, the commit index to reach; see Events.OnCaughtUp
+
+	logOptions  logOptions
+	events      Events
+	tieBreak    TieBreak
+	unknown     UnknownCandidatePolicy // see WithUnknownCandidatePolicy
+	preAppend   PreAppendHook
+	storeErrors StoreErrorPolicy // see WithStoreErrorPolicy
+	stuckAfter  int              // see WithStuckCandidateThreshold
+	candidacy   candidacy        // only touched by candidates
+	unsafeOps   bool             // see WithUnsafeOperations
+	clockDrift  time.Duration    // see WithMaxClockDrift
+	anomalies   clockAnomalies   // see WithLeaseAnomalyThreshold
+	maxTermGap  uint64           // see WithMaxTermGap
+	commits     commitNotifier   // see Events.OnCommit
+	committed   commitSignal     // see TailFrom
+	readFunc    ReadFunc         // see WithReadFunc
+	maxPending  uint64           // see WithMaxPendingEntries
+	transfers   chan struct{}    // slots for WriteLogTo; nil means no limit
+	now         func() time.Time // time.Now, unless a test replaces it
+
+	after      func(time.Duration) <-chan time.Time // see timer
+	grace      time.Duration                        // see WithStartupGrace
+	observer   bool                                 // see WithObserverMode
+	quorumFunc QuorumFunc                           // see WithQuorum
+
+	anomalyThreshold int // see WithLeaseAnomalyThreshold
+
+	sticky        bool      // see WithLeaderStickiness
+	leaderContact time.Time // when we last heard from a leader, or, as leader, from a quorum
+
+	required        []uint64      // see WithRequiredPeers
+	requiredTimeout time.Duration // see WithRequiredPeers
+
+	readReplica   bool   // see WithReadReplica
+	replicaSource uint64 // see WithReadReplica
+	replicas      *protectedPeers
+	paused        pausedPeers // see PausePeer
+	learners      learners    // see AddLearner
+
+	downstream        *nextIndex // only used by read replicas
+	downstreamFlights *inFlight  // only used by read replicas
+
+	configChanges []configChange  // received, but not yet committed
+	pending       pendingCommands // appended as leader, but not yet committed
+
+	snapshotter   Snapshotter
+	snapshotStore SnapshotStore
+	stateStore    StateStore // see WithStateStore
+	stateErr      error      // from loading the hard state
+	retainEntries int        // see WithRetainSnapshotEntries
+
+	snapshotRequest snapshotRequest // see RequestSnapshot
+	lastSnapshot    snapshotInfo    // see Stats
+	snapshotChan    chan struct{}   // signals a snapshotRequest
 
 	appendEntriesChan chan appendEntriesTuple
 	requestVoteChan   chan requestVoteTuple
 	commandChan       chan commandTuple
 	configurationChan chan configurationTuple
+	forceChan         chan forceTuple
+	relinquishChan    chan chan error
+	compactChan       chan compactTuple
 
 	electionTick <-chan time.Time
 	quit         chan chan struct{}
+	stopped      chan struct{} // closed once the server stops
 }
 
 // ApplyFunc is a client-provided function that should apply a successfully
 // replicated state transition, represented by cmd, to the local state machine,
 // and return a response. commitIndex is the sequence number of the state
-// transition, which is guaranteed to be gapless and monotonically increasing,
-// but not necessarily duplicate-free. ApplyFuncs are not called concurrently.
-// Therefore, clients should ensure they return quickly, i.e. <<
-// MinimumElectionTimeout.
+// transition. Among commands with the same key (see CommandMeta), commitIndex
+// is guaranteed to be monotonically increasing, but not necessarily
+// duplicate-free. ApplyFuncs may be called concurrently for commands with
+// different keys, never for commands with the same key. Clients should ensure
+// they return quickly, i.e. << MinimumElectionTimeout.
+//
+// Every server applies the same command with the same commitIndex, and applies
+// each at most once, so the state machines agree on the sequence of commands
+// applied, whatever leaders come and go.
 type ApplyFunc func(commitIndex uint64, cmd []byte) []byte
 
+// MetadataFunc is a client-provided function that receives cluster-wide
+// metadata, as appended by AppendMetadata, once it's committed, along with the
+// index of its log entry. Metadata is delivered in index order, each once every
+// command before it has been applied, and, like commands, at most once. See
+// WithMetadataFunc.
+type MetadataFunc func(index uint64, metadata []byte)
+
+// ExpiryFunc is a client-provided function that's told when a command appended
+// by CommandTTL expires, with the index of the tombstone which expired it, and
+// the index of the command. Expiries are delivered in index order, like
+// metadata, and at most once, so every state machine expires the same
+// commands at the same point in the log, whatever its own clock says. See
+// WithExpiryFunc.
+type ExpiryFunc func(index, expired uint64)
+
 // NewServer returns an initialized, un-started server. The ID must be unique in
 // the Raft network, and greater than 0. The store will be used by the
 // distributed log as a persistence layer. It's read-from during creation, in
@@ -158,34 +366,66 @@ type ApplyFunc func(commitIndex uint64, cmd []byte) []byte
 // replicated and committed to this server's log.
 //
 // NewServer creates a server, but you'll need to couple it with a transport to
-// make it usable. See the example(s) for usage scenarios.
-func NewServer(id uint64, store io.ReadWriter, a ApplyFunc) *Server {
+// make it usable. See the example(s) for usage scenarios. Options may be passed
+// to change the default behavior of the server.
+func NewServer(id uint64, store io.ReadWriter, a ApplyFunc, options ...Option) *Server {
 	if id <= 0 {
 		panic("server id must be > 0")
 	}
 
-	// 5.2 Leader election: "the latest term this server has seen is persisted,
-	// and is initialized to 0 on first boot."
-	log := newRaftLog(store, a)
-	latestTerm := log.lastTerm()
-
 	s := &Server{
 		id:      id,
 		state:   &protectedString{value: follower}, // "when servers start up they begin as followers"
 		running: &protectedBool{value: false},
 		leader:  unknownLeader, // unknown at startup
-		log:     log,
-		term:    latestTerm,
+		seen:    &protectedLeader{value: unknownLeader},
+		now:     time.Now,
 		config:  newConfiguration(peerMap{}),
 
+		replicas: &protectedPeers{},
+
 		appendEntriesChan: make(chan appendEntriesTuple),
 		requestVoteChan:   make(chan requestVoteTuple),
 		commandChan:       make(chan commandTuple),
 		configurationChan: make(chan configurationTuple),
+		forceChan:         make(chan forceTuple),
+		relinquishChan:    make(chan chan error),
+		compactChan:       make(chan compactTuple),
+		snapshotChan:      make(chan struct{}, 1),
+		transfers:         make(chan struct{}, defaultMaxTransfers),
 
 		electionTick: nil,
 		quit:         make(chan chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	s.commits.notify = s.events.OnCommit
+	s.logOptions.slowApply.notify = s.events.OnSlowApply
+	s.logOptions.onApplied = s.events.OnApplied
+
+	// 5.2 Leader election: "the latest term this server has seen is persisted,
+	// and is initialized to 0 on first boot."
+	var err error
+	s.log, err = recoverRaftLog(store, a, s.logOptions)
+	if err != nil {
+		s.logGeneric("log recovery stopped after index %d: %s", s.log.lastIndex(), err)
 	}
+	s.term = s.log.lastTerm()
+	if s.stateErr = s.loadHardState(); s.stateErr != nil {
+		s.logGeneric("hard state recovery failed: %s", s.stateErr)
+	}
+
+	// Resume with the most recent configuration in the log, if any.
+	if entry, ok := s.log.lastConfiguration(); ok {
+		if oldPeers, newPeers, err := decodeConfiguration(entry.Command, s.config.factory); err != nil {
+			s.logGeneric("couldn't recover configuration from index %d: %s", entry.Index, err)
+		} else {
+			s.config.restore(oldPeers, newPeers, entry.Index)
+		}
+	}
+
 	s.resetElectionTimeout()
 	return s
 }
@@ -199,7 +439,13 @@ type configurationTuple struct {
 // with. The set peers should include a peer that represents this server.
 // SetConfiguration must be called before starting the server. Calls to
 // SetConfiguration after the server has been started will be replicated
-// throughout the Raft network using the joint-consensus mechanism.
+// throughout the Raft network using the joint-consensus mechanism, unless
+// the peers are described exactly as the active configuration's are, in which
+// case nothing is appended. See PeerDescriptor.
+//
+// A change commits once it has a majority of both the old and the new
+// configurations, so an unreachable peer can be removed, as long as the live
+// peers are a majority of the old configuration: the new one doesn't count it.
 //
 // TODO we need to refactor how we parse entries: a single code path from any
 // source (snapshot, persisted log at startup, or over the network) into the
@@ -209,7 +455,7 @@ type configurationTuple struct {
 // and the log as data sinks.
 func (s *Server) SetConfiguration(peers ...Peer) error {
 	if !s.running.Get() {
-		s.config.directSet(makePeerMap(peers...))
+		s.config.directSet(makePeerMap(peers...), 0)
 		return nil
 	}
 
@@ -218,8 +464,144 @@ func (s *Server) SetConfiguration(peers ...Peer) error {
 	return <-err
 }
 
+// Bootstrap seeds a brand-new Raft network with its initial configuration. It
+// must be called on exactly one server, before it's started, and only while its
+// log is completely empty; otherwise it would clobber an existing network, so
+// it returns an error. It sets the configuration, like SetConfiguration, and
+// also persists it as the first entry in the log, at index 1 and term 1. That
+// entry is committed immediately, as there's no previous configuration to
+// agree with it. Since only this server's log contains anything, only this
+// server can win the first election, and it then replicates the configuration
+// to the others.
+func (s *Server) Bootstrap(peers ...Peer) error {
+	if s.running.Get() {
+		return errAlreadyRunning
+	}
+	if s.log.lastIndex() != 0 {
+		return errLogNotEmpty
+	}
+
+	pm := makePeerMap(peers...)
+	config := newConfiguration(pm)
+	config.factory = s.config.factory
+	encodedConfiguration, err := config.encode()
+	if err != nil {
+		return err
+	}
+	if err := s.log.appendEntry(logEntry{
+		Index:   1,
+		Term:    1,
+		Command: encodedConfiguration,
+		Kind:    kindConfiguration,
+	}); err != nil {
+		return err
+	}
+	if err := s.log.commitTo(1); err != nil {
+		return err
+	}
+	s.config.directSet(pm, 1)
+	s.term = 1
+	return s.saveHardState()
+}
+
+type forceTuple struct {
+	Term     uint64
+	Assigned bool // by AssumeLeadership, rather than forced
+	Err      chan error
+}
+
+// ForceLeadership makes this server the leader in the passed term, without an
+// election. It's UNSAFE, and intended only for manual disaster recovery, e.g.
+// when a majority of the network has been permanently lost, and so no leader
+// can ever be elected. It's refused unless the server was created with
+// WithUnsafeOperations, and term must be greater than the server's current
+// term.
+//
+// The forced leader ignores the election restriction, which exists to ensure
+// a leader holds every committed entry. So any committed entries which this
+// server doesn't have may be lost, and followers which have them may refuse to
+// follow it. Use it only on the server with the most up-to-date log that
+// remains.
+func (s *Server) ForceLeadership(term uint64) error {
+	if !s.unsafeOps {
+		return errUnsafeOpsDisabled
+	}
+	if s.isReadReplica() {
+		return errReadReplica
+	}
+
+	return s.takeLeadership(forceTuple{Term: term, Err: make(chan error, 1)})
+}
+
+// AssumeLeadership makes this server the leader in the passed term, when an
+// external coordinator, e.g. a lock service, has decided it should lead. It's
+// refused unless the server was created with WithObserverMode, and term must
+// be greater than the server's current term. The coordinator must ensure
+// there's at most one leader per term, and that each leader's term is greater
+// than the last.
+func (s *Server) AssumeLeadership(term uint64) error {
+	if !s.observer {
+		return errNotObserver
+	}
+	if s.isReadReplica() {
+		return errReadReplica
+	}
+	return s.takeLeadership(forceTuple{Term: term, Assigned: true, Err: make(chan error, 1)})
+}
+
+// takeLeadership passes a forceTuple to the server goroutine, or, if it's not
+// running, handles it directly.
+func (s *Server) takeLeadership(t forceTuple) error {
+	if !s.running.Get() {
+		s.forceLeadership(t)
+		return <-t.Err
+	}
+	s.forceChan <- t
+	return <-t.Err
+}
+
+// Relinquish makes the leader step down to follower, when an external
+// coordinator has decided it should no longer lead. It doesn't start an
+// election, so the network is leaderless until another server is told to
+// AssumeLeadership. It's refused unless the server was created with
+// WithObserverMode, and returns an error if the server isn't the leader.
+func (s *Server) Relinquish() error {
+	if !s.observer {
+		return errNotObserver
+	}
+	if !s.running.Get() {
+		return errNotLeader
+	}
+	err := make(chan error, 1)
+	s.relinquishChan <- err
+	return <-err
+}
+
+// forceLeadership makes us leader, if the request is valid, and returns true
+// if it did. It's called from the server goroutine, or before it's started.
+func (s *Server) forceLeadership(t forceTuple) bool {
+	if t.Term <= s.term {
+		t.Err <- ErrTermTooSmall
+		return false
+	}
+	if t.Assigned {
+		s.logGeneric("assuming leadership in term %d", t.Term)
+	} else {
+		s.logGeneric("WARNING: forcing leadership in term %d without an election; committed entries may be lost", t.Term)
+	}
+	s.advanceTerm(t.Term)
+	s.voteFor(s.id) // as if we'd won an election, so we vote for nobody else
+	s.setLeader(s.id)
+	s.state.Set(leader)
+	t.Err <- nil
+	return true
+}
+
 // Start triggers the server to begin communicating with its peers.
 func (s *Server) Start() {
+	if s.grace > 0 {
+		s.electionTick = s.timer(s.grace + electionTimeout()) // see WithStartupGrace
+	}
 	go s.loop()
 }
 
@@ -231,10 +613,161 @@ func (s *Server) Stop() {
 	s.logGeneric("server stopped")
 }
 
+// WaitForLeader blocks until this server observes a leader, which may be
+// itself, and returns its ID. It returns early with the context's error if the
+// context is done first.
+func (s *Server) WaitForLeader(ctx context.Context) (uint64, error) {
+	for {
+		id, changed := s.seen.Get()
+		if id != unknownLeader {
+			return id, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return unknownLeader, ctx.Err()
+		}
+	}
+}
+
+// commitTo commits the log through index, and reports the newly committed
+// entries, if any, even if it fails part way. A failure to persist them is
+// reported too, and handled according to the StoreErrorPolicy.
+func (s *Server) commitTo(index uint64) error {
+	before := s.log.getCommitIndex()
+	err := s.log.commitTo(index)
+	if after := s.log.getCommitIndex(); after > before {
+		s.commits.add(before, after)
+		s.pending.committed(after)
+		s.committed.notify()
+	}
+	if errors.Is(err, errStoreWrite) {
+		s.events.storeError(index, err)
+		if s.storeErrors == FailOnStoreError {
+			panic(storeFailure{err}) // see transitions
+		}
+	}
+	return err
+}
+
+// expire appends a tombstone for each command in the leader's log which has
+// expired by now, and doesn't have one yet. See CommandTTL.
+func (s *Server) expire(now time.Time) {
+	for _, index := range s.log.expired(now.UnixNano()) {
+		entry := logEntry{
+			Index:   s.log.lastIndex() + 1,
+			Term:    s.term,
+			Command: tombstone(index),
+			Kind:    kindTombstone,
+		}
+		if err := s.log.appendEntry(entry); err != nil {
+			s.logGeneric("appending a tombstone for index %d: %s", index, err)
+			return
+		}
+	}
+}
+
+// committable returns the highest index the leader may commit, given the
+// highest index each server is known to have, by the configuration's quorum.
+// See commitIndex.
+//
+// 5.4.2 Committing entries from previous terms: "Raft never commits log
+// entries from previous terms by counting replicas." A later leader could yet
+// overwrite them. So until the quorum has an entry from the current term, only
+// the entries every voter has are committed.
+func (s *Server) committable(matches map[uint64]uint64) uint64 {
+	q := s.config.quorum(s.quorumFunc)
+	if len(s.required) > 0 {
+		q = RequiredQuorum{Quorum: q, Required: s.required}
+	}
+	if index := commitIndex(q, matches, s.term, s.log.termAt); index > 0 {
+		return index
+	}
+	index := q.Committed(matches)
+	for id := range s.config.allPeers() {
+		if matches[id] < index {
+			index = matches[id]
+		}
+	}
+	return index
+}
+
+// failHeldUp tells the waiters of the entries which the quorum alone would
+// have committed, but which the required peers have held up for longer than
+// WithRequiredPeers allows, ErrRequiredPeersTimeout.
+func (s *Server) failHeldUp(matches map[uint64]uint64) {
+	if len(s.required) == 0 || s.requiredTimeout <= 0 {
+		return
+	}
+	commitIndex := s.log.getCommitIndex()
+	index := s.config.quorum(s.quorumFunc).Committed(matches)
+	if index <= commitIndex {
+		return
+	}
+	if through := s.log.appendedBefore(time.Now().Add(-s.requiredTimeout), commitIndex, index); through > 0 {
+		s.pending.failThrough(through, ErrRequiredPeersTimeout)
+	}
+}
+
+// storeFailure is raised by commitTo, with FailOnStoreError, to fail the
+// server.
+type storeFailure struct{ err error }
+
+// LastContact returns when this server, as leader, last received a response to
+// an AppendEntries RPC from the given peer, successful or not. It returns false
+// if it never has. A leader which hasn't heard from a quorum of its followers
+// for longer than an election timeout has probably been superseded, without
+// knowing it yet.
+func (s *Server) LastContact(id uint64) (time.Time, bool) {
+	return s.contact.Get(id)
+}
+
+// advanceTerm moves us to a newer term, in which we haven't voted yet. Once
+// we're running, it's the only way the term changes, and the only way a vote
+// is cleared, so the term and vote always change together: a vote cast in an
+// older term is never mistaken for one in the current term, and a vote in the
+// current term is never forgotten.
+func (s *Server) advanceTerm(term uint64) {
+	if term <= s.term {
+		panic(fmt.Sprintf("advanceTerm from %d to %d", s.term, term))
+	}
+	s.term = term
+	s.vote = noVote
+	if err := s.saveHardState(); err != nil {
+		panic(stateFailure{err}) // see transitions
+	}
+}
+
+// voteFor casts our vote in the current term. Like advanceTerm, it saves the
+// hard state before returning, so the vote is never forgotten.
+func (s *Server) voteFor(id uint64) {
+	s.vote = id
+	if err := s.saveHardState(); err != nil {
+		panic(stateFailure{err}) // see transitions
+	}
+}
+
+// setLeader records who we believe is the leader, and publishes it to other
+// goroutines, e.g. those blocked in WaitForLeader. A known leader is recorded
+// in the LeaderHistory.
+func (s *Server) setLeader(id uint64) {
+	s.leader = id
+	s.seen.Set(id)
+	if id != unknownLeader && s.now != nil {
+		s.leaders.add(LeaderChange{Term: s.term, Leader: id, StartedAt: s.now()})
+	}
+}
+
 type commandTuple struct {
 	Command         []byte
 	CommandResponse chan<- []byte
 	Err             chan error
+	Index           *uint64       // set to the command's index, before Err gets nil
+	Lost            chan<- error  // if not nil, see pendingCommands
+	Cond            func() bool   // if not nil, see CommandIf
+	Kind            entryKind     // of the entry to append; see AppendMetadata
+	TTL             time.Duration // if not zero, see CommandTTL
+	admitted        bool          // passed the PreAppendHook already
 }
 
 // Command appends the passed command to the leader log. If error is nil, the
@@ -242,14 +775,202 @@ type commandTuple struct {
 // command gets committed to the local server log, it's passed to the apply
 // function, and the response from that function is provided on the
 // passed response chan.
+//
+// A retry of a client's latest command, as identified by CommandMeta, isn't
+// applied again; the original response is provided instead. If the leader
+// already knows the command is a retry, it returns ErrStaleCommand for a retry
+// of an older command, and ErrDuplicateCommand if the original response isn't
+// known. If it's only found to be a retry once committed, the response chan is
+// closed without a value in either case.
 func (s *Server) Command(cmd []byte, response chan<- []byte) error {
-	err := make(chan error)
-	s.commandChan <- commandTuple{cmd, response, err}
-	return <-err
+	_, err := s.CommandIndex(cmd, response)
+	return err
+}
+
+// CommandIndex is like Command, but also returns the index of the log entry
+// the command was appended in, as soon as it's appended, before it's
+// committed. Once the server's commit index reaches it, the command has been
+// applied, so a client may record it to read its own writes later. For a
+// retry answered from the client's session, it's the index of the original
+// command.
+func (s *Server) CommandIndex(cmd []byte, response chan<- []byte) (uint64, error) {
+	return s.command(cmd, response, nil, nil, 0)
+}
+
+// CommandWait is like Command, but waits for the response, and returns it. If
+// the leader steps down before the command is committed, it returns
+// ErrLeadershipLost, so the client can retry against the new leader.
+func (s *Server) CommandWait(cmd []byte) ([]byte, error) {
+	_, resp, err := s.commandWait(cmd)
+	return resp, err
+}
+
+// commandWait is CommandWait, also returning the command's index.
+func (s *Server) commandWait(cmd []byte) (uint64, []byte, error) {
+	var (
+		response = make(chan []byte, 1)
+		lost     = make(chan error, 1)
+	)
+	index, err := s.command(cmd, response, lost, nil, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	select {
+	case resp, ok := <-response:
+		if ok {
+			return index, resp, nil
+		}
+		select {
+		case err := <-lost:
+			return index, nil, err
+		default:
+			return index, nil, ErrDuplicateCommand // found to be a retry once committed
+		}
+	case err := <-lost:
+		return index, nil, err
+	}
+}
+
+// CommandIf is like Command, but only appends the command if cond returns true.
+// cond is evaluated by the leader's main loop when it would append the command,
+// once its state machine has applied every entry in its log, so it should
+// consult the state machine, which reflects every command committed before this
+// one will be. That allows a compare-and-swap, or any other optimistic update,
+// without the client reading the state first. cond should return quickly.
+//
+// CommandIf must be called on the leader, and isn't forwarded; otherwise it
+// returns errNotLeader. Like ConsistentRead, it first waits for a quorum to
+// confirm the server is still the leader, so cond isn't evaluated against the
+// state of a deposed leader. If cond returns false, it returns
+// ErrPreconditionFailed; if the server is stopped while the command waits for
+// the state machine, ErrServerStopped.
+func (s *Server) CommandIf(cond func() bool, cmd []byte, response chan<- []byte) error {
+	if err := s.confirmLeadership(); err != nil {
+		return err
+	}
+	_, err := s.command(cmd, response, nil, cond, 0)
+	return err
+}
+
+// CommandTTL is like Command, but the command expires once ttl has passed,
+// e.g. a lock with a lease. Expiry is decided by the leader, and replicated:
+// the leader stamps the command's entry with its expiry, by its own clock,
+// and once that's passed, whichever server is leader appends a tombstone for
+// it. Once the tombstone is committed, each server passes it to its
+// ExpiryFunc; see WithExpiryFunc. So expiry isn't exact, but every state
+// machine sees it at the same point. A server which finds the command expired
+// by its own clock, but hasn't been told so, may still treat it as expired.
+//
+// CommandTTL must be called on the leader, and isn't forwarded; otherwise it
+// returns errNotLeader.
+func (s *Server) CommandTTL(cmd []byte, response chan<- []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errBadTTL
+	}
+	_, err := s.command(cmd, response, nil, nil, ttl)
+	return err
+}
+
+// command is CommandIndex, with an optional, buffered chan to be sent
+// ErrLeadershipLost if we step down before the command is committed, an
+// optional condition for CommandIf, and an optional TTL for CommandTTL.
+func (s *Server) command(cmd []byte, response chan<- []byte, lost chan<- error, cond func() bool, ttl time.Duration) (uint64, error) {
+	if len(cmd) > maxCommandSize {
+		return 0, errCommandTooBig // it could never be persisted
+	}
+	if s.state.Get() == leader {
+		if last, seq, ok := s.log.retryOf(cmd); ok {
+			switch {
+			case seq < last.Seq:
+				return 0, ErrStaleCommand
+			case !last.Known:
+				return 0, ErrDuplicateCommand
+			}
+			if response != nil {
+				s.log.respond(response, last.Response)
+			}
+			return last.Index, nil
+		}
+	}
+	var (
+		err   = make(chan error)
+		index uint64
+	)
+	t := commandTuple{Command: cmd, CommandResponse: response, Err: err, Index: &index, Lost: lost, Cond: cond, TTL: ttl}
+	if s.preAppend != nil && s.state.Get() == leader {
+		// Validate in the caller's goroutine, so a slow hook doesn't stall
+		// the leader loop. Followers forward to the leader, which does this.
+		if e := s.preAppend(cmd); e != nil {
+			return 0, e
+		}
+		t.admitted = true
+	}
+	s.commandChan <- t
+	if e := <-err; e != nil {
+		return 0, e
+	}
+	return index, nil
+}
+
+// AppendMetadata appends cluster-wide metadata, e.g. feature flags, to the
+// leader log, and returns the index of its entry. Once the entry is committed,
+// each server passes the metadata to its MetadataFunc, not its ApplyFunc; see
+// WithMetadataFunc. AppendMetadata must be called on the leader, and isn't
+// forwarded; otherwise it returns errNotLeader.
+func (s *Server) AppendMetadata(metadata []byte) (uint64, error) {
+	if len(metadata) > maxCommandSize {
+		return 0, errCommandTooBig
+	}
+	var (
+		err   = make(chan error)
+		index uint64
+	)
+	s.commandChan <- commandTuple{Command: metadata, Err: err, Index: &index, Kind: kindMetadata, admitted: true}
+	if e := <-err; e != nil {
+		return 0, e
+	}
+	return index, nil
+}
+
+// DrainApply applies every committed entry the state machine hasn't yet, on
+// the calling goroutine, and returns how many it applied. Responses go to the
+// waiting clients as they would otherwise. It's only needed with
+// WithManualApply; otherwise, entries are applied as soon as they're committed,
+// and there's never anything to drain.
+func (s *Server) DrainApply() int {
+	return s.log.drainApply()
+}
+
+// IsCommitted returns true if the log entry with the passed index, e.g. as
+// returned by CommandIndex, is committed on this server. An entry which has
+// been replicated here, but not committed, isn't: it may yet be overwritten by
+// a new leader, so it mustn't be acted on.
+func (s *Server) IsCommitted(index uint64) bool {
+	return s.log.isCommitted(index)
+}
+
+// TermAt returns the term of the log entry with the passed index, from the one
+// before the first entry in the log, whose term is the snapshot's once the log
+// is compacted, through the last. Before then, it returns a LogError matching
+// ErrIndexTooSmall, and after, one matching ErrIndexTooBig. Index 0 is in term
+// 0. Like IsCommitted, it's for checking this server against others: unless
+// the entry is committed, a new leader may yet overwrite it, in another term.
+func (s *Server) TermAt(index uint64) (uint64, error) {
+	return s.log.term(index)
+}
+
+// CommandAsync is like Command, for a client which doesn't want the response:
+// it returns as soon as the command is appended to the leader's log, and
+// nothing waits for it to be applied. Like Command, it fails if the leader
+// already has too many pending entries; see WithMaxPendingEntries.
+func (s *Server) CommandAsync(cmd []byte) error {
+	_, err := s.CommandIndex(cmd, nil)
+	return err
 }
 
 // appendEntries processes the given RPC and returns the response.
 func (s *Server) appendEntries(ae appendEntries) appendEntriesResponse {
+	s.traffic.receivedAppendEntries(ae.LeaderID, ae.Entries)
 	t := appendEntriesTuple{
 		Request:  ae,
 		Response: make(chan appendEntriesResponse),
@@ -260,6 +981,7 @@ func (s *Server) appendEntries(ae appendEntries) appendEntriesResponse {
 
 // requestVote processes the given RPC and returns the response.
 func (s *Server) requestVote(rv requestVote) requestVoteResponse {
+	s.traffic.receivedRequestVote(rv.CandidateID)
 	t := requestVoteTuple{
 		Request:  rv,
 		Response: make(chan requestVoteResponse),
@@ -288,6 +1010,35 @@ func (s *Server) requestVote(rv requestVote) requestVoteResponse {
 
 func (s *Server) loop() {
 	s.running.Set(true)
+	if err := s.log.storeError(); err != nil {
+		s.fail(fmt.Errorf("%w: log store: %s", ErrServerFailed, err))
+		return
+	}
+	if s.stateErr != nil {
+		s.fail(fmt.Errorf("%w: state store: %s", ErrServerFailed, s.stateErr))
+		return
+	}
+	if err := s.transitions(); err != nil {
+		s.fail(err)
+	}
+}
+
+// transitions runs the server through its states until it's stopped. A panic
+// is recovered, and returned as an error wrapping ErrServerFailed. That
+// includes a panic in a flush to a follower, which concurrentFlush re-raises
+// here, a storeFailure, and a stateFailure.
+func (s *Server) transitions() (err error) {
+	defer func() {
+		r := recover()
+		if f, ok := r.(storeFailure); ok {
+			err = fmt.Errorf("%w: log store: %s", ErrServerFailed, f.err)
+		} else if f, ok := r.(stateFailure); ok {
+			err = fmt.Errorf("%w: state store: %s", ErrServerFailed, f.err)
+		} else if r != nil {
+			err = fmt.Errorf("%w: panic: %v", ErrServerFailed, r)
+		}
+	}()
+
 	for s.running.Get() {
 		switch state := s.state.Get(); state {
 		case follower:
@@ -300,10 +1051,72 @@ func (s *Server) loop() {
 			panic(fmt.Sprintf("unknown Server State '%s'", state))
 		}
 	}
+	return nil
 }
 
+// fail puts the server in the failed state, after its main loop panicked, or
+// when it finds its log store unusable, and rejects every request until it's
+// stopped.
+func (s *Server) fail(err error) {
+	s.state.Set(failed)
+	s.setLeader(unknownLeader)
+	s.logGeneric("%s", err)
+	s.events.fatalError(err)
+
+	for {
+		select {
+		case q := <-s.quit:
+			s.handleQuit(q)
+			return
+
+		case t := <-s.commandChan:
+			t.Err <- ErrServerFailed
+
+		case t := <-s.configurationChan:
+			t.Err <- ErrServerFailed
+
+		case t := <-s.forceChan:
+			t.Err <- ErrServerFailed
+
+		case err := <-s.relinquishChan:
+			err <- ErrServerFailed
+
+		case t := <-s.compactChan:
+			t.Err <- ErrServerFailed
+
+		case t := <-s.appendEntriesChan:
+			t.Response <- appendEntriesResponse{
+				Term:    s.term,
+				Success: false,
+				reason:  ErrServerFailed.Error(),
+			}
+
+		case t := <-s.requestVoteChan:
+			t.Response <- requestVoteResponse{
+				Term:        s.term,
+				VoteGranted: false,
+				reason:      ErrServerFailed.Error(),
+			}
+		}
+	}
+}
+
+// resetElectionTimeout starts a new election timeout. Apart from starting an
+// election, and while a follower holds a vote for the tie-break, only two
+// things reset it: an appendEntries from a leader of the current term, and a
+// vote granted. A requestVote which is denied mustn't, whatever its term, or
+// a candidate which can't win could stop everyone else from standing.
 func (s *Server) resetElectionTimeout() {
-	s.electionTick = time.NewTimer(electionTimeout()).C
+	s.electionTick = s.timer(electionTimeout())
+}
+
+// timer returns a channel which receives the time after d, for an election
+// timeout. A test may replace the timer with its own clock's, via after.
+func (s *Server) timer(d time.Duration) <-chan time.Time {
+	if s.after != nil {
+		return s.after(d)
+	}
+	return time.NewTimer(d).C
 }
 
 func (s *Server) logGeneric(format string, args ...interface{}) {
@@ -337,10 +1150,43 @@ func (s *Server) logRequestVoteResponse(req requestVote, resp requestVoteRespons
 func (s *Server) handleQuit(q chan struct{}) {
 	s.logGeneric("got quit signal")
 	s.running.Set(false)
+	if s.stopped != nil {
+		select {
+		case <-s.stopped:
+		default:
+			close(s.stopped)
+		}
+	}
 	close(q)
 }
 
+// resubmit passes a command which was set aside off the main loop back to it,
+// unless the server is stopped, or the deadline passes, first.
+func (s *Server) resubmit(t commandTuple, deadline time.Time) {
+	timeout := time.NewTimer(time.Until(deadline))
+	defer timeout.Stop()
+	select {
+	case s.commandChan <- t:
+	case <-s.stopped:
+		t.Err <- ErrServerStopped
+	case <-timeout.C:
+		t.Err <- errTimeout
+	}
+}
+
 func (s *Server) forwardCommand(t commandTuple) {
+	if t.Cond != nil {
+		t.Err <- errNotLeader // the condition only holds for our state machine
+		return
+	}
+	if t.Kind != kindCommand {
+		t.Err <- errNotLeader // peers only forward commands
+		return
+	}
+	if t.TTL != 0 {
+		t.Err <- errNotLeader // nor do they forward expiries
+		return
+	}
 	switch s.leader {
 	case unknownLeader:
 		s.logGeneric("got command, but don't know leader")
@@ -351,6 +1197,11 @@ func (s *Server) forwardCommand(t commandTuple) {
 
 	default:
 		leader, ok := s.config.get(s.leader)
+		if !ok && s.readReplica {
+			s.logGeneric("got command, but fed by a replica (%d)", s.leader)
+			t.Err <- errUnknownLeader
+			return
+		}
 		if !ok {
 			panic("invalid state in peers")
 		}
@@ -358,7 +1209,11 @@ func (s *Server) forwardCommand(t commandTuple) {
 		// We're blocking our {follower,candidate}Select function in the
 		// receive-command branch. If we continue to block while forwarding
 		// the command, the leader won't be able to get a response from us!
-		go func() { t.Err <- leader.callCommand(t.Command, t.CommandResponse) }()
+		go func() {
+			index, err := leader.callCommand(t.Command, t.CommandResponse)
+			*t.Index = index
+			t.Err <- err
+		}()
 	}
 }
 
@@ -373,6 +1228,11 @@ func (s *Server) forwardConfiguration(t configurationTuple) {
 
 	default:
 		leader, ok := s.config.get(s.leader)
+		if !ok && s.readReplica {
+			s.logGeneric("got configuration, but fed by a replica (%d)", s.leader)
+			t.Err <- errUnknownLeader
+			return
+		}
 		if !ok {
 			panic("invalid state in peers")
 		}
@@ -382,9 +1242,24 @@ func (s *Server) forwardConfiguration(t configurationTuple) {
 }
 
 func (s *Server) followerSelect() {
+	// A vote held back by the tie-break, and when to give up waiting for a
+	// preferred candidate. See holdVote.
+	var (
+		held     *requestVoteTuple
+		holdOver <-chan time.Time
+	)
+	release := func() {
+		if held != nil {
+			s.followerRequestVote(*held)
+			held, holdOver = nil, nil
+		}
+	}
+	defer release()
+
 	for {
 		select {
 		case q := <-s.quit:
+			release()
 			s.handleQuit(q)
 			return
 
@@ -394,6 +1269,24 @@ func (s *Server) followerSelect() {
 		case t := <-s.configurationChan:
 			s.forwardConfiguration(t)
 
+		case t := <-s.forceChan:
+			if s.forceLeadership(t) {
+				return
+			}
+
+		case err := <-s.relinquishChan:
+			err <- errNotLeader
+
+		case t := <-s.compactChan:
+			if t.Safe {
+				t.Err <- errNotLeader
+				continue
+			}
+			t.Err <- s.compact(s.log.getCommitIndex())
+
+		case <-s.snapshotChan:
+			s.compactRequested(s.log.getCommitIndex())
+
 		case <-s.electionTick:
 			// 5.2 Leader election: "A follower increments its current term and
 			// transitions to candidate state."
@@ -402,47 +1295,105 @@ func (s *Server) followerSelect() {
 				s.resetElectionTimeout()
 				continue
 			}
+			if s.isReadReplica() || s.observer {
+				s.resetElectionTimeout()
+				continue
+			}
+			release()
 			s.logGeneric("election timeout, becoming candidate")
-			s.term++
-			s.vote = noVote
-			s.leader = unknownLeader
+			s.advanceTerm(s.term + 1)
+			s.setLeader(unknownLeader)
 			s.state.Set(candidate)
+			s.candidacy = candidacy{since: s.now()}
 			s.resetElectionTimeout()
 			return
 
 		case t := <-s.appendEntriesChan:
+			if !s.acceptsFrom(t.Request.LeaderID) {
+				t.Response <- appendEntriesResponse{
+					Term:    s.term,
+					Success: false,
+					reason:  fmt.Sprintf("read replica of %d, not %d", s.replicaSource, t.Request.LeaderID),
+				}
+				continue
+			}
+			release()
 			if s.leader == unknownLeader {
-				s.leader = t.Request.LeaderID
+				s.setLeader(t.Request.LeaderID)
 				s.logGeneric("discovered Leader %d", s.leader)
 			}
 			resp, stepDown := s.handleAppendEntries(t.Request)
 			s.logAppendEntriesResponse(t.Request, resp, stepDown)
 			t.Response <- resp
+			if s.isReadReplica() && resp.Success {
+				s.feedReplicas()
+			}
 			if stepDown {
 				// stepDown as a Follower means just to reset the leader
 				if s.leader != unknownLeader {
 					s.logGeneric("abandoning old leader=%d", s.leader)
 				}
 				s.logGeneric("following new leader=%d", t.Request.LeaderID)
-				s.leader = t.Request.LeaderID
+				s.setLeader(t.Request.LeaderID)
 			}
 
 		case t := <-s.requestVoteChan:
-			resp, stepDown := s.handleRequestVote(t.Request)
-			s.logRequestVoteResponse(t.Request, resp, stepDown)
-			t.Response <- resp
-			if stepDown {
-				// stepDown as a Follower means just to reset the leader
-				if s.leader != unknownLeader {
-					s.logGeneric("abandoning old leader=%d", s.leader)
-				}
-				s.logGeneric("new leader unknown")
-				s.leader = unknownLeader
+			switch {
+			case held != nil && t.Request.Term == held.Request.Term && s.tieBreak.prefers(t.Request.CandidateID, held.Request.CandidateID):
+				s.logGeneric("tie-break: preferring %d over %d", t.Request.CandidateID, held.Request.CandidateID)
+				s.followerRequestVote(t)
+				release()
+			case held == nil && s.holdVote(t.Request):
+				s.logGeneric("tie-break: holding vote for %d, in case a preferred candidate asks", t.Request.CandidateID)
+				held, holdOver = &t, time.After(broadcastInterval())
+				s.resetElectionTimeout() // an election's underway
+			default:
+				release()
+				s.followerRequestVote(t)
 			}
+
+		case <-holdOver:
+			release()
 		}
 	}
 }
 
+// followerRequestVote answers a requestVote as a follower.
+func (s *Server) followerRequestVote(t requestVoteTuple) {
+	resp, stepDown := s.handleRequestVote(t.Request)
+	s.logRequestVoteResponse(t.Request, resp, stepDown)
+	t.Response <- resp
+	if stepDown {
+		// stepDown as a Follower means just to reset the leader
+		if s.leader != unknownLeader {
+			s.logGeneric("abandoning old leader=%d", s.leader)
+		}
+		s.logGeneric("new leader unknown")
+		s.setLeader(unknownLeader)
+	}
+}
+
+// holdVote returns true if a follower should hold back its answer to the
+// requestVote for a little while, because it would grant the vote, but the
+// tie-break prefers another server which may yet ask for it in the same term.
+func (s *Server) holdVote(rv requestVote) bool {
+	if s.tieBreak == NoTieBreak || s.isReadReplica() || rv.Term < s.term {
+		return false
+	}
+	if rv.Term == s.term && s.vote != noVote {
+		return false // already voted
+	}
+	if s.log.lastIndex() > rv.LastLogIndex || s.log.lastTerm() > rv.LastLogTerm {
+		return false // won't grant it anyway
+	}
+	for id := range s.config.allPeers() {
+		if id != s.id && id != rv.CandidateID && s.tieBreak.prefers(id, rv.CandidateID) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Server) candidateSelect() {
 	if s.leader != unknownLeader {
 		panic("known leader when entering candidateSelect")
@@ -450,13 +1401,15 @@ func (s *Server) candidateSelect() {
 	if s.vote != 0 {
 		panic("existing vote when entering candidateSelect")
 	}
+	s.voteFor(s.id) // before we ask anyone else for theirs
 
 	// "[A server entering the candidate stage] issues requestVote RPCs in
 	// parallel to each of the other servers in the cluster. If the candidate
 	// receives no response for an RPC, it reissues the RPC repeatedly until a
 	// response arrives or the election concludes."
 
-	requestVoteResponses, canceler := s.config.allPeers().except(s.id).requestVotes(requestVote{
+	voters := s.traffic.counted(s.config.allPeers().except(s.id))
+	requestVoteResponses, canceler := voters.requestVotes(requestVote{
 		Term:         s.term,
 		CandidateID:  s.id,
 		LastLogIndex: s.log.lastIndex(),
@@ -466,15 +1419,13 @@ func (s *Server) candidateSelect() {
 
 	// Set up vote tallies (plus, vote for myself)
 	votes := map[uint64]bool{s.id: true}
-	s.vote = s.id
 	s.logGeneric("term=%d election started (configuration state %s)", s.term, s.config.state)
 
 	// catch a weird state
 	if s.config.pass(votes) {
 		s.logGeneric("I immediately won the election")
-		s.leader = s.id
+		s.setLeader(s.id)
 		s.state.Set(leader)
-		s.vote = noVote
 		return
 	}
 
@@ -493,15 +1444,36 @@ func (s *Server) candidateSelect() {
 		case t := <-s.configurationChan:
 			s.forwardConfiguration(t)
 
+		case t := <-s.forceChan:
+			if s.forceLeadership(t) {
+				return
+			}
+
+		case err := <-s.relinquishChan:
+			err <- errNotLeader
+
+		case t := <-s.compactChan:
+			if t.Safe {
+				t.Err <- errNotLeader
+				continue
+			}
+			t.Err <- s.compact(s.log.getCommitIndex())
+
+		case <-s.snapshotChan:
+			s.compactRequested(s.log.getCommitIndex())
+
 		case t := <-requestVoteResponses:
 			s.logGeneric("got vote: id=%d term=%d granted=%v", t.id, t.response.Term, t.response.VoteGranted)
 			// "A candidate wins the election if it receives votes from a
 			// majority of servers in the full cluster for the same term."
+			if s.termGapExceeded(t.id, t.response.Term, s.term) {
+				continue
+			}
 			if t.response.Term > s.term {
 				s.logGeneric("got vote from future term (%d>%d); abandoning election", t.response.Term, s.term)
-				s.leader = unknownLeader
+				s.advanceTerm(t.response.Term)
+				s.setLeader(unknownLeader)
 				s.state.Set(follower)
-				s.vote = noVote
 				return // lose
 			}
 			if t.response.Term < s.term {
@@ -515,9 +1487,8 @@ func (s *Server) candidateSelect() {
 			// "Once a candidate wins an election, it becomes leader."
 			if s.config.pass(votes) {
 				s.logGeneric("I won the election")
-				s.leader = s.id
+				s.setLeader(s.id)
 				s.state.Set(leader)
-				s.vote = noVote
 				return // win
 			}
 
@@ -533,7 +1504,7 @@ func (s *Server) candidateSelect() {
 			t.Response <- resp
 			if stepDown {
 				s.logGeneric("after an appendEntries, stepping down to Follower (leader=%d)", t.Request.LeaderID)
-				s.leader = t.Request.LeaderID
+				s.setLeader(t.Request.LeaderID)
 				s.state.Set(follower)
 				return // lose
 			}
@@ -545,7 +1516,7 @@ func (s *Server) candidateSelect() {
 			t.Response <- resp
 			if stepDown {
 				s.logGeneric("after a requestVote, stepping down to Follower (leader unknown)")
-				s.leader = unknownLeader
+				s.setLeader(unknownLeader)
 				s.state.Set(follower)
 				return // lose
 			}
@@ -558,26 +1529,53 @@ func (s *Server) candidateSelect() {
 			// election by incrementing its term and initiating another round of
 			// requestVote RPCs."
 			s.logGeneric("election ended with no winner; incrementing term and trying again")
+			s.candidacyFailed()
 			s.resetElectionTimeout()
-			s.term++
-			s.vote = noVote
+			s.advanceTerm(s.term + 1)
 			return // draw
 		}
 	}
 }
 
+// candidacy tracks consecutive failed elections, from when a follower first
+// becomes a candidate, until it wins or steps down.
+type candidacy struct {
+	attempts int
+	since    time.Time
+}
+
+// candidacyFailed records a failed election, and reports a stuck candidate
+// each time another stuckAfter elections have failed in a row.
+func (s *Server) candidacyFailed() {
+	s.candidacy.attempts++
+	if s.stuckAfter <= 0 || s.candidacy.attempts%s.stuckAfter != 0 {
+		return
+	}
+	elapsed := s.now().Sub(s.candidacy.since)
+	s.logGeneric(
+		"stuck candidate: %d failed election(s) in a row, over %s",
+		s.candidacy.attempts,
+		elapsed,
+	)
+	s.events.stuckCandidate(s.term, s.candidacy.attempts, elapsed)
+}
+
 //
 //
 //
 
 type nextIndex struct {
 	sync.RWMutex
-	m map[uint64]uint64 // followerId: nextIndex
+	m       map[uint64]uint64 // followerId: nextIndex
+	match   map[uint64]uint64 // followerId: highest index it's acknowledged
+	repairs map[uint64]bool   // followerId: whether its corrupt log is being rebuilt
 }
 
 func newNextIndex(pm peerMap, defaultNextIndex uint64) *nextIndex {
 	ni := &nextIndex{
-		m: map[uint64]uint64{},
+		m:       map[uint64]uint64{},
+		match:   map[uint64]uint64{},
+		repairs: map[uint64]bool{},
 	}
 	for id := range pm {
 		ni.m[id] = defaultNextIndex
@@ -585,6 +1583,62 @@ func newNextIndex(pm peerMap, defaultNextIndex uint64) *nextIndex {
 	return ni
 }
 
+// add starts tracking the passed peers which aren't already tracked. Since they
+// are presumably new to the network, they start out needing every log entry.
+func (ni *nextIndex) add(pm peerMap) {
+	ni.Lock()
+	defer ni.Unlock()
+
+	for id := range pm {
+		if _, ok := ni.m[id]; !ok {
+			ni.m[id] = 0
+		}
+	}
+}
+
+// matched records that the given follower acknowledged an appendEntries which
+// left its log matching ours through the passed index. Unlike the nextIndex,
+// which is a guess, that's known to be replicated; and it never goes down.
+func (ni *nextIndex) matched(id, index uint64) {
+	ni.Lock()
+	defer ni.Unlock()
+
+	if index > ni.match[id] {
+		ni.match[id] = index
+	}
+}
+
+// lowestMatch returns the highest index every tracked follower is known to
+// have, which is zero for any follower that's yet to acknowledge anything.
+func (ni *nextIndex) lowestMatch() uint64 {
+	ni.RLock()
+	defer ni.RUnlock()
+
+	if len(ni.m) <= 0 {
+		return 0
+	}
+
+	i := uint64(math.MaxUint64)
+	for id := range ni.m {
+		if match := ni.match[id]; match < i {
+			i = match
+		}
+	}
+	return i
+}
+
+// matches returns the highest index each of the passed peers is known to have.
+func (ni *nextIndex) matches(pm peerMap) map[uint64]uint64 {
+	ni.RLock()
+	defer ni.RUnlock()
+
+	m := make(map[uint64]uint64, len(pm))
+	for id := range pm {
+		m[id] = ni.match[id]
+	}
+	return m
+}
+
 func (ni *nextIndex) bestIndex() uint64 {
 	ni.RLock()
 	defer ni.RUnlock()
@@ -602,6 +1656,24 @@ func (ni *nextIndex) bestIndex() uint64 {
 	return i
 }
 
+// bestIndexOf is like bestIndex, but only considers the passed peers.
+func (ni *nextIndex) bestIndexOf(pm peerMap) uint64 {
+	ni.RLock()
+	defer ni.RUnlock()
+
+	if len(pm) <= 0 {
+		return 0
+	}
+
+	i := uint64(math.MaxUint64)
+	for id := range pm {
+		if nextIndex := ni.m[id]; nextIndex < i {
+			i = nextIndex
+		}
+	}
+	return i
+}
+
 func (ni *nextIndex) prevLogIndex(id uint64) uint64 {
 	ni.RLock()
 	defer ni.RUnlock()
@@ -611,6 +1683,28 @@ func (ni *nextIndex) prevLogIndex(id uint64) uint64 {
 	return ni.m[id]
 }
 
+// backtrack returns where a follower which rejected an appendEntries with the
+// passed prevLogIndex should be sent entries from next, based on where it says
+// its log diverges from ours. If we have entries in the follower's conflicting
+// term, we resume after the last of them; otherwise, we skip the whole term.
+// It returns false if the follower gave us nothing to go on, or if there's
+// nothing to skip, and we should step back a single entry.
+func (s *Server) backtrack(prevLogIndex uint64, resp appendEntriesResponse) (uint64, bool) {
+	if resp.ConflictIndex == 0 {
+		return 0, false
+	}
+	backTo := resp.ConflictIndex - 1
+	if resp.ConflictTerm > 0 {
+		if index, ok := s.log.lastIndexOfTerm(prevLogIndex, resp.ConflictTerm); ok {
+			backTo = index
+		}
+	}
+	if backTo >= prevLogIndex {
+		return 0, false
+	}
+	return backTo, true
+}
+
 func (ni *nextIndex) decrement(id uint64, prev uint64) (uint64, error) {
 	ni.Lock()
 	defer ni.Unlock()
@@ -630,20 +1724,99 @@ func (ni *nextIndex) decrement(id uint64, prev uint64) (uint64, error) {
 	return ni.m[id], nil
 }
 
-func (ni *nextIndex) set(id, index, prev uint64) (uint64, error) {
+func (ni *nextIndex) set(id, index, prev uint64) (uint64, error) {
+	ni.Lock()
+	defer ni.Unlock()
+
+	i, ok := ni.m[id]
+	if !ok {
+		panic(fmt.Sprintf("peer %d not found", id))
+	}
+	if i != prev {
+		return i, errOutOfSync
+	}
+
+	ni.m[id] = index
+	return index, nil
+}
+
+// repair is like set, but also marks the follower's log as being rebuilt, from
+// the entries after index, until it next accepts them; see repaired.
+func (ni *nextIndex) repair(id, index, prev uint64) (uint64, error) {
+	index, err := ni.set(id, index, prev)
+	if err != nil {
+		return index, err
+	}
+	ni.Lock()
+	defer ni.Unlock()
+	ni.repairs[id] = true
+	return index, nil
+}
+
+func (ni *nextIndex) repairing(id uint64) bool {
+	ni.RLock()
+	defer ni.RUnlock()
+	return ni.repairs[id]
+}
+
+func (ni *nextIndex) repaired(id uint64) {
 	ni.Lock()
 	defer ni.Unlock()
+	delete(ni.repairs, id)
+}
 
-	i, ok := ni.m[id]
-	if !ok {
-		panic(fmt.Sprintf("peer %d not found", id))
+// inFlight tracks the followers with an outstanding flush. A follower whose
+// previous flush hasn't returned is skipped, so a hung follower neither holds
+// up heartbeats to the others nor accumulates a blocked goroutine per
+// heartbeat.
+type inFlight struct {
+	sync.Mutex
+	m        map[uint64]bool
+	panicked interface{} // by the first flush that panicked, if any
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{m: map[uint64]bool{}}
+}
+
+// begin marks a flush to the given follower as outstanding. It returns false
+// if one already was.
+func (f *inFlight) begin(id uint64) bool {
+	f.Lock()
+	defer f.Unlock()
+	if f.m[id] {
+		return false
 	}
-	if i != prev {
-		return i, errOutOfSync
+	f.m[id] = true
+	return true
+}
+
+func (f *inFlight) end(id uint64) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.m, id)
+}
+
+// fail marks a flush to the given follower as finished, by a panic.
+func (f *inFlight) fail(id uint64, r interface{}) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.m, id)
+	if f.panicked == nil {
+		f.panicked = r
 	}
+}
 
-	ni.m[id] = index
-	return index, nil
+// repanic raises, in the calling goroutine, the panic of any flush that
+// panicked. Flushes run in their own goroutines, where a panic would otherwise
+// crash the process, rather than fail the server.
+func (f *inFlight) repanic() {
+	f.Lock()
+	r := f.panicked
+	f.Unlock()
+	if r != nil {
+		panic(r)
+	}
 }
 
 // flush generates and forwards an appendEntries request that attempts to bring
@@ -658,29 +1831,79 @@ func (ni *nextIndex) set(id, index, prev uint64) (uint64, error) {
 func (s *Server) flush(peer Peer, ni *nextIndex) error {
 	peerID := peer.id()
 	currentTerm := s.term
-	prevLogIndex := ni.prevLogIndex(peerID)
-	entries, prevLogTerm := s.log.entriesAfter(prevLogIndex)
+	prevLogIndex, repair := ni.prevLogIndex(peerID), ni.repairing(peerID)
+	entries, prevLogTerm, compacted := s.log.entriesAfter(prevLogIndex)
+	if compacted {
+		// Sending what's left would only be rejected: the follower's log
+		// doesn't reach it. Only a snapshot can catch the follower up.
+		s.logGeneric("flush to %d: entries after prevLogIndex=%d are compacted", peerID, prevLogIndex)
+		return errSnapshotNeeded
+	}
 	commitIndex := s.log.getCommitIndex()
-	s.logGeneric("flush to %d: term=%d leaderId=%d prevLogIndex/Term=%d/%d sz=%d commitIndex=%d", peerID, currentTerm, s.id, prevLogIndex, prevLogTerm, len(entries), commitIndex)
+	if sent := prevLogIndex + uint64(len(entries)); commitIndex > sent {
+		// More may have been committed since we read the entries, but the
+		// follower can only commit those we send it.
+		commitIndex = sent
+	}
+	var prevLogHash []byte
+	if hash, ok := s.log.hashAt(prevLogIndex); ok && prevLogIndex > 0 {
+		prevLogHash = hash[:]
+	}
+	s.logGeneric("flush to %d: term=%d leaderId=%d prevLogIndex/Term=%d/%d sz=%d commitIndex=%d repair=%v", peerID, currentTerm, s.id, prevLogIndex, prevLogTerm, len(entries), commitIndex, repair)
+	s.traffic.sentAppendEntries(peerID, entries)
 	resp := peer.callAppendEntries(appendEntries{
 		Term:         currentTerm,
 		LeaderID:     s.id,
 		PrevLogIndex: prevLogIndex,
 		PrevLogTerm:  prevLogTerm,
+		PrevLogHash:  prevLogHash,
 		Entries:      entries,
 		CommitIndex:  commitIndex,
+		Repair:       repair,
 	})
+	if resp.Term > 0 {
+		s.contact.Set(peerID, s.now()) // a transport failure has no term
+	}
 
+	if s.termGapExceeded(peerID, resp.Term, currentTerm) {
+		return errTermGap
+	}
 	if resp.Term > currentTerm {
 		s.logGeneric("flush to %d: responseTerm=%d > currentTerm=%d: deposed", peerID, resp.Term, currentTerm)
+		s.lease.invalidate()
 		return errDeposed
 	}
 
 	// It's possible the leader has timed out waiting for us, and moved on.
 	// So we should be careful, here, to make only valid state changes to `ni`.
 
+	if !resp.Success && resp.Term == 0 {
+		// A transport failure says nothing about the follower's log, so we
+		// mustn't step back, or we could step back past what it's committed.
+		s.logGeneric("flush to %d: no response", peerID)
+		return errNoResponse
+	}
+	if !resp.Success && resp.Corrupt {
+		// The follower's log has diverged from ours, so it's rebuilt from
+		// everything we have: the entries after the last compacted one.
+		newPrevLogIndex, err := ni.repair(peerID, s.log.firstIndex()-1, prevLogIndex)
+		if err != nil {
+			s.logGeneric("flush to %d: while rewinding prevLogIndex: %s", peerID, err)
+			return err
+		}
+		s.logGeneric("flush to %d: its log is corrupt; rebuilding it after index %d", peerID, newPrevLogIndex)
+		return errFollowerCorrupt
+	}
 	if !resp.Success {
-		newPrevLogIndex, err := ni.decrement(peerID, prevLogIndex)
+		var (
+			newPrevLogIndex uint64
+			err             error
+		)
+		if backTo, ok := s.backtrack(prevLogIndex, resp); ok {
+			newPrevLogIndex, err = ni.set(peerID, backTo, prevLogIndex)
+		} else {
+			newPrevLogIndex, err = ni.decrement(peerID, prevLogIndex)
+		}
 		if err != nil {
 			s.logGeneric("flush to %d: while decrementing prevLogIndex: %s", peerID, err)
 			return err
@@ -689,6 +1912,16 @@ func (s *Server) flush(peer Peer, ni *nextIndex) error {
 		return errAppendEntriesRejected
 	}
 
+	// The follower's log now matches ours, through the last entry we sent.
+	if repair {
+		ni.repaired(peerID)
+	}
+	matchIndex := prevLogIndex
+	if len(entries) > 0 {
+		matchIndex = entries[len(entries)-1].Index
+	}
+	ni.matched(peerID, matchIndex)
+
 	if len(entries) > 0 {
 		newPrevLogIndex, err := ni.set(peer.id(), entries[len(entries)-1].Index, prevLogIndex)
 		if err != nil {
@@ -705,28 +1938,46 @@ func (s *Server) flush(peer Peer, ni *nextIndex) error {
 
 // concurrentFlush triggers a concurrent flush to each of the peers. All peers
 // must respond (or timeout) before concurrentFlush will return. timeout is per
-// peer.
-func (s *Server) concurrentFlush(pm peerMap, ni *nextIndex, timeout time.Duration) (int, bool) {
+// peer. Peers which are still working on a previous flush are skipped. The
+// returned map contains the peers which accepted the flush. If a flush
+// panicked, this flush or an earlier one, so does concurrentFlush.
+func (s *Server) concurrentFlush(pm peerMap, ni *nextIndex, fl *inFlight, timeout time.Duration) (map[uint64]bool, bool) {
+	fl.repanic()
+
 	type tuple struct {
 		id  uint64
 		err error
 	}
 	responses := make(chan tuple, len(pm))
 	for _, peer := range pm {
+		if !fl.begin(peer.id()) {
+			responses <- tuple{peer.id(), errFlushInFlight}
+			continue
+		}
 		go func(peer Peer) {
 			errChan := make(chan error, 1)
-			go func() { errChan <- s.flush(peer, ni) }()
+			go func() {
+				defer func() {
+					if r := recover(); r != nil {
+						fl.fail(peer.id(), r)
+						errChan <- fmt.Errorf("panic: %v", r)
+					}
+				}()
+				err := s.flush(peer, ni)
+				fl.end(peer.id())
+				errChan <- err
+			}()
 			go func() { time.Sleep(timeout); errChan <- errTimeout }()
 			responses <- tuple{peer.id(), <-errChan} // first responder wins
 		}(peer)
 	}
 
-	successes, stepDown := 0, false
+	successes, stepDown := map[uint64]bool{}, false
 	for i := 0; i < cap(responses); i++ {
 		switch t := <-responses; t.err {
 		case nil:
 			s.logGeneric("concurrentFlush: peer %d: OK (prevLogIndex(%d)=%d)", t.id, t.id, ni.prevLogIndex(t.id))
-			successes++
+			successes[t.id] = true
 		case errDeposed:
 			s.logGeneric("concurrentFlush: peer %d: deposed!", t.id)
 			stepDown = true
@@ -735,6 +1986,7 @@ func (s *Server) concurrentFlush(pm peerMap, ni *nextIndex, timeout time.Duratio
 			// nothing to do but log and continue
 		}
 	}
+	fl.repanic()
 	return successes, stepDown
 }
 
@@ -742,8 +1994,21 @@ func (s *Server) leaderSelect() {
 	if s.leader != s.id {
 		panic(fmt.Sprintf("leader (%d) not me (%d) when entering leaderSelect", s.leader, s.id))
 	}
-	if s.vote != 0 {
-		panic(fmt.Sprintf("vote (%d) not zero when entering leaderSelect", s.leader))
+	if s.vote != s.id {
+		panic(fmt.Sprintf("vote (%d) not for me (%d) when entering leaderSelect", s.vote, s.id))
+	}
+
+	// However we stop being leader, we stop holding the lease, and commands
+	// still waiting to be committed are failed.
+	defer s.lease.invalidate()
+	defer s.pending.fail(ErrLeadershipLost)
+
+	// If we restarted partway through a configuration change, the entry which
+	// began it is committed, or it wouldn't have been in our store; so the
+	// change is complete.
+	if index := s.config.restoredChange(); index > 0 {
+		s.logGeneric("completing configuration change from index %d", index)
+		s.config.changeCommitted(index)
 	}
 
 	// 5.3 Log replication: "The leader maintains a nextIndex for each follower,
@@ -757,6 +2022,25 @@ func (s *Server) leaderSelect() {
 	// sneak in a command before the first heartbeat. Then, it will never get
 	// properly replicated (it seemed).
 	ni := newNextIndex(s.config.allPeers().except(s.id), s.log.lastIndex()) // +1)
+	fl := newInFlight()
+
+	// We may have inherited entries which were committed by an earlier leader,
+	// but which we don't know are committed. Until we do, our state machine
+	// may be behind, so we can't take a lease. See extendLease.
+	inherited := s.log.lastIndex()
+
+	// When the latest flush each server acknowledged began, for the lease.
+	acked := map[uint64]time.Time{}
+
+	// Signalled once we've committed a configuration which excludes us.
+	expelled := make(chan struct{}, 1)
+
+	// When we last looked for expired commands.
+	var expiryChecked time.Time
+
+	// When the previous flush began, by our clock and by the monotonic
+	// clock, to catch our clock jumping.
+	var clockAt, monoAt time.Time
 
 	flush := make(chan struct{})
 	heartbeat := time.NewTicker(broadcastInterval())
@@ -774,6 +2058,59 @@ func (s *Server) leaderSelect() {
 			return
 
 		case t := <-s.commandChan:
+			// Give the client a chance to reject the command. Normally
+			// Command has done this already; if we became leader after it
+			// looked, do it now, but off the loop, and resubmit.
+			if s.preAppend != nil && !t.admitted {
+				go func(t commandTuple) {
+					if err := s.preAppend(t.Command); err != nil {
+						s.logGeneric("got command, but rejected it before appending: %s", err)
+						t.Err <- err
+						return
+					}
+					t.admitted = true
+					s.resubmit(t, time.Now().Add(maximumElectionTimeout()))
+				}(t)
+				continue
+			}
+
+			// Push back on clients which outpace replication
+			if s.maxPending > 0 && s.log.lastIndex()-s.log.getCommitIndex() >= s.maxPending {
+				t.Err <- ErrTooManyPendingEntries
+				continue
+			}
+
+			// A conditional command is checked against our state
+			// machine, once it's applied everything in our log. If it
+			// hasn't yet, wait off the loop, and resubmit.
+			if t.Cond != nil {
+				if lastIndex := s.log.lastIndex(); s.log.getAppliedTo() < lastIndex {
+					go func(t commandTuple) {
+						deadline := time.Now().Add(maximumElectionTimeout())
+						for s.log.getAppliedTo() < lastIndex {
+							select {
+							case <-s.stopped:
+								t.Err <- ErrServerStopped
+								return
+							default:
+							}
+							if time.Now().After(deadline) {
+								t.Err <- errTimeout
+								return
+							}
+							time.Sleep(time.Millisecond)
+						}
+						s.resubmit(t, deadline)
+					}(t)
+					continue
+				}
+				if !t.Cond() {
+					s.logGeneric("got command, but its precondition failed")
+					t.Err <- ErrPreconditionFailed
+					continue
+				}
+			}
+
 			// Append the command to our (leader) log
 			s.logGeneric("got command, appending")
 			currentTerm := s.term
@@ -782,6 +2119,11 @@ func (s *Server) leaderSelect() {
 				Term:            currentTerm,
 				Command:         t.Command,
 				commandResponse: t.CommandResponse,
+				lost:            t.Lost,
+				Kind:            t.Kind,
+			}
+			if t.TTL > 0 {
+				entry.Expires = s.now().Add(t.TTL).UnixNano()
 			}
 			if err := s.log.appendEntry(entry); err != nil {
 				t.Err <- err
@@ -799,49 +2141,46 @@ func (s *Server) leaderSelect() {
 			// and advance the commit index. We trigger a manual flush as a
 			// convenience, so our caller might get a response a bit sooner.
 			go func() { flush <- struct{}{} }()
+			s.pending.add(entry.Index, t.Lost)
+			*t.Index = entry.Index
 			t.Err <- nil
 
-		case t := <-s.configurationChan:
-			// Attempt to change our local configuration
-			if err := s.config.changeTo(makePeerMap(t.Peers...)); err != nil {
-				t.Err <- err
-				continue
-			}
+		case t := <-s.forceChan:
+			t.Err <- errAlreadyLeader
 
-			// Serialize the local (C_old,new) configuration
-			encodedConfiguration, err := s.config.encode()
-			if err != nil {
-				t.Err <- err
-				continue
-			}
+		case err := <-s.relinquishChan:
+			s.logGeneric("relinquishing leadership")
+			s.setLeader(unknownLeader)
+			s.state.Set(follower)
+			err <- nil
+			return
 
-			// We're gonna write+replicate that config via log mechanisms.
-			// Prepare the on-commit callback.
-			entry := logEntry{
-				Index:           s.log.lastIndex() + 1,
-				Term:            s.term,
-				Command:         encodedConfiguration,
-				isConfiguration: true,
-				committed:       make(chan bool),
-			}
-			go func() {
-				committed := <-entry.committed
-				if !committed {
-					s.config.changeAborted()
-					return
-				}
-				s.config.changeCommitted()
-				if _, ok := s.config.allPeers()[s.id]; !ok {
-					s.logGeneric("leader expelled; shutting down")
-					q := make(chan struct{})
-					s.quit <- q
-					<-q
-				}
-			}()
-			if err := s.log.appendEntry(entry); err != nil {
-				t.Err <- err
+		case <-expelled:
+			// The remaining servers only adopt the new configuration, and
+			// elect a leader from among themselves, once they know it's
+			// committed. So we tell them, before we step down and stop.
+			s.logGeneric("leader expelled; shutting down")
+			s.announceCommit(ni, fl)
+			s.running.Set(false)
+			s.state.Set(follower)
+			s.setLeader(unknownLeader)
+			return
+
+		case t := <-s.compactChan:
+			t.Err <- s.compact(s.compactableIndex(ni))
+
+		case <-s.snapshotChan:
+			s.compactRequested(s.compactableIndex(ni))
+
+		case t := <-s.configurationChan:
+			// A change to the configuration we already have would only
+			// churn the network
+			pm := makePeerMap(t.Peers...)
+			if s.config.unchanged(pm) {
+				t.Err <- nil
 				continue
 			}
+			t.Err <- s.changeConfiguration(pm, flush, expelled)
 
 		case <-flush:
 			// Flushes attempt to sync the follower log with ours.
@@ -849,57 +2188,98 @@ func (s *Server) leaderSelect() {
 			// After every flush, we check if we can advance our commitIndex.
 			// If so, we do it, and trigger another flush ASAP.
 			// A flush can cause us to be deposed.
+			//
+			// Commands which have expired are buried first, so their
+			// tombstones go out with this flush. We needn't look more
+			// than once a heartbeat.
+			if now := s.now(); now.Sub(expiryChecked) >= broadcastInterval() {
+				s.expire(now)
+				expiryChecked = now
+			}
 			recipients := s.config.allPeers().except(s.id)
+			replicas := s.replicas.except(s.config.allPeers())
+			ni.add(recipients)
+			ni.add(replicas)
+			epoch, began, mono := s.lease.current(), s.now(), time.Now()
+			if !clockAt.IsZero() && s.checkClock(began.Round(0).Sub(clockAt), mono.Sub(monoAt)) {
+				acked = map[uint64]time.Time{} // reckoned by the clock's old readings
+			}
+			clockAt, monoAt = began.Round(0), mono
 
 			// Special case: network of 1
 			if len(recipients) <= 0 {
 				ourLastIndex := s.log.lastIndex()
 				if ourLastIndex > 0 {
-					if err := s.log.commitTo(ourLastIndex); err != nil {
+					if err := s.commitTo(ourLastIndex); err != nil {
 						s.logGeneric("commitTo(%d): %s", ourLastIndex, err)
 						continue
 					}
 					s.logGeneric("after commitTo(%d), commitIndex=%d", ourLastIndex, s.log.getCommitIndex())
 				}
+				s.extendLease(epoch, began, inherited)
+				s.leaderContact = mono
+				if replicas := s.paused.except(replicas); len(replicas) > 0 {
+					s.concurrentFlush(replicas, ni, fl, 2*broadcastInterval())
+				}
+				s.promoteLearners(replicas, ni, flush, expelled)
 				continue
 			}
 
 			// Normal case: network of at-least-2
-			successes, stepDown := s.concurrentFlush(recipients, ni, 2*broadcastInterval())
+			// Read replicas are flushed alongside, but don't count.
+			// Paused peers aren't flushed, but still count, with the
+			// entries they already have.
+			successes, stepDown := s.concurrentFlush(s.paused.except(recipients.union(replicas)), ni, fl, 2*broadcastInterval())
+			for id := range replicas {
+				delete(successes, id)
+			}
 			if stepDown {
 				s.logGeneric("deposed during flush")
 				s.state.Set(follower)
-				s.leader = unknownLeader
+				s.setLeader(unknownLeader)
 				return
 			}
 
-			// Only when we know all followers accepted the flush can we
-			// consider incrementing commitIndex and pushing out another
-			// round of flushes.
-			if successes == len(recipients) {
-				peersBestIndex := ni.bestIndex()
-				ourLastIndex := s.log.lastIndex()
-				ourCommitIndex := s.log.getCommitIndex()
-				if peersBestIndex > ourLastIndex {
+			// If a quorum heard from us, nobody else can be elected until
+			// they've waited out an election timeout. We extend the lease
+			// once we've seen if the flush lets us commit.
+			successes[s.id] = true
+			for id := range successes {
+				acked[id] = began
+			}
+
+			// Once the quorum has an entry, we can consider incrementing
+			// commitIndex and pushing out another round of flushes.
+			ourLastIndex := s.log.lastIndex()
+			ourCommitIndex := s.log.getCommitIndex()
+			matches := ni.matches(recipients)
+			matches[s.id] = ourLastIndex
+			for id, index := range matches {
+				if index > ourLastIndex {
 					// safety check: we've probably been deposed
-					s.logGeneric("peers' best index %d > our lastIndex %d", peersBestIndex, ourLastIndex)
+					s.logGeneric("peer %d's match index %d > our lastIndex %d", id, index, ourLastIndex)
 					s.logGeneric("this is crazy, I'm gonna become a follower")
-					s.leader = unknownLeader
-					s.vote = noVote
+					s.setLeader(unknownLeader)
 					s.state.Set(follower)
 					return
 				}
-				if peersBestIndex > ourCommitIndex {
-					if err := s.log.commitTo(peersBestIndex); err != nil {
-						s.logGeneric("commitTo(%d): %s", peersBestIndex, err)
-						continue // oh well, next time?
-					}
-					if s.log.getCommitIndex() > ourCommitIndex {
-						s.logGeneric("after commitTo(%d), commitIndex=%d -- queueing another flush", peersBestIndex, s.log.getCommitIndex())
-						go func() { flush <- struct{}{} }()
-					}
+			}
+			if commitIndex := s.committable(matches); commitIndex > ourCommitIndex {
+				if err := s.commitTo(commitIndex); err != nil {
+					s.logGeneric("commitTo(%d): %s", commitIndex, err)
+					continue // oh well, next time?
 				}
+				if s.log.getCommitIndex() > ourCommitIndex {
+					s.logGeneric("after commitTo(%d), commitIndex=%d -- queueing another flush", commitIndex, s.log.getCommitIndex())
+					go func() { flush <- struct{}{} }()
+				}
+			}
+			s.failHeldUp(matches)
+			if since, ok := quorumAckedSince(acked, s.config.pass); ok {
+				s.extendLease(epoch, since, inherited)
+				s.leaderContact = mono.Add(since.Sub(began))
 			}
+			s.promoteLearners(replicas, ni, flush, expelled)
 
 		case t := <-s.appendEntriesChan:
 			resp, stepDown := s.handleAppendEntries(t.Request)
@@ -907,7 +2287,7 @@ func (s *Server) leaderSelect() {
 			t.Response <- resp
 			if stepDown {
 				s.logGeneric("after an appendEntries, deposed to Follower (leader=%d)", t.Request.LeaderID)
-				s.leader = t.Request.LeaderID
+				s.setLeader(t.Request.LeaderID)
 				s.state.Set(follower)
 				return // deposed
 			}
@@ -918,7 +2298,7 @@ func (s *Server) leaderSelect() {
 			t.Response <- resp
 			if stepDown {
 				s.logGeneric("after a requestVote, deposed to Follower (leader unknown)")
-				s.leader = unknownLeader
+				s.setLeader(unknownLeader)
 				s.state.Set(follower)
 				return // deposed
 			}
@@ -926,11 +2306,109 @@ func (s *Server) leaderSelect() {
 	}
 }
 
+// changeConfiguration begins changing the configuration to the passed peers,
+// by appending a C_old,new entry to our (leader) log. The change completes, or
+// is abandoned, when the entry is committed, or lost. flush and expelled are
+// the leader loop's: the entry goes out with the next flush, and if the new
+// configuration excludes us, we're expelled once it's committed.
+func (s *Server) changeConfiguration(pm peerMap, flush, expelled chan struct{}) error {
+	// Attempt to change our local configuration
+	if err := s.config.changeTo(pm); err != nil {
+		return err
+	}
+
+	// Serialize the local (C_old,new) configuration
+	encodedConfiguration, err := s.config.encode()
+	if err != nil {
+		return err
+	}
+
+	// We're gonna write+replicate that config via log mechanisms.
+	// Prepare the on-commit callback.
+	entry := logEntry{
+		Index:     s.log.lastIndex() + 1,
+		Term:      s.term,
+		Command:   encodedConfiguration,
+		Kind:      kindConfiguration,
+		committed: make(chan bool),
+	}
+	go func() {
+		committed := <-entry.committed
+		if !committed {
+			s.config.changeAborted()
+			return
+		}
+		oldPeers, _ := s.config.active()
+		s.config.changeCommitted(entry.Index)
+		newPeers, _ := s.config.active()
+		s.events.configurationChange(oldPeers, newPeers, entry.Index, entry.Term)
+		if _, ok := s.config.allPeers()[s.id]; !ok {
+			expelled <- struct{}{}
+		}
+	}()
+	if err := s.log.appendEntry(entry); err != nil {
+		entry.committed <- false // abort the change
+		return err
+	}
+
+	// Like a command, the change will be replicated by the normal
+	// flushing mechanism.
+	go func() { flush <- struct{}{} }()
+	return nil
+}
+
+// announceCommit flushes our commit index to every follower which isn't
+// paused, retrying those which don't acknowledge it, for up to an election
+// timeout.
+func (s *Server) announceCommit(ni *nextIndex, fl *inFlight) {
+	pending := s.paused.except(s.config.allPeers().except(s.id))
+	deadline := time.Now().Add(minimumElectionTimeout())
+	for len(pending) > 0 && time.Now().Before(deadline) {
+		successes, stepDown := s.concurrentFlush(pending, ni, fl, 2*broadcastInterval())
+		if stepDown {
+			return
+		}
+		for id := range successes {
+			delete(pending, id)
+		}
+	}
+}
+
 // handleRequestVote will modify s.term and s.vote, but nothing else.
 // stepDown means you need to: s.leader=unknownLeader, s.state.Set(Follower).
+// termGapExceeded returns true, and reports it, if a peer presents a term more
+// than maxTermGap ahead of ours. It's more likely a corrupt or misbehaving peer
+// than a real election, so rather than adopt the term, we ignore the peer.
+func (s *Server) termGapExceeded(peerID, term, currentTerm uint64) bool {
+	if s.maxTermGap == 0 || term <= currentTerm || term-currentTerm <= s.maxTermGap {
+		return false
+	}
+	s.logGeneric("peer %d presented term %d, more than %d ahead of %d: ignoring", peerID, term, s.maxTermGap, currentTerm)
+	s.events.termGap(peerID, term, currentTerm)
+	return true
+}
+
 func (s *Server) handleRequestVote(rv requestVote) (requestVoteResponse, bool) {
 	// Spec is ambiguous here; basing this (loosely!) on benbjohnson's impl
 
+	// Read replicas don't vote, and don't care about elections
+	if s.isReadReplica() {
+		return requestVoteResponse{
+			Term:        s.term,
+			VoteGranted: false,
+			reason:      "read replica",
+		}, false
+	}
+
+	// Nor do observers, whose leaders are assigned, not elected
+	if s.observer {
+		return requestVoteResponse{
+			Term:        s.term,
+			VoteGranted: false,
+			reason:      "observer mode",
+		}, false
+	}
+
 	// If the request is from an old term, reject
 	if rv.Term < s.term {
 		return requestVoteResponse{
@@ -940,16 +2418,53 @@ func (s *Server) handleRequestVote(rv requestVote) (requestVoteResponse, bool) {
 		}, false
 	}
 
+	if s.termGapExceeded(rv.CandidateID, rv.Term, s.term) {
+		return requestVoteResponse{
+			Term:        s.term,
+			VoteGranted: false,
+			reason:      fmt.Sprintf("Term %d too far ahead of %d", rv.Term, s.term),
+		}, false
+	}
+
+	// Leader stickiness: having heard from a leader so recently, we don't
+	// believe the candidate needs to replace it. See WithLeaderStickiness.
+	if s.sticky && time.Since(s.leaderContact) < minimumElectionTimeout() {
+		return requestVoteResponse{
+			Term:        s.term,
+			VoteGranted: false,
+			reason:      fmt.Sprintf("heard from a leader %s ago", time.Since(s.leaderContact)),
+		}, false
+	}
+
+	unknown := s.unknownCandidate(rv)
+	if unknown && s.unknown == IgnoreUnknownCandidates {
+		return requestVoteResponse{
+			Term:        s.term,
+			VoteGranted: false,
+			reason:      fmt.Sprintf("candidate %d not in configuration; ignored", rv.CandidateID),
+		}, false
+	}
+
 	// If the request is from a newer term, reset our state
 	stepDown := false
 	if rv.Term > s.term {
 		s.logGeneric("requestVote from newer term (%d): we defer", rv.Term)
-		s.term = rv.Term
-		s.vote = noVote
-		s.leader = unknownLeader
+		s.lease.invalidate()
+		s.advanceTerm(rv.Term)
+		s.setLeader(unknownLeader)
 		stepDown = true
 	}
 
+	// Membership-change safety: a candidate outside our configuration
+	// doesn't get our vote
+	if unknown && s.unknown == DenyUnknownCandidates {
+		return requestVoteResponse{
+			Term:        s.term,
+			VoteGranted: false,
+			reason:      fmt.Sprintf("candidate %d not in configuration", rv.CandidateID),
+		}, stepDown
+	}
+
 	// Special case: if we're the leader, and we haven't been deposed by a more
 	// recent term, then we should always deny the vote
 	if s.state.Get() == leader && !stepDown {
@@ -960,6 +2475,20 @@ func (s *Server) handleRequestVote(rv requestVote) (requestVoteResponse, bool) {
 		}, stepDown
 	}
 
+	// If we're a candidate in the same term as another, equally qualified,
+	// candidate whom the tie-break prefers, yield to them. We can't vote for
+	// them, because we voted for ourselves, but we can stop competing.
+	if s.state.Get() == candidate && !stepDown &&
+		s.tieBreak.prefers(rv.CandidateID, s.id) &&
+		s.log.lastIndex() == rv.LastLogIndex && s.log.lastTerm() == rv.LastLogTerm {
+		s.electionTick = s.timer(maximumElectionTimeout() + broadcastInterval()) // after theirs
+		return requestVoteResponse{
+			Term:        s.term,
+			VoteGranted: false,
+			reason:      fmt.Sprintf("already cast vote for %d, but yielding to %d", s.vote, rv.CandidateID),
+		}, true
+	}
+
 	// If we've already voted for someone else this term, reject
 	if s.vote != 0 && s.vote != rv.CandidateID {
 		if stepDown {
@@ -988,7 +2517,7 @@ func (s *Server) handleRequestVote(rv requestVote) (requestVoteResponse, bool) {
 	}
 
 	// We passed all the tests: cast vote in favor
-	s.vote = rv.CandidateID
+	s.voteFor(rv.CandidateID)
 	s.resetElectionTimeout()
 	return requestVoteResponse{
 		Term:        s.term,
@@ -996,6 +2525,75 @@ func (s *Server) handleRequestVote(rv requestVote) (requestVoteResponse, bool) {
 	}, stepDown
 }
 
+// unknownCandidate returns true, and reports it, if the candidate isn't in our
+// configuration. If we have no configuration, every candidate is known.
+func (s *Server) unknownCandidate(rv requestVote) bool {
+	if s.config == nil || len(s.config.allPeers()) <= 0 {
+		return false
+	}
+	if _, ok := s.config.get(rv.CandidateID); ok {
+		return false
+	}
+	s.logGeneric("requestVote from %d, which isn't in our configuration", rv.CandidateID)
+	s.events.voteFromUnknownPeer(rv.CandidateID, rv.Term)
+	return true
+}
+
+// configChange is a configuration change a follower has received, and will
+// report once it's committed.
+type configChange struct {
+	oldPeers, newPeers peerMap
+	index, term        uint64
+}
+
+// reportConfigurationChanges reports, in order, the configuration changes
+// received by a follower which have since been committed, and forgets those
+// which were overwritten. Once the latest change received is committed, the
+// follower leaves C_old,new for C_new, as the leader does. If the server's
+// been expelled, it shuts down; a read replica, which is never a member, or a
+// learner, which may not be yet, carries on.
+func (s *Server) reportConfigurationChanges() {
+	commitIndex, pending := s.log.getCommitIndex(), s.configChanges[:0]
+	for _, c := range s.configChanges {
+		if c.index > commitIndex {
+			pending = append(pending, c)
+			continue
+		}
+		if entry, ok := s.log.entryAt(c.index); !ok || entry.Term != c.term {
+			continue // overwritten by a later leader
+		}
+		s.events.configurationChange(c.oldPeers, c.newPeers, c.index, c.term)
+		if _, latest := s.config.active(); latest == c.index {
+			s.config.directSet(c.newPeers, c.index)
+		}
+		if _, member := c.newPeers[s.id]; !member && !s.readReplica {
+			s.logGeneric("non-leader expelled; shutting down")
+			go func() {
+				q := make(chan struct{})
+				s.quit <- q
+				<-q
+			}()
+		}
+	}
+	s.configChanges = pending
+}
+
+// noteLag records whether our log is more than catchUpThreshold entries behind
+// the leader's commit index. Once we fall behind, we're caught up when our
+// commit index reaches the leader's, as it was then.
+func (s *Server) noteLag(leaderCommit uint64) {
+	lastIndex := s.log.lastIndex()
+	lagging := leaderCommit > lastIndex && leaderCommit-lastIndex > catchUpThreshold
+	s.catchingUp.Set(lagging)
+	if lagging && s.caughtUpAt == 0 {
+		s.caughtUpAt = leaderCommit
+	}
+	if commitIndex := s.log.getCommitIndex(); s.caughtUpAt > 0 && !lagging && commitIndex >= s.caughtUpAt {
+		s.caughtUpAt = 0
+		s.events.caughtUp(commitIndex)
+	}
+}
+
 // handleAppendEntries will modify s.term and s.vote, but nothing else.
 // stepDown means you need to: s.leader=r.LeaderID, s.state.Set(Follower).
 func (s *Server) handleAppendEntries(r appendEntries) (appendEntriesResponse, bool) {
@@ -1014,11 +2612,36 @@ func (s *Server) handleAppendEntries(r appendEntries) (appendEntriesResponse, bo
 		}, false
 	}
 
+	if s.termGapExceeded(r.LeaderID, r.Term, s.term) {
+		return appendEntriesResponse{
+			Term:    s.term,
+			Success: false,
+			reason:  fmt.Sprintf("Term %d too far ahead of %d", r.Term, s.term),
+		}, false
+	}
+
+	// There's only ever one leader per term, so if we're leader, and another
+	// server claims to lead our term, an election has gone badly wrong. We
+	// don't step down, which would only make its claim look legitimate, and
+	// we don't let it touch our log.
+	if r.Term == s.term && s.state.Get() == leader {
+		err := fmt.Errorf("%w: %d claims term %d, which %d leads", errTwoLeaders, r.LeaderID, r.Term, s.id)
+		s.logGeneric("%s", err)
+		s.events.safetyViolation(err)
+		return appendEntriesResponse{
+			Term:    s.term,
+			Success: false,
+			reason:  err.Error(),
+		}, false
+	}
+
 	// If the request is from a newer term, reset our state
 	stepDown := false
 	if r.Term > s.term {
-		s.term = r.Term
-		s.vote = noVote
+		// Fail our pending commands before ensureLastIs can overwrite them.
+		s.lease.invalidate()
+		s.pending.fail(ErrLeadershipLost)
+		s.advanceTerm(r.Term)
 		stepDown = true
 	}
 
@@ -1027,20 +2650,51 @@ func (s *Server) handleAppendEntries(r appendEntries) (appendEntriesResponse, bo
 	// If the leader’s term (included in its RPC) is at least as large as the
 	// candidate’s current term, then the candidate recognizes the leader as
 	// legitimate and steps down, meaning that it returns to follower state."
+	//
+	// By now, the terms are equal. We stay in the same term, and so we must
+	// keep our vote (for ourselves), or we could vote twice in one term.
 	if s.state.Get() == candidate && r.LeaderID != s.leader && r.Term >= s.term {
-		s.term = r.Term
-		s.vote = noVote
 		stepDown = true
 	}
 
 	// In any case, reset our election timeout
 	s.resetElectionTimeout()
+	s.leaderContact = time.Now()
 
-	// Reject if log doesn't contain a matching previous entry
-	if err := s.log.ensureLastIs(r.PrevLogIndex, r.PrevLogTerm); err != nil {
+	// And, once we've processed the request, note how far behind we are
+	defer s.noteLag(r.CommitIndex)
+
+	// A corrupt log can't be repaired entry by entry, so it's discarded, once
+	// the leader sends the entries to rebuild it from; see flush.
+	if r.Repair && s.log.isCorrupt() {
+		if err := s.log.rebuild(r.PrevLogIndex, r.PrevLogTerm, r.PrevLogHash); err != nil {
+			return appendEntriesResponse{
+				Term:    s.term,
+				Success: false,
+				Corrupt: true,
+				reason:  fmt.Sprintf("rebuilding corrupt log after index %d failed: %s", r.PrevLogIndex, err),
+			}, stepDown
+		}
+		s.logGeneric("discarded corrupt log; rebuilding it after index %d", r.PrevLogIndex)
+	}
+	if s.log.isCorrupt() {
 		return appendEntriesResponse{
 			Term:    s.term,
 			Success: false,
+			Corrupt: true,
+			reason:  "log is corrupt",
+		}, stepDown
+	}
+
+	// Reject if log doesn't contain a matching previous entry, and tell the
+	// leader where we diverge, so it can skip the whole conflicting term
+	if err := s.log.ensureLastIs(r.PrevLogIndex, r.PrevLogTerm); err != nil {
+		conflictTerm, conflictIndex := s.log.conflict(r.PrevLogIndex)
+		return appendEntriesResponse{
+			Term:          s.term,
+			Success:       false,
+			ConflictTerm:  conflictTerm,
+			ConflictIndex: conflictIndex,
 			reason: fmt.Sprintf(
 				"while ensuring last log entry had index=%d term=%d: error: %s",
 				r.PrevLogIndex,
@@ -1049,75 +2703,84 @@ func (s *Server) handleAppendEntries(r appendEntries) (appendEntriesResponse, bo
 			),
 		}, stepDown
 	}
+	if s.log.diverged(r.PrevLogIndex, r.PrevLogHash) {
+		s.logGeneric("log diverged from the leader's at or before index %d: corrupt", r.PrevLogIndex)
+		return appendEntriesResponse{
+			Term:    s.term,
+			Success: false,
+			Corrupt: true,
+			reason:  fmt.Sprintf("log diverged at or before index %d", r.PrevLogIndex),
+		}, stepDown
+	}
 
-	// Process the entries
+	// Configuration changes require special preprocessing, which is done up
+	// front, so the entries are appended all together, or not at all
+	type configurationEntry struct {
+		pos  int
+		pm   peerMap // the old and new peers together
+		cNew peerMap // the configuration once this entry is committed
+	}
+	configurations := []configurationEntry{}
 	for i, entry := range r.Entries {
-		// Configuration changes requre special preprocessing
-		var pm peerMap
-		if entry.isConfiguration {
-			commandBuf := bytes.NewBuffer(entry.Command)
-			if err := gob.NewDecoder(commandBuf).Decode(&pm); err != nil {
-				panic("gob decode of peers failed")
-			}
-
-			if s.state.Get() == leader {
-				// TODO should we instead just ignore this entry?
-				return appendEntriesResponse{
-					Term:    s.term,
-					Success: false,
-					reason: fmt.Sprintf(
-						"AppendEntry %d/%d failed (configuration): %s",
-						i+1,
-						len(r.Entries),
-						"Leader shouldn't receive configurations via appendEntries",
-					),
-				}, stepDown
-			}
-
-			// Expulsion recognition
-			if _, ok := pm[s.id]; !ok {
-				entry.committed = make(chan bool)
-				go func() {
-					if <-entry.committed {
-						s.logGeneric("non-leader expelled; shutting down")
-						q := make(chan struct{})
-						s.quit <- q
-						<-q
-					}
-				}()
-			}
+		if entry.Kind != kindConfiguration {
+			continue
+		}
+		oldPeers, newPeers, err := decodeConfiguration(entry.Command, s.config.factory)
+		if err != nil {
+			panic(fmt.Sprintf("decoding configuration failed: %s", err))
+		}
+		c := configurationEntry{pos: i, pm: oldPeers.union(newPeers), cNew: newPeers}
+		if len(c.cNew) <= 0 {
+			c.cNew = oldPeers
 		}
 
-		// Append entry to the log
-		if err := s.log.appendEntry(entry); err != nil {
+		if s.state.Get() == leader {
+			// TODO should we instead just ignore this entry?
 			return appendEntriesResponse{
 				Term:    s.term,
 				Success: false,
 				reason: fmt.Sprintf(
-					"AppendEntry %d/%d failed: %s",
+					"AppendEntry %d/%d failed (configuration): %s",
 					i+1,
 					len(r.Entries),
-					err,
+					"Leader shouldn't receive configurations via appendEntries",
 				),
 			}, stepDown
 		}
+		configurations = append(configurations, c)
+	}
 
-		// "Once a given server adds the new configuration entry to its log, it
-		// uses that configuration for all future decisions (it does not wait
-		// for the entry to become committed)."
-		if entry.isConfiguration {
-			if err := s.config.directSet(pm); err != nil {
-				return appendEntriesResponse{
-					Term:    s.term,
-					Success: false,
-					reason: fmt.Sprintf(
-						"AppendEntry %d/%d failed (configuration): %s",
-						i+1,
-						len(r.Entries),
-						err,
-					),
-				}, stepDown
-			}
+	// Append the entries to the log
+	if err := s.log.appendEntries(r.Entries); err != nil {
+		return appendEntriesResponse{
+			Term:    s.term,
+			Success: false,
+			reason:  fmt.Sprintf("AppendEntries (%d) failed: %s", len(r.Entries), err),
+		}, stepDown
+	}
+
+	// "Once a given server adds the new configuration entry to its log, it
+	// uses that configuration for all future decisions (it does not wait for
+	// the entry to become committed)."
+	for _, c := range configurations {
+		entry := r.Entries[c.pos]
+
+		// Report the change once it's committed, and recognize expulsion.
+		// See reportConfigurationChanges.
+		active, _ := s.config.active()
+		s.configChanges = append(s.configChanges, configChange{active, c.cNew, entry.Index, entry.Term})
+
+		if err := s.config.directSet(c.pm, entry.Index); err != nil {
+			return appendEntriesResponse{
+				Term:    s.term,
+				Success: false,
+				reason: fmt.Sprintf(
+					"AppendEntry %d/%d failed (configuration): %s",
+					c.pos+1,
+					len(r.Entries),
+					err,
+				),
+			}, stepDown
 		}
 	}
 
@@ -1134,7 +2797,9 @@ func (s *Server) handleAppendEntries(r appendEntries) (appendEntriesResponse, bo
 	//  match the term at the same index on the recipient
 	//
 	if r.CommitIndex > 0 && r.CommitIndex > s.log.getCommitIndex() {
-		if err := s.log.commitTo(r.CommitIndex); err != nil {
+		err := s.commitTo(r.CommitIndex)
+		s.reportConfigurationChanges()
+		if err != nil {
 			return appendEntriesResponse{
 				Term:    s.term,
 				Success: false,
@@ -1143,6 +2808,16 @@ func (s *Server) handleAppendEntries(r appendEntries) (appendEntriesResponse, bo
 		}
 	}
 
+	// Persist the entries before acknowledging them, if we're to; see
+	// WithDurableAcks.
+	if err := s.log.persist(); err != nil {
+		return appendEntriesResponse{
+			Term:    s.term,
+			Success: false,
+			reason:  fmt.Sprintf("persisting entries failed: %s", err),
+		}, stepDown
+	}
+
 	// all good
 	return appendEntriesResponse{
 		Term:    s.term,
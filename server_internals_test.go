@@ -3,7 +3,9 @@ package raft
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -33,6 +35,241 @@ func TestFollowerAllegiance(t *testing.T) {
 	}
 }
 
+func TestVoteResetOnNewTerm(t *testing.T) {
+	// a follower in term=5
+	s := Server{
+		id:     1,
+		term:   5,
+		state:  &protectedString{value: follower},
+		leader: unknownLeader,
+		seen:   &protectedLeader{},
+		log:    newRaftLog(&bytes.Buffer{}, noop),
+	}
+	s.resetElectionTimeout()
+	vote := func(term, candidate uint64) bool {
+		resp, _ := s.handleRequestVote(requestVote{Term: term, CandidateID: candidate})
+		return resp.VoteGranted
+	}
+
+	// votes for one candidate in term=5, and no other
+	if !vote(5, 2) {
+		t.Fatal("didn't vote for the first candidate in term 5")
+	}
+	if vote(5, 3) {
+		t.Fatal("voted twice in term 5")
+	}
+
+	// but is willing to vote again in term=6
+	if !vote(6, 3) {
+		t.Fatal("wouldn't vote in term 6, having voted in term 5")
+	}
+}
+
+func TestVoteFromUnknownPeer(t *testing.T) {
+	for _, tuple := range []struct {
+		policy  UnknownCandidatePolicy
+		granted bool
+		newTerm uint64
+	}{
+		{DenyUnknownCandidates, false, 6},
+		{IgnoreUnknownCandidates, false, 5},
+		{AllowUnknownCandidates, true, 6},
+	} {
+		// a follower in term=5, in a network of 3
+		reported := 0
+		s := NewServer(1, &bytes.Buffer{}, noop, WithUnknownCandidatePolicy(tuple.policy), WithEvents(Events{
+			OnVoteFromUnknownPeer: func(candidateID, term uint64) { reported++ },
+		}))
+		s.SetConfiguration(acceptingPeer{1}, acceptingPeer{2}, acceptingPeer{3})
+		s.term = 5
+
+		// asked for its vote by a server that was removed
+		resp, _ := s.handleRequestVote(requestVote{Term: 6, CandidateID: 4})
+		if expected, got := tuple.granted, resp.VoteGranted; expected != got {
+			t.Errorf("policy %d: expected granted=%v, got %v", tuple.policy, expected, got)
+		}
+		if expected, got := tuple.newTerm, s.term; expected != got {
+			t.Errorf("policy %d: expected term %d, got %d", tuple.policy, expected, got)
+		}
+		if expected, got := 1, reported; expected != got {
+			t.Errorf("policy %d: expected %d reports, got %d", tuple.policy, expected, got)
+		}
+
+		// but votes for a member as usual
+		if tuple.policy != AllowUnknownCandidates {
+			if resp, _ := s.handleRequestVote(requestVote{Term: 6, CandidateID: 2}); !resp.VoteGranted {
+				t.Errorf("policy %d: denied a member: %s", tuple.policy, resp.reason)
+			}
+		}
+	}
+}
+
+func TestWinnerKeepsItsVote(t *testing.T) {
+	// a candidate in a network of 1
+	s := NewServer(1, &bytes.Buffer{}, noop)
+	s.SetConfiguration(newLocalPeer(s))
+	s.setLeader(unknownLeader)
+	s.state.Set(candidate)
+	s.advanceTerm(1)
+
+	// wins the election
+	s.candidateSelect()
+	if expected, got := leader, s.state.Get(); expected != got {
+		t.Fatalf("expected state %s, got %s", expected, got)
+	}
+
+	// and remembers that it voted for itself in that term, so it won't vote
+	// for anyone else, even if it steps down
+	if expected, got := uint64(1), s.vote; expected != got {
+		t.Errorf("expected vote for %d, got %d", expected, got)
+	}
+}
+
+func TestCandidateKeepsVoteWhenSteppingDown(t *testing.T) {
+	// a candidate in term=5, which has voted for itself
+	s := Server{
+		id:     1,
+		term:   5,
+		vote:   1,
+		state:  &protectedString{value: candidate},
+		leader: unknownLeader,
+		seen:   &protectedLeader{},
+		log:    newRaftLog(&bytes.Buffer{}, noop),
+	}
+
+	// recognizes a leader in the same term
+	if _, stepDown := s.handleAppendEntries(appendEntries{Term: 5, LeaderID: 2}); !stepDown {
+		t.Fatal("didn't step down")
+	}
+	s.state.Set(follower)
+
+	// but mustn't vote again in that term
+	if resp, _ := s.handleRequestVote(requestVote{Term: 5, CandidateID: 3}); resp.VoteGranted {
+		t.Fatal("voted twice in term 5")
+	}
+}
+
+func TestElectionTimerResets(t *testing.T) {
+	// a server in term 5, with entries through index 2, which has voted as given
+	server := func(state string, vote uint64) (*Server, *int) {
+		resets := 0
+		s := &Server{
+			id:     1,
+			term:   5,
+			vote:   vote,
+			state:  &protectedString{value: state},
+			leader: unknownLeader,
+			seen:   &protectedLeader{},
+			log:    newRaftLog(&bytes.Buffer{}, noop),
+			after:  func(time.Duration) <-chan time.Time { resets++; return nil },
+		}
+		s.log.appendEntry(logEntry{Index: 1, Term: 4})
+		s.log.appendEntry(logEntry{Index: 2, Term: 5})
+		return s, &resets
+	}
+
+	// resets its election timer only when it grants a vote, or hears from a
+	// leader of the current term; a vote it denies mustn't, or a server asked
+	// by a hopeless candidate could never time out and stand itself
+	for _, tu := range []struct {
+		name   string
+		state  string
+		vote   uint64
+		rv     *requestVote
+		ae     *appendEntries
+		resets int
+	}{
+		{"stale candidate, as a candidate", candidate, 1, &requestVote{Term: 4, CandidateID: 2, LastLogIndex: 2, LastLogTerm: 5}, nil, 0},
+		{"stale candidate", follower, 0, &requestVote{Term: 4, CandidateID: 2, LastLogIndex: 2, LastLogTerm: 5}, nil, 0},
+		{"already voted", follower, 3, &requestVote{Term: 5, CandidateID: 2, LastLogIndex: 2, LastLogTerm: 5}, nil, 0},
+		{"stale log", follower, 0, &requestVote{Term: 5, CandidateID: 2, LastLogIndex: 1, LastLogTerm: 4}, nil, 0},
+		{"stale log, newer term", candidate, 1, &requestVote{Term: 6, CandidateID: 2, LastLogIndex: 1, LastLogTerm: 4}, nil, 0},
+		{"vote granted", follower, 0, &requestVote{Term: 5, CandidateID: 2, LastLogIndex: 2, LastLogTerm: 5}, nil, 1},
+		{"stale leader", follower, 0, nil, &appendEntries{Term: 4, LeaderID: 2}, 0},
+		{"current leader", follower, 0, nil, &appendEntries{Term: 5, LeaderID: 2, PrevLogIndex: 2, PrevLogTerm: 5}, 1},
+		{"new leader, as a candidate", candidate, 1, nil, &appendEntries{Term: 5, LeaderID: 2, PrevLogIndex: 2, PrevLogTerm: 5}, 1},
+	} {
+		s, resets := server(tu.state, tu.vote)
+		if tu.rv != nil {
+			resp, _ := s.handleRequestVote(*tu.rv)
+			if expected, got := tu.resets > 0, resp.VoteGranted; expected != got {
+				t.Errorf("%s: expected granted=%v, got %v (%s)", tu.name, expected, got, resp.reason)
+			}
+			if resp.Term < tu.rv.Term || resp.Term < 5 {
+				t.Errorf("%s: replied with term %d", tu.name, resp.Term)
+			}
+		} else {
+			s.handleAppendEntries(*tu.ae)
+		}
+		if expected, got := tu.resets, *resets; expected != got {
+			t.Errorf("%s: expected %d resets, got %d", tu.name, expected, got)
+		}
+	}
+}
+
+func TestTwoLeadersInOneTerm(t *testing.T) {
+	// a server in term 5, with entries through index 2, which reports safety
+	// violations
+	server := func(state string) (*Server, *safetyMonitor) {
+		monitor := &safetyMonitor{}
+		s := &Server{
+			id:     1,
+			term:   5,
+			state:  &protectedString{value: state},
+			leader: unknownLeader,
+			seen:   &protectedLeader{},
+			log:    newRaftLog(&bytes.Buffer{}, noop),
+			events: monitor.events(),
+			after:  func(time.Duration) <-chan time.Time { return nil },
+		}
+		s.log.appendEntry(logEntry{Index: 1, Term: 4})
+		s.log.appendEntry(logEntry{Index: 2, Term: 5})
+		return s, monitor
+	}
+	ae := func(term uint64) appendEntries {
+		return appendEntries{
+			Term:         term,
+			LeaderID:     2,
+			PrevLogIndex: 2,
+			PrevLogTerm:  5,
+			Entries:      []logEntry{{Index: 3, Term: term, Command: []byte(`{}`)}},
+		}
+	}
+
+	// as leader, hears from another leader of its own term, which it rejects,
+	// without stepping down, and reports
+	s, monitor := server(leader)
+	resp, stepDown := s.handleAppendEntries(ae(5))
+	if resp.Success || stepDown {
+		t.Errorf("expected the appendEntries rejected, without stepping down; got success=%v, stepDown=%v", resp.Success, stepDown)
+	}
+	if expected, got := uint64(2), s.log.lastIndex(); expected != got {
+		t.Errorf("expected last index %d, got %d", expected, got)
+	}
+	if got := monitor.get(); len(got) != 1 || !errors.Is(got[0], errTwoLeaders) {
+		t.Errorf("expected a single %v, got %v", errTwoLeaders, got)
+	}
+
+	// but there's nothing wrong with a leader of a newer term, nor with the
+	// leader of its own term, if it's not the leader itself
+	for _, tu := range []struct {
+		state string
+		term  uint64
+	}{
+		{leader, 6},
+		{follower, 5},
+		{candidate, 5},
+	} {
+		s, monitor := server(tu.state)
+		if resp, _ := s.handleAppendEntries(ae(tu.term)); !resp.Success {
+			t.Errorf("%s, from term %d: expected success, got %s", tu.state, tu.term, resp.reason)
+		}
+		if got := monitor.get(); len(got) != 0 {
+			t.Errorf("%s, from term %d: expected no violations, got %v", tu.state, tu.term, got)
+		}
+	}
+}
+
 func TestStrongLeader(t *testing.T) {
 	// a leader in term=2
 	s := Server{
@@ -60,6 +297,91 @@ func TestStrongLeader(t *testing.T) {
 	}
 }
 
+func TestTieBreakSplitVote(t *testing.T) {
+	for _, tuple := range []struct {
+		tieBreak     TieBreak
+		candidateID  uint64
+		lastLogIndex uint64
+		expectYield  bool
+	}{
+		{NoTieBreak, 1, 0, false},
+		{PreferLowerID, 1, 0, true},  // preferred, and equally up-to-date
+		{PreferLowerID, 3, 0, false}, // not preferred
+		{PreferLowerID, 1, 1, false}, // preferred, but more up-to-date, so not a tie
+		{PreferHigherID, 3, 0, true},
+		{PreferHigherID, 1, 0, false},
+	} {
+		// a candidate with id=2 in term=1, which has voted for itself
+		s := Server{
+			id:       2,
+			term:     1,
+			vote:     2,
+			state:    &protectedString{value: candidate},
+			leader:   unknownLeader,
+			log:      newRaftLog(&bytes.Buffer{}, noop),
+			tieBreak: tuple.tieBreak,
+		}
+
+		// receives a requestVote from a rival candidate in the same term
+		resp, stepDown := s.handleRequestVote(requestVote{
+			Term:         1,
+			CandidateID:  tuple.candidateID,
+			LastLogIndex: tuple.lastLogIndex,
+			LastLogTerm:  tuple.lastLogIndex,
+		})
+
+		// it should never grant a second vote in the same term
+		if resp.VoteGranted {
+			t.Errorf("%v, candidate %d: granted a second vote in term 1", tuple.tieBreak, tuple.candidateID)
+		}
+		if s.vote != 2 {
+			t.Errorf("%v, candidate %d: vote changed to %d", tuple.tieBreak, tuple.candidateID, s.vote)
+		}
+
+		// but should abandon its own election, only if the tie-break says so
+		if expected, got := tuple.expectYield, stepDown; expected != got {
+			t.Errorf("%v, candidate %d: expected yield=%v, got %v", tuple.tieBreak, tuple.candidateID, expected, got)
+		}
+	}
+}
+
+func TestTieBreakHoldsVote(t *testing.T) {
+	for _, tuple := range []struct {
+		tieBreak    TieBreak
+		term        uint64
+		vote        uint64
+		candidateID uint64
+		expectHold  bool
+	}{
+		{NoTieBreak, 1, noVote, 3, false},
+		{PreferLowerID, 1, noVote, 3, true},  // 2 is preferred, and may yet ask
+		{PreferLowerID, 1, noVote, 2, false}, // no-one else is preferred
+		{PreferLowerID, 1, 3, 3, false},      // already voted
+		{PreferLowerID, 2, 3, 3, true},       // but that was last term
+		{PreferHigherID, 1, noVote, 2, true},
+		{PreferHigherID, 1, noVote, 3, false},
+	} {
+		// a follower with id=1 in term=1, in a network of 3
+		s := Server{
+			id:       1,
+			term:     1,
+			vote:     tuple.vote,
+			state:    &protectedString{value: follower},
+			leader:   unknownLeader,
+			log:      newRaftLog(&bytes.Buffer{}, noop),
+			config:   newConfiguration(makePeerMap(nonresponsivePeer(1), nonresponsivePeer(2), nonresponsivePeer(3))),
+			tieBreak: tuple.tieBreak,
+		}
+
+		// asked for its vote, should hold it back only if another server is
+		// preferred, and it'd otherwise grant it
+		rv := requestVote{Term: tuple.term, CandidateID: tuple.candidateID}
+		if expected, got := tuple.expectHold, s.holdVote(rv); expected != got {
+			t.Errorf("%v, term %d, candidate %d: expected hold=%v, got %v", tuple.tieBreak, tuple.term, tuple.candidateID, expected, got)
+		}
+	}
+}
+
 func TestLimitedClientPatience(t *testing.T) {
 	// a client issues a command
 
@@ -82,7 +404,8 @@ func TestLenientCommit(t *testing.T) {
 			logEntry{Index: 4, Term: 2},
 			logEntry{Index: 5, Term: 2},
 		},
-		commitPos: 4,
+		commitPos:   4,
+		lastApplied: 5,
 	}
 
 	// belongs to a follower
@@ -119,8 +442,9 @@ func TestConfigurationReceipt(t *testing.T) {
 		term:   1,
 		leader: 1,
 		log: &raftLog{
-			entries:   []logEntry{logEntry{Index: 1, Term: 1}},
-			commitPos: 0,
+			entries:     []logEntry{logEntry{Index: 1, Term: 1}},
+			commitPos:   0,
+			lastApplied: 1,
 		},
 		state:  &protectedString{value: follower},
 		config: newConfiguration(peerMap{}),
@@ -132,9 +456,9 @@ func TestConfigurationReceipt(t *testing.T) {
 		serializablePeer{2, "bar"},
 		serializablePeer{3, "baz"},
 	)
-	configurationBuf := &bytes.Buffer{}
 	gob.Register(&serializablePeer{})
-	if err := gob.NewEncoder(configurationBuf).Encode(pm); err != nil {
+	encodedConfiguration, err := newConfiguration(pm).encode()
+	if err != nil {
 		t.Fatal(err)
 	}
 
@@ -146,10 +470,10 @@ func TestConfigurationReceipt(t *testing.T) {
 		PrevLogTerm:  1,
 		Entries: []logEntry{
 			logEntry{
-				Index:           2,
-				Term:            1,
-				Command:         configurationBuf.Bytes(),
-				isConfiguration: true,
+				Index:   2,
+				Term:    1,
+				Command: encodedConfiguration,
+				Kind:    kindConfiguration,
 			},
 		},
 		CommitIndex: 1,
@@ -180,9 +504,10 @@ func TestNonLeaderExpulsion(t *testing.T) {
 		term:   1,
 		leader: 1,
 		log: &raftLog{
-			store:     &bytes.Buffer{},
-			entries:   []logEntry{logEntry{Index: 1, Term: 1}},
-			commitPos: 0,
+			store:       &bytes.Buffer{},
+			entries:     []logEntry{logEntry{Index: 1, Term: 1}},
+			commitPos:   0,
+			lastApplied: 1,
 		},
 		state:  &protectedString{value: follower},
 		config: newConfiguration(peerMap{}),
@@ -195,9 +520,9 @@ func TestNonLeaderExpulsion(t *testing.T) {
 		serializablePeer{3, "baz"},
 		serializablePeer{5, "bat"},
 	)
-	configurationBuf := &bytes.Buffer{}
 	gob.Register(&serializablePeer{})
-	if err := gob.NewEncoder(configurationBuf).Encode(pm); err != nil {
+	encodedConfiguration, err := newConfiguration(pm).encode()
+	if err != nil {
 		t.Fatal(err)
 	}
 
@@ -209,10 +534,10 @@ func TestNonLeaderExpulsion(t *testing.T) {
 		PrevLogTerm:  1,
 		Entries: []logEntry{
 			logEntry{
-				Index:           2,
-				Term:            1,
-				Command:         configurationBuf.Bytes(),
-				isConfiguration: true,
+				Index:   2,
+				Term:    1,
+				Command: encodedConfiguration,
+				Kind:    kindConfiguration,
 			},
 		},
 		CommitIndex: 1,
@@ -236,6 +561,269 @@ func TestNonLeaderExpulsion(t *testing.T) {
 	}
 }
 
+func TestConfigurationChangesReportedInOrder(t *testing.T) {
+	// a follower, which records configuration change events
+	var indexes []uint64
+	s := Server{
+		id:     2,
+		term:   1,
+		leader: 1,
+		log: &raftLog{
+			store:       &bytes.Buffer{},
+			entries:     []logEntry{logEntry{Index: 1, Term: 1}},
+			commitPos:   0,
+			lastApplied: 1,
+		},
+		state:  &protectedString{value: follower},
+		config: newConfiguration(peerMap{}),
+		events: Events{OnConfigurationChange: func(_, _ []uint64, index, _ uint64) {
+			indexes = append(indexes, index)
+		}},
+	}
+
+	// receives two configuration changes in one appendEntries
+	gob.Register(&serializablePeer{})
+	encode := func(peers ...Peer) []byte {
+		b, err := newConfiguration(makePeerMap(peers...)).encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	s.handleAppendEntries(appendEntries{
+		Term:         1,
+		LeaderID:     1,
+		PrevLogIndex: 1,
+		PrevLogTerm:  1,
+		Entries: []logEntry{
+			logEntry{Index: 2, Term: 1, Command: encode(serializablePeer{1, ""}, serializablePeer{2, ""}), Kind: kindConfiguration},
+			logEntry{Index: 3, Term: 1, Command: encode(serializablePeer{1, ""}, serializablePeer{2, ""}, serializablePeer{3, ""}), Kind: kindConfiguration},
+		},
+		CommitIndex: 1,
+	})
+	if len(indexes) != 0 {
+		t.Fatalf("reported uncommitted changes %v", indexes)
+	}
+
+	// and once both are committed, they should be reported in order
+	s.handleAppendEntries(appendEntries{
+		Term:         1,
+		LeaderID:     1,
+		PrevLogIndex: 3,
+		PrevLogTerm:  1,
+		CommitIndex:  3,
+	})
+	if expected, got := "[2 3]", fmt.Sprint(indexes); expected != got {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestDurableAcks(t *testing.T) {
+	newFollower := func(store *syncTrackingStore, options logOptions) *Server {
+		l, err := recoverRaftLog(store, noop, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Server{
+			id:     2,
+			term:   1,
+			leader: 1,
+			log:    l,
+			state:  &protectedString{value: follower},
+			config: newConfiguration(peerMap{}),
+		}
+	}
+	entries := []logEntry{
+		logEntry{Index: 1, Term: 1, Command: []byte(`{"a":1}`)},
+		logEntry{Index: 2, Term: 1, Command: []byte(`{"b":2}`)},
+	}
+
+	// a follower, by default, acknowledges entries it hasn't persisted
+	store := &syncTrackingStore{InMemoryStore: &InMemoryStore{}}
+	resp, _ := newFollower(store, logOptions{}).handleAppendEntries(appendEntries{Term: 1, LeaderID: 1, Entries: entries})
+	if !resp.Success {
+		t.Fatalf("expected success, got %s", resp.reason)
+	}
+	if store.Len() > 0 {
+		t.Errorf("expected nothing persisted, got %d bytes", store.Len())
+	}
+
+	// but with durable acks, they're persisted, and synced, before it does
+	store = &syncTrackingStore{InMemoryStore: &InMemoryStore{}}
+	s := newFollower(store, logOptions{durable: true})
+	resp, _ = s.handleAppendEntries(appendEntries{Term: 1, LeaderID: 1, Entries: entries})
+	if !resp.Success {
+		t.Fatalf("expected success, got %s", resp.reason)
+	}
+	if store.Len() == 0 || store.synced != store.Len() {
+		t.Errorf("expected %d bytes synced before the ack, got %d", store.Len(), store.synced)
+	}
+
+	// and recovered, still uncommitted
+	recovered := newFollower(&syncTrackingStore{InMemoryStore: store.Reopen()}, logOptions{durable: true})
+	if expected, got := uint64(2), recovered.log.lastIndex(); expected != got {
+		t.Errorf("expected last index %d, got %d", expected, got)
+	}
+	if expected, got := uint64(0), recovered.log.getCommitIndex(); expected != got {
+		t.Errorf("expected commit index %d, got %d", expected, got)
+	}
+
+	// until they're committed
+	resp, _ = s.handleAppendEntries(appendEntries{Term: 1, LeaderID: 1, PrevLogIndex: 2, PrevLogTerm: 1, CommitIndex: 2})
+	if !resp.Success {
+		t.Fatalf("expected success, got %s", resp.reason)
+	}
+	recovered = newFollower(&syncTrackingStore{InMemoryStore: store.Reopen()}, logOptions{durable: true})
+	if expected, got := uint64(2), recovered.log.getCommitIndex(); expected != got {
+		t.Errorf("after commit: expected commit index %d, got %d", expected, got)
+	}
+}
+
+// syncTrackingStore records how much of the store had been written when it was
+// last synced.
+type syncTrackingStore struct {
+	*InMemoryStore
+	synced int
+}
+
+func (s *syncTrackingStore) Sync() error {
+	s.synced = s.Len()
+	return s.InMemoryStore.Sync()
+}
+
+func TestElectionTimeoutMultiplier(t *testing.T) {
+	oldMin, oldMax := resetElectionTimeoutMS(0, 0)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+	oldMultiplier := atomic.LoadInt32(&electionTimeoutMultiplier)
+	defer atomic.StoreInt32(&electionTimeoutMultiplier, oldMultiplier)
+
+	// derives every timing from the heartbeat
+	if err := SetElectionTimeoutMultiplier(100*time.Millisecond, 20); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 100*time.Millisecond, broadcastInterval(); expected != got {
+		t.Errorf("expected broadcast interval %s, got %s", expected, got)
+	}
+	if expected, got := 2*time.Second, minimumElectionTimeout(); expected != got {
+		t.Errorf("expected minimum election timeout %s, got %s", expected, got)
+	}
+	if expected, got := 4*time.Second, maximumElectionTimeout(); expected != got {
+		t.Errorf("expected maximum election timeout %s, got %s", expected, got)
+	}
+	for i := 0; i < 100; i++ {
+		if d := electionTimeout(); d < 2*time.Second || d >= 4*time.Second {
+			t.Fatalf("election timeout %s out of range", d)
+		}
+	}
+
+	// but refuses a multiplier, or a heartbeat, that's too small
+	for _, c := range []struct {
+		heartbeat  time.Duration
+		multiplier int
+		err        error
+	}{
+		{100 * time.Millisecond, minElectionTimeoutMultiplier - 1, errMultiplierTooSmall},
+		{100 * time.Microsecond, 20, errBadHeartbeat},
+	} {
+		if err := SetElectionTimeoutMultiplier(c.heartbeat, c.multiplier); err != c.err {
+			t.Errorf("%s * %d: expected %v, got %v", c.heartbeat, c.multiplier, c.err, err)
+		}
+	}
+	if expected, got := 100*time.Millisecond, broadcastInterval(); expected != got {
+		t.Errorf("after refusals: expected broadcast interval %s, got %s", expected, got)
+	}
+}
+
+func TestFollowerCatchingUp(t *testing.T) {
+	// a new follower, with an empty log, hears from a leader which has
+	// committed far more than the threshold
+	s := NewServer(3, &bytes.Buffer{}, noop)
+	leaderCommit := uint64(3 * catchUpThreshold)
+	send := func(from, to uint64) {
+		ae := appendEntries{Term: 1, LeaderID: 1, PrevLogIndex: from - 1, CommitIndex: leaderCommit}
+		if from > 1 {
+			ae.PrevLogTerm = 1
+		}
+		for index := from; index <= to; index++ {
+			ae.Entries = append(ae.Entries, logEntry{Index: index, Term: 1, Command: []byte(`{}`)})
+		}
+		s.handleAppendEntries(ae) // can't commit to the leader's index yet
+		if to > 0 && s.log.lastIndex() != to {
+			t.Fatalf("appendEntries %d-%d: last index %d", from, to, s.log.lastIndex())
+		}
+	}
+
+	// so it reports catching up, after a heartbeat
+	send(1, 0)
+	if !s.Stats().CatchingUp {
+		t.Errorf("expected a follower with an empty log to be catching up")
+	}
+
+	// while it's more than the threshold behind
+	send(1, leaderCommit-catchUpThreshold-1)
+	if !s.Stats().CatchingUp {
+		t.Errorf("expected a follower %d entries behind to be catching up", catchUpThreshold+1)
+	}
+
+	// but not once it's near the leader's index
+	send(leaderCommit-catchUpThreshold, leaderCommit-catchUpThreshold/2)
+	if s.Stats().CatchingUp {
+		t.Errorf("expected a follower %d entries behind to have caught up", catchUpThreshold/2)
+	}
+}
+
+func TestOnCaughtUp(t *testing.T) {
+	var caughtUp []uint64
+	s := NewServer(3, &bytes.Buffer{}, noop, WithEvents(Events{
+		OnCaughtUp: func(index uint64) { caughtUp = append(caughtUp, index) },
+	}))
+
+	// the leader probes with an entry the follower doesn't have, and then
+	// sends it entries, with its commit index, so far as they reach it
+	probe := func(index, leaderCommit uint64) {
+		s.handleAppendEntries(appendEntries{Term: 1, LeaderID: 1, PrevLogIndex: index, PrevLogTerm: 1, CommitIndex: leaderCommit})
+	}
+	send := func(from, to, leaderCommit uint64) {
+		ae := appendEntries{Term: 1, LeaderID: 1, PrevLogIndex: from - 1, CommitIndex: leaderCommit}
+		if from > 1 {
+			ae.PrevLogTerm = 1
+		}
+		if to < leaderCommit {
+			ae.CommitIndex = to
+		}
+		for index := from; index <= to; index++ {
+			ae.Entries = append(ae.Entries, logEntry{Index: index, Term: 1, Command: []byte(`{}`)})
+		}
+		if resp, _ := s.handleAppendEntries(ae); !resp.Success {
+			t.Fatalf("appendEntries %d-%d: %s", from, to, resp.reason)
+		}
+	}
+
+	// a new follower is found to be behind a leader, which commits more
+	// meanwhile
+	target := uint64(3 * catchUpThreshold)
+	probe(target, target)
+	send(1, target/2, target+10)
+	if len(caughtUp) > 0 {
+		t.Fatalf("caught up too soon, at %v", caughtUp)
+	}
+
+	// it's caught up once it's committed as much as the leader had, when it
+	// was found to be behind, and only then
+	send(target/2+1, target+10, target+10)
+	send(target+11, target+10, target+10)
+	if expected, got := fmt.Sprint([]uint64{target + 10}), fmt.Sprint(caughtUp); expected != got {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	// and again, if it falls behind again
+	probe(3*target, 3*target)
+	send(target+11, 3*target, 3*target)
+	if expected, got := fmt.Sprint([]uint64{target + 10, 3 * target}), fmt.Sprint(caughtUp); expected != got {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
 type serializablePeer struct {
 	MyID uint64
 	Err  string
@@ -248,9 +836,101 @@ func (p serializablePeer) callAppendEntries(appendEntries) appendEntriesResponse
 func (p serializablePeer) callRequestVote(requestVote) requestVoteResponse {
 	return requestVoteResponse{}
 }
-func (p serializablePeer) callCommand([]byte, chan<- []byte) error {
-	return fmt.Errorf("%s", p.Err)
+func (p serializablePeer) callCommand([]byte, chan<- []byte) (uint64, error) {
+	return 0, fmt.Errorf("%s", p.Err)
 }
 func (p serializablePeer) callSetConfiguration(...Peer) error {
 	return fmt.Errorf("%s", p.Err)
 }
+func (p serializablePeer) callRead([]byte) ([]byte, error) {
+	return nil, fmt.Errorf("%s", p.Err)
+}
+
+func TestLeaderSkipsConflictingTerms(t *testing.T) {
+	newLog := func(terms ...uint64) *raftLog {
+		log := newRaftLog(&bytes.Buffer{}, noop)
+		for i, term := range terms {
+			if err := log.appendEntry(logEntry{Index: uint64(i + 1), Term: term, Command: []byte(`{}`)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return log
+	}
+
+	// a leader in term=8, and a follower which diverged after index 3, and
+	// has a longer log, full of entries from terms the leader never saw
+	s := Server{
+		id:     1,
+		term:   8,
+		state:  &protectedString{value: leader},
+		leader: 1,
+		log:    newLog(1, 1, 1, 4, 4, 5, 5, 6, 6, 6),
+		now:    time.Now,
+	}
+	f := &Server{
+		id:     2,
+		term:   3,
+		state:  &protectedString{value: follower},
+		leader: unknownLeader,
+		seen:   &protectedLeader{},
+		config: newConfiguration(peerMap{}),
+		log:    newLog(1, 1, 1, 2, 2, 2, 3, 3, 3, 3, 3),
+	}
+	follower := &handlingPeer{s: f}
+	ni := newNextIndex(makePeerMap(follower), s.log.lastIndex())
+
+	// catches it up
+	for i := 0; s.flush(follower, ni) != nil; i++ {
+		if i > 10 {
+			t.Fatal("follower never caught up")
+		}
+	}
+	if expected, got := "[1 1 1 4 4 5 5 6 6 6]", fmt.Sprint(terms(f.log)); expected != got {
+		t.Errorf("expected follower terms %s, got %s", expected, got)
+	}
+
+	// after one rejection for each of the follower's conflicting terms,
+	// rather than one for each of its conflicting entries
+	if expected, got := 2, follower.rejections; expected != got {
+		t.Errorf("expected %d rejections, got %d", expected, got)
+	}
+}
+
+// handlingPeer passes appendEntries straight to a server's handler, without
+// its server loop, and counts rejections.
+type handlingPeer struct {
+	s          *Server
+	rejections int
+}
+
+func (p *handlingPeer) id() uint64 { return p.s.id }
+func (p *handlingPeer) callAppendEntries(ae appendEntries) appendEntriesResponse {
+	resp, _ := p.s.handleAppendEntries(ae)
+	if !resp.Success {
+		p.rejections++
+	}
+	return resp
+}
+func (p *handlingPeer) callRequestVote(requestVote) requestVoteResponse {
+	return requestVoteResponse{}
+}
+func (p *handlingPeer) callCommand([]byte, chan<- []byte) (uint64, error) {
+	return 0, fmt.Errorf("not implemented")
+}
+func (p *handlingPeer) callSetConfiguration(...Peer) error {
+	return fmt.Errorf("not implemented")
+}
+func (p *handlingPeer) callRead([]byte) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// terms returns the terms of every entry in the log, in order.
+func terms(l *raftLog) []uint64 {
+	l.RLock()
+	defer l.RUnlock()
+	a := []uint64{}
+	for _, entry := range l.entries {
+		a = append(a, entry.Term)
+	}
+	return a
+}
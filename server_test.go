@@ -3,12 +3,19 @@ package raft
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
+	"net/url"
 	"os"
+	"reflect"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -90,27 +97,2103 @@ func TestCandidateToLeader(t *testing.T) {
 	}
 }
 
+func TestWaitForLeader(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	server := NewServer(1, &bytes.Buffer{}, noop)
+	server.SetConfiguration(newLocalPeer(server))
+
+	// before it's started, nobody is leader
+	ctx, cancel := context.WithTimeout(context.Background(), maximumElectionTimeout())
+	defer cancel()
+	if _, err := server.WaitForLeader(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// once started, it elects itself within an election timeout
+	server.Start()
+	defer server.Stop()
+	began := time.Now()
+	ctx, cancel = context.WithTimeout(context.Background(), 4*maximumElectionTimeout())
+	defer cancel()
+	id, err := server.WaitForLeader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(1), id; expected != got {
+		t.Errorf("expected leader %d, got %d", expected, got)
+	}
+	if took := time.Since(began); took > 2*maximumElectionTimeout() {
+		t.Errorf("took %s to observe the election", took)
+	}
+}
+
 func TestFailedElection(t *testing.T) {
 	log.SetOutput(&bytes.Buffer{})
 	defer log.SetOutput(os.Stdout)
 	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
 	defer resetElectionTimeoutMS(oldMin, oldMax)
 
-	server := NewServer(1, &bytes.Buffer{}, noop)
-	server.SetConfiguration(
-		newLocalPeer(server),
-		disapprovingPeer(2),
-		nonresponsivePeer(3),
+	server := NewServer(1, &bytes.Buffer{}, noop)
+	server.SetConfiguration(
+		newLocalPeer(server),
+		disapprovingPeer(2),
+		nonresponsivePeer(3),
+	)
+
+	server.Start()
+	defer server.Stop()
+	time.Sleep(2 * electionTimeout())
+
+	if server.state.Get() == leader {
+		t.Fatalf("erroneously became Leader")
+	}
+	t.Logf("remained %s", server.state.Get())
+}
+
+func TestCandidateStepsDownMidElection(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a candidate in a network of 3, whose votes are slow to arrive
+	voter := &slowVoter{id_: 2, requests: make(chan uint64, 100), release: make(chan struct{})}
+	server := NewServer(1, &bytes.Buffer{}, noop)
+	server.SetConfiguration(newLocalPeer(server), voter, nonresponsivePeer(3))
+	server.Start()
+	defer server.Stop()
+	term := <-voter.requests
+
+	// hears from a leader in the same term
+	if resp := server.appendEntries(appendEntries{Term: term, LeaderID: 3}); !resp.Success {
+		t.Fatalf("appendEntries rejected: %s", resp.reason)
+	}
+
+	// and steps down straight away
+	deadline := time.Now().Add(broadcastInterval())
+	for server.state.Get() != follower {
+		if time.Now().After(deadline) {
+			t.Fatalf("still %s after hearing from the leader", server.state.Get())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if id, _ := server.seen.Get(); id != 3 {
+		t.Errorf("expected leader 3, got %d", id)
+	}
+
+	// so the vote it was waiting for doesn't count
+	close(voter.release)
+	time.Sleep(broadcastInterval())
+	if expected, got := follower, server.state.Get(); expected != got {
+		t.Errorf("after a late vote, expected %s, got %s", expected, got)
+	}
+}
+
+func TestStuckCandidateEvent(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a clock which moves only when we say: each report moves it on an hour
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	type stuck struct {
+		term     uint64
+		attempts int
+		elapsed  time.Duration
+	}
+	reports := make(chan stuck, 10)
+	server := NewServer(1, &bytes.Buffer{}, noop,
+		WithStuckCandidateThreshold(3),
+		WithEvents(Events{
+			OnStuckCandidate: func(term uint64, attempts int, elapsed time.Duration) {
+				reports <- stuck{term, attempts, elapsed}
+				clock.advance(time.Hour)
+			},
+		}),
+	)
+	server.now = clock.now
+
+	// a network of 3, partitioned from both of its peers
+	server.SetConfiguration(newLocalPeer(server), nonresponsivePeer(2), nonresponsivePeer(3))
+	server.Start()
+	defer server.Stop()
+
+	// the first election is in term 1, so the third failure is in term 3, and
+	// the sixth in term 6, an hour later
+	for _, expected := range []stuck{{3, 3, 0}, {6, 6, time.Hour}} {
+		select {
+		case got := <-reports:
+			if expected != got {
+				t.Errorf("expected %+v, got %+v", expected, got)
+			}
+		case <-time.After(8 * maximumElectionTimeout()):
+			t.Fatal("stuck candidate wasn't reported")
+		}
+	}
+}
+
+func TestStartupGrace(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a server which waits a second before its first election, with a clock
+	// which moves only when we say, in a network of 3 it can't reach
+	grace := time.Second
+	start := func() (*Server, *fakeClock) {
+		clock := &fakeClock{t: time.Unix(0, 0)}
+		server := NewServer(1, &bytes.Buffer{}, noop, WithStartupGrace(grace))
+		server.now, server.after = clock.now, clock.after
+		server.SetConfiguration(newLocalPeer(server), nonresponsivePeer(2), nonresponsivePeer(3))
+		server.Start()
+		return server, clock
+	}
+	stillFollower := func(server *Server, when string) {
+		time.Sleep(maximumElectionTimeout()) // for it to have noticed a timeout
+		if expected, got := follower, server.state.Get(); expected != got {
+			t.Errorf("%s: expected %s, got %s", when, expected, got)
+		}
+	}
+
+	// doesn't start an election within the grace period, although it's far
+	// longer than an election timeout
+	server, clock := start()
+	defer server.Stop()
+	clock.advance(grace - time.Millisecond)
+	stillFollower(server, "within the grace period")
+
+	// and once a leader makes contact, it's back to the usual election
+	// timeout, from then
+	server.appendEntries(appendEntries{Term: 1, LeaderID: 2})
+	clock.advance(2 * time.Millisecond)
+	stillFollower(server, "after a heartbeat, past the grace period")
+	clock.advance(maximumElectionTimeout())
+	waitForState(t, server, candidate)
+
+	// without contact, it starts an election once the grace period is over
+	quiet, clock := start()
+	defer quiet.Stop()
+	clock.advance(grace + maximumElectionTimeout())
+	waitForState(t, quiet, candidate)
+}
+
+func TestTwoServerNetworkLoneNode(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 2, whose other node is down
+	server := NewServer(1, &bytes.Buffer{}, noop)
+	server.SetConfiguration(newLocalPeer(server), nonresponsivePeer(2))
+
+	server.Start()
+	defer server.Stop()
+	time.Sleep(4 * maximumElectionTimeout())
+
+	// its own vote is only 1 of the 2 it needs
+	if server.state.Get() == leader {
+		t.Fatalf("erroneously became Leader with 1 of 2 votes")
+	}
+}
+
+func TestTwoServerNetworkCommitNeedsBoth(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 2, whose other node votes for us, but never accepts any
+	// log entries
+	server := NewServer(1, &bytes.Buffer{}, noop)
+	server.SetConfiguration(newLocalPeer(server), approvingPeer(2))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	if err := server.Command([]byte(`{}`), make(chan []byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(4 * maximumElectionTimeout())
+
+	// the command is appended, but our own ack isn't enough to commit it
+	if expected, got := uint64(1), server.log.lastIndex(); expected != got {
+		t.Errorf("expected last index %d, got %d", expected, got)
+	}
+	if expected, got := uint64(0), server.log.getCommitIndex(); expected != got {
+		t.Errorf("expected commit index %d, got %d", expected, got)
+	}
+}
+
+func TestHungFollowerDoesntBlockHeartbeats(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a leader-to-be, with one follower whose appendEntries never returns,
+	// and one follower which is healthy
+	hung := &hungPeer{id_: 2, release: make(chan struct{})}
+	defer close(hung.release)
+	healthy := &countingPeer{id_: 3}
+
+	server := NewServer(1, &bytes.Buffer{}, noop)
+	server.SetConfiguration(newLocalPeer(server), hung, healthy)
+	server.Start()
+	defer server.Stop()
+
+	waitForState(t, server, leader)
+
+	// the healthy follower should keep receiving heartbeats
+	before := healthy.appendEntries()
+	time.Sleep(maximumElectionTimeout())
+	if got := healthy.appendEntries() - before; got < 2 {
+		t.Errorf("healthy follower got %d heartbeat(s) during an election timeout", got)
+	}
+
+	// and the hung follower should only have a single flush outstanding
+	if expected, got := int32(1), hung.appendEntries(); expected != got {
+		t.Errorf("hung follower: expected %d outstanding appendEntries, got %d", expected, got)
+	}
+}
+
+func TestCorruptFollowerRebuilt(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 2, whose state machines count commands
+	var (
+		stores  = []*InMemoryStore{{}, {}}
+		sms     = []*countingStateMachine{{}, {}}
+		servers = []*Server{}
+		peers   = []Peer{}
+	)
+	for i := range stores {
+		server := NewServer(uint64(i+1), stores[i], sms[i].apply)
+		servers, peers = append(servers, server), append(peers, newLocalPeer(server))
+	}
+	for _, server := range servers {
+		server.SetConfiguration(peers...)
+		server.Start()
+		defer server.Stop()
+	}
+	lastHash := func(l *raftLog) [sha256.Size]byte {
+		l.RLock()
+		defer l.RUnlock()
+		return l.lastHashWithLock()
+	}
+	var leading, following *Server
+	deadline := time.Now().Add(4 * maximumElectionTimeout())
+	for leading == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("no leader")
+		}
+		for i, server := range servers {
+			if server.state.Get() == leader {
+				leading, following = server, servers[1-i]
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := leading.commandWait([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline = time.Now().Add(4 * maximumElectionTimeout())
+	for following.log.getCommitIndex() < leading.log.getCommitIndex() {
+		if time.Now().After(deadline) {
+			t.Fatal("follower didn't commit the commands")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// whose follower's log diverges, in a committed command, but keeps its
+	// own hash chain intact, so that only the leader's hash gives it away
+	following.log.Lock()
+	n := len(following.log.entries)
+	following.log.entries[n-2].Command = []byte("corrupt")
+	following.log.entries[n-1].PrevHash = following.log.entries[n-2].hash()
+	following.log.Unlock()
+
+	// gets it rebuilt from the leader's, without applying anything twice
+	if _, _, err := leading.commandWait([]byte(`3`)); err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(4 * maximumElectionTimeout())
+	for lastHash(following.log) != lastHash(leading.log) || following.log.getCommitIndex() < leading.log.getCommitIndex() {
+		if time.Now().After(deadline) {
+			t.Fatal("follower's log wasn't rebuilt")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	following.log.RLock()
+	if expected, got := "1", string(following.log.entries[n-2].Command); expected != got {
+		t.Errorf("expected command %q, got %q", expected, got)
+	}
+	following.log.RUnlock()
+	for i, sm := range sms {
+		sm.Lock()
+		if expected, got := 4, sm.n; expected != got {
+			t.Errorf("server %d: expected %d commands applied, got %d", i+1, expected, got)
+		}
+		sm.Unlock()
+	}
+
+	// and in its store too
+	recovered, err := recoverRaftLog(stores[following.id-1].Reopen(), noop, logOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastHash(recovered) != lastHash(leading.log) {
+		t.Errorf("follower's store wasn't rebuilt")
+	}
+}
+
+func TestConfigurationChangeEvent(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	type change struct {
+		oldPeers, newPeers []uint64
+		index, term        uint64
+	}
+	changes := make(chan change, 1)
+	server := NewServer(1, &bytes.Buffer{}, noop, WithEvents(Events{
+		OnConfigurationChange: func(oldPeers, newPeers []uint64, index, term uint64) {
+			changes <- change{oldPeers, newPeers, index, term}
+		},
+	}))
+
+	// a network of 1, which quickly elects itself
+	gob.Register(acceptingPeer{})
+	server.SetConfiguration(acceptingPeer{1})
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	// grows to a network of 3
+	if err := server.SetConfiguration(acceptingPeer{1}, acceptingPeer{2}, acceptingPeer{3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// and reports the change once it's committed
+	select {
+	case c := <-changes:
+		if expected, got := "[1]", fmt.Sprint(c.oldPeers); expected != got {
+			t.Errorf("old peers: expected %s, got %s", expected, got)
+		}
+		if expected, got := "[1 2 3]", fmt.Sprint(c.newPeers); expected != got {
+			t.Errorf("new peers: expected %s, got %s", expected, got)
+		}
+		if expected, got := uint64(1), c.index; expected != got {
+			t.Errorf("index: expected %d, got %d", expected, got)
+		}
+		entries, _, _ := server.log.entriesAfter(0)
+		if expected, got := entries[0].Term, c.term; expected != got {
+			t.Errorf("term: expected %d, got %d", expected, got)
+		}
+	case <-time.After(4 * maximumElectionTimeout()):
+		t.Fatal("configuration change wasn't reported")
+	}
+
+	// and in its stats
+	stats := server.Stats()
+	if expected, got := "[1 2 3]", fmt.Sprint(stats.Configuration); expected != got {
+		t.Errorf("stats configuration: expected %s, got %s", expected, got)
+	}
+	if expected, got := uint64(1), stats.ConfigurationIndex; expected != got {
+		t.Errorf("stats configuration index: expected %d, got %d", expected, got)
+	}
+}
+
+func TestRemoveLeader(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 3, which records its peers by description
+	servers := []*Server{}
+	factory := func(d PeerDescriptor) (Peer, error) {
+		return newLocalPeer(servers[d.ID-1]), nil
+	}
+	for id := uint64(1); id <= 3; id++ {
+		servers = append(servers, NewServer(id, &bytes.Buffer{}, noop, WithPeerFactory(factory)))
+	}
+	peers := []Peer{}
+	for _, server := range servers {
+		peers = append(peers, newLocalPeer(server))
+	}
+	for _, server := range servers {
+		server.SetConfiguration(peers...)
+		server.Start()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*maximumElectionTimeout())
+	defer cancel()
+	id, err := servers[0].WaitForLeader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := servers[id-1]
+	remaining := []*Server{}
+	for _, server := range servers {
+		if server != old {
+			remaining = append(remaining, server)
+			defer server.Stop()
+		}
+	}
+
+	// removes its leader
+	if err := old.SetConfiguration(newLocalPeer(remaining[0]), newLocalPeer(remaining[1])); err != nil {
+		t.Fatal(err)
+	}
+
+	// which stops, and the others elect a new leader among themselves
+	deadline := time.Now().Add(10 * maximumElectionTimeout())
+	var successor *Server
+	for successor == nil || old.running.Get() {
+		if time.Now().After(deadline) {
+			t.Fatalf("no new leader, or the old one didn't stop")
+		}
+		for _, server := range remaining {
+			if server.state.Get() == leader {
+				successor = server
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if expected, got := follower, old.state.Get(); expected != got {
+		t.Errorf("old leader: expected %s, got %s", expected, got)
+	}
+
+	// which can commit commands without it
+	response := make(chan []byte, 1)
+	if err := successor.Command([]byte(`{}`), response); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-response:
+	case <-time.After(4 * maximumElectionTimeout()):
+		t.Fatal("command wasn't committed")
+	}
+}
+
+func TestRemoveUnreachablePeer(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 3, whose third server is dead
+	servers := []*Server{}
+	factory := func(d PeerDescriptor) (Peer, error) {
+		if d.ID == 3 {
+			return nonresponsivePeer(3), nil
+		}
+		return newLocalPeer(servers[d.ID-1]), nil
+	}
+	for id := uint64(1); id <= 2; id++ {
+		servers = append(servers, NewServer(id, &bytes.Buffer{}, noop, WithPeerFactory(factory)))
+	}
+	for _, server := range servers {
+		server.SetConfiguration(newLocalPeer(servers[0]), newLocalPeer(servers[1]), nonresponsivePeer(3))
+		server.Start()
+		defer server.Stop()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*maximumElectionTimeout())
+	defer cancel()
+	id, err := servers[0].WaitForLeader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaderServer := servers[id-1]
+
+	// removes it: the joint quorum needs 2 of C_old, and both of C_new, all
+	// of which are alive
+	if err := leaderServer.SetConfiguration(newLocalPeer(servers[0]), newLocalPeer(servers[1])); err != nil {
+		t.Fatal(err)
+	}
+
+	// and the change is committed, by every live server
+	deadline := time.Now().Add(10 * maximumElectionTimeout())
+	for _, server := range servers {
+		for fmt.Sprint(server.Stats().Configuration) != "[1 2]" {
+			if time.Now().After(deadline) {
+				t.Fatalf("server %d: configuration change wasn't committed: %v", server.id, server.Stats().Configuration)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// which go on committing commands without it
+	if _, _, err := leaderServer.commandWait([]byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommitEvent(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+
+	entries := func(from, to uint64) []logEntry {
+		a := []logEntry{}
+		for index := from; index <= to; index++ {
+			a = append(a, logEntry{Index: index, Term: 1, Command: []byte(`{}`)})
+		}
+		return a
+	}
+
+	for _, tuple := range []struct {
+		window   time.Duration
+		expected string
+	}{
+		{0, "[(0, 5] (5, 7]]"},
+		{25 * time.Millisecond, "[(0, 7]]"},
+	} {
+		var (
+			mu      sync.Mutex
+			commits = []string{}
+		)
+		server := NewServer(1, &bytes.Buffer{}, noop, WithCommitCoalescing(tuple.window), WithEvents(Events{
+			OnCommit: func(from, to uint64) {
+				mu.Lock()
+				defer mu.Unlock()
+				commits = append(commits, fmt.Sprintf("(%d, %d]", from, to))
+			},
+		}))
+
+		// a follower which commits a batch of entries, and then some more
+		server.handleAppendEntries(appendEntries{Term: 1, LeaderID: 2, Entries: entries(1, 5), CommitIndex: 5})
+		server.handleAppendEntries(appendEntries{Term: 1, LeaderID: 2, PrevLogIndex: 5, PrevLogTerm: 1, Entries: entries(6, 7), CommitIndex: 7})
+		time.Sleep(2 * tuple.window)
+
+		// reports each batch as a single range, or, if they're coalesced,
+		// both together
+		mu.Lock()
+		if got := fmt.Sprint(commits); tuple.expected != got {
+			t.Errorf("window %s: expected %s, got %s", tuple.window, tuple.expected, got)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+
+	applied := 0
+	apply := func(uint64, []byte) []byte { applied++; return []byte{} }
+	gob.Register(acceptingPeer{})
+
+	// a brand-new server bootstraps from an empty log
+	store := &InMemoryStore{}
+	server := NewServer(1, store, apply)
+	if err := server.Bootstrap(acceptingPeer{1}, acceptingPeer{2}, acceptingPeer{3}); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(1), server.log.getCommitIndex(); expected != got {
+		t.Errorf("expected commit index %d, got %d", expected, got)
+	}
+	if expected, got := "[1 2 3]", fmt.Sprint(server.Stats().Configuration); expected != got {
+		t.Errorf("expected configuration %s, got %s", expected, got)
+	}
+
+	// after a restart, the configuration is recovered from the log, and never
+	// passed to the state machine
+	server = NewServer(1, store.Reopen(), apply)
+	if expected, got := "[1 2 3]", fmt.Sprint(server.Stats().Configuration); expected != got {
+		t.Errorf("after restart, expected configuration %s, got %s", expected, got)
+	}
+	if applied != 0 {
+		t.Errorf("configuration was applied as a command %d time(s)", applied)
+	}
+
+	// and the log is no longer empty, so it can't be bootstrapped again
+	if expected, got := errLogNotEmpty, server.Bootstrap(acceptingPeer{1}); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if expected, got := "[1 2 3]", fmt.Sprint(server.Stats().Configuration); expected != got {
+		t.Errorf("after refused bootstrap, expected configuration %s, got %s", expected, got)
+	}
+}
+
+func TestRestartDuringConfigurationChange(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+	gob.Register(acceptingPeer{})
+
+	// a store whose last configuration entry was written in C_old,new, while
+	// growing from 2 servers to 3
+	config := newConfiguration(makePeerMap(acceptingPeer{1}, acceptingPeer{2}))
+	if err := config.changeTo(makePeerMap(acceptingPeer{1}, acceptingPeer{2}, acceptingPeer{3})); err != nil {
+		t.Fatal(err)
+	}
+	encodedConfiguration, err := config.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &InMemoryStore{}
+	l := newRaftLog(store, noop)
+	l.appendEntry(logEntry{Index: 1, Term: 1, Command: encodedConfiguration, Kind: kindConfiguration})
+	if err := l.commitTo(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// restores both halves of the joint configuration
+	server := NewServer(1, store.Reopen(), noop)
+	if expected, got := cOldNew, server.config.state; expected != got {
+		t.Fatalf("expected state %s, got %s", expected, got)
+	}
+	if expected, got := "[1 2]", fmt.Sprint(server.config.cOldPeers.ids()); expected != got {
+		t.Errorf("expected C_old %s, got %s", expected, got)
+	}
+	if expected, got := "[1 2 3]", fmt.Sprint(server.config.cNewPeers.ids()); expected != got {
+		t.Errorf("expected C_new %s, got %s", expected, got)
+	}
+
+	// and, once elected, completes the change, so it can make another
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+	if expected, got := "[1 2 3]", fmt.Sprint(server.Stats().Configuration); expected != got {
+		t.Errorf("expected configuration %s, got %s", expected, got)
+	}
+	if err := server.SetConfiguration(acceptingPeer{1}, acceptingPeer{2}); err != nil {
+		t.Errorf("SetConfiguration: %s", err)
+	}
+}
+
+func TestPeerFactory(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a factory which builds local peers, which can't be encoded, and
+	// accepting peers, which aren't registered with encoding/gob
+	var (
+		server      *Server
+		mu          sync.Mutex
+		constructed = []uint64{}
+	)
+	factory := func(d PeerDescriptor) (Peer, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		constructed = append(constructed, d.ID)
+		if d.ID == 1 {
+			return newLocalPeer(server), nil
+		}
+		return acceptingPeer{d.ID}, nil
+	}
+
+	// lets a network of 1 grow to 2
+	store := &InMemoryStore{}
+	server = NewServer(1, store, noop, WithPeerFactory(factory))
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	waitForState(t, server, leader)
+	if err := server.SetConfiguration(newLocalPeer(server), acceptingPeer{2}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(4 * maximumElectionTimeout())
+	for fmt.Sprint(server.Stats().Configuration) != "[1 2]" {
+		if time.Now().After(deadline) {
+			t.Fatalf("configuration change wasn't committed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	server.Stop()
+
+	// and, after a restart, constructs the configuration from its descriptors
+	server = NewServer(1, store.Reopen(), noop, WithPeerFactory(factory))
+	if expected, got := "[1 2]", fmt.Sprint(server.config.allPeers().ids()); expected != got {
+		t.Errorf("expected configuration %s, got %s", expected, got)
+	}
+	if peer, ok := server.config.get(2); !ok || peer != (acceptingPeer{2}) {
+		t.Errorf("expected peer 2 from the factory, got %v", peer)
+	}
+	mu.Lock()
+	if expected, got := "[1 1 2]", fmt.Sprint(constructed); expected != got { // C_old, then C_new
+		t.Errorf("expected factory calls for %s, got %s", expected, got)
+	}
+	mu.Unlock()
+
+	// as it does for the latest configuration entry
+	peers, index, err := server.LatestConfiguration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []uint64{}
+	for _, peer := range peers {
+		ids = append(ids, peer.id())
+	}
+	entry, _ := server.log.lastConfiguration()
+	if expected, got := "[1 2]", fmt.Sprint(ids); expected != got || index != entry.Index {
+		t.Errorf("expected latest configuration %s at index %d, got %s at %d", expected, entry.Index, got, index)
+	}
+
+	// which a server without a factory can't do
+	if _, _, err := decodeConfiguration(entry.Command, nil); err != errNoPeerFactory {
+		t.Errorf("without a factory, expected %v, got %v", errNoPeerFactory, err)
+	}
+}
+
+func TestSetConfigurationIdempotent(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	server := NewServer(1, &bytes.Buffer{}, noop)
+	gob.Register(acceptingPeer{})
+	server.SetConfiguration(acceptingPeer{1})
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	change := func(peers ...Peer) {
+		if err := server.SetConfiguration(peers...); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(4 * maximumElectionTimeout())
+		for server.Stats().CommitIndex < server.log.lastIndex() {
+			if time.Now().After(deadline) {
+				t.Fatalf("configuration change wasn't committed")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// a change appends a configuration entry
+	change(acceptingPeer{1}, acceptingPeer{2})
+	lastIndex := server.log.lastIndex()
+	if lastIndex == 0 {
+		t.Fatalf("expected a configuration entry")
+	}
+
+	// but the same peers again append nothing
+	change(acceptingPeer{1}, acceptingPeer{2})
+	if expected, got := lastIndex, server.log.lastIndex(); expected != got {
+		t.Errorf("expected last index %d, got %d", expected, got)
+	}
+
+	// peers are compared by their descriptors, roles included
+	u, _ := url.Parse("http://localhost:1234")
+	config := newConfiguration(makePeerMap(&httpPeer{remoteID: 2, url: u, role: "voter"}))
+	if !config.unchanged(makePeerMap(&httpPeer{remoteID: 2, url: u, role: "voter"})) {
+		t.Errorf("expected identical descriptors to be unchanged")
+	}
+	if config.unchanged(makePeerMap(&httpPeer{remoteID: 2, url: u, role: "witness"})) {
+		t.Errorf("expected a different role to be a change")
+	}
+}
+
+func TestCommandAsync(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a leader whose follower votes, but never acknowledges an entry, so
+	// nothing it appends is committed
+	server := NewServer(1, &bytes.Buffer{}, noop, WithMaxPendingEntries(2))
+	server.SetConfiguration(newLocalPeer(server), approvingPeer(2))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	// appends commands without anything waiting on their responses
+	for i := 0; i < 2; i++ {
+		if err := server.CommandAsync([]byte("foo")); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+	}
+	entries, _, _ := server.log.entriesAfter(0)
+	if expected, got := 2, len(entries); expected != got {
+		t.Fatalf("expected %d entries, got %d", expected, got)
+	}
+	server.log.RLock()
+	for i := range server.log.entries {
+		if server.log.entries[i].commandResponse != nil {
+			t.Errorf("%d: expected no response chan", i)
+		}
+	}
+	server.log.RUnlock()
+
+	// until too many are pending
+	if expected, got := ErrTooManyPendingEntries, server.CommandAsync([]byte("foo")); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestForceLeadership(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// it's refused, unless unsafe operations are enabled
+	server := NewServer(1, &bytes.Buffer{}, noop)
+	if expected, got := errUnsafeOpsDisabled, server.ForceLeadership(10); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// a network of 3, which has lost the other 2 for good
+	server = NewServer(1, &bytes.Buffer{}, noop, WithUnsafeOperations())
+	server.SetConfiguration(newLocalPeer(server), nonresponsivePeer(2), nonresponsivePeer(3))
+	server.Start()
+	defer server.Stop()
+	time.Sleep(2 * maximumElectionTimeout())
+	if server.state.Get() == leader {
+		t.Fatal("erroneously became Leader")
+	}
+
+	// it won't go back in time
+	if expected, got := ErrTermTooSmall, server.ForceLeadership(1); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// but it can be forced to lead
+	if err := server.ForceLeadership(1000); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := leader, server.state.Get(); expected != got {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+	if expected, got := errAlreadyLeader, server.ForceLeadership(1001); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestObserverMode(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// it's refused, unless observer mode is enabled
+	server := NewServer(1, &bytes.Buffer{}, noop)
+	if expected, got := errNotObserver, server.AssumeLeadership(1); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if expected, got := errNotObserver, server.Relinquish(); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// a network of 3, whose leaders are chosen by us
+	servers := make([]*Server, 3)
+	peers := make([]Peer, len(servers))
+	for i := range servers {
+		servers[i] = NewServer(uint64(i+1), &bytes.Buffer{}, noop, WithObserverMode())
+		peers[i] = newLocalPeer(servers[i])
+	}
+	for _, server := range servers {
+		server.SetConfiguration(peers...)
+		server.Start()
+		defer server.Stop()
+	}
+	committedEverywhere := func(index uint64) {
+		t.Helper()
+		deadline := time.Now().Add(10 * maximumElectionTimeout())
+		for _, server := range servers {
+			for server.log.getCommitIndex() < index {
+				if time.Now().After(deadline) {
+					t.Fatalf("server %d didn't commit index %d", server.id, index)
+				}
+				time.Sleep(minimumElectionTimeout())
+			}
+		}
+	}
+
+	// nobody holds an election, however long they wait
+	time.Sleep(4 * maximumElectionTimeout())
+	for _, server := range servers {
+		if expected, got := follower, server.state.Get(); expected != got {
+			t.Fatalf("server %d: expected %s, got %s", server.id, expected, got)
+		}
+	}
+
+	// until one is told to lead, which replicates, and commits, as usual
+	if err := servers[0].AssumeLeadership(1); err != nil {
+		t.Fatal(err)
+	}
+	index, _, err := servers[0].commandWait([]byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	committedEverywhere(index)
+
+	// once it steps down, nobody leads, and another can be told to, in a
+	// later term
+	if err := servers[0].Relinquish(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := errNotLeader, servers[0].Relinquish(); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if expected, got := ErrTermTooSmall, servers[1].AssumeLeadership(1); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if err := servers[1].AssumeLeadership(2); err != nil {
+		t.Fatal(err)
+	}
+	index, _, err = servers[1].commandWait([]byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	committedEverywhere(index)
+
+	// and a leader told to lead in a later term deposes the last, without
+	// it having to relinquish
+	if err := servers[2].AssumeLeadership(3); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := servers[2].commandWait([]byte("third")); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, servers[1], follower)
+}
+
+func TestServerFailsAfterPanic(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 1, whose state machine has a bug
+	buggy := func(uint64, []byte) []byte { panic("bug") }
+	fatal := make(chan error, 1)
+	server := NewServer(1, &bytes.Buffer{}, buggy, WithEvents(Events{
+		OnFatalError: func(err error) { fatal <- err },
+	}))
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	// which panics when the first command is committed
+	if err := server.Command([]byte(`{}`), make(chan []byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-fatal:
+		if !errors.Is(err, ErrServerFailed) {
+			t.Errorf("expected an error wrapping %v, got %v", ErrServerFailed, err)
+		}
+	case <-time.After(4 * maximumElectionTimeout()):
+		t.Fatal("fatal error wasn't reported")
+	}
+
+	// then it reports that it's failed
+	if expected, got := failed, server.Stats().State; expected != got {
+		t.Errorf("expected state %s, got %s", expected, got)
+	}
+
+	// and rejects commands and RPCs, rather than hanging
+	if expected, got := ErrServerFailed, server.Command([]byte(`{}`), make(chan []byte, 1)); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if resp := server.requestVote(requestVote{Term: 100, CandidateID: 2}); resp.VoteGranted {
+		t.Errorf("failed server granted a vote")
+	}
+}
+
+func TestServerFailsAfterPanicInFlush(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 2, whose other server's transport has a bug
+	fatal := make(chan error, 1)
+	server := NewServer(1, &bytes.Buffer{}, noop, WithEvents(Events{
+		OnFatalError: func(err error) { fatal <- err },
+	}))
+	server.SetConfiguration(newLocalPeer(server), panickingPeer(2))
+	server.Start()
+	defer server.Stop()
+
+	// which panics in the first flush after it's elected, in the flush's own
+	// goroutine, and fails the server rather than the process
+	select {
+	case err := <-fatal:
+		if !errors.Is(err, ErrServerFailed) {
+			t.Errorf("expected an error wrapping %v, got %v", ErrServerFailed, err)
+		}
+	case <-time.After(8 * maximumElectionTimeout()):
+		t.Fatal("fatal error wasn't reported")
+	}
+	if expected, got := failed, server.Stats().State; expected != got {
+		t.Errorf("expected state %s, got %s", expected, got)
+	}
+}
+
+func TestStoreWriteFailure(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 1, whose store can be made to fail, as if the disk were
+	// full, and which reports store errors
+	store := &fullDiskStore{}
+	storeErrors := make(chan uint64, 100)
+	server := NewServer(1, store, noop, WithEvents(Events{
+		OnStoreError: func(index uint64, err error) { storeErrors <- index },
+	}))
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+	if _, err := server.CommandWait([]byte(`1`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a command appended while the store is failing isn't acknowledged
+	atomic.StoreInt32(&store.full, 1)
+	response := make(chan []byte, 1)
+	if err := server.Command([]byte(`2`), response); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case index := <-storeErrors:
+		if expected, got := uint64(2), index; expected != got {
+			t.Errorf("expected a store error at index %d, got %d", expected, got)
+		}
+	case <-time.After(4 * maximumElectionTimeout()):
+		t.Fatal("store error wasn't reported")
+	}
+	select {
+	case <-response:
+		t.Fatal("got a response to a command which wasn't persisted")
+	case <-time.After(maximumElectionTimeout()):
+	}
+
+	// nor committed
+	if expected, got := uint64(1), server.log.getCommitIndex(); expected != got {
+		t.Errorf("expected commit index %d, got %d", expected, got)
+	}
+
+	// until the store recovers
+	atomic.StoreInt32(&store.full, 0)
+	select {
+	case <-response:
+	case <-time.After(4 * maximumElectionTimeout()):
+		t.Fatal("command wasn't committed once the store recovered")
+	}
+	if recovered := newRaftLog(store.Reopen(), noop); recovered.lastIndex() != 2 {
+		t.Errorf("expected the store to hold through index 2, got %d", recovered.lastIndex())
+	}
+}
+
+func TestStoreWriteFailurePolicy(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 1, which fails on a store error
+	store := &fullDiskStore{}
+	fatal := make(chan error, 1)
+	server := NewServer(1, store, noop, WithStoreErrorPolicy(FailOnStoreError), WithEvents(Events{
+		OnFatalError: func(err error) { fatal <- err },
+	}))
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	atomic.StoreInt32(&store.full, 1)
+	if err := server.Command([]byte(`{}`), make(chan []byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-fatal:
+		if !errors.Is(err, ErrServerFailed) {
+			t.Errorf("expected an error wrapping %v, got %v", ErrServerFailed, err)
+		}
+	case <-time.After(4 * maximumElectionTimeout()):
+		t.Fatal("fatal error wasn't reported")
+	}
+	if expected, got := failed, server.Stats().State; expected != got {
+		t.Errorf("expected state %s, got %s", expected, got)
+	}
+}
+
+// fullDiskStore is an InMemoryStore whose writes fail while full is set.
+type fullDiskStore struct {
+	InMemoryStore
+	full int32
+}
+
+func (s *fullDiskStore) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&s.full) == 1 {
+		return 0, errors.New("no space left on device")
+	}
+	return s.InMemoryStore.Write(p)
+}
+
+func TestServerRefusesUnknownLogFormat(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a server, over a store that isn't a log we can read
+	store := &InMemoryStore{}
+	store.Write([]byte("not a raft log"))
+	fatal := make(chan error, 1)
+	server := NewServer(1, store, noop, WithEvents(Events{
+		OnFatalError: func(err error) { fatal <- err },
+	}))
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+
+	// refuses to start
+	select {
+	case err := <-fatal:
+		t.Logf("fatal error: %s", err)
+	case <-time.After(4 * maximumElectionTimeout()):
+		t.Fatal("fatal error wasn't reported")
+	}
+	if expected, got := ErrServerFailed, server.Command([]byte(`{}`), make(chan []byte, 1)); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if expected, got := "not a raft log", string(store.Bytes()); expected != got {
+		t.Errorf("expected the store untouched, got %q", got)
+	}
+}
+
+func TestPreAppendHook(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 1, which only accepts JSON objects
+	errNotAnObject := fmt.Errorf("not a JSON object")
+	hook := func(cmd []byte) error {
+		var m map[string]interface{}
+		if err := json.Unmarshal(cmd, &m); err != nil {
+			return errNotAnObject
+		}
+		return nil
+	}
+	server := NewServer(1, &bytes.Buffer{}, noop, WithPreAppendHook(hook))
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	// accepts a valid command
+	if err := server.Command([]byte(`{}`), oneshot()); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(1), server.log.lastIndex(); expected != got {
+		t.Fatalf("expected last index %d, got %d", expected, got)
+	}
+
+	// but rejects an invalid one, without appending it
+	if expected, got := errNotAnObject, server.Command([]byte(`[]`), oneshot()); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if expected, got := uint64(1), server.log.lastIndex(); expected != got {
+		t.Errorf("expected last index %d, got %d", expected, got)
+	}
+}
+
+func TestOversizeCommandRejected(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	server := NewServer(1, &bytes.Buffer{}, noop)
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	// a command too big to persist is rejected, rather than appended
+	if expected, got := errCommandTooBig, server.Command(make([]byte, maxCommandSize+1), oneshot()); expected != got {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	if expected, got := uint64(0), server.log.lastIndex(); expected != got {
+		t.Errorf("expected last index %d, got %d", expected, got)
+	}
+
+	// and doesn't stop later commands from committing
+	if err := server.Command([]byte(`{}`), oneshot()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxTermGap(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	const wild = 1e9
+	for _, gap := range []uint64{0, 100} {
+		// a server in a network of 2, whose other server never responds
+		gaps := make(chan uint64, 2)
+		server := NewServer(1, &bytes.Buffer{}, noop, WithMaxTermGap(gap), WithEvents(Events{
+			OnTermGap: func(peerID, term, currentTerm uint64) { gaps <- term - currentTerm },
+		}))
+		server.SetConfiguration(newLocalPeer(server), nonresponsivePeer(2))
+		server.Start()
+
+		// hears from a peer claiming a wildly higher term
+		vote := server.requestVote(requestVote{Term: wild, CandidateID: 2})
+		ae := server.appendEntries(appendEntries{Term: wild, LeaderID: 2})
+		server.Stop()
+
+		if gap == 0 {
+			// by default, it adopts the term
+			if expected, got := uint64(wild), vote.Term; expected != got {
+				t.Errorf("gap %d: expected term %d, got %d", gap, expected, got)
+			}
+			continue
+		}
+
+		// but with a limit, it ignores the peer, and says so
+		if vote.VoteGranted || vote.Term >= wild {
+			t.Errorf("gap %d: requestVote: expected a rejection in our term, got %+v", gap, vote)
+		}
+		if ae.Success || ae.Term >= wild {
+			t.Errorf("gap %d: appendEntries: expected a rejection in our term, got %+v", gap, ae)
+		}
+		if expected, got := 2, len(gaps); expected != got {
+			t.Fatalf("gap %d: expected %d events, got %d", gap, expected, got)
+		}
+		if got := <-gaps; got <= gap {
+			t.Errorf("gap %d: reported a gap of only %d", gap, got)
+		}
+	}
+}
+
+func TestLeaderStickiness(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(100, 200) // so heartbeats are timely under load
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	for _, sticky := range []bool{false, true} {
+		// a network of 3, which elects a leader
+		var options []Option
+		if sticky {
+			options = append(options, WithLeaderStickiness())
+		}
+		servers := make([]*Server, 3)
+		peers := make([]Peer, len(servers))
+		for i := range servers {
+			servers[i] = NewServer(uint64(i+1), &bytes.Buffer{}, noop, options...)
+			peers[i] = newLocalPeer(servers[i])
+		}
+		for _, server := range servers {
+			server.SetConfiguration(peers...)
+			server.Start()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*maximumElectionTimeout())
+		id, err := servers[0].WaitForLeader(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		incumbent := servers[id-1]
+		disruptive := servers[id%3] // some follower
+
+		// which, once every follower has heard from it, is asked for votes,
+		// as are the others, in an ever higher term, while it carries on
+		// heartbeating
+		time.Sleep(2 * broadcastInterval())
+		var term uint64 = 1000
+		unseated := false
+		for deadline := time.Now().Add(2 * maximumElectionTimeout()); time.Now().Before(deadline); {
+			term++
+			for _, server := range servers {
+				if server == disruptive {
+					continue
+				}
+				resp := server.requestVote(requestVote{
+					Term:         term,
+					CandidateID:  disruptive.id,
+					LastLogIndex: 1000,
+					LastLogTerm:  term - 1,
+				})
+				if resp.Term >= term {
+					unseated = true // it adopted the term, if only to step down
+				}
+			}
+			time.Sleep(broadcastInterval())
+		}
+		state := incumbent.state.Get()
+		for _, server := range servers {
+			server.Stop()
+		}
+
+		// which, by default, unseats it, but not with stickiness
+		if expected, got := !sticky, unseated; expected != got {
+			t.Errorf("sticky %v: expected unseated %v, got %v", sticky, expected, got)
+		}
+		if sticky && state != leader {
+			t.Errorf("leader %d was unseated, despite stickiness", incumbent.id)
+		}
+	}
+}
+
+func TestLastContact(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a leader of 3, one of whose followers never answers
+	clock := &fakeClock{t: time.Now()}
+	server := NewServer(1, &bytes.Buffer{}, noop)
+	server.now = clock.now
+	server.SetConfiguration(newLocalPeer(server), acceptingPeer{2}, nonresponsivePeer(3))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	// has heard from the other follower, as of its latest flush
+	clock.advance(time.Hour)
+	later := clock.now()
+	deadline := time.Now().Add(maximumElectionTimeout())
+	for {
+		if contact, ok := server.LastContact(2); ok && !contact.Before(later) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no recent contact with peer 2")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// but not from the one that never answers
+	if contact, ok := server.LastContact(3); ok {
+		t.Errorf("expected no contact with peer 3, got %s", contact)
+	}
+}
+
+func TestPausePeer(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a leader of 3, which pauses 3
+	two, three := &countingPeer{id_: 2}, &countingPeer{id_: 3}
+	server := NewServer(1, &bytes.Buffer{}, noop)
+	server.SetConfiguration(newLocalPeer(server), two, three)
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+	server.PausePeer(3)
+	time.Sleep(2 * broadcastInterval()) // for any flush already under way
+	paused := three.appendEntries()
+
+	// sends 3 nothing, but carries on committing commands, and leading
+	if _, err := server.CommandWait([]byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(maximumElectionTimeout())
+	if got := three.appendEntries(); got != paused {
+		t.Errorf("expected no appendEntries to 3 while it's paused, got %d", got-paused)
+	}
+	if expected, got := leader, server.state.Get(); expected != got {
+		t.Errorf("expected state %s, got %s", expected, got)
+	}
+
+	// until it's resumed
+	server.ResumePeer(3)
+	deadline := time.Now().Add(maximumElectionTimeout())
+	for three.appendEntries() == paused {
+		if time.Now().After(deadline) {
+			t.Fatal("no appendEntries to 3 once it's resumed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCommandIndex(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 1, whose state machine won't apply anything until released
+	release := make(chan struct{})
+	apply := func(uint64, []byte) []byte { <-release; return []byte{} }
+	server := NewServer(1, &bytes.Buffer{}, apply)
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	// learns the index of its first command before it's applied
+	response := make(chan []byte, 1)
+	index, err := server.CommandIndex([]byte(`{}`), response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(1), index; expected != got {
+		t.Errorf("expected index %d, got %d", expected, got)
+	}
+	select {
+	case <-response:
+		t.Fatal("got a response before the command was applied")
+	default:
+	}
+	close(release)
+	<-response
+
+	// and of the next
+	index, err = server.CommandIndex([]byte(`{}`), oneshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(2), index; expected != got {
+		t.Errorf("expected index %d, got %d", expected, got)
+	}
+}
+
+func TestPendingCommandsFailedOnStepDown(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 2, whose other node votes for us, but never accepts any
+	// log entries, so nothing is committed
+	server := NewServer(1, &bytes.Buffer{}, noop)
+	server.SetConfiguration(newLocalPeer(server), approvingPeer(2))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := server.CommandWait([]byte(`{}`))
+			errs <- err
+		}()
+	}
+	server.CommandAsync([]byte(`{}`))
+
+	// the commands are listed as pending
+	deadline := time.Now().Add(maximumElectionTimeout())
+	for server.Stats().PendingCount < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	stats := server.Stats()
+	if expected, got := "[1 2 3]", fmt.Sprint(stats.PendingIndices); expected != got {
+		t.Fatalf("expected pending indices %s, got %s", expected, got)
+	}
+
+	// until the leader hears of a later term, and steps down, when its
+	// waiters are failed, so they can retry elsewhere
+	server.appendEntries(appendEntries{Term: 100, LeaderID: 2})
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != ErrLeadershipLost {
+				t.Errorf("expected %v, got %v", ErrLeadershipLost, err)
+			}
+		case <-time.After(maximumElectionTimeout()):
+			t.Fatal("waiter wasn't failed on step-down")
+		}
+	}
+	if got := server.Stats().PendingCount; got != 0 {
+		t.Errorf("expected no pending commands after stepping down, got %d", got)
+	}
+}
+
+func TestAppendMetadata(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 1, with a state machine, and somewhere for metadata
+	applied, metadata := &protectedSlice{}, make(chan string, 1)
+	server := NewServer(1, &bytes.Buffer{}, appender(applied), WithMetadataFunc(func(index uint64, data []byte) {
+		metadata <- string(data)
+	}))
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	// metadata goes to the metadata func, once committed, and not to apply
+	if _, err := server.AppendMetadata([]byte("flags=on")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.CommandWait([]byte("command")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-metadata:
+		if expected := "flags=on"; expected != got {
+			t.Errorf("expected %q, got %q", expected, got)
+		}
+	case <-time.After(maximumElectionTimeout()):
+		t.Fatal("metadata wasn't delivered")
+	}
+	if expected, got := "[command]", fmt.Sprintf("%s", applied.Get()); expected != got {
+		t.Errorf("expected %s applied, got %s", expected, got)
+	}
+}
+
+func TestManualApply(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 1, whose state machine is driven by hand
+	applied := &protectedSlice{}
+	server := NewServer(1, &bytes.Buffer{}, appender(applied), WithManualApply())
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+	server.DrainApply()
+
+	// a committed command isn't applied, nor answered
+	response := make(chan []byte, 1)
+	index, err := server.CommandIndex([]byte("command"), response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cutoff := time.Now().Add(maximumElectionTimeout()); !server.IsCommitted(index); time.Sleep(time.Millisecond) {
+		if time.Now().After(cutoff) {
+			t.Fatal("command wasn't committed")
+		}
+	}
+	if n := len(applied.Get()); n > 0 {
+		t.Fatalf("%d commands applied before draining", n)
+	}
+	select {
+	case <-response:
+		t.Fatal("response before draining")
+	default:
+	}
+
+	// until it's drained, on this goroutine, once
+	if expected, got := 1, server.DrainApply(); expected != got {
+		t.Errorf("expected %d applied, got %d", expected, got)
+	}
+	if expected, got := "[command]", fmt.Sprintf("%s", applied.Get()); expected != got {
+		t.Errorf("expected %s applied, got %s", expected, got)
+	}
+	select {
+	case <-response:
+	default:
+		t.Error("no response after draining")
+	}
+	if expected, got := 0, server.DrainApply(); expected != got {
+		t.Errorf("expected nothing more to drain, got %d", got)
+	}
+}
+
+func TestCommandTTL(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 2, each of which is told of expiries
+	var (
+		servers  = make([]*Server, 2)
+		expiries = make([]chan uint64, 2)
+	)
+	for i := range servers {
+		expired := make(chan uint64, 10)
+		expiries[i] = expired
+		servers[i] = NewServer(uint64(i+1), &bytes.Buffer{}, func(index uint64, _ []byte) []byte {
+			return []byte(fmt.Sprint(index))
+		}, WithExpiryFunc(func(_, index uint64) { expired <- index }))
+	}
+	for _, server := range servers {
+		server.SetConfiguration(newLocalPeer(servers[0]), newLocalPeer(servers[1]))
+		server.Start()
+		defer server.Stop()
+	}
+	var leading, following *Server
+	for cutoff := time.Now().Add(4 * maximumElectionTimeout()); leading == nil; time.Sleep(minimumElectionTimeout()) {
+		if time.Now().After(cutoff) {
+			t.Fatal("no leader")
+		}
+		for i, server := range servers {
+			if server.state.Get() == leader {
+				leading, following = server, servers[1-i]
+			}
+		}
+	}
+
+	// only the leader takes a TTL, and only a positive one
+	if expected, got := errNotLeader, following.CommandTTL([]byte("lock"), nil, time.Second); expected != got {
+		t.Errorf("follower: expected %v, got %v", expected, got)
+	}
+	if expected, got := errBadTTL, leading.CommandTTL([]byte("lock"), nil, 0); expected != got {
+		t.Errorf("zero TTL: expected %v, got %v", expected, got)
+	}
+
+	// a command with a TTL is applied, and then expired everywhere, once
+	response := make(chan []byte, 1)
+	if err := leading.CommandTTL([]byte("lock"), response, 2*broadcastInterval()); err != nil {
+		t.Fatal(err)
+	}
+	var index uint64
+	select {
+	case resp := <-response:
+		fmt.Sscan(string(resp), &index)
+	case <-time.After(maximumElectionTimeout()):
+		t.Fatal("command wasn't applied")
+	}
+	if entry, ok := following.log.entryAt(index); !ok || entry.Expires == 0 {
+		t.Errorf("the follower's entry doesn't expire: %+v", entry)
+	}
+	for i, expired := range expiries {
+		select {
+		case got := <-expired:
+			if index != got {
+				t.Errorf("server %d: expected index %d to expire, got %d", i+1, index, got)
+			}
+		case <-time.After(4 * maximumElectionTimeout()):
+			t.Fatalf("server %d: command didn't expire", i+1)
+		}
+	}
+	time.Sleep(4 * broadcastInterval())
+	for i, expired := range expiries {
+		if n := len(expired); n > 0 {
+			t.Errorf("server %d: %d more expiries", i+1, n)
+		}
+	}
+}
+
+func TestCommandIfCompareAndSwap(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 1, whose state machine holds the last command
+	var (
+		mu   sync.Mutex
+		last = "0"
 	)
+	apply := func(_ uint64, cmd []byte) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		last = string(cmd)
+		return []byte{}
+	}
+	compareAndSwap := func(server *Server, old, new string) error {
+		response := make(chan []byte, 1)
+		cond := func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return last == old
+		}
+		if err := server.CommandIf(cond, []byte(new), response); err != nil {
+			return err
+		}
+		<-response
+		return nil
+	}
+	server := NewServer(1, &bytes.Buffer{}, apply)
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	// a client reads 0, but another writes 1 before it swaps
+	if _, err := server.CommandWait([]byte(`1`)); err != nil {
+		t.Fatal(err)
+	}
 
+	// so its precondition is stale, and the swap fails
+	if err := compareAndSwap(server, "0", "2"); err != ErrPreconditionFailed {
+		t.Errorf("expected %v, got %v", ErrPreconditionFailed, err)
+	}
+	if expected, got := uint64(1), server.log.lastIndex(); expected != got {
+		t.Errorf("expected last index %d, got %d", expected, got)
+	}
+
+	// but succeeds with the current value
+	if err := compareAndSwap(server, "1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if expected, got := "2", last; expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestCommandIfStopped(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(250, 500)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 1, whose state machine lags behind its log
+	server := NewServer(1, &bytes.Buffer{}, noop, WithManualApply())
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	waitForState(t, server, leader)
+	server.DrainApply()
+	index, err := server.CommandIndex([]byte(`{}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cutoff := time.Now().Add(maximumElectionTimeout()); !server.IsCommitted(index); time.Sleep(time.Millisecond) {
+		if time.Now().After(cutoff) {
+			t.Fatal("command wasn't committed")
+		}
+	}
+
+	// so a conditional command waits for it
+	errs := make(chan error, 1)
+	go func() { errs <- server.CommandIf(func() bool { return true }, []byte(`{}`), nil) }()
+	time.Sleep(minimumElectionTimeout() / 2)
+	select {
+	case err := <-errs:
+		t.Fatalf("expected the command to wait, got %v", err)
+	default:
+	}
+
+	// until the server stops, when it fails at once
+	server.Stop()
+	select {
+	case err := <-errs:
+		if err != ErrServerStopped {
+			t.Errorf("expected %v, got %v", ErrServerStopped, err)
+		}
+	case <-time.After(minimumElectionTimeout() / 2):
+		t.Fatalf("the command still waits after the server stopped: %v", <-errs)
+	}
+}
+
+func TestSlowPreAppendHookDoesntBlockLeader(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a hook which hangs on one particular command
+	release := make(chan struct{})
+	hook := func(cmd []byte) error {
+		if string(cmd) == "slow" {
+			<-release
+		}
+		return nil
+	}
+	server := NewServer(1, &bytes.Buffer{}, noop, WithPreAppendHook(hook))
+	server.SetConfiguration(newLocalPeer(server))
 	server.Start()
 	defer server.Stop()
-	time.Sleep(2 * electionTimeout())
+	waitForState(t, server, leader)
 
-	if server.state.Get() == leader {
-		t.Fatalf("erroneously became Leader")
+	slow := make(chan error, 1)
+	go func() { slow <- server.Command([]byte("slow"), oneshot()) }()
+
+	// other commands still get through while the hook is stuck
+	done := make(chan error, 1)
+	go func() { done <- server.Command([]byte("fast"), oneshot()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(4 * maximumElectionTimeout()):
+		t.Fatal("a slow PreAppendHook blocked the leader")
+	}
+
+	close(release)
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(2), server.log.lastIndex(); expected != got {
+		t.Errorf("expected last index %d, got %d", expected, got)
+	}
+}
+
+func TestReadReplica(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 1, with a read replica, which has a read replica of its own
+	var applied2, applied3 int32
+	counter := func(n *int32) ApplyFunc {
+		return func(uint64, []byte) []byte { atomic.AddInt32(n, 1); return nil }
+	}
+	server := NewServer(1, &bytes.Buffer{}, noop)
+	replica := NewServer(2, &bytes.Buffer{}, counter(&applied2), WithReadReplica(1), WithUnsafeOperations())
+	chained := NewServer(3, &bytes.Buffer{}, counter(&applied3), WithReadReplica(2))
+	server.SetConfiguration(newLocalPeer(server))
+	replica.SetConfiguration(newLocalPeer(server))
+	chained.SetConfiguration(newLocalPeer(server))
+	server.AddReadReplica(newLocalPeer(replica))
+	replica.AddReadReplica(newLocalPeer(chained))
+	server.Start()
+	replica.Start()
+	defer replica.Stop()
+	chained.Start()
+	defer chained.Stop()
+	waitForState(t, server, leader)
+
+	// commands are committed, and make their way down the chain
+	for i := 0; i < 3; i++ {
+		if err := server.Command([]byte(`{}`), oneshot()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cutoff := time.Now().Add(4 * maximumElectionTimeout())
+	for atomic.LoadInt32(&applied2) < 3 || atomic.LoadInt32(&applied3) < 3 {
+		if time.Now().After(cutoff) {
+			t.Fatalf("replicas applied %d and %d of 3 commands", atomic.LoadInt32(&applied2), atomic.LoadInt32(&applied3))
+		}
+		time.Sleep(minimumElectionTimeout())
+	}
+
+	// once the leader is gone, the replicas don't stand for election
+	server.Stop()
+	time.Sleep(4 * maximumElectionTimeout())
+	for _, s := range []*Server{replica, chained} {
+		if expected, got := follower, s.state.Get(); expected != got {
+			t.Errorf("%d: expected %s, got %s", s.id, expected, got)
+		}
+		if resp := s.requestVote(requestVote{Term: 100, CandidateID: 4, LastLogIndex: 100, LastLogTerm: 100}); resp.VoteGranted {
+			t.Errorf("%d: granted a vote", s.id)
+		}
+	}
+
+	// and can't be forced to
+	if expected, got := errReadReplica, replica.ForceLeadership(100); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestServerConfiguration(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+
+	// a configuration set directly wasn't established by any entry
+	server := NewServer(1, &bytes.Buffer{}, noop)
+	server.SetConfiguration(newLocalPeer(server), nonresponsivePeer(2))
+	if expected, got := (Configuration{Peers: []ConfigurationPeer{
+		{PeerDescriptor{ID: 1}, Voter},
+		{PeerDescriptor{ID: 2}, Voter},
+	}}), server.Configuration(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+
+	// a bootstrapped one was, and read replicas are listed alongside
+	gob.Register(acceptingPeer{})
+	server = NewServer(1, &bytes.Buffer{}, noop)
+	if err := server.Bootstrap(acceptingPeer{1}, acceptingPeer{2}); err != nil {
+		t.Fatal(err)
+	}
+	server.AddReadReplica(nonresponsivePeer(3))
+	if expected, got := (Configuration{Peers: []ConfigurationPeer{
+		{PeerDescriptor{ID: 1}, Voter},
+		{PeerDescriptor{ID: 2}, Voter},
+		{PeerDescriptor{ID: 3}, ReadReplica},
+	}, Index: 1, Term: 1}), server.Configuration(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+
+	// a read replica lists itself as one
+	replica := NewServer(4, &bytes.Buffer{}, noop, WithReadReplica(1))
+	replica.SetConfiguration(nonresponsivePeer(1), nonresponsivePeer(2))
+	if expected, got := (Configuration{Peers: []ConfigurationPeer{
+		{PeerDescriptor{ID: 1}, Voter},
+		{PeerDescriptor{ID: 2}, Voter},
+		{PeerDescriptor{ID: 4}, ReadReplica},
+	}}), replica.Configuration(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestUnresponsiveReadReplica(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 2, with a read replica that never answers
+	var applied int32
+	countApplied := func(uint64, []byte) []byte { atomic.AddInt32(&applied, 1); return nil }
+	s1 := NewServer(1, &bytes.Buffer{}, countApplied)
+	s2 := NewServer(2, &bytes.Buffer{}, countApplied)
+	for _, s := range []*Server{s1, s2} {
+		s.SetConfiguration(newLocalPeer(s1), newLocalPeer(s2))
+		s.AddReadReplica(nonresponsivePeer(3))
+	}
+	s1.Start()
+	defer s1.Stop()
+	s2.Start()
+	defer s2.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 4*maximumElectionTimeout())
+	defer cancel()
+	id, err := s1.WaitForLeader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader := map[uint64]*Server{1: s1, 2: s2}[id]
+
+	// still commits commands, on both servers
+	if err := leader.Command([]byte(`{}`), oneshot()); err != nil {
+		t.Fatal(err)
+	}
+	cutoff := time.Now().Add(4 * maximumElectionTimeout())
+	for atomic.LoadInt32(&applied) < 2 {
+		if time.Now().After(cutoff) {
+			t.Fatal("command wasn't committed")
+		}
+		time.Sleep(minimumElectionTimeout())
+	}
+}
+
+func TestLearnerPromotion(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 1, which records its peers by description, with some
+	// commands committed, and two more servers to be read replicas
+	servers := []*Server{}
+	factory := func(d PeerDescriptor) (Peer, error) {
+		return newLocalPeer(servers[d.ID-1]), nil
+	}
+	server := NewServer(1, &bytes.Buffer{}, noop, WithPeerFactory(factory))
+	learner := NewServer(2, &bytes.Buffer{}, noop, WithReadReplica(0), WithPeerFactory(factory))
+	replica := NewServer(3, &bytes.Buffer{}, noop, WithReadReplica(0), WithPeerFactory(factory))
+	servers = append(servers, server, learner, replica)
+	for _, s := range servers {
+		s.SetConfiguration(newLocalPeer(server))
+		s.Start()
+	}
+	defer func() {
+		for _, s := range servers {
+			s.Stop() // the leader first, so it's not left flushing to the others
+		}
+	}()
+	waitForState(t, server, leader)
+	for i := 0; i < 20; i++ {
+		if _, _, err := server.commandWait([]byte(`{}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// adds one as a learner, which it holds off for now, and the other as
+	// a read replica
+	membership := func(s *Server, id uint64) Membership {
+		for _, peer := range s.Configuration().Peers {
+			if peer.ID == id {
+				return peer.Membership
+			}
+		}
+		return ""
+	}
+	server.PausePeer(2)
+	server.AddLearner(2, newLocalPeer(learner))
+	server.AddReadReplica(newLocalPeer(replica))
+
+	// the learner isn't promoted while it's behind
+	time.Sleep(2 * maximumElectionTimeout())
+	if expected, got := ReadReplica, membership(server, 2); expected != got {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+
+	// but once it catches up, it's a voter, as far as either knows
+	server.ResumePeer(2)
+	cutoff := time.Now().Add(8 * maximumElectionTimeout())
+	for membership(server, 2) != Voter || membership(learner, 2) != Voter {
+		if time.Now().After(cutoff) {
+			t.Fatalf("learner is a %s, by its own account a %s", membership(server, 2), membership(learner, 2))
+		}
+		time.Sleep(minimumElectionTimeout())
+	}
+	if learner.isReadReplica() {
+		t.Error("promoted learner still behaves as a read replica")
+	}
+
+	// and commits carry on with it, while the read replica stays one
+	if _, _, err := server.commandWait([]byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := ReadReplica, membership(server, 3); expected != got {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestTieBreakReducesSplitVotes(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(20, 21) // so split votes are likely
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// the term in which a fresh network of 3 elects its first leader
+	electedIn := func(tb TieBreak) uint64 {
+		servers, peers := make([]*Server, 3), make([]Peer, 3)
+		for i := range servers {
+			servers[i] = NewServer(uint64(i+1), &bytes.Buffer{}, noop, WithTieBreak(tb))
+			peers[i] = newLocalPeer(servers[i])
+		}
+		for _, s := range servers {
+			s.SetConfiguration(peers...)
+			s.Start()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*maximumElectionTimeout())
+		defer cancel()
+		id, err := servers[0].WaitForLeader(ctx)
+		for _, s := range servers {
+			s.Stop()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return servers[id-1].term
+	}
+
+	// should take fewer rounds of elections with a tie-break than without
+	const trials = 40
+	var without, with uint64
+	for i := 0; i < trials; i++ {
+		without += electedIn(NoTieBreak)
+		with += electedIn(PreferLowerID)
+	}
+	t.Logf("over %d elections: %d terms without a tie-break, %d with", trials, without, with)
+	if with >= without {
+		t.Errorf("tie-break didn't help: %d terms without, %d with", without, with)
 	}
-	t.Logf("remained %s", server.state.Get())
 }
 
 func TestLeaderExpulsion(t *testing.T) {
@@ -180,7 +2263,7 @@ func TestSimpleConsensus(t *testing.T) {
 	response := make(chan []byte, 1)
 	func() {
 		for {
-			switch err := p1.callCommand(cmd, response); err {
+			switch _, err := p1.callCommand(cmd, response); err {
 			case nil:
 				return
 			case errUnknownLeader:
@@ -330,7 +2413,7 @@ func testOrder(t *testing.T, nServers int) {
 		for {
 			log.Printf("command=%d/%d peer=%d: sending %s", i+1, len(cmds), id, buf)
 			response := make(chan []byte, 1)
-			err := peer.callCommand(buf, response)
+			_, err := peer.callCommand(buf, response)
 
 			switch err {
 			case nil:
@@ -383,10 +2466,108 @@ func testOrder(t *testing.T, nServers int) {
 	}
 }
 
+func BenchmarkGroupCommit_1Committer(b *testing.B)   { benchmarkGroupCommit(b, 1) }
+func BenchmarkGroupCommit_8Committers(b *testing.B)  { benchmarkGroupCommit(b, 8) }
+func BenchmarkGroupCommit_64Committers(b *testing.B) { benchmarkGroupCommit(b, 64) }
+
+func benchmarkGroupCommit(b *testing.B, committers int) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 1, with a store that counts syncs
+	store := &syncingStore{}
+	server := NewServer(1, store, noop)
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+	waitForState(b, server, leader)
+
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for i := 0; i < committers; i++ {
+		n := b.N / committers
+		if i < b.N%committers {
+			n++
+		}
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				response := make(chan []byte, 1)
+				if err := server.Command([]byte(`{}`), response); err != nil {
+					b.Error(err)
+					return
+				}
+				<-response
+			}
+		}(n)
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	b.ReportMetric(float64(atomic.LoadInt32(&store.syncs))/float64(b.N), "syncs/commit")
+}
+
 //
 //
 //
 
+// fakeClock is a clock for tests, which stands still until it's advanced.
+// Timers from after fire only as it's advanced past them.
+type fakeClock struct {
+	sync.Mutex
+	t      time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	timer := fakeTimer{at: c.t.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	return timer.c
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.t = c.t.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.t) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- c.t
+	}
+	c.timers = pending
+}
+
+// waitForState waits a few election timeouts for the server to reach the given
+// state, and fails the test if it doesn't.
+func waitForState(t testing.TB, s *Server, state string) {
+	cutoff := time.Now().Add(4 * maximumElectionTimeout())
+	for s.state.Get() != state {
+		if time.Now().After(cutoff) {
+			t.Fatalf("failed to become %s", state)
+		}
+		time.Sleep(minimumElectionTimeout())
+	}
+}
+
 func printOnFailure(t *testing.T, r io.Reader) {
 	if !t.Failed() {
 		return
@@ -427,12 +2608,122 @@ func (p nonresponsivePeer) callAppendEntries(appendEntries) appendEntriesRespons
 func (p nonresponsivePeer) callRequestVote(requestVote) requestVoteResponse {
 	return requestVoteResponse{}
 }
-func (p nonresponsivePeer) callCommand([]byte, chan<- []byte) error {
-	return fmt.Errorf("not implemented")
+func (p nonresponsivePeer) callCommand([]byte, chan<- []byte) (uint64, error) {
+	return 0, fmt.Errorf("not implemented")
 }
 func (p nonresponsivePeer) callSetConfiguration(...Peer) error {
 	return fmt.Errorf("not implemented")
 }
+func (p nonresponsivePeer) callRead([]byte) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// countingPeer grants every vote, accepts every appendEntries, and counts the
+// appendEntries it receives.
+type countingPeer struct {
+	id_ uint64
+	n   int32
+}
+
+func (p *countingPeer) id() uint64 { return p.id_ }
+func (p *countingPeer) callAppendEntries(ae appendEntries) appendEntriesResponse {
+	atomic.AddInt32(&p.n, 1)
+	return appendEntriesResponse{Term: ae.Term, Success: true}
+}
+func (p *countingPeer) callRequestVote(rv requestVote) requestVoteResponse {
+	return requestVoteResponse{Term: rv.Term, VoteGranted: true}
+}
+func (p *countingPeer) callCommand([]byte, chan<- []byte) (uint64, error) {
+	return 0, fmt.Errorf("not implemented")
+}
+func (p *countingPeer) callSetConfiguration(...Peer) error {
+	return fmt.Errorf("not implemented")
+}
+func (p *countingPeer) callRead([]byte) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+func (p *countingPeer) appendEntries() int32 { return atomic.LoadInt32(&p.n) }
+
+// hungPeer grants every vote, but blocks every appendEntries until release is
+// closed.
+// slowVoter grants every vote, but not until it's released.
+type slowVoter struct {
+	id_      uint64
+	requests chan uint64 // the term of each vote requested
+	release  chan struct{}
+}
+
+func (p *slowVoter) id() uint64 { return p.id_ }
+func (p *slowVoter) callAppendEntries(appendEntries) appendEntriesResponse {
+	return appendEntriesResponse{}
+}
+func (p *slowVoter) callRequestVote(rv requestVote) requestVoteResponse {
+	select {
+	case p.requests <- rv.Term:
+	default:
+	}
+	<-p.release
+	return requestVoteResponse{Term: rv.Term, VoteGranted: true}
+}
+func (p *slowVoter) callCommand([]byte, chan<- []byte) (uint64, error) {
+	return 0, fmt.Errorf("not implemented")
+}
+func (p *slowVoter) callSetConfiguration(...Peer) error {
+	return fmt.Errorf("not implemented")
+}
+func (p *slowVoter) callRead([]byte) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+type hungPeer struct {
+	id_     uint64
+	n       int32
+	release chan struct{}
+}
+
+func (p *hungPeer) id() uint64 { return p.id_ }
+func (p *hungPeer) callAppendEntries(ae appendEntries) appendEntriesResponse {
+	atomic.AddInt32(&p.n, 1)
+	<-p.release
+	return appendEntriesResponse{}
+}
+func (p *hungPeer) callRequestVote(rv requestVote) requestVoteResponse {
+	return requestVoteResponse{Term: rv.Term, VoteGranted: true}
+}
+func (p *hungPeer) callCommand([]byte, chan<- []byte) (uint64, error) {
+	return 0, fmt.Errorf("not implemented")
+}
+func (p *hungPeer) callSetConfiguration(...Peer) error {
+	return fmt.Errorf("not implemented")
+}
+func (p *hungPeer) callRead([]byte) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+func (p *hungPeer) appendEntries() int32 { return atomic.LoadInt32(&p.n) }
+
+// acceptingPeer grants every vote and accepts every appendEntries. Unlike
+// countingPeer, it's serializable, so it can be part of a replicated
+// configuration.
+type acceptingPeer struct {
+	MyID uint64
+}
+
+func (p acceptingPeer) id() uint64 { return p.MyID }
+func (p acceptingPeer) callAppendEntries(ae appendEntries) appendEntriesResponse {
+	return appendEntriesResponse{Term: ae.Term, Success: true}
+}
+func (p acceptingPeer) callRequestVote(rv requestVote) requestVoteResponse {
+	return requestVoteResponse{Term: rv.Term, VoteGranted: true}
+}
+func (p acceptingPeer) callCommand([]byte, chan<- []byte) (uint64, error) {
+	return 0, fmt.Errorf("not implemented")
+}
+func (p acceptingPeer) callSetConfiguration(...Peer) error {
+	return fmt.Errorf("not implemented")
+}
+func (p acceptingPeer) callRead([]byte) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
 
 type approvingPeer uint64
 
@@ -446,12 +2737,38 @@ func (p approvingPeer) callRequestVote(rv requestVote) requestVoteResponse {
 		VoteGranted: true,
 	}
 }
-func (p approvingPeer) callCommand([]byte, chan<- []byte) error {
-	return fmt.Errorf("not implemented")
+func (p approvingPeer) callCommand([]byte, chan<- []byte) (uint64, error) {
+	return 0, fmt.Errorf("not implemented")
 }
 func (p approvingPeer) callSetConfiguration(...Peer) error {
 	return fmt.Errorf("not implemented")
 }
+func (p approvingPeer) callRead([]byte) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// panickingPeer grants every vote, and panics on appendEntries.
+type panickingPeer uint64
+
+func (p panickingPeer) id() uint64 { return uint64(p) }
+func (p panickingPeer) callAppendEntries(appendEntries) appendEntriesResponse {
+	panic("bug")
+}
+func (p panickingPeer) callRequestVote(rv requestVote) requestVoteResponse {
+	return requestVoteResponse{
+		Term:        rv.Term,
+		VoteGranted: true,
+	}
+}
+func (p panickingPeer) callCommand([]byte, chan<- []byte) (uint64, error) {
+	return 0, fmt.Errorf("not implemented")
+}
+func (p panickingPeer) callSetConfiguration(...Peer) error {
+	return fmt.Errorf("not implemented")
+}
+func (p panickingPeer) callRead([]byte) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
 
 type disapprovingPeer uint64
 
@@ -465,9 +2782,12 @@ func (p disapprovingPeer) callRequestVote(rv requestVote) requestVoteResponse {
 		VoteGranted: false,
 	}
 }
-func (p disapprovingPeer) callCommand([]byte, chan<- []byte) error {
-	return fmt.Errorf("not implemented")
+func (p disapprovingPeer) callCommand([]byte, chan<- []byte) (uint64, error) {
+	return 0, fmt.Errorf("not implemented")
 }
 func (p disapprovingPeer) callSetConfiguration(...Peer) error {
 	return fmt.Errorf("not implemented")
 }
+func (p disapprovingPeer) callRead([]byte) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
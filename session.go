@@ -0,0 +1,316 @@
+package raft
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrStaleCommand is returned by Command for a retry of a command older
+	// than the latest one its client has had applied. It's never applied, and
+	// its response is long gone.
+	ErrStaleCommand = errors.New("stale command")
+
+	// ErrDuplicateCommand is returned by Command for a retry of the latest
+	// command its client has had applied, when the original response isn't
+	// known, e.g. because it was applied before a restart.
+	ErrDuplicateCommand = errors.New("duplicate command")
+)
+
+// defaultMaxSessions is the number of client sessions kept for deduplication,
+// unless WithMaxSessions says otherwise.
+const defaultMaxSessions = 10000
+
+// session is the most recent command applied for a client, as identified by
+// CommandMeta. Its fields are exported only so it can be encoded.
+type session struct {
+	Seq      uint64
+	Response []byte
+	Known    bool   // whether Response is the command's response
+	Index    uint64 // of the entry which carried the command
+}
+
+// sessionSnapshot is the encoded form of a log's sessions, reflecting every
+// command up to and including Index.
+type sessionSnapshot struct {
+	Index    uint64
+	Sessions map[uint64]session
+}
+
+// sessionTable holds a session for each of the most recently active clients.
+type sessionTable struct {
+	sessions map[uint64]session       // by client ID
+	order    *list.List               // of client IDs, least recently active first
+	elements map[uint64]*list.Element // by client ID, in order
+	max      int
+}
+
+func newSessionTable(max int) *sessionTable {
+	return &sessionTable{
+		sessions: map[uint64]session{},
+		order:    list.New(),
+		elements: map[uint64]*list.Element{},
+		max:      max,
+	}
+}
+
+func (t *sessionTable) get(client uint64) (session, bool) {
+	s, ok := t.sessions[client]
+	return s, ok
+}
+
+// start records a new command for a client, forgetting the least recently
+// active clients if there are too many. Which clients are forgotten depends
+// only on the order of commands in the log, so every server forgets the same
+// ones, provided they have the same max.
+func (t *sessionTable) start(client uint64, s session) {
+	t.sessions[client] = s
+	if e, ok := t.elements[client]; ok {
+		t.order.MoveToBack(e)
+	} else {
+		t.elements[client] = t.order.PushBack(client)
+	}
+	for t.order.Len() > t.max {
+		oldest := t.order.Remove(t.order.Front()).(uint64)
+		delete(t.sessions, oldest)
+		delete(t.elements, oldest)
+	}
+}
+
+// finish records the response to a client's command, if it's still the
+// client's latest.
+func (t *sessionTable) finish(client uint64, index uint64, resp []byte, known bool) {
+	if s, ok := t.sessions[client]; ok && s.Index == index {
+		s.Response, s.Known = resp, known
+		t.sessions[client] = s
+	}
+}
+
+func (t *sessionTable) len() int { return len(t.sessions) }
+
+// restore replaces the table's sessions with the passed ones, which are
+// ordered by the index of their latest command.
+func (t *sessionTable) restore(sessions map[uint64]session) {
+	clients := make([]uint64, 0, len(sessions))
+	for client := range sessions {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return sessions[clients[i]].Index < sessions[clients[j]].Index
+	})
+	*t = *newSessionTable(t.max)
+	for _, client := range clients {
+		t.start(client, sessions[client])
+	}
+}
+
+// applyJob is a committed command on its way to the state machine.
+type applyJob struct {
+	pos         int // in the log's entries
+	key         string
+	client, seq uint64
+	apply       bool // pass it to the state machine; if not, it's a retry
+	dupOf       int  // if it retries an earlier job in the batch, that job; else -1
+	resp        []byte
+	known       bool          // whether resp is the command's response
+	took        time.Duration // in the state machine, if it was applied
+	applied     time.Time     // when the state machine returned, if it was applied
+}
+
+// applyCommitted passes the commands at positions [from, to) of the log to the
+// state machine, unless it's already seen them: either because they're at or
+// below lastApplied, or because CommandMeta identifies them as retries of
+// commands their clients already had applied. It returns a job per command, in
+// order, with its response, if that's known: a retry of a client's most recent
+// command gets the original response, but a retry of an older command gets
+// none.
+//
+// Retries are identified the same way on every server, and during recovery, so
+// every state machine sees the same commands. Commands with different keys are
+// applied concurrently; those with the same key are applied in order.
+//
+// Metadata entries are passed to the MetadataFunc, if any, and tombstones to
+// the ExpiryFunc, if any, in order, once the commands are applied. Other
+// entries, configurations and no-ops, go nowhere.
+//
+// Every entry past lastApplied must follow it directly, whatever its kind. An
+// entry which doesn't, e.g. the first after a snapshot which ended short of
+// it, would leave the state machine missing the entries between, so it panics
+// with errApplyGap rather than apply it.
+func (l *raftLog) applyCommitted(from, to int) []applyJob {
+	var (
+		jobs     = []applyJob{}
+		latest   = map[uint64]int{} // client ID: its latest job in this batch
+		deferred = []int{}          // positions of metadata and tombstones yet to be delivered
+	)
+	for pos := from; pos < to; pos++ {
+		entry := &l.entries[pos]
+		alreadyApplied := entry.Index <= l.lastApplied
+		if !alreadyApplied {
+			if entry.Index != l.lastApplied+1 {
+				panic(fmt.Errorf("%w: index %d follows %d", errApplyGap, entry.Index, l.lastApplied))
+			}
+			l.lastApplied = entry.Index
+		}
+
+		switch entry.Kind {
+		case kindCommand:
+		case kindMetadata, kindTombstone:
+			if !alreadyApplied {
+				deferred = append(deferred, pos)
+			}
+			continue
+		default:
+			continue
+		}
+
+		key, client, seq := l.meta(entry.Command)
+		job := applyJob{pos: pos, key: key, client: client, seq: seq, apply: !alreadyApplied, dupOf: -1}
+		if client == 0 || entry.Index <= l.sessionsIndex {
+			jobs = append(jobs, job) // not deduplicated, or already in the sessions
+			continue
+		}
+
+		if last, ok := l.sessions.get(client); ok && seq <= last.Seq {
+			job.apply = false
+			if seq == last.Seq {
+				if i, ok := latest[client]; ok {
+					job.dupOf = i
+				} else {
+					job.resp, job.known = last.Response, last.Known
+				}
+			}
+			jobs = append(jobs, job)
+			continue
+		}
+
+		l.sessions.start(client, session{Seq: seq, Index: entry.Index})
+		latest[client] = len(jobs)
+		jobs = append(jobs, job)
+	}
+
+	l.execute(jobs)
+
+	for i := range jobs {
+		job := &jobs[i]
+		if job.dupOf >= 0 {
+			job.resp, job.known = jobs[job.dupOf].resp, jobs[job.dupOf].known
+		}
+		if j, ok := latest[job.client]; ok && j == i {
+			l.sessions.finish(job.client, l.entries[job.pos].Index, job.resp, job.known)
+		}
+	}
+
+	for _, pos := range deferred {
+		entry := &l.entries[pos]
+		switch {
+		case entry.Kind == kindMetadata && l.metadata != nil:
+			l.metadata(entry.Index, entry.Command)
+		case entry.Kind == kindTombstone && l.expiry != nil:
+			l.expiry(entry.Index, tombstoneOf(entry.Command))
+		}
+	}
+	return jobs
+}
+
+// execute applies the jobs which need applying. Jobs with the same key are
+// applied in order, in one goroutine per key. A panic in the state machine is
+// re-raised in the caller's goroutine, once every key is done.
+func (l *raftLog) execute(jobs []applyJob) {
+	var (
+		keys  = []string{}
+		byKey = map[string][]int{}
+	)
+	for i, job := range jobs {
+		if !job.apply {
+			continue
+		}
+		if _, ok := byKey[job.key]; !ok {
+			keys = append(keys, job.key)
+		}
+		byKey[job.key] = append(byKey[job.key], i)
+	}
+
+	run := func(a []int) {
+		for _, i := range a {
+			entry := &l.entries[jobs[i].pos]
+			began := time.Now()
+			jobs[i].resp, jobs[i].known = l.apply(entry.Index, entry.Command), true
+			jobs[i].applied = time.Now()
+			jobs[i].took = jobs[i].applied.Sub(began)
+		}
+	}
+	if len(keys) <= 1 {
+		for _, key := range keys {
+			run(byKey[key])
+		}
+		return
+	}
+
+	var (
+		wg     sync.WaitGroup
+		panics = make(chan interface{}, len(keys))
+	)
+	for _, key := range keys {
+		wg.Add(1)
+		go func(a []int) {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					panics <- r
+				}
+			}()
+			run(a)
+		}(byKey[key])
+	}
+	wg.Wait()
+	select {
+	case r := <-panics:
+		panic(r)
+	default:
+	}
+}
+
+// retryOf returns the session of the client which sent cmd, and the command's
+// seq, if cmd is a retry: that is, if the client has already had a command
+// with the same or a later seq applied.
+func (l *raftLog) retryOf(cmd []byte) (session, uint64, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	_, client, seq := l.meta(cmd)
+	if client == 0 {
+		return session{}, 0, false
+	}
+	last, ok := l.sessions.get(client)
+	return last, seq, ok && seq <= last.Seq
+}
+
+// encodeSessionsWithLock encodes the sessions, which reflect every committed
+// command, for a snapshot. See WithSessions.
+func (l *raftLog) encodeSessionsWithLock() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(sessionSnapshot{
+		Index:    l.getCommitIndexWithLock(),
+		Sessions: l.sessions.sessions,
+	})
+	return buf.Bytes(), err
+}
+
+// decodeSessions decodes sessions encoded by encodeSessionsWithLock.
+func decodeSessions(b []byte) (sessionSnapshot, error) {
+	var snapshot sessionSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&snapshot); err != nil {
+		return sessionSnapshot{}, err
+	}
+	if snapshot.Sessions == nil {
+		snapshot.Sessions = map[uint64]session{}
+	}
+	return snapshot, nil
+}
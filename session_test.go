@@ -0,0 +1,184 @@
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// clientSeqMeta reads commands of the form "key client seq".
+func clientSeqMeta(cmd []byte) (string, uint64, uint64) {
+	var (
+		key         string
+		client, seq uint64
+	)
+	fmt.Sscanf(string(cmd), "%s %d %d", &key, &client, &seq)
+	return key, client, seq
+}
+
+func TestSessionEviction(t *testing.T) {
+	applied := []string{}
+	apply := func(index uint64, cmd []byte) []byte {
+		applied = append(applied, string(cmd))
+		return []byte{}
+	}
+
+	l, _ := recoverRaftLog(&InMemoryStore{}, apply, logOptions{meta: clientSeqMeta, maxSessions: 2})
+	for i, cmd := range []string{"k 1 1", "k 2 1", "k 3 1", "k 3 1", "k 1 1"} {
+		l.appendEntry(logEntry{Index: uint64(i + 1), Term: 1, Command: []byte(cmd)})
+	}
+	l.commitTo(5)
+
+	// client 1 was the oldest, so it was forgotten, and its retry applied
+	if expected, got := "[k 1 1 k 2 1 k 3 1 k 1 1]", fmt.Sprint(applied); expected != got {
+		t.Errorf("expected applied %s, got %s", expected, got)
+	}
+	if expected, got := 2, l.sessions.len(); expected != got {
+		t.Errorf("expected %d sessions, got %d", expected, got)
+	}
+}
+
+func TestSessionsSurviveSnapshot(t *testing.T) {
+	apply := func(index uint64, cmd []byte) []byte {
+		return []byte(fmt.Sprintf("response to %s", cmd))
+	}
+
+	store := &InMemoryStore{}
+	l, _ := recoverRaftLog(store, apply, logOptions{meta: clientSeqMeta})
+	l.appendEntry(logEntry{Index: 1, Term: 1, Command: []byte("k 1 1")})
+	l.commitTo(1)
+	var sessions []byte
+	if err := l.compactTo(1, func(_, _ uint64, b []byte) error { sessions = b; return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	retry := func(options logOptions) ([]byte, bool) {
+		l, err := recoverRaftLog(store.Reopen(), apply, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := make(chan []byte, 1)
+		l.appendEntry(logEntry{Index: 2, Term: 1, Command: []byte("k 1 1"), commandResponse: response})
+		l.commitTo(2)
+		resp, ok := <-response
+		return resp, ok
+	}
+
+	// a state machine restored from the snapshot, without its sessions,
+	// can't give the original response to a retry
+	if resp, ok := retry(logOptions{meta: clientSeqMeta, appliedIndex: 1}); ok {
+		t.Errorf("without sessions, expected no response, got %q", resp)
+	}
+
+	// but with them, it can
+	resp, _ := retry(logOptions{meta: clientSeqMeta, appliedIndex: 1, sessions: sessions})
+	if expected, got := "response to k 1 1", string(resp); expected != got {
+		t.Errorf("with sessions, expected %q, got %q", expected, got)
+	}
+
+	// and sessions that can't be decoded stop the log from being used
+	if _, err := recoverRaftLog(store.Reopen(), apply, logOptions{sessions: []byte("junk")}); err == nil {
+		t.Errorf("expected an error for undecodable sessions")
+	}
+}
+
+func TestCommandsWithDifferentKeysApplyConcurrently(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		applied = []string{}
+		bDone   = make(chan struct{})
+	)
+	apply := func(index uint64, cmd []byte) []byte {
+		key, _, _ := clientSeqMeta(cmd)
+		if key == "a" && index == 1 {
+			// only finishes if b is applied meanwhile
+			select {
+			case <-bDone:
+			case <-time.After(time.Second):
+				t.Errorf("key b wasn't applied while key a was busy")
+			}
+		}
+		mu.Lock()
+		applied = append(applied, string(cmd))
+		mu.Unlock()
+		if key == "b" {
+			close(bDone)
+		}
+		return []byte{}
+	}
+
+	l, _ := recoverRaftLog(&InMemoryStore{}, apply, logOptions{meta: clientSeqMeta})
+	for i, cmd := range []string{"a 0 1", "b 0 1", "a 0 2"} {
+		l.appendEntry(logEntry{Index: uint64(i + 1), Term: 1, Command: []byte(cmd)})
+	}
+	if err := l.commitTo(3); err != nil {
+		t.Fatal(err)
+	}
+
+	// commands with the same key are still applied in order
+	if expected, got := "[b 0 1 a 0 1 a 0 2]", fmt.Sprint(applied); expected != got {
+		t.Errorf("expected applied %s, got %s", expected, got)
+	}
+}
+
+func TestCommandRejectsRetries(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	apply := func(index uint64, cmd []byte) []byte {
+		return []byte(fmt.Sprintf("response to %s", cmd))
+	}
+
+	// a state machine which had applied a command before a restart
+	store := &InMemoryStore{}
+	l, _ := recoverRaftLog(store, apply, logOptions{meta: clientSeqMeta})
+	l.appendEntry(logEntry{Index: 1, Term: 1, Command: []byte("k 1 1")})
+	l.commitTo(1)
+
+	server := NewServer(1, store.Reopen(), apply, WithCommandMeta(clientSeqMeta), WithAppliedIndex(1))
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	command := func(cmd string) (string, error) {
+		response := make(chan []byte, 1)
+		if err := server.Command([]byte(cmd), response); err != nil {
+			return "", err
+		}
+		select {
+		case resp := <-response:
+			return string(resp), nil
+		case <-time.After(maximumElectionTimeout()):
+			t.Fatalf("%s: timeout waiting for response", cmd)
+		}
+		return "", nil
+	}
+
+	// the original response to a command applied before the restart is lost
+	if _, err := command("k 1 1"); err != ErrDuplicateCommand {
+		t.Errorf("expected %v, got %v", ErrDuplicateCommand, err)
+	}
+
+	// a new command is applied, and a retry of it gets the same response
+	for i := 0; i < 2; i++ {
+		resp, err := command("k 1 2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := "response to k 1 2", resp; expected != got {
+			t.Errorf("%d: expected %q, got %q", i, expected, got)
+		}
+	}
+
+	// and a retry of an older command is refused
+	if _, err := command("k 1 1"); err != ErrStaleCommand {
+		t.Errorf("expected %v, got %v", ErrStaleCommand, err)
+	}
+}
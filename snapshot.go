@@ -0,0 +1,197 @@
+package raft
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	errNoSnapshots    = errors.New("snapshots not configured")
+	errSnapshotNeeded = errors.New("entries compacted; follower needs a snapshot")
+)
+
+// Snapshotter is implemented by state machines which can serialize their
+// state, so that the log entries which produced it can be discarded.
+type Snapshotter interface {
+	// Snapshot returns the state of the state machine, reflecting every
+	// command it has applied. It's never called concurrently with the
+	// ApplyFunc, and mustn't call back into the server.
+	Snapshot() ([]byte, error)
+}
+
+// SnapshotStore persists state machine snapshots. The server only ever saves
+// them; it's up to the application to restore its state machine from one,
+// e.g. to seed a new replica.
+type SnapshotStore interface {
+	// Save durably persists a snapshot, which reflects every command up to
+	// and including the log entry at index, which has the passed term. The
+	// sessions record which commands each client has had applied; a state
+	// machine restored from the snapshot should be passed them with
+	// WithSessions, so retries are still recognized.
+	Save(index, term uint64, snapshot, sessions []byte) error
+}
+
+// Compact synchronously takes a snapshot of the state machine at the current
+// commit index, saves it to the SnapshotStore, and discards the log entries
+// the snapshot covers, except any retained by WithRetainSnapshotEntries. It
+// requires WithSnapshots.
+//
+// A leader only discards entries which every follower has acknowledged, so
+// that no follower's catch-up ever needs a discarded entry. Other servers
+// compact through their commit index; see CompactSafe to avoid that.
+//
+// Compaction is memory-only. The log store is only ever appended to, and a
+// restarted server doesn't load a snapshot: it recovers the whole log from the
+// store, and re-applies it (see WithAppliedIndex), as if it had never been
+// compacted.
+func (s *Server) Compact() error {
+	if s.snapshotter == nil {
+		return errNoSnapshots
+	}
+	if !s.running.Get() {
+		return s.compact(s.log.getCommitIndex())
+	}
+
+	t := compactTuple{Err: make(chan error)}
+	s.compactChan <- t
+	return <-t.Err
+}
+
+// CompactSafe is like Compact, but only compacts on the leader, where it's
+// guaranteed to keep every entry that any follower, voter or read replica,
+// hasn't acknowledged: it compacts only up to the lowest index they've all
+// matched, which may be well short of the commit index. No follower can then
+// need an entry which has been discarded. On any other server, which doesn't
+// know how far its peers have got, it fails.
+func (s *Server) CompactSafe() error {
+	if s.snapshotter == nil {
+		return errNoSnapshots
+	}
+	if !s.running.Get() {
+		return errNotLeader
+	}
+
+	t := compactTuple{Safe: true, Err: make(chan error)}
+	s.compactChan <- t
+	return <-t.Err
+}
+
+// RequestSnapshot asks the server to compact its log through index, as Compact
+// would, but without waiting. It's meant for a state machine which knows a good
+// moment to snapshot: the ApplyFunc may call it, with the index of the command
+// it's applying, once the server has started. The server compacts as soon as
+// the apply completes, though never beyond what Compact would, and logs any
+// error. Of several requests made before then, the latest index wins.
+func (s *Server) RequestSnapshot(index uint64) {
+	s.snapshotRequest.set(index)
+	select {
+	case s.snapshotChan <- struct{}{}:
+	default: // already signalled
+	}
+}
+
+// snapshotRequest is the index requested by RequestSnapshot, if any.
+type snapshotRequest struct {
+	sync.Mutex
+	index uint64
+}
+
+func (r *snapshotRequest) set(index uint64) {
+	r.Lock()
+	defer r.Unlock()
+	if index > r.index {
+		r.index = index
+	}
+}
+
+// take returns the requested index, or zero if there's none, and forgets it.
+func (r *snapshotRequest) take() uint64 {
+	r.Lock()
+	defer r.Unlock()
+	index := r.index
+	r.index = 0
+	return index
+}
+
+// compactRequested compacts through the index requested by RequestSnapshot,
+// but no further than the passed index. It's called from the server goroutine.
+func (s *Server) compactRequested(limit uint64) {
+	index := s.snapshotRequest.take()
+	if index > limit {
+		index = limit
+	}
+	if index == 0 {
+		return
+	}
+	if s.snapshotter == nil {
+		s.logGeneric("snapshot requested through index %d: %s", index, errNoSnapshots)
+		return
+	}
+	if err := s.compact(index); err != nil {
+		s.logGeneric("snapshot requested through index %d: %s", index, err)
+	}
+}
+
+type compactTuple struct {
+	Safe bool // only on the leader; see CompactSafe
+	Err  chan error
+}
+
+// compactableIndex returns how far a leader may compact its log. It keeps every
+// entry a follower might still need: anything it hasn't acknowledged.
+func (s *Server) compactableIndex(ni *nextIndex) uint64 {
+	index := s.log.getCommitIndex()
+	if len(s.config.allPeers().except(s.id)) > 0 {
+		if match := ni.lowestMatch(); match < index {
+			index = match
+		}
+	}
+	return index
+}
+
+// compact snapshots the state machine, and discards log entries up to and
+// including the passed index, less any retained by WithRetainSnapshotEntries.
+// It's called from the server goroutine, or before it's started.
+func (s *Server) compact(index uint64) error {
+	if k := uint64(s.retainEntries); index > k {
+		index -= k
+	} else {
+		index = 0
+	}
+	s.logGeneric("compacting log through index %d", index)
+	return s.log.compactTo(index, func(index, term uint64, sessions []byte) error {
+		snapshot, err := s.snapshotter.Snapshot()
+		if err != nil {
+			return err
+		}
+		return s.saveSnapshot(index, term, snapshot, sessions)
+	})
+}
+
+// saveSnapshot saves a snapshot to the SnapshotStore, and records it for Stats.
+func (s *Server) saveSnapshot(index, term uint64, snapshot, sessions []byte) error {
+	if err := s.snapshotStore.Save(index, term, snapshot, sessions); err != nil {
+		return err
+	}
+	s.lastSnapshot.set(index, int64(len(snapshot)+len(sessions)))
+	return nil
+}
+
+// snapshotInfo is the index and size of the latest snapshot saved, if any.
+type snapshotInfo struct {
+	sync.Mutex
+	index uint64
+	size  int64
+}
+
+func (i *snapshotInfo) set(index uint64, size int64) {
+	i.Lock()
+	defer i.Unlock()
+	i.index, i.size = index, size
+}
+
+func (i *snapshotInfo) get() (uint64, int64) {
+	i.Lock()
+	defer i.Unlock()
+	return i.index, i.size
+}
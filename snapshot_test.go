@@ -0,0 +1,293 @@
+package raft
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 1, whose state machine counts commands
+	sm, snapshots := &countingStateMachine{}, &snapshotRecorder{}
+	server := NewServer(1, &bytes.Buffer{}, sm.apply, WithSnapshots(sm, snapshots))
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	for i := 0; i < 3; i++ {
+		response := make(chan []byte, 1)
+		if err := server.Command([]byte(`{}`), response); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-response:
+		case <-time.After(maximumElectionTimeout()):
+			t.Fatal("command wasn't committed")
+		}
+	}
+
+	if err := server.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the snapshot was taken at the commit index
+	if expected, got := uint64(3), snapshots.index; expected != got {
+		t.Errorf("expected snapshot at index %d, got %d", expected, got)
+	}
+	if expected, got := "3", string(snapshots.snapshot); expected != got {
+		t.Errorf("expected snapshot %q, got %q", expected, got)
+	}
+
+	// and the entries it covers are gone
+	if expected, got := uint64(4), server.log.firstIndex(); expected != got {
+		t.Errorf("expected first index %d, got %d", expected, got)
+	}
+	for index := uint64(1); index <= 3; index++ {
+		if _, ok := server.log.entryAt(index); ok {
+			t.Errorf("entry %d wasn't discarded", index)
+		}
+	}
+
+	// but the log carries on from where it left off
+	if err := server.Command([]byte(`{}`), make(chan []byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(4), server.log.lastIndex(); expected != got {
+		t.Errorf("expected last index %d, got %d", expected, got)
+	}
+}
+
+func TestCompactKeepsUnacknowledgedEntries(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a store with 3 committed entries
+	store := &InMemoryStore{}
+	l := newRaftLog(store, noop)
+	for index := uint64(1); index <= 3; index++ {
+		l.appendEntry(logEntry{Index: index, Term: 1, Command: []byte(`{}`)})
+	}
+	if err := l.commitTo(3); err != nil {
+		t.Fatal(err)
+	}
+
+	// recovered by a leader, whose follower has never acknowledged anything
+	sm, snapshots := &countingStateMachine{}, &snapshotRecorder{}
+	server := NewServer(1, store.Reopen(), sm.apply, WithSnapshots(sm, snapshots))
+	follower := &hungPeer{id_: 2, release: make(chan struct{})}
+	server.SetConfiguration(newLocalPeer(server), follower)
+	server.Start()
+	defer server.Stop()
+	defer close(follower.release)
+	waitForState(t, server, leader)
+
+	// keeps every entry, since the follower may need them all
+	if err := server.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(1), server.log.firstIndex(); expected != got {
+		t.Errorf("expected first index %d, got %d", expected, got)
+	}
+}
+
+func TestCompactRetainsEntries(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	const k = 3
+	committed := func(n uint64) *InMemoryStore {
+		store := &InMemoryStore{}
+		l := newRaftLog(store, noop)
+		for index := uint64(1); index <= n; index++ {
+			l.appendEntry(logEntry{Index: index, Term: 1, Command: []byte(`{}`)})
+		}
+		if err := l.commitTo(n); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+
+	// a server with 10 committed entries, which compacts them all but k
+	sm, snapshots := &countingStateMachine{}, &snapshotRecorder{}
+	s1 := NewServer(1, committed(10).Reopen(), sm.apply, WithSnapshots(sm, snapshots), WithRetainSnapshotEntries(k))
+	if err := s1.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(10), snapshots.index; expected != got {
+		t.Errorf("expected snapshot at index %d, got %d", expected, got)
+	}
+	if expected, got := uint64(10-k+1), s1.log.firstIndex(); expected != got {
+		t.Errorf("expected first index %d, got %d", expected, got)
+	}
+
+	// and a follower k entries behind it
+	s2 := NewServer(2, committed(10-k).Reopen(), noop)
+
+	peers := []Peer{newLocalPeer(s1), newLocalPeer(s2)}
+	for _, server := range []*Server{s1, s2} {
+		server.SetConfiguration(peers...)
+		server.Start()
+		defer server.Stop()
+	}
+
+	// the follower catches up from the retained entries
+	deadline := time.Now().Add(10 * maximumElectionTimeout())
+	for s2.log.lastIndex() < 10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("follower stuck at index %d", s2.log.lastIndex())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCompactSafe(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a store with 5 committed entries
+	store := &InMemoryStore{}
+	l := newRaftLog(store, noop)
+	for index := uint64(1); index <= 5; index++ {
+		l.appendEntry(logEntry{Index: index, Term: 1, Command: []byte(`{}`)})
+	}
+	if err := l.commitTo(5); err != nil {
+		t.Fatal(err)
+	}
+
+	// isn't compacted by a server which isn't the leader
+	sm, snapshots := &countingStateMachine{}, &snapshotRecorder{}
+	server := NewServer(1, store.Reopen(), sm.apply, WithSnapshots(sm, snapshots))
+	if expected, got := errNotLeader, server.CompactSafe(); expected != got {
+		t.Errorf("not leader: expected %v, got %v", expected, got)
+	}
+
+	// nor, beyond what it's matched, by a leader with a lagging follower
+	lagging := laggingPeer{acceptingPeer{3}, make(chan struct{})}
+	server.SetConfiguration(newLocalPeer(server), acceptingPeer{2}, lagging)
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+	if err := server.CompactSafe(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(1), server.log.firstIndex(); expected != got {
+		t.Errorf("lagging: expected first index %d, got %d", expected, got)
+	}
+
+	// until the follower catches up
+	close(lagging.release)
+	deadline := time.Now().Add(4 * maximumElectionTimeout())
+	for server.log.firstIndex() != 6 {
+		if time.Now().After(deadline) {
+			t.Fatalf("caught up: expected first index 6, got %d", server.log.firstIndex())
+		}
+		if err := server.CompactSafe(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRequestSnapshot(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a state machine which asks for a snapshot after a particular command
+	var server *Server
+	sm, snapshots := &countingStateMachine{}, &snapshotRecorder{}
+	apply := func(index uint64, cmd []byte) []byte {
+		if string(cmd) == "snapshot" {
+			server.RequestSnapshot(index)
+		}
+		return sm.apply(index, cmd)
+	}
+	server = NewServer(1, &bytes.Buffer{}, apply, WithSnapshots(sm, snapshots))
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	for _, cmd := range []string{"a", "snapshot", "b"} {
+		response := make(chan []byte, 1)
+		if err := server.Command([]byte(cmd), response); err != nil {
+			t.Fatal(err)
+		}
+		<-response
+	}
+
+	// gets one, at the index of that command
+	deadline := time.Now().Add(4 * maximumElectionTimeout())
+	for server.log.firstIndex() != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected compaction through index 2, first index is %d", server.log.firstIndex())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if expected, got := uint64(2), snapshots.index; expected != got {
+		t.Errorf("expected snapshot at index %d, got %d", expected, got)
+	}
+}
+
+func TestCompactWithoutSnapshots(t *testing.T) {
+	server := NewServer(1, &bytes.Buffer{}, noop)
+	if expected, got := errNoSnapshots, server.Compact(); expected != got {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+// laggingPeer accepts every appendEntries, but not until it's released.
+type laggingPeer struct {
+	acceptingPeer
+	release chan struct{}
+}
+
+func (p laggingPeer) callAppendEntries(ae appendEntries) appendEntriesResponse {
+	<-p.release
+	return p.acceptingPeer.callAppendEntries(ae)
+}
+
+type countingStateMachine struct {
+	sync.Mutex
+	n int
+}
+
+func (sm *countingStateMachine) apply(uint64, []byte) []byte {
+	sm.Lock()
+	defer sm.Unlock()
+	sm.n++
+	return []byte{}
+}
+
+func (sm *countingStateMachine) Snapshot() ([]byte, error) {
+	sm.Lock()
+	defer sm.Unlock()
+	return []byte(strconv.Itoa(sm.n)), nil
+}
+
+type snapshotRecorder struct {
+	index, term        uint64
+	snapshot, sessions []byte
+}
+
+func (r *snapshotRecorder) Save(index, term uint64, snapshot, sessions []byte) error {
+	r.index, r.term, r.snapshot, r.sessions = index, term, snapshot, sessions
+	return nil
+}
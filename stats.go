@@ -0,0 +1,242 @@
+package raft
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats is a point-in-time summary of the state of a Server, intended for
+// operators and monitoring.
+type Stats struct {
+	ID          uint64 `json:"id"`
+	State       string `json:"state"`
+	CommitIndex uint64 `json:"commit_index"`
+	FirstIndex  uint64 `json:"first_index"`
+	LastIndex   uint64 `json:"last_index"`
+
+	// CatchingUp is set on a follower whose log is well behind the leader's
+	// commit index, as it would be just after joining, until it's nearly
+	// caught up. Such a follower isn't yet much use to a quorum.
+	CatchingUp bool `json:"catching_up"`
+
+	// LogEntries is how many entries are in the log, FirstIndex through
+	// LastIndex, and LogBytes is their encoded size, uncompressed. StoreBytes
+	// is the size of the log store, which only grows: compaction discards
+	// entries from memory, not from the store. SnapshotIndex and
+	// SnapshotBytes describe the latest snapshot saved, if any, including its
+	// sessions.
+	LogEntries    int    `json:"log_entries"`
+	LogBytes      int64  `json:"log_bytes"`
+	StoreBytes    int64  `json:"store_bytes"`
+	SnapshotIndex uint64 `json:"snapshot_index"`
+	SnapshotBytes int64  `json:"snapshot_bytes"`
+
+	// Configuration holds the IDs of the peers in the active configuration.
+	// ConfigurationIndex is the index of the log entry which established it,
+	// or zero if it was set before the server was started.
+	Configuration      []uint64 `json:"configuration"`
+	ConfigurationIndex uint64   `json:"configuration_index"`
+
+	// PendingIndices holds the indices of the commands this server, as
+	// leader, has appended but not yet committed, in order; PendingCount is
+	// how many there are. If the server steps down, they're forgotten, and
+	// anyone waiting on them in CommandWait gets ErrLeadershipLost.
+	PendingCount   int      `json:"pending_count"`
+	PendingIndices []uint64 `json:"pending_indices"`
+
+	// CommitLatency summarizes the time from appending each entry to this
+	// server's log, to applying it, since the server was created, or since
+	// the last ResetCommitLatency. Entries applied during log recovery aren't
+	// counted. ApplyLatency summarizes the part of that spent in the state
+	// machine, for each command it applied, so the rest is the wait for the
+	// entry to be committed.
+	CommitLatency LatencyStats `json:"commit_latency"`
+	ApplyLatency  LatencyStats `json:"apply_latency"`
+
+	// Traffic counts the RPCs exchanged with each peer, by ID, since the
+	// server was created.
+	Traffic map[uint64]PeerTraffic `json:"traffic"`
+}
+
+// LatencyStats summarizes a histogram of latencies. The percentiles are
+// approximate: each is the upper bound of the histogram bucket it falls in.
+type LatencyStats struct {
+	Count uint64        `json:"count"`
+	P50   time.Duration `json:"p50"`
+	P99   time.Duration `json:"p99"`
+}
+
+// Stats returns a summary of the current state of the server.
+func (s *Server) Stats() Stats {
+	pm, index := s.config.active()
+	state, pending := s.state.Get(), s.pending.indices()
+	entries, logBytes, storeBytes := s.log.sizes()
+	snapshotIndex, snapshotBytes := s.lastSnapshot.get()
+	return Stats{
+		ID:                 s.id,
+		State:              state,
+		CatchingUp:         state == follower && s.catchingUp.Get(),
+		CommitIndex:        s.log.getCommitIndex(),
+		FirstIndex:         s.log.firstIndex(),
+		LastIndex:          s.log.lastIndex(),
+		LogEntries:         entries,
+		LogBytes:           logBytes,
+		StoreBytes:         storeBytes,
+		SnapshotIndex:      snapshotIndex,
+		SnapshotBytes:      snapshotBytes,
+		Configuration:      pm.ids(),
+		ConfigurationIndex: index,
+		PendingCount:       len(pending),
+		PendingIndices:     pending,
+		CommitLatency:      s.log.latencies.stats(),
+		ApplyLatency:       s.log.applyTimes.stats(),
+		Traffic:            s.traffic.get(),
+	}
+}
+
+// ResetCommitLatency clears the commit and apply latency histograms reported
+// by Stats.
+func (s *Server) ResetCommitLatency() {
+	s.log.latencies.reset()
+	s.log.applyTimes.reset()
+}
+
+// leaderHistoryLength is the number of leader changes kept by LeaderHistory.
+const leaderHistoryLength = 32
+
+// LeaderChange records a leader observed by a server: the term it led, and
+// when the server first saw it leading.
+type LeaderChange struct {
+	Term      uint64    `json:"term"`
+	Leader    uint64    `json:"leader"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// LeaderHistory returns the leaders this server has observed, oldest first,
+// one per term, up to the most recent 32. A server observes a leader when it
+// first hears from it in a new term, or when it wins an election itself. It's
+// meant for correlating client errors with leadership changes.
+func (s *Server) LeaderHistory() []LeaderChange {
+	return s.leaders.get()
+}
+
+// leaderHistory is a ring buffer of the most recent leader changes.
+type leaderHistory struct {
+	sync.Mutex
+	changes []LeaderChange
+	next    int // position of the oldest change, once the buffer is full
+}
+
+// add records a leader, unless it's already been recorded for its term.
+func (h *leaderHistory) add(c LeaderChange) {
+	h.Lock()
+	defer h.Unlock()
+
+	if n := len(h.changes); n > 0 {
+		last := h.changes[(h.next+n-1)%n]
+		if last.Term == c.Term && last.Leader == c.Leader {
+			return
+		}
+	}
+	if len(h.changes) < leaderHistoryLength {
+		h.changes = append(h.changes, c)
+		return
+	}
+	h.changes[h.next] = c
+	h.next = (h.next + 1) % len(h.changes)
+}
+
+func (h *leaderHistory) get() []LeaderChange {
+	h.Lock()
+	defer h.Unlock()
+	return append(append([]LeaderChange{}, h.changes[h.next:]...), h.changes[:h.next]...)
+}
+
+// latencyBuckets is the number of buckets in a histogram. Bucket i holds
+// latencies up to 100µs * 2^i, so the last one is for latencies over ~6.5s.
+const latencyBuckets = 18
+
+// histogram is a lightweight histogram of latencies, with fixed, exponentially
+// sized buckets. The zero value is an empty histogram, ready to use.
+type histogram struct {
+	sync.Mutex
+	counts [latencyBuckets]uint64
+	total  uint64
+	max    time.Duration
+}
+
+func bucketBound(i int) time.Duration {
+	return 100 * time.Microsecond << uint(i)
+}
+
+func (h *histogram) observe(d time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+
+	i := 0
+	for i < latencyBuckets-1 && d > bucketBound(i) {
+		i++
+	}
+	h.counts[i]++
+	h.total++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func (h *histogram) reset() {
+	h.Lock()
+	defer h.Unlock()
+	h.counts = [latencyBuckets]uint64{}
+	h.total = 0
+	h.max = 0
+}
+
+func (h *histogram) stats() LatencyStats {
+	h.Lock()
+	defer h.Unlock()
+	return LatencyStats{
+		Count: h.total,
+		P50:   h.percentileWithLock(0.50),
+		P99:   h.percentileWithLock(0.99),
+	}
+}
+
+func (h *histogram) percentileWithLock(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank, seen := uint64(p*float64(h.total)+0.5), uint64(0)
+	if rank < 1 {
+		rank = 1
+	}
+	for i := 0; i < latencyBuckets-1; i++ {
+		if seen += h.counts[i]; seen >= rank {
+			return bucketBound(i)
+		}
+	}
+	return h.max // the last bucket has no upper bound
+}
+
+// slowApply reports commands the state machine took longer than threshold to
+// apply. The zero value reports none.
+type slowApply struct {
+	threshold time.Duration
+	notify    func(index uint64, took time.Duration)
+}
+
+func (a slowApply) check(index uint64, took time.Duration) {
+	if a.threshold > 0 && took > a.threshold && a.notify != nil {
+		a.notify(index, took)
+	}
+}
+
+// appliedNotifier reports when each command was appended to the leader's log,
+// committed, and applied. See Events.OnApplied.
+type appliedNotifier func(index uint64, appended, committed, applied time.Time)
+
+func (n appliedNotifier) notify(index uint64, appended, committed, applied time.Time) {
+	if n != nil {
+		n(index, appended, committed, applied)
+	}
+}
@@ -0,0 +1,313 @@
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHistogramPercentiles(t *testing.T) {
+	var h histogram
+
+	// 98 fast, and 2 slow
+	for i := 0; i < 98; i++ {
+		h.observe(150 * time.Microsecond)
+	}
+	h.observe(time.Second)
+	h.observe(time.Minute)
+
+	stats := h.stats()
+	if expected, got := uint64(100), stats.Count; expected != got {
+		t.Errorf("count: expected %d, got %d", expected, got)
+	}
+	if expected, got := 200*time.Microsecond, stats.P50; expected != got {
+		t.Errorf("p50: expected %s, got %s", expected, got)
+	}
+	if expected, got := bucketBound(14), stats.P99; expected != got {
+		t.Errorf("p99: expected %s, got %s", expected, got)
+	}
+
+	// a reset empties it
+	h.reset()
+	if expected, got := (LatencyStats{}), h.stats(); expected != got {
+		t.Errorf("after reset: expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestCommitLatencyRecorded(t *testing.T) {
+	log := newRaftLog(&bytes.Buffer{}, noop)
+	for i := uint64(1); i <= 3; i++ {
+		log.appendEntry(logEntry{Index: i, Term: 1, Command: []byte(`{}`)})
+	}
+	if err := log.commitTo(3); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(3), log.latencies.stats().Count; expected != got {
+		t.Errorf("expected %d latencies, got %d", expected, got)
+	}
+}
+
+func TestSlowApply(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 1, whose state machine takes a while over some commands
+	apply := func(index uint64, cmd []byte) []byte {
+		if string(cmd) == "slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return cmd
+	}
+	slow := make(chan uint64, 10)
+	server := NewServer(1, &bytes.Buffer{}, apply, WithSlowApplyThreshold(25*time.Millisecond), WithEvents(Events{
+		OnSlowApply: func(index uint64, took time.Duration) {
+			if took < 50*time.Millisecond {
+				t.Errorf("index %d: took %s, which isn't slow", index, took)
+			}
+			slow <- index
+		},
+	}))
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	// only the slow one is reported
+	var slowIndex uint64
+	for _, cmd := range []string{"fast", "slow", "fast"} {
+		index, _, err := server.commandWait([]byte(cmd))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmd == "slow" {
+			slowIndex = index
+		}
+	}
+	select {
+	case index := <-slow:
+		if expected, got := slowIndex, index; expected != got {
+			t.Errorf("expected index %d, got %d", expected, got)
+		}
+	default:
+		t.Fatal("slow apply wasn't reported")
+	}
+	if len(slow) > 0 {
+		t.Errorf("fast apply of index %d was reported", <-slow)
+	}
+
+	// and every apply is in the histogram, apart from commit latency
+	stats := server.Stats()
+	if expected, got := uint64(3), stats.ApplyLatency.Count; expected != got {
+		t.Errorf("expected %d apply latencies, got %d", expected, got)
+	}
+	if min, got := 50*time.Millisecond, stats.ApplyLatency.P99; got < min {
+		t.Errorf("expected p99 apply latency of at least %s, got %s", min, got)
+	}
+}
+
+func TestOnApplied(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 1, whose state machine takes a while over each command
+	apply := func(index uint64, cmd []byte) []byte {
+		time.Sleep(10 * time.Millisecond)
+		return cmd
+	}
+	type times struct{ appended, committed, applied time.Time }
+	reported := make(chan times, 10)
+	server := NewServer(1, &bytes.Buffer{}, apply, WithEvents(Events{
+		OnApplied: func(index uint64, appended, committed, applied time.Time) {
+			reported <- times{appended, committed, applied}
+		},
+	}))
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+
+	// each command is reported once, appended after it's submitted, then
+	// committed, and then applied, by the time its response arrives
+	for i := 0; i < 3; i++ {
+		submitted := time.Now()
+		if _, _, err := server.commandWait([]byte(fmt.Sprintf("cmd %d", i))); err != nil {
+			t.Fatal(err)
+		}
+		responded := time.Now()
+		var got times
+		select {
+		case got = <-reported:
+		default:
+			t.Fatalf("command %d: wasn't reported", i)
+		}
+		if got.appended.Before(submitted) {
+			t.Errorf("command %d: appended before it was submitted", i)
+		}
+		if got.committed.Before(got.appended) {
+			t.Errorf("command %d: committed %s before it was appended", i, got.appended.Sub(got.committed))
+		}
+		if got.applied.Sub(got.committed) < 10*time.Millisecond {
+			t.Errorf("command %d: applied %s after it was committed, less than the state machine took", i, got.applied.Sub(got.committed))
+		}
+		if got.applied.After(responded) {
+			t.Errorf("command %d: applied after its response arrived", i)
+		}
+		if len(reported) > 0 {
+			t.Fatalf("command %d: reported more than once", i)
+		}
+	}
+}
+
+func TestPeerTraffic(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(100, 200) // so the leader lasts the workload
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 3, which elects a leader
+	servers := make([]*Server, 3)
+	peers := make([]Peer, len(servers))
+	for i := range servers {
+		servers[i] = NewServer(uint64(i+1), &bytes.Buffer{}, noop)
+		peers[i] = newLocalPeer(servers[i])
+	}
+	for _, server := range servers {
+		server.SetConfiguration(peers...)
+		server.Start()
+		defer server.Stop()
+	}
+	var leaderServer *Server
+	for deadline := time.Now().Add(20 * maximumElectionTimeout()); leaderServer == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("no leader elected")
+		}
+		for _, server := range servers {
+			if server.state.Get() == leader {
+				leaderServer = server
+			}
+		}
+		time.Sleep(minimumElectionTimeout())
+	}
+
+	// replicates a workload
+	command := []byte(`{"key":"value"}`)
+	const n = 10
+	for i := 0; i < n; i++ {
+		if _, _, err := leaderServer.commandWait(command); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// which every follower was sent, and received, along with the votes
+	// that elected the leader
+	minBytes := uint64(n * (entryHeaderSize + len(command)))
+	sent := leaderServer.Stats().Traffic
+	for _, server := range servers {
+		if server == leaderServer {
+			continue
+		}
+		out, in := sent[server.id], server.Stats().Traffic[leaderServer.id]
+		if out.AppendEntriesSent == 0 || out.BytesSent < minBytes || out.RequestVoteSent == 0 {
+			t.Errorf("leader to %d: expected appendEntries, at least %d bytes, and requestVotes sent, got %+v", server.id, minBytes, out)
+		}
+		if in.AppendEntriesReceived == 0 || in.BytesReceived < minBytes || in.RequestVoteReceived == 0 {
+			t.Errorf("%d from leader: expected appendEntries, at least %d bytes, and requestVotes received, got %+v", server.id, minBytes, in)
+		}
+	}
+}
+
+func TestLeaderHistoryBounded(t *testing.T) {
+	var h leaderHistory
+	for term := uint64(1); term <= leaderHistoryLength+2; term++ {
+		h.add(LeaderChange{Term: term, Leader: term % 3})
+		h.add(LeaderChange{Term: term, Leader: term % 3}) // seen again
+	}
+
+	// keeps only the most recent, oldest first, once each
+	changes := h.get()
+	if expected, got := leaderHistoryLength, len(changes); expected != got {
+		t.Fatalf("expected %d changes, got %d", expected, got)
+	}
+	for i, c := range changes {
+		if expected, got := uint64(i+3), c.Term; expected != got {
+			t.Errorf("%d: expected term %d, got %d", i, expected, got)
+		}
+	}
+}
+
+func TestStorageStats(t *testing.T) {
+	sm, snapshots := &countingStateMachine{}, &snapshotRecorder{}
+	server := NewServer(1, &bytes.Buffer{}, sm.apply, WithSnapshots(sm, snapshots))
+
+	// grows as entries are appended
+	command := []byte(`{"key":"value"}`)
+	for index := uint64(1); index <= 4; index++ {
+		if err := server.log.appendEntry(logEntry{Index: index, Term: 1, Command: command}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := server.Stats()
+	entrySize := int64(entryHeaderSize + len(command))
+	if expected, got := 4, stats.LogEntries; expected != got {
+		t.Errorf("expected %d entries, got %d", expected, got)
+	}
+	if expected, got := 4*entrySize, stats.LogBytes; expected != got {
+		t.Errorf("expected %d log bytes, got %d", expected, got)
+	}
+	if expected, got := "1-4", fmt.Sprintf("%d-%d", stats.FirstIndex, stats.LastIndex); expected != got {
+		t.Errorf("expected range %s, got %s", expected, got)
+	}
+
+	// and the store, once they're committed
+	if err := server.log.commitTo(4); err != nil {
+		t.Fatal(err)
+	}
+	stats = server.Stats()
+	if expected, got := int64(logHeaderSize)+4*entrySize, stats.StoreBytes; expected != got {
+		t.Errorf("expected %d store bytes, got %d", expected, got)
+	}
+
+	// shrinks when they're compacted, except for the store
+	if err := server.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	before := stats
+	stats = server.Stats()
+	if expected, got := 0, stats.LogEntries; expected != got {
+		t.Errorf("after compaction: expected %d entries, got %d", expected, got)
+	}
+	if expected, got := int64(0), stats.LogBytes; expected != got {
+		t.Errorf("after compaction: expected %d log bytes, got %d", expected, got)
+	}
+	if expected, got := "5-4", fmt.Sprintf("%d-%d", stats.FirstIndex, stats.LastIndex); expected != got {
+		t.Errorf("after compaction: expected range %s, got %s", expected, got)
+	}
+	if expected, got := before.StoreBytes, stats.StoreBytes; expected != got {
+		t.Errorf("after compaction: expected %d store bytes, got %d", expected, got)
+	}
+
+	// and reports the snapshot
+	if expected, got := uint64(4), stats.SnapshotIndex; expected != got {
+		t.Errorf("expected snapshot index %d, got %d", expected, got)
+	}
+	if expected, got := int64(len(snapshots.snapshot)+len(snapshots.sessions)), stats.SnapshotBytes; expected != got {
+		t.Errorf("expected %d snapshot bytes, got %d", expected, got)
+	}
+
+	// and a truncation
+	server.log.appendEntry(logEntry{Index: 5, Term: 2, Command: command})
+	server.log.appendEntry(logEntry{Index: 6, Term: 2, Command: command})
+	if err := server.log.ensureLastIs(5, 2); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := entrySize, server.Stats().LogBytes; expected != got {
+		t.Errorf("after truncation: expected %d log bytes, got %d", expected, got)
+	}
+}
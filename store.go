@@ -0,0 +1,100 @@
+package raft
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	errBadTruncation = errors.New("truncation beyond end of store")
+)
+
+// InMemoryStore is a log store which keeps everything in memory. It's intended
+// for tests. Unlike a bytes.Buffer, reading from it doesn't consume its
+// contents, so it may be reopened to simulate a restart; and it may be
+// truncated, like a file. The zero value is an empty store, ready to use.
+type InMemoryStore struct {
+	mtx    sync.Mutex
+	buf    []byte
+	offset int // of the next read
+	syncs  int
+}
+
+// Read reads from the store, starting where the previous Read left off. It
+// returns io.EOF once everything written to the store has been read.
+func (s *InMemoryStore) Read(p []byte) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.offset >= len(s.buf) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.buf[s.offset:])
+	s.offset += n
+	return n, nil
+}
+
+// Write appends to the store.
+func (s *InMemoryStore) Write(p []byte) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.buf = append(s.buf, p...)
+	return len(p), nil
+}
+
+// Sync does nothing but count how many times it's been called.
+func (s *InMemoryStore) Sync() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.syncs++
+	return nil
+}
+
+// Syncs returns the number of times Sync has been called.
+func (s *InMemoryStore) Syncs() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.syncs
+}
+
+// Truncate discards everything in the store after the first size bytes.
+func (s *InMemoryStore) Truncate(size int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if size < 0 || size > int64(len(s.buf)) {
+		return errBadTruncation
+	}
+	s.buf = s.buf[:size]
+	if s.offset > len(s.buf) {
+		s.offset = len(s.buf)
+	}
+	return nil
+}
+
+// Len returns the number of bytes in the store.
+func (s *InMemoryStore) Len() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return len(s.buf)
+}
+
+// Bytes returns a copy of the contents of the store.
+func (s *InMemoryStore) Bytes() []byte {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return append([]byte{}, s.buf...)
+}
+
+// Reopen returns a new store, with a copy of the contents of this one, to be
+// read from the beginning. It simulates a restart over the same persistent
+// storage.
+func (s *InMemoryStore) Reopen() *InMemoryStore {
+	return &InMemoryStore{buf: s.Bytes()}
+}
@@ -0,0 +1,69 @@
+package raft
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestInMemoryStore(t *testing.T) {
+	s := &InMemoryStore{}
+	s.Write([]byte("foo"))
+	s.Write([]byte("bar"))
+
+	// reading doesn't consume
+	buf, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "foobar", string(buf); expected != got {
+		t.Errorf("read: expected %q, got %q", expected, got)
+	}
+	if expected, got := "foobar", string(s.Bytes()); expected != got {
+		t.Errorf("after read: expected %q, got %q", expected, got)
+	}
+
+	// truncation is like a file
+	if err := s.Truncate(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Truncate(5); err != errBadTruncation {
+		t.Errorf("truncate beyond end: expected %v, got %v", errBadTruncation, err)
+	}
+	s.Write([]byte("az"))
+
+	// and reopening reads everything again
+	buf, err = ioutil.ReadAll(s.Reopen())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "foobaz", string(buf); expected != got {
+		t.Errorf("reopened: expected %q, got %q", expected, got)
+	}
+}
+
+func TestInMemoryStoreLogRecovery(t *testing.T) {
+	// a log which commits some entries to the store
+	store := &InMemoryStore{}
+	log := newRaftLog(store, noop)
+	for _, index := range []uint64{1, 2, 3} {
+		log.appendEntry(logEntry{Index: index, Term: 1, Command: []byte(`{}`)})
+	}
+	log.commitTo(2)
+	if expected, got := 1, store.Syncs(); expected != got {
+		t.Errorf("expected %d sync(s), got %d", expected, got)
+	}
+
+	// recovers only the committed entries after a restart
+	applied := &bytes.Buffer{}
+	recovered := newRaftLog(store.Reopen(), func(index uint64, cmd []byte) []byte {
+		applied.Write(cmd)
+		return []byte{}
+	})
+	if expected, got := uint64(2), recovered.lastIndex(); expected != got {
+		t.Errorf("expected last index %d, got %d", expected, got)
+	}
+	if expected, got := `{}{}`, applied.String(); expected != got {
+		t.Errorf("expected %q applied, got %q", expected, got)
+	}
+}
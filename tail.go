@@ -0,0 +1,111 @@
+package raft
+
+import (
+	"sync"
+)
+
+// maxTailBatch is the most entries a tail copies out of the log at once.
+const maxTailBatch = 256
+
+// LogEntry is a committed log entry, as TailFrom delivers it.
+type LogEntry struct {
+	Index   uint64
+	Term    uint64
+	Command []byte
+
+	// Internal is true for the server's own entries, e.g. configurations
+	// and no-ops, rather than client commands. They're delivered too, so
+	// the indexes are contiguous.
+	Internal bool
+}
+
+// TailFrom streams the committed log entries from index on, in order, e.g. to
+// ship them to an external system. Once it's delivered every entry committed
+// so far, it waits for more, until the returned function is called, which
+// stops the tail, closes the channel, and returns the error which ended the
+// tail, if any. It must be called, even after the channel is closed.
+//
+// The tail only ends by itself if it can't carry on: if an entry it's yet to
+// deliver has been compacted, whether before TailFrom was called or since, it
+// closes the channel, and the returned function returns a LogError matching
+// ErrIndexTooSmall. So a shipper which resumes from the entry after the last
+// one it knows was shipped sees every entry at least once, provided it keeps
+// up with compaction.
+func (s *Server) TailFrom(index uint64) (<-chan LogEntry, func() error) {
+	var (
+		entries = make(chan LogEntry)
+		done    = make(chan struct{})
+		result  = make(chan error, 1)
+		once    sync.Once
+		err     error
+	)
+	go func() {
+		defer close(entries)
+		result <- s.tail(index, entries, done)
+	}()
+	return entries, func() error {
+		once.Do(func() {
+			close(done)
+			err = <-result
+		})
+		return err
+	}
+}
+
+// tail sends the committed entries from next on to entries, until done is
+// closed. See TailFrom.
+func (s *Server) tail(next uint64, entries chan<- LogEntry, done <-chan struct{}) error {
+	if next == 0 {
+		next = 1
+	}
+	for {
+		committed := s.committed.wait() // before we look, so no commit is missed
+		batch, err := s.log.committedFrom(next, maxTailBatch)
+		if err != nil {
+			return err
+		}
+		for _, entry := range batch {
+			select {
+			case entries <- LogEntry{Index: entry.Index, Term: entry.Term, Command: entry.Command, Internal: entry.Kind != kindCommand}:
+				next = entry.Index + 1
+			case <-done:
+				return nil
+			}
+		}
+		if len(batch) == maxTailBatch {
+			continue // there may be more already
+		}
+		select {
+		case <-committed:
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// commitSignal lets other goroutines wait for the server to commit entries.
+// The zero value is ready to use.
+type commitSignal struct {
+	sync.Mutex
+	c chan struct{} // closed and replaced on every commit
+}
+
+// wait returns a chan which is closed on the next commit.
+func (c *commitSignal) wait() <-chan struct{} {
+	c.Lock()
+	defer c.Unlock()
+	if c.c == nil {
+		c.c = make(chan struct{})
+	}
+	return c.c
+}
+
+// notify wakes everyone waiting for a commit.
+func (c *commitSignal) notify() {
+	c.Lock()
+	defer c.Unlock()
+	if c.c != nil {
+		close(c.c)
+		c.c = nil
+	}
+}
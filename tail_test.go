@@ -0,0 +1,87 @@
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTailFrom(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+	oldMin, oldMax := resetElectionTimeoutMS(25, 50)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 1, which has committed commands 1-5
+	sm := &countingStateMachine{}
+	server := NewServer(1, &bytes.Buffer{}, sm.apply, WithSnapshots(sm, &snapshotRecorder{}))
+	server.SetConfiguration(newLocalPeer(server))
+	server.Start()
+	defer server.Stop()
+	waitForState(t, server, leader)
+	command := func(i int) {
+		if _, _, err := server.commandWait([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 5; i++ {
+		command(i)
+	}
+	receive := func(entries <-chan LogEntry, n int) string {
+		var got []string
+		for ; n > 0; n-- {
+			select {
+			case entry := <-entries:
+				got = append(got, fmt.Sprintf("%d:%s", entry.Index, entry.Command))
+			case <-time.After(maximumElectionTimeout()):
+				t.Fatalf("expected %d more entries, got %v", n, got)
+			}
+		}
+		return fmt.Sprint(got)
+	}
+
+	// tailed from 3, delivers 3-5
+	entries, stop := server.TailFrom(3)
+	if expected, got := "[3:3 4:4 5:5]", receive(entries, 3); expected != got {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	// and then each command as it's committed
+	command(6)
+	command(7)
+	if expected, got := "[6:6 7:7]", receive(entries, 2); expected != got {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	// until it's stopped
+	if err := stop(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if _, ok := <-entries; ok {
+		t.Error("expected the channel closed")
+	}
+
+	// but can't be tailed from an entry which has been compacted
+	if err := server.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	entries, stop = server.TailFrom(7)
+	if _, ok := <-entries; ok {
+		t.Error("expected the channel closed")
+	}
+	if err := stop(); !errors.Is(err, ErrIndexTooSmall) {
+		t.Errorf("expected %v, got %v", ErrIndexTooSmall, err)
+	}
+
+	// only from the one after
+	entries, stop = server.TailFrom(8)
+	defer stop()
+	command(8)
+	if expected, got := "[8:8]", receive(entries, 1); expected != got {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
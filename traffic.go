@@ -0,0 +1,122 @@
+package raft
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// PeerTraffic counts the AppendEntries and RequestVote RPCs a server has
+// exchanged with one peer, since the server was created. Bytes are the
+// encoded size of the log entries the AppendEntries RPCs carried, whatever
+// the transport, so heartbeats count as RPCs, but not bytes. A peer whose
+// BytesSent keeps growing much faster than the others' is being caught up.
+type PeerTraffic struct {
+	AppendEntriesSent     uint64 `json:"append_entries_sent"`
+	AppendEntriesReceived uint64 `json:"append_entries_received"`
+	BytesSent             uint64 `json:"bytes_sent"`
+	BytesReceived         uint64 `json:"bytes_received"`
+	RequestVoteSent       uint64 `json:"request_vote_sent"`
+	RequestVoteReceived   uint64 `json:"request_vote_received"`
+}
+
+// peerTraffic is the live PeerTraffic of a peer. Every field is updated
+// atomically, so counting never contends with anything but other counting.
+type peerTraffic struct {
+	PeerTraffic
+}
+
+func (t *peerTraffic) get() PeerTraffic {
+	return PeerTraffic{
+		AppendEntriesSent:     atomic.LoadUint64(&t.AppendEntriesSent),
+		AppendEntriesReceived: atomic.LoadUint64(&t.AppendEntriesReceived),
+		BytesSent:             atomic.LoadUint64(&t.BytesSent),
+		BytesReceived:         atomic.LoadUint64(&t.BytesReceived),
+		RequestVoteSent:       atomic.LoadUint64(&t.RequestVoteSent),
+		RequestVoteReceived:   atomic.LoadUint64(&t.RequestVoteReceived),
+	}
+}
+
+// trafficCounters holds the peerTraffic of every peer a server has exchanged
+// RPCs with, by ID. The zero value is ready to use.
+type trafficCounters struct {
+	sync.RWMutex
+	m map[uint64]*peerTraffic
+}
+
+// peer returns the counters for the passed peer, creating them if need be.
+func (c *trafficCounters) peer(id uint64) *peerTraffic {
+	c.RLock()
+	t, ok := c.m[id]
+	c.RUnlock()
+	if ok {
+		return t
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if t, ok := c.m[id]; ok {
+		return t
+	}
+	if c.m == nil {
+		c.m = map[uint64]*peerTraffic{}
+	}
+	t = &peerTraffic{}
+	c.m[id] = t
+	return t
+}
+
+func (c *trafficCounters) sentAppendEntries(id uint64, entries []logEntry) {
+	t := c.peer(id)
+	atomic.AddUint64(&t.AppendEntriesSent, 1)
+	atomic.AddUint64(&t.BytesSent, entriesSize(entries))
+}
+
+func (c *trafficCounters) receivedAppendEntries(id uint64, entries []logEntry) {
+	t := c.peer(id)
+	atomic.AddUint64(&t.AppendEntriesReceived, 1)
+	atomic.AddUint64(&t.BytesReceived, entriesSize(entries))
+}
+
+func (c *trafficCounters) receivedRequestVote(id uint64) {
+	atomic.AddUint64(&c.peer(id).RequestVoteReceived, 1)
+}
+
+// counted returns the passed peers, wrapped so that each RequestVote sent to
+// them is counted, including retries.
+func (c *trafficCounters) counted(pm peerMap) peerMap {
+	counted := peerMap{}
+	for id, peer := range pm {
+		counted[id] = countedPeer{peer, c.peer(id)}
+	}
+	return counted
+}
+
+// get returns a copy of every peer's counters.
+func (c *trafficCounters) get() map[uint64]PeerTraffic {
+	c.RLock()
+	defer c.RUnlock()
+	m := make(map[uint64]PeerTraffic, len(c.m))
+	for id, t := range c.m {
+		m[id] = t.get()
+	}
+	return m
+}
+
+// countedPeer is a Peer which counts the RequestVote RPCs sent to it.
+type countedPeer struct {
+	Peer
+	traffic *peerTraffic
+}
+
+func (p countedPeer) callRequestVote(rv requestVote) requestVoteResponse {
+	atomic.AddUint64(&p.traffic.RequestVoteSent, 1)
+	return p.Peer.callRequestVote(rv)
+}
+
+func entriesSize(entries []logEntry) uint64 {
+	var size int64
+	for i := range entries {
+		size += entries[i].size()
+	}
+	return uint64(size)
+}
@@ -0,0 +1,335 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+var errBadTransfer = errors.New("not a valid log transfer")
+
+// A log transfer, as written by WriteLogTo, is
+//
+//	MAGIC VERSION HAS-SNAPSHOT
+//	[INDEX TERM SNAPSHOT-SIZE SNAPSHOT SESSIONS-SIZE SESSIONS]
+//	BASE-INDEX BASE-TERM BASE-HASH COUNT
+//	ENTRY...
+//	CRC
+//
+// The snapshot section is present only if HAS-SNAPSHOT is 1. BASE is the last
+// compacted entry, which the first ENTRY follows, or zero if nothing has been
+// compacted. There are COUNT entries, each encoded as in the store, though
+// never compressed. The CRC covers everything before it. Integers are
+// little-endian.
+const (
+	transferMagic        = "rxfr"
+	transferVersion byte = 1
+)
+
+// defaultMaxTransfers is how many log transfers are written at once, unless
+// WithMaxConcurrentTransfers says otherwise.
+const defaultMaxTransfers = 1
+
+// transferSnapshot is a snapshot of the state machine, and of the client
+// sessions, as of index.
+type transferSnapshot struct {
+	index, term        uint64
+	snapshot, sessions []byte
+}
+
+// WriteLogTo writes the server's committed log to w, as a single stream which
+// ReadLogFrom can load into a new server, e.g. to seed a replica from a backup
+// much faster than entry-by-entry replication would. It returns the number of
+// bytes written.
+//
+// The stream is consistent: it's captured with the log locked, so nothing is
+// committed or applied meanwhile, and then written without holding anything
+// up. With WithSnapshots, it includes a snapshot of the state machine at the
+// commit index, so the new server needn't apply any of the entries; without
+// it, a log which has been compacted can't be written, and errNoSnapshots is
+// returned.
+//
+// Only as many transfers as WithMaxConcurrentTransfers allows, one by default,
+// are written at once. The rest wait, before anything is captured, for one to
+// finish.
+func (s *Server) WriteLogTo(w io.Writer) (int64, error) {
+	return s.writeLogTo(context.Background(), w)
+}
+
+// writeLogTo is WriteLogTo, but it gives up waiting for a transfer slot, and
+// returns the context's error, once ctx is done.
+func (s *Server) writeLogTo(ctx context.Context, w io.Writer) (int64, error) {
+	if s.transfers != nil {
+		select {
+		case s.transfers <- struct{}{}:
+			defer func() { <-s.transfers }()
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	var snapshot func() ([]byte, error)
+	if s.snapshotter != nil {
+		snapshot = s.snapshotter.Snapshot
+	}
+	return s.log.writeTo(w, snapshot)
+}
+
+// ReadLogFrom loads a stream written by WriteLogTo into the server's log, and
+// persists it to the store. Like Bootstrap, it must be called before the
+// server is started, and while its log is completely empty. Nothing is loaded
+// unless the whole stream is intact.
+//
+// If the stream includes a snapshot, it's saved to the SnapshotStore, which
+// WithSnapshots must provide, and the entries it covers aren't applied; the
+// application should restore its state machine from the snapshot before
+// starting the server, and pass its index with WithAppliedIndex whenever the
+// server is restarted. Otherwise, every entry is applied, in order. The server
+// resumes with the last configuration in the stream, if any.
+func (s *Server) ReadLogFrom(r io.Reader) (int64, error) {
+	if s.running.Get() {
+		return 0, errAlreadyRunning
+	}
+	var save func(index, term uint64, snapshot, sessions []byte) error
+	if s.snapshotStore != nil {
+		save = s.saveSnapshot
+	}
+	n, err := s.log.readFrom(r, save)
+	if err != nil {
+		return n, err
+	}
+
+	s.term = s.log.lastTerm()
+	if entry, ok := s.log.lastConfiguration(); ok {
+		oldPeers, newPeers, err := decodeConfiguration(entry.Command, s.config.factory)
+		if err != nil {
+			return n, err
+		}
+		s.config.restore(oldPeers, newPeers, entry.Index)
+	}
+	return n, nil
+}
+
+// writeTo writes the log's committed entries to w, as a log transfer, with a
+// snapshot taken by the passed function, if it's not nil. See WriteLogTo.
+func (l *raftLog) writeTo(w io.Writer, snapshot func() ([]byte, error)) (int64, error) {
+	var (
+		baseIndex, baseTerm uint64
+		baseHash            [sha256.Size]byte
+		entries             []logEntry
+		snap                *transferSnapshot
+	)
+	if err := func() error {
+		l.RLock()
+		defer l.RUnlock()
+
+		baseIndex, baseTerm, baseHash = l.compactedIndex, l.compactedTerm, l.compactedHash
+		entries = append([]logEntry{}, l.entries[:l.commitPos+1]...)
+		if snapshot == nil {
+			if l.compactedIndex > 0 {
+				return errNoSnapshots
+			}
+			return nil
+		}
+
+		snap = &transferSnapshot{index: l.getCommitIndexWithLock(), term: l.compactedTerm}
+		if l.commitPos >= 0 {
+			snap.term = l.entries[l.commitPos].Term
+		}
+		var err error
+		if snap.sessions, err = l.encodeSessionsWithLock(); err != nil {
+			return err
+		}
+		snap.snapshot, err = snapshot()
+		return err
+	}(); err != nil {
+		return 0, err
+	}
+
+	tw := &transferWriter{w: w, crc: crc32.NewIEEE()}
+	fields := []interface{}{[]byte(transferMagic), transferVersion, snap != nil}
+	if snap != nil {
+		fields = append(fields,
+			snap.index, snap.term,
+			uint64(len(snap.snapshot)), snap.snapshot,
+			uint64(len(snap.sessions)), snap.sessions,
+		)
+	}
+	fields = append(fields, baseIndex, baseTerm, baseHash, uint64(len(entries)))
+	for _, field := range fields {
+		if err := binary.Write(tw, binary.LittleEndian, field); err != nil {
+			return tw.n, err
+		}
+	}
+	for i := range entries {
+		if _, err := entries[i].encodeAs(tw, logVersion, compression{}, headerBuffers{}); err != nil {
+			return tw.n, err
+		}
+	}
+	err := binary.Write(w, binary.LittleEndian, tw.crc.Sum32())
+	if err == nil {
+		tw.n += 4
+	}
+	return tw.n, err
+}
+
+// readFrom loads a log transfer into the empty log, and commits it, so it's
+// persisted to the store. A snapshot in the transfer is passed to save, and the
+// entries it covers aren't applied. See ReadLogFrom.
+func (l *raftLog) readFrom(r io.Reader, save func(index, term uint64, snapshot, sessions []byte) error) (int64, error) {
+	l.RLock()
+	empty := l.lastIndexWithLock() == 0 && l.storeSize == 0
+	l.RUnlock()
+	if !empty {
+		return 0, errLogNotEmpty
+	}
+
+	tr := &transferReader{r: r, crc: crc32.NewIEEE()}
+	read := func(fields ...interface{}) error {
+		for _, field := range fields {
+			if err := binary.Read(tr, binary.LittleEndian, field); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	readBytes := func() ([]byte, error) {
+		var size uint64
+		if err := read(&size); err != nil {
+			return nil, err
+		}
+		buf := &bytes.Buffer{} // grown as it's read, in case size is corrupt
+		if _, err := io.CopyN(buf, tr, int64(size)); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	var (
+		magic               = make([]byte, len(transferMagic))
+		version             byte
+		hasSnapshot         bool
+		snap                transferSnapshot
+		baseIndex, baseTerm uint64
+		baseHash            [sha256.Size]byte
+		count               uint64
+		err                 error
+	)
+	if err := read(magic, &version, &hasSnapshot); err != nil {
+		return tr.n, err
+	}
+	if string(magic) != transferMagic || version != transferVersion {
+		return tr.n, errBadTransfer
+	}
+	if hasSnapshot {
+		if err := read(&snap.index, &snap.term); err != nil {
+			return tr.n, err
+		}
+		if snap.snapshot, err = readBytes(); err != nil {
+			return tr.n, err
+		}
+		if snap.sessions, err = readBytes(); err != nil {
+			return tr.n, err
+		}
+	}
+	if err := read(&baseIndex, &baseTerm, &baseHash, &count); err != nil {
+		return tr.n, err
+	}
+	entries := []logEntry{}
+	prevIndex, prevHash := baseIndex, baseHash
+	for i := uint64(0); i < count; i++ {
+		var entry logEntry
+		if _, err := entry.decodeAs(tr, logVersion, nil); err != nil {
+			return tr.n, err
+		}
+		if entry.Index != prevIndex+1 {
+			return tr.n, errBadTransfer
+		}
+		if entry.PrevHash != prevHash {
+			return tr.n, errBrokenHashChain
+		}
+		entries = append(entries, entry)
+		prevIndex, prevHash = entry.Index, entry.hash()
+	}
+	sum := tr.crc.Sum32()
+	var crc uint32
+	if err := read(&crc); err != nil {
+		return tr.n, err
+	}
+	if crc != sum {
+		return tr.n, errInvalidChecksum
+	}
+
+	// The stream is intact; now load it.
+	switch {
+	case hasSnapshot && (snap.index < baseIndex || snap.index > prevIndex):
+		return tr.n, errBadTransfer
+	case !hasSnapshot && baseIndex > 0:
+		return tr.n, errBadTransfer // the compacted entries are lost
+	case hasSnapshot && save == nil:
+		return tr.n, errNoSnapshots
+	}
+	if hasSnapshot {
+		sessions, err := decodeSessions(snap.sessions)
+		if err != nil {
+			return tr.n, err
+		}
+		if err := save(snap.index, snap.term, snap.snapshot, snap.sessions); err != nil {
+			return tr.n, err
+		}
+		l.Lock()
+		l.sessions.restore(sessions.Sessions)
+		l.sessionsIndex = sessions.Index
+		if snap.index > l.lastApplied {
+			l.lastApplied = snap.index
+		}
+		l.Unlock()
+	}
+
+	l.Lock()
+	l.compactedIndex, l.compactedTerm, l.compactedHash = baseIndex, baseTerm, baseHash
+	l.Unlock()
+	if err := l.restoreEntries(entries); err != nil {
+		return tr.n, err
+	}
+	if prevIndex > baseIndex {
+		if err := l.commitTo(prevIndex); err != nil {
+			return tr.n, err
+		}
+	}
+	return tr.n, nil
+}
+
+// transferWriter passes writes through to w, keeping their CRC, and the number
+// of bytes written.
+type transferWriter struct {
+	w   io.Writer
+	crc hash.Hash32
+	n   int64
+}
+
+func (t *transferWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	t.crc.Write(p[:n])
+	t.n += int64(n)
+	return n, err
+}
+
+// transferReader passes reads through from r, keeping their CRC, and the number
+// of bytes read.
+type transferReader struct {
+	r   io.Reader
+	crc hash.Hash32
+	n   int64
+}
+
+func (t *transferReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.crc.Write(p[:n])
+	t.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,214 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogTransfer(t *testing.T) {
+	// a log with 5 committed entries, the first of them a configuration
+	committed := func(apply func(uint64, []byte) []byte) *raftLog {
+		l := newRaftLog(&InMemoryStore{}, apply)
+		l.appendEntry(logEntry{Index: 1, Term: 1, Command: []byte(`{}`), Kind: kindConfiguration})
+		for index := uint64(2); index <= 5; index++ {
+			l.appendEntry(logEntry{Index: index, Term: 2, Command: []byte(fmt.Sprint(index))})
+		}
+		if err := l.commitTo(5); err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	recorder := func(applied *[]uint64) func(uint64, []byte) []byte {
+		return func(index uint64, cmd []byte) []byte {
+			*applied = append(*applied, index)
+			return []byte{}
+		}
+	}
+
+	// is transferred whole, and applied in full
+	src := committed(noop)
+	buf := &bytes.Buffer{}
+	n, err := src.writeTo(buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := int64(buf.Len()), n; expected != got {
+		t.Errorf("expected %d bytes written, got %d", expected, got)
+	}
+	applied := []uint64{}
+	store := &InMemoryStore{}
+	dst := newRaftLog(store, recorder(&applied))
+	if n, err = dst.readFrom(bytes.NewReader(buf.Bytes()), nil); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := int64(buf.Len()), n; expected != got {
+		t.Errorf("expected %d bytes read, got %d", expected, got)
+	}
+	if expected, got := "[2 3 4 5]", fmt.Sprint(applied); expected != got {
+		t.Errorf("expected applied %s, got %s", expected, got)
+	}
+	if expected, got := src.lastHashWithLock(), dst.lastHashWithLock(); expected != got {
+		t.Errorf("expected the same hash chain")
+	}
+	if _, ok := dst.lastConfiguration(); !ok {
+		t.Errorf("lost the configuration")
+	}
+
+	// and persisted
+	if recovered := newRaftLog(store.Reopen(), noop); recovered.lastIndex() != 5 {
+		t.Errorf("expected the store recovered through index 5, got %d", recovered.lastIndex())
+	}
+
+	// but not into a log which isn't empty
+	if _, err := dst.readFrom(bytes.NewReader(buf.Bytes()), nil); err != errLogNotEmpty {
+		t.Errorf("expected %v, got %v", errLogNotEmpty, err)
+	}
+
+	// nor if it's damaged
+	damaged := append([]byte{}, buf.Bytes()...)
+	damaged[len(damaged)-10] ^= 0xff
+	if _, err := newRaftLog(&InMemoryStore{}, noop).readFrom(bytes.NewReader(damaged), nil); err == nil {
+		t.Errorf("expected a damaged transfer to fail")
+	}
+
+	// a compacted log needs a snapshot
+	src = committed(noop)
+	if err := src.compactTo(3, func(uint64, uint64, []byte) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.writeTo(&bytes.Buffer{}, nil); err != errNoSnapshots {
+		t.Errorf("expected %v, got %v", errNoSnapshots, err)
+	}
+
+	// with which it's transferred, as of the commit index, and none of the
+	// entries is applied again
+	buf.Reset()
+	if _, err := src.writeTo(buf, func() ([]byte, error) { return []byte("state"), nil }); err != nil {
+		t.Fatal(err)
+	}
+	applied = []uint64{}
+	store = &InMemoryStore{}
+	dst = newRaftLog(store, recorder(&applied))
+	snapshots := &snapshotRecorder{}
+	if _, err := dst.readFrom(bytes.NewReader(buf.Bytes()), snapshots.Save); err != nil {
+		t.Fatal(err)
+	}
+	if snapshots.index != 5 || snapshots.term != 2 || string(snapshots.snapshot) != "state" {
+		t.Errorf("expected snapshot %q at index 5, term 2, got %q at index %d, term %d", "state", snapshots.snapshot, snapshots.index, snapshots.term)
+	}
+	if len(applied) > 0 {
+		t.Errorf("expected nothing applied, got %v", applied)
+	}
+	if expected, got := uint64(4), dst.firstIndex(); expected != got {
+		t.Errorf("expected first index %d, got %d", expected, got)
+	}
+	if expected, got := src.lastHashWithLock(), dst.lastHashWithLock(); expected != got {
+		t.Errorf("expected the same hash chain")
+	}
+
+	// and the store it's persisted to keeps its hash chain as it grows
+	recovered := newRaftLog(store.Reopen(), noop)
+	recovered.appendEntry(logEntry{Index: 6, Term: 2, Command: []byte(`6`)})
+	if err := recovered.commitTo(6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := recoverRaftLog(store.Reopen(), noop, logOptions{}); err != nil {
+		t.Errorf("after growing: %s", err)
+	}
+}
+
+func TestConcurrentTransferLimit(t *testing.T) {
+	newServer := func(options ...Option) *Server {
+		s := NewServer(1, &InMemoryStore{}, noop, options...)
+		for index := uint64(1); index <= 3; index++ {
+			s.log.appendEntry(logEntry{Index: index, Term: 1, Command: []byte(fmt.Sprint(index))})
+		}
+		if err := s.log.commitTo(3); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	transfer := func(s *Server) (*gatedWriter, chan error) {
+		w, done := newGatedWriter(), make(chan error, 1)
+		go func() {
+			_, err := s.WriteLogTo(w)
+			done <- err
+		}()
+		return w, done
+	}
+	started := func(w *gatedWriter) bool {
+		select {
+		case <-w.started:
+			return true
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	}
+
+	// by default, a second transfer waits for the first to finish
+	s := newServer()
+	first, firstDone := transfer(s)
+	if !started(first) {
+		t.Fatal("the first transfer didn't start")
+	}
+	second, secondDone := transfer(s)
+	if started(second) {
+		t.Fatal("the second transfer started alongside the first")
+	}
+	close(first.release)
+	if err := <-firstDone; err != nil {
+		t.Fatal(err)
+	}
+	if !started(second) {
+		t.Fatal("the second transfer didn't start once the first finished")
+	}
+	close(second.release)
+	if err := <-secondDone; err != nil {
+		t.Fatal(err)
+	}
+
+	// and one still waiting gives up when its context is done
+	first, firstDone = transfer(s)
+	started(first)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.writeLogTo(ctx, newGatedWriter()); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	close(first.release)
+	<-firstDone
+
+	// with a higher limit, both are written at once
+	s = newServer(WithMaxConcurrentTransfers(2))
+	first, firstDone = transfer(s)
+	second, secondDone = transfer(s)
+	if !started(first) || !started(second) {
+		t.Fatal("with a limit of 2, both transfers should start")
+	}
+	close(first.release)
+	close(second.release)
+	<-firstDone
+	<-secondDone
+}
+
+// gatedWriter signals started on its first write, and blocks every write until
+// release is closed.
+type gatedWriter struct {
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func newGatedWriter() *gatedWriter {
+	return &gatedWriter{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.started) })
+	<-w.release
+	return len(p), nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,6 +12,8 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
+	"time"
 )
 
 var (
@@ -33,8 +36,37 @@ var (
 	// SetConfigurationPath is where the SetConfiguration RPC handler (POST)
 	// will be installed by the HTTPTransport.
 	SetConfigurationPath = "/raft/setconfiguration"
+
+	// ReadPath is where the Read RPC handler (POST) will be installed by the
+	// HTTPTransport. It answers queries forwarded by ConsistentRead.
+	ReadPath = "/raft/read"
+
+	// LogPath is where the log transfer handler (GET) will be installed by
+	// the HTTPTransport. It streams the server's log, as WriteLogTo does.
+	LogPath = "/raft/log"
+
+	// IndexHeader is the HTTP header in which the Command RPC handler returns
+	// the log index the command was appended at.
+	IndexHeader = "X-Raft-Index"
+
+	// VersionHeader is the HTTP header in which HTTP peers send, and the
+	// HTTPTransport returns, the version of the RPC protocol they speak. A
+	// server which doesn't return it predates it: version 0.
+	VersionHeader = "X-Raft-Version"
+
+	// RPCPrefix is where the HTTPTransport installs its handler for the RPCs
+	// under it which it doesn't know; see WithUnsupportedRPCHandler.
+	RPCPrefix = "/raft/"
 )
 
+// rpcVersion is the version of the RPC protocol. It's incremented whenever an
+// RPC is added, so a server that supports more RPCs has a higher version.
+const rpcVersion = 1
+
+// ErrUnsupportedRPC is returned when an RPC is sent to a server which doesn't
+// support it, because it runs an earlier version.
+var ErrUnsupportedRPC = errors.New("unsupported RPC")
+
 var (
 	emptyAppendEntriesResponse bytes.Buffer
 	emptyRequestVoteResponse   bytes.Buffer
@@ -48,12 +80,59 @@ func init() {
 
 // HTTPTransport creates an ingress bridge from the outside world to the passed
 // server, by installing handlers for all the necessary RPCs to the passed mux.
-func HTTPTransport(mux *http.ServeMux, s *Server) {
-	mux.HandleFunc(IDPath, idHandler(s))
-	mux.HandleFunc(AppendEntriesPath, appendEntriesHandler(s))
-	mux.HandleFunc(RequestVotePath, requestVoteHandler(s))
-	mux.HandleFunc(CommandPath, commandHandler(s))
-	mux.HandleFunc(SetConfigurationPath, setConfigurationHandler(s))
+// Every response carries the VersionHeader, and RPCs it has no handler for
+// fail with 501 Not Implemented, unless options say otherwise.
+func HTTPTransport(mux *http.ServeMux, s *Server, options ...TransportOption) {
+	mux.HandleFunc(IDPath, versioned(idHandler(s)))
+	mux.HandleFunc(AppendEntriesPath, versioned(appendEntriesHandler(s)))
+	mux.HandleFunc(RequestVotePath, versioned(requestVoteHandler(s)))
+	mux.HandleFunc(CommandPath, versioned(commandHandler(s)))
+	mux.HandleFunc(SetConfigurationPath, versioned(setConfigurationHandler(s)))
+	mux.HandleFunc(ReadPath, versioned(readHandler(s)))
+	mux.HandleFunc(LogPath, versioned(logHandler(s)))
+	handleUnsupported(mux, options)
+}
+
+// TransportOption configures an HTTPTransport, or a MultiRaftHTTPTransport.
+type TransportOption func(*transportOptions)
+
+type transportOptions struct {
+	unsupported http.Handler // see WithUnsupportedRPCHandler
+}
+
+// WithUnsupportedRPCHandler makes the transport answer RPCs under RPCPrefix
+// which it doesn't know, e.g. those added in a later version, sent by an
+// upgraded peer, with h. By default, they fail with 501 Not Implemented, which
+// HTTP peers report as ErrUnsupportedRPC, rather than being left to the mux.
+// A nil h installs nothing at RPCPrefix, leaving it to the application.
+func WithUnsupportedRPCHandler(h http.Handler) TransportOption {
+	return func(o *transportOptions) { o.unsupported = h }
+}
+
+// versioned returns the VersionHeader with every response of the handler.
+func versioned(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(VersionHeader, strconv.Itoa(rpcVersion))
+		handler(w, r)
+	}
+}
+
+// handleUnsupported installs the handler for unknown RPCs, if any, at
+// RPCPrefix. See WithUnsupportedRPCHandler.
+func handleUnsupported(mux *http.ServeMux, options []TransportOption) {
+	o := transportOptions{unsupported: http.HandlerFunc(unsupportedRPC)}
+	for _, option := range options {
+		option(&o)
+	}
+	if o.unsupported != nil {
+		mux.Handle(RPCPrefix, o.unsupported)
+	}
+}
+
+// unsupportedRPC is the default handler for unknown RPCs.
+func unsupportedRPC(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(VersionHeader, strconv.Itoa(rpcVersion))
+	http.Error(w, "unsupported RPC: "+r.URL.Path, http.StatusNotImplemented)
 }
 
 func idHandler(s *Server) http.HandlerFunc {
@@ -111,18 +190,13 @@ func commandHandler(s *Server) http.HandlerFunc {
 			return
 		}
 
-		response := make(chan []byte, 1)
-		if err := s.Command(cmd, response); err != nil {
-			http.Error(w, "", http.StatusInternalServerError)
-			return
-		}
-
-		resp, ok := <-response
-		if !ok {
+		index, resp, err := s.commandWait(cmd)
+		if err != nil {
 			http.Error(w, "", http.StatusInternalServerError)
 			return
 		}
 
+		w.Header().Set(IndexHeader, strconv.FormatUint(index, 10))
 		w.Write(resp)
 	}
 }
@@ -149,6 +223,37 @@ func setConfigurationHandler(s *Server) http.HandlerFunc {
 	}
 }
 
+func readHandler(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		query, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		resp, err := s.readIndex(query)
+		if err != nil {
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(resp)
+	}
+}
+
+func logHandler(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, err := s.writeLogTo(r.Context(), w)
+		if err != nil && n == 0 {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else if err != nil {
+			s.logGeneric("log transfer failed after %d bytes: %s", n, err)
+		}
+	}
+}
+
 // commaError is the structure returned by the configuration handler, to clients
 // that make set-configuration requests over the HTTP Transport.
 type commaError struct {
@@ -159,45 +264,168 @@ type commaError struct {
 // HTTPPeer represents a remote Raft server in the local process space. The
 // remote server is expected to be accessible through an HTTPTransport.
 type httpPeer struct {
-	remoteID uint64
-	url      *url.URL
+	sync.RWMutex // protects url, remoteVersion, and unsupported
+	remoteID     uint64
+	url          *url.URL
+	resolver     PeerResolver
+	group        uint64 // zero means no GroupHeader, as no group has ID zero
+	role         string // see WithPeerRole
+	interceptor  Interceptor
+
+	rpcTimeout           time.Duration // zero means maximumElectionTimeout
+	appendEntriesRetries int
+	retryBackoff         time.Duration
+
+	// The remote server's version, as of its last response, and the paths it
+	// failed with 501 Not Implemented at that version. They aren't sent again
+	// until the version changes, i.e. the server is upgraded.
+	remoteVersion int
+	unsupported   map[string]bool
+}
+
+// HTTPPeerOption configures optional behavior of a HTTP peer. Options are
+// passed to NewHTTPPeer.
+type HTTPPeerOption func(*httpPeer)
+
+// WithRPCTimeout bounds each AppendEntries and RequestVote RPC attempt made by
+// the HTTP peer, so that a hung remote server can't stall the caller. By
+// default, the timeout is the maximum election timeout.
+func WithRPCTimeout(d time.Duration) HTTPPeerOption {
+	return func(p *httpPeer) { p.rpcTimeout = d }
+}
+
+// WithAppendEntriesRetries makes the HTTP peer retry a failed AppendEntries RPC
+// up to n times, waiting backoff before the first retry and doubling the wait
+// before each subsequent one. RequestVote RPCs are never retried by the peer:
+// a candidate already reissues them for as long as its election lasts. By
+// default, AppendEntries RPCs aren't retried either, as the leader will send
+// another one with its next heartbeat.
+func WithAppendEntriesRetries(n int, backoff time.Duration) HTTPPeerOption {
+	return func(p *httpPeer) {
+		p.appendEntriesRetries = n
+		p.retryBackoff = backoff
+	}
+}
+
+// PeerResolver maps the ID of a server to the URL where its HTTPTransport can
+// currently be reached. It decouples the membership of the network, which is
+// expressed in IDs, from the addresses of its servers.
+type PeerResolver interface {
+	Resolve(id uint64) (*url.URL, error)
+}
+
+// PeerResolverFunc adapts an ordinary function to the PeerResolver interface.
+type PeerResolverFunc func(id uint64) (*url.URL, error)
+
+// Resolve calls f(id).
+func (f PeerResolverFunc) Resolve(id uint64) (*url.URL, error) { return f(id) }
+
+// WithPeerResolver makes the HTTP peer consult the resolver for the remote
+// server's current URL whenever an RPC fails to reach it. Subsequent RPCs
+// (including retries) go to the resolved URL, so a server whose address
+// changes can be reached again without a configuration change.
+func WithPeerResolver(r PeerResolver) HTTPPeerOption {
+	return func(p *httpPeer) { p.resolver = r }
+}
+
+// WithGroup makes the HTTP peer address the given Raft group on the remote
+// node, which is expected to be exposed via a MultiRaftHTTPTransport. The group
+// is also used when resolving the remote server's ID during construction.
+// Group IDs are greater than 0, so WithGroup(0) is the same as no group.
+func WithGroup(group uint64) HTTPPeerOption {
+	return func(p *httpPeer) { p.group = group }
+}
+
+// WithPeerRole sets the Role of the HTTP peer's PeerDescriptor, for the
+// application's PeerFactory to act on. See WithPeerFactory.
+func WithPeerRole(role string) HTTPPeerOption {
+	return func(p *httpPeer) { p.role = role }
+}
+
+// Interceptor inspects each AppendEntries and RequestVote RPC an HTTP peer is
+// about to send to the server with the passed ID, as the JSON body that would
+// be POSTed to path, and returns the body to send instead. It may return the
+// body unchanged, or mutate it; delay it, by sleeping; or drop it, by returning
+// an error, with which the RPC then fails, as if the network had failed.
+//
+// It's meant for fault injection in tests, e.g. to reproduce partitions, or
+// misbehaving peers, with the real transport; it's unsafe otherwise. The wire
+// format isn't a stable API.
+type Interceptor func(to uint64, path string, body []byte) ([]byte, error)
+
+// WithInterceptor makes the HTTP peer pass each AppendEntries and RequestVote
+// RPC through the Interceptor before sending it. It's for tests only. The
+// interceptor is lost if the peer is encoded in a configuration, so it only
+// applies to peers passed to SetConfiguration. By default, there's none.
+func WithInterceptor(i Interceptor) HTTPPeerOption {
+	return func(p *httpPeer) { p.interceptor = i }
 }
 
 // NewHTTPPeer constructs a new HTTP peer. Part of construction involves making
 // a HTTP GET request against the passed URL at IDPath, to resolve the remote
 // server's ID.
-func NewHTTPPeer(url *url.URL) (Peer, error) {
+func NewHTTPPeer(url *url.URL, options ...HTTPPeerOption) (Peer, error) {
 	url.Path = ""
 
-	idURL := *url
-	idURL.Path = IDPath
-	resp, err := http.Get(idURL.String())
+	p := &httpPeer{url: url}
+	for _, option := range options {
+		option(p)
+	}
+
+	id, err := p.fetchID(url)
 	if err != nil {
 		return nil, err
 	}
+
+	p.remoteID = id
+	return p, nil
+}
+
+// fetchID makes a HTTP GET request against the passed URL at IDPath, and
+// returns the ID of the server there.
+func (p *httpPeer) fetchID(u *url.URL) (uint64, error) {
+	idURL := *u
+	idURL.Path = IDPath
+	req, err := http.NewRequest("GET", idURL.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	p.setGroup(req)
+	client := http.Client{Timeout: p.timeout()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return 0, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
 	defer resp.Body.Close()
 
 	buf, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	id, err := strconv.ParseUint(string(buf), 10, 64)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	if id <= 0 {
-		return nil, fmt.Errorf("invalid peer ID %d", id)
+		return 0, fmt.Errorf("invalid peer ID %d", id)
 	}
-
-	return &httpPeer{
-		remoteID: id,
-		url:      url,
-	}, nil
+	return id, nil
 }
 
 // ID returns the Raft-domain ID retrieved during construction of the httpPeer.
 func (p *httpPeer) id() uint64 { return p.remoteID }
 
+// descriptor describes the peer by its current URL.
+func (p *httpPeer) descriptor() PeerDescriptor {
+	p.RLock()
+	defer p.RUnlock()
+	return PeerDescriptor{ID: p.remoteID, Address: p.url.String(), Role: p.role}
+}
+
 // AppendEntries triggers a AppendEntries RPC to the remote server, and
 // returns the response. Errors at the transport layers are logged, and
 // represented by a default (unsuccessful) response.
@@ -210,8 +438,14 @@ func (p *httpPeer) callAppendEntries(ae appendEntries) appendEntriesResponse {
 		return aer
 	}
 
+	request, err := p.intercept(AppendEntriesPath, body.Bytes())
+	if err != nil {
+		log.Printf("Raft: HTTP Peer: AppendEntries: intercepted: %s", err)
+		return aer
+	}
+
 	var resp bytes.Buffer
-	if err := p.rpc(&body, AppendEntriesPath, &resp); err != nil {
+	if err := p.rpcWithRetry(request, AppendEntriesPath, &resp, p.appendEntriesRetries); err != nil {
 		log.Printf("Raft: HTTP Peer: AppendEntries: during RPC: %s", err)
 		return aer
 	}
@@ -236,8 +470,14 @@ func (p *httpPeer) callRequestVote(rv requestVote) requestVoteResponse {
 		return rvr
 	}
 
+	request, err := p.intercept(RequestVotePath, body.Bytes())
+	if err != nil {
+		log.Printf("Raft: HTTP Peer: RequestVote: intercepted: %s", err)
+		return rvr
+	}
+
 	var resp bytes.Buffer
-	if err := p.rpc(&body, RequestVotePath, &resp); err != nil {
+	if _, err := p.rpc(bytes.NewBuffer(request), RequestVotePath, &resp, p.timeout()); err != nil {
 		log.Printf("Raft: HTTP Peer: RequestVote: during RPC: %s", err)
 		return rvr
 	}
@@ -251,21 +491,29 @@ func (p *httpPeer) callRequestVote(rv requestVote) requestVoteResponse {
 }
 
 // Command forwards the passed cmd to the remote server. Any error at the
-// transport or application layer is returned synchronously. If no error
-// occurs, the response (the output of the remote server's ApplyFunc) is
-// eventually sent on the passed response chan.
-func (p *httpPeer) callCommand(cmd []byte, response chan<- []byte) error {
-	errChan := make(chan error)
+// transport or application layer is returned synchronously, and otherwise the
+// index the command was appended at. If no error occurs, the response (the
+// output of the remote server's ApplyFunc) is eventually sent on the passed
+// response chan.
+func (p *httpPeer) callCommand(cmd []byte, response chan<- []byte) (uint64, error) {
+	type result struct {
+		index uint64
+		err   error
+	}
+	resultChan := make(chan result)
 	go func() {
 		var responseBuf bytes.Buffer
-		err := p.rpc(bytes.NewBuffer(cmd), CommandPath, &responseBuf)
-		errChan <- err
+		header, err := p.rpc(bytes.NewBuffer(cmd), CommandPath, &responseBuf, 0)
 		if err != nil {
+			resultChan <- result{0, err}
 			return
 		}
+		index, _ := strconv.ParseUint(header.Get(IndexHeader), 10, 64) // 0 from an older server
+		resultChan <- result{index, nil}
 		response <- responseBuf.Bytes()
 	}()
-	return <-errChan // TODO timeout?
+	r := <-resultChan // TODO timeout?
+	return r.index, r.err
 }
 
 // SetConfiguration forwards the passed network configuration to the remote
@@ -280,7 +528,7 @@ func (p *httpPeer) callSetConfiguration(peers ...Peer) error {
 	}
 
 	var resp bytes.Buffer
-	if err := p.rpc(buf, SetConfigurationPath, &resp); err != nil {
+	if _, err := p.rpc(buf, SetConfigurationPath, &resp, 0); err != nil {
 		log.Printf("Raft: HTTP Peer: SetConfiguration: during RPC: %s", err)
 		return err
 	}
@@ -292,32 +540,162 @@ func (p *httpPeer) callSetConfiguration(peers ...Peer) error {
 	}
 
 	if !commaErr.Success {
-		return fmt.Errorf(commaErr.Error)
+		return errors.New(commaErr.Error)
 	}
 	return nil
 }
 
-func (p *httpPeer) rpc(request *bytes.Buffer, path string, response *bytes.Buffer) error {
+// Read forwards the passed query to the remote server, which must be the
+// leader, and returns its answer. Any error at the transport or application
+// layer is returned.
+func (p *httpPeer) callRead(query []byte) ([]byte, error) {
+	var resp bytes.Buffer
+	if _, err := p.rpc(bytes.NewBuffer(query), ReadPath, &resp, 0); err != nil {
+		log.Printf("Raft: HTTP Peer: Read: during RPC: %s", err)
+		return nil, err
+	}
+	return resp.Bytes(), nil
+}
+
+// timeout returns the per-attempt timeout for AppendEntries and RequestVote
+// RPCs.
+func (p *httpPeer) timeout() time.Duration {
+	if p.rpcTimeout > 0 {
+		return p.rpcTimeout
+	}
+	return maximumElectionTimeout()
+}
+
+// rpcWithRetry makes the RPC, and retries it up to retries times if it fails,
+// with exponential backoff between attempts.
+func (p *httpPeer) rpcWithRetry(request []byte, path string, response *bytes.Buffer, retries int) error {
+	backoff := p.retryBackoff
+	for attempt := 0; ; attempt++ {
+		response.Reset()
+		_, err := p.rpc(bytes.NewBuffer(request), path, response, p.timeout())
+		if err == nil || attempt >= retries || errors.Is(err, ErrUnsupportedRPC) {
+			return err
+		}
+		log.Printf("Raft: HTTP Peer: %s: attempt %d/%d failed: %s", path, attempt+1, retries+1, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// intercept passes an outgoing RPC through the peer's Interceptor, if any.
+func (p *httpPeer) intercept(path string, body []byte) ([]byte, error) {
+	if p.interceptor == nil {
+		return body, nil
+	}
+	return p.interceptor(p.remoteID, path, body)
+}
+
+// resolve consults the resolver, if any, for the current URL of the remote
+// server. The peer only moves to a new URL once the server there confirms it
+// has the expected ID.
+func (p *httpPeer) resolve() {
+	if p.resolver == nil {
+		return
+	}
+	u, err := p.resolver.Resolve(p.remoteID)
+	if err != nil {
+		log.Printf("Raft: HTTP Peer: resolve %d: %s", p.remoteID, err)
+		return
+	}
+	u.Path = ""
+
+	p.RLock()
+	moved := u.String() != p.url.String()
+	p.RUnlock()
+	if !moved {
+		return
+	}
+	id, err := p.fetchID(u)
+	if err != nil {
+		log.Printf("Raft: HTTP Peer: %d resolved to %s, but: %s", p.remoteID, u, err)
+		return
+	}
+	if id != p.remoteID {
+		log.Printf("Raft: HTTP Peer: %d resolved to %s, but that's %d", p.remoteID, u, id)
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	log.Printf("Raft: HTTP Peer: %d moved from %s to %s", p.remoteID, p.url, u)
+	p.url = u
+}
+
+// setGroup addresses the HTTP request to the peer's group, if it has one.
+func (p *httpPeer) setGroup(req *http.Request) {
+	if p.group != 0 {
+		req.Header.Set(GroupHeader, strconv.FormatUint(p.group, 10))
+	}
+}
+
+// rpc POSTs the request to the given path of the remote server, copies the
+// response body into response, and returns the response header. A timeout of
+// zero means no timeout. If the remote server doesn't support the RPC, it
+// fails with ErrUnsupportedRPC, without being sent again until the server's
+// version changes.
+func (p *httpPeer) rpc(request *bytes.Buffer, path string, response *bytes.Buffer, timeout time.Duration) (http.Header, error) {
+	p.RLock()
 	url := *p.url
+	unsupported := p.unsupported[path]
+	p.RUnlock()
+	if unsupported {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedRPC, path)
+	}
 	url.Path = path
-	resp, err := http.Post(url.String(), "application/json", request)
+	req, err := http.NewRequest("POST", url.String(), request)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(VersionHeader, strconv.Itoa(rpcVersion))
+	p.setGroup(req)
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("Raft: HTTP Peer: rpc POST: %s", err)
-		return err
+		p.resolve() // maybe it moved
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	p.noteVersion(resp.Header)
+	if resp.StatusCode == http.StatusNotImplemented {
+		p.Lock()
+		if p.unsupported == nil {
+			p.unsupported = map[string]bool{}
+		}
+		p.unsupported[path] = true
+		p.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedRPC, path)
+	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP %d", resp.StatusCode)
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
 	}
 
 	n, err := io.Copy(response, resp.Body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if l := response.Len(); n < int64(l) {
-		return fmt.Errorf("short read (%d < %d)", n, l)
+		return nil, fmt.Errorf("short read (%d < %d)", n, l)
 	}
 
-	return nil
+	return resp.Header, nil
+}
+
+// noteVersion notes the remote server's version, from the header of its
+// response. When it changes, whatever the server didn't support before may
+// be supported now, so every RPC is sent to it again.
+func (p *httpPeer) noteVersion(header http.Header) {
+	version, _ := strconv.Atoi(header.Get(VersionHeader)) // 0 from an older server
+	p.Lock()
+	defer p.Unlock()
+	if version != p.remoteVersion {
+		p.remoteVersion, p.unsupported = version, nil
+	}
 }
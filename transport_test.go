@@ -2,12 +2,16 @@ package raft
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -91,9 +95,13 @@ func testNServersOverHTTP(t *testing.T, n int) {
 	// send a command into the network
 	cmd := []byte(`{"do_something":true}`)
 	response := make(chan []byte, 1)
-	if err := raftServers[0].Command(cmd, response); err != nil {
+	index, err := raftServers[0].CommandIndex(cmd, response)
+	if err != nil {
 		t.Fatal(err)
 	}
+	if expected, got := uint64(1), index; expected != got {
+		t.Errorf("expected the command at index %d, got %d", expected, got)
+	}
 	select {
 	case resp := <-response:
 		t.Logf("got %d-byte command response ('%s')", len(resp), resp)
@@ -135,6 +143,355 @@ func testNServersOverHTTP(t *testing.T, n int) {
 	}
 }
 
+func TestHTTPPeerRPCTimeout(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+
+	// a remote server whose appendEntries handler hangs
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc(IDPath, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("2")) })
+	mux.HandleFunc(AppendEntriesPath, func(w http.ResponseWriter, r *http.Request) { <-release })
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	defer close(release) // before Close, which waits for the hung handler
+
+	u, _ := url.Parse(server.URL)
+	timeout := 25 * time.Millisecond
+	peer, err := NewHTTPPeer(u, WithRPCTimeout(timeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// shouldn't block the caller beyond the timeout
+	begin := time.Now()
+	if resp := peer.callAppendEntries(appendEntries{Term: 1, LeaderID: 1}); resp.Success {
+		t.Errorf("hung appendEntries reported success")
+	}
+	if took := time.Since(begin); took > 10*timeout {
+		t.Errorf("appendEntries took %s, with a timeout of %s", took, timeout)
+	}
+}
+
+func TestHTTPPeerAppendEntriesRetry(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+
+	// a remote server which fails the first two appendEntries and requestVotes
+	var appendEntriesCalls, requestVoteCalls int32
+	flaky := func(calls *int32, resp interface{}) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(calls, 1) <= 2 {
+				http.Error(w, "", http.StatusServiceUnavailable)
+				return
+			}
+			json.NewEncoder(w).Encode(resp)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(IDPath, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("2")) })
+	mux.HandleFunc(AppendEntriesPath, flaky(&appendEntriesCalls, appendEntriesResponse{Term: 1, Success: true}))
+	mux.HandleFunc(RequestVotePath, flaky(&requestVoteCalls, requestVoteResponse{Term: 1, VoteGranted: true}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	peer, err := NewHTTPPeer(u, WithAppendEntriesRetries(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// appendEntries should be retried until it succeeds
+	if resp := peer.callAppendEntries(appendEntries{Term: 1, LeaderID: 1}); !resp.Success {
+		t.Errorf("appendEntries wasn't retried to success")
+	}
+	if expected, got := int32(3), atomic.LoadInt32(&appendEntriesCalls); expected != got {
+		t.Errorf("appendEntries: expected %d attempts, got %d", expected, got)
+	}
+
+	// requestVote should never be retried
+	if resp := peer.callRequestVote(requestVote{Term: 1, CandidateID: 1}); resp.VoteGranted {
+		t.Errorf("requestVote was retried")
+	}
+	if expected, got := int32(1), atomic.LoadInt32(&requestVoteCalls); expected != got {
+		t.Errorf("requestVote: expected %d attempt, got %d", expected, got)
+	}
+}
+
+func TestHTTPPeerResolver(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+
+	// the same remote server, at two different addresses over time, and a
+	// different server which turns up at a stale address
+	var impostorCalls int32
+	newRemote := func(id string, calls *int32) *httptest.Server {
+		mux := http.NewServeMux()
+		mux.HandleFunc(IDPath, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(id)) })
+		mux.HandleFunc(AppendEntriesPath, func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(calls, 1)
+			json.NewEncoder(w).Encode(appendEntriesResponse{Term: 1, Success: true})
+		})
+		return httptest.NewServer(mux)
+	}
+	before, after := newRemote("2", new(int32)), newRemote("2", new(int32))
+	defer after.Close()
+	impostor := newRemote("3", &impostorCalls)
+	defer impostor.Close()
+
+	var mtx sync.Mutex
+	current := before.URL
+	resolver := PeerResolverFunc(func(id uint64) (*url.URL, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if id != 2 {
+			t.Errorf("asked to resolve unexpected id %d", id)
+		}
+		return url.Parse(current)
+	})
+
+	u, _ := url.Parse(before.URL)
+	peer, err := NewHTTPPeer(u, WithPeerResolver(resolver), WithAppendEntriesRetries(1, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := peer.callAppendEntries(appendEntries{Term: 1, LeaderID: 1}); !resp.Success {
+		t.Fatal("appendEntries failed before the move")
+	}
+
+	// when the remote server goes away, and the resolver is out of date
+	before.Close()
+	mtx.Lock()
+	current = impostor.URL
+	mtx.Unlock()
+
+	// replication shouldn't go to whoever's at the old address
+	if resp := peer.callAppendEntries(appendEntries{Term: 1, LeaderID: 1}); resp.Success {
+		t.Fatal("appendEntries succeeded against the wrong server")
+	}
+	if n := atomic.LoadInt32(&impostorCalls); n > 0 {
+		t.Fatalf("wrong server got %d appendEntries", n)
+	}
+
+	// and when the resolver catches up
+	mtx.Lock()
+	current = after.URL
+	mtx.Unlock()
+
+	// replication should recover, at the new address
+	if resp := peer.callAppendEntries(appendEntries{Term: 1, LeaderID: 1}); !resp.Success {
+		t.Fatal("appendEntries failed after the move")
+	}
+}
+
+func TestHTTPPeerInterceptor(t *testing.T) {
+	logBuffer := &bytes.Buffer{}
+	log.SetOutput(logBuffer)
+	defer log.SetOutput(os.Stdout)
+	defer printOnFailure(t, logBuffer)
+	oldMin, oldMax := resetElectionTimeoutMS(100, 200)
+	defer resetElectionTimeoutMS(oldMin, oldMax)
+
+	// a network of 3 over HTTP, whose peers drop every other appendEntries
+	const n = 3
+	var (
+		stateMachines = make([]*protectedSlice, n)
+		servers       = make([]*Server, n)
+		urls          = make([]*url.URL, n)
+		dropped       int32
+	)
+	for i := 0; i < n; i++ {
+		stateMachines[i] = &protectedSlice{}
+		servers[i] = NewServer(uint64(i+1), &bytes.Buffer{}, appender(stateMachines[i]))
+		mux := http.NewServeMux()
+		HTTPTransport(mux, servers[i])
+		u, err := url.Parse(httptest.NewServer(mux).URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls[i] = u
+	}
+	dropEveryOther := func() Interceptor {
+		var sent int32
+		return func(to uint64, path string, body []byte) ([]byte, error) {
+			if path == AppendEntriesPath && atomic.AddInt32(&sent, 1)%2 == 0 {
+				atomic.AddInt32(&dropped, 1)
+				return nil, errors.New("dropped")
+			}
+			return body, nil
+		}
+	}
+	for _, server := range servers {
+		peers := []Peer{}
+		for _, u := range urls {
+			peer, err := NewHTTPPeer(u, WithInterceptor(dropEveryOther()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			peers = append(peers, peer)
+		}
+		server.SetConfiguration(peers...)
+	}
+	for _, server := range servers {
+		server.Start()
+		defer server.Stop()
+	}
+
+	// still commits every command, on every server
+	const commands = 5
+	deadline := time.Now().Add(20 * maximumElectionTimeout())
+	for i := 0; i < commands; {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d/%d commands committed", i, commands)
+		}
+		response := make(chan []byte, 1)
+		err := errUnknownLeader
+		for _, server := range servers {
+			if server.state.Get() == leader {
+				err = server.Command([]byte(fmt.Sprint(i)), response)
+				break
+			}
+		}
+		if err != nil {
+			time.Sleep(maximumElectionTimeout())
+			continue // no leader yet
+		}
+		select {
+		case <-response:
+			i++
+		case <-time.After(4 * maximumElectionTimeout()):
+		}
+	}
+	for i, sm := range stateMachines {
+		for len(sm.Get()) < commands {
+			if time.Now().After(deadline) {
+				t.Fatalf("server %d applied only %d/%d commands", i+1, len(sm.Get()), commands)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if atomic.LoadInt32(&dropped) == 0 {
+		t.Errorf("nothing was dropped")
+	}
+}
+
+func TestHTTPUnsupportedRPC(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+
+	// a transport answers an RPC it doesn't know with 501, and its version
+	mux := http.NewServeMux()
+	HTTPTransport(mux, NewServer(1, &bytes.Buffer{}, noop))
+	current := httptest.NewServer(mux)
+	defer current.Close()
+	resp, err := http.Post(current.URL+"/raft/installsnapshot", "application/json", &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if expected, got := http.StatusNotImplemented, resp.StatusCode; expected != got {
+		t.Errorf("expected HTTP %d, got %d", expected, got)
+	}
+	if expected, got := fmt.Sprint(rpcVersion), resp.Header.Get(VersionHeader); expected != got {
+		t.Errorf("expected version %s, got %q", expected, got)
+	}
+
+	// a remote server of an earlier version, without the Read RPC until it's
+	// upgraded to version 2
+	var version, readCalls int32
+	versioned := func(w http.ResponseWriter) {
+		w.Header().Set(VersionHeader, fmt.Sprint(atomic.LoadInt32(&version)))
+	}
+	older := http.NewServeMux()
+	older.HandleFunc(IDPath, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("2")) })
+	older.HandleFunc(AppendEntriesPath, func(w http.ResponseWriter, r *http.Request) {
+		versioned(w)
+		json.NewEncoder(w).Encode(appendEntriesResponse{Term: 1, Success: true})
+	})
+	older.HandleFunc(RPCPrefix, func(w http.ResponseWriter, r *http.Request) {
+		versioned(w)
+		if r.URL.Path != ReadPath {
+			http.Error(w, "", http.StatusNotImplemented)
+			return
+		}
+		if atomic.AddInt32(&readCalls, 1); atomic.LoadInt32(&version) < 2 {
+			http.Error(w, "", http.StatusNotImplemented)
+			return
+		}
+		w.Write([]byte("answer"))
+	})
+	server := httptest.NewServer(older)
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	peer, err := NewHTTPPeer(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fails forwarded reads as unsupported, and doesn't send any more
+	for i := 0; i < 3; i++ {
+		if _, err := peer.callRead([]byte(`{}`)); !errors.Is(err, ErrUnsupportedRPC) {
+			t.Fatalf("read %d: expected %v, got %v", i+1, ErrUnsupportedRPC, err)
+		}
+	}
+	if expected, got := int32(1), atomic.LoadInt32(&readCalls); expected != got {
+		t.Errorf("expected %d read sent, got %d", expected, got)
+	}
+
+	// while the RPCs it does support carry on as ever
+	if resp := peer.callAppendEntries(appendEntries{Term: 1, LeaderID: 1}); !resp.Success {
+		t.Errorf("appendEntries failed")
+	}
+
+	// until it's upgraded, which its next response reveals, when they're sent
+	// again
+	atomic.StoreInt32(&version, 2)
+	peer.callAppendEntries(appendEntries{Term: 1, LeaderID: 1})
+	if answer, err := peer.callRead([]byte(`{}`)); err != nil || string(answer) != "answer" {
+		t.Fatalf("after the upgrade, expected an answer, got %q (%v)", answer, err)
+	}
+	if expected, got := int32(2), atomic.LoadInt32(&readCalls); expected != got {
+		t.Errorf("after the upgrade, expected %d reads sent, got %d", expected, got)
+	}
+}
+
+func TestHTTPUnsupportedRPCHandlerOption(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stdout)
+
+	post := func(mux *http.ServeMux) int {
+		server := httptest.NewServer(mux)
+		defer server.Close()
+		resp, err := http.Post(server.URL+"/raft/installsnapshot", "application/json", &bytes.Buffer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// two transports in one process, one of them with its own handler
+	custom, standard := http.NewServeMux(), http.NewServeMux()
+	HTTPTransport(custom, NewServer(1, &bytes.Buffer{}, noop), WithUnsupportedRPCHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) }),
+	))
+	HTTPTransport(standard, NewServer(2, &bytes.Buffer{}, noop))
+	if expected, got := http.StatusTeapot, post(custom); expected != got {
+		t.Errorf("custom: expected HTTP %d, got %d", expected, got)
+	}
+	if expected, got := http.StatusNotImplemented, post(standard); expected != got {
+		t.Errorf("standard: expected HTTP %d, got %d", expected, got)
+	}
+
+	// without a handler, the application may install its own at RPCPrefix
+	mux := http.NewServeMux()
+	HTTPTransport(mux, NewServer(3, &bytes.Buffer{}, noop), WithUnsupportedRPCHandler(nil))
+	mux.HandleFunc(RPCPrefix, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusGone) })
+	if expected, got := http.StatusGone, post(mux); expected != got {
+		t.Errorf("nil: expected HTTP %d, got %d", expected, got)
+	}
+}
+
 type protectedSlice struct {
 	sync.RWMutex
 	slice [][]byte